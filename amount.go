@@ -0,0 +1,331 @@
+package climatic
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultPrecision is the default number of decimal places of an Amount.
+const DefaultPrecision = 8
+
+// MaxPrecision is the largest supported number of decimal places. Amounts are
+// kept in an int64 of units, so at MaxPrecision they go up to about 92 billion
+// Jobcoins; any more decimal places would cap them at a few Jobcoins.
+const MaxPrecision = 8
+
+// precision is the number of decimal places of every Amount, and scale is
+// 10^precision.
+var (
+	precision       = DefaultPrecision
+	scale     int64 = pow10(DefaultPrecision)
+)
+
+// Precision returns the number of decimal places of an Amount.
+func Precision() int { return precision }
+
+// SetPrecision sets the number of decimal places of an Amount, which should
+// match the precision of the ledger. The precision is global and not guarded,
+// so SetPrecision is meant to be called once at startup: before any Amount is
+// created, since existing Amounts are not converted, and before anything that
+// uses Amounts runs in another goroutine.
+func SetPrecision(p int) error {
+	if p < 0 || p > MaxPrecision {
+		return errors.Errorf("precision must be between 0 and %d", MaxPrecision)
+	}
+	precision = p
+	scale = pow10(p)
+
+	return nil
+}
+
+// ErrPrecision is returned when an amount has more decimal places than the
+// configured precision and rounding was not asked for.
+var ErrPrecision = errors.New("amount is more precise than the ledger")
+
+// ErrOverflow is returned when an amount is too large to be represented.
+var ErrOverflow = errors.New("amount overflows")
+
+// RoundingMode says how to round amounts that are more precise than Precision.
+type RoundingMode int
+
+const (
+	// RoundDown rounds toward zero.
+	RoundDown RoundingMode = iota
+	// RoundUp rounds away from zero.
+	RoundUp
+	// RoundHalfEven rounds to the nearest amount, and to the even one on
+	// ties.
+	RoundHalfEven
+)
+
+// Amount is an exact decimal amount of Jobcoins with Precision decimal places.
+// Amounts are values: arithmetic returns new Amounts and they can be compared
+// with ==. The zero value is zero Jobcoins.
+type Amount struct {
+	// units is the amount in multiples of 10^-precision
+	units int64
+}
+
+// ParseAmount parses a decimal amount such as "12.5". It fails with
+// ErrPrecision if the amount has more decimal places than Precision.
+func ParseAmount(s string) (Amount, error) {
+	return parseAmount(s, nil)
+}
+
+// ParseAmountRound parses a decimal amount such as "12.5", rounding it to
+// Precision decimal places with mode.
+func ParseAmountRound(s string, mode RoundingMode) (Amount, error) {
+	return parseAmount(s, &mode)
+}
+
+// MustParseAmount is like ParseAmount, but panics on errors. It is meant for
+// constants.
+func MustParseAmount(s string) Amount {
+	amt, err := ParseAmount(s)
+	if err != nil {
+		panic(err)
+	}
+	return amt
+}
+
+func parseAmount(s string, mode *RoundingMode) (Amount, error) {
+	s = strings.TrimSpace(s)
+	// big.Rat also accepts fractions, which are not amounts
+	if s == "" || strings.Contains(s, "/") {
+		return Amount{}, errors.Errorf("invalid amount %q", s)
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return Amount{}, errors.Errorf("invalid amount %q", s)
+	}
+
+	amt, err := amountFromRat(r, mode)
+	if err != nil {
+		return Amount{}, errors.Wrapf(err, "invalid amount %q", s)
+	}
+	return amt, nil
+}
+
+// AmountFromFloat converts f to an Amount, rounding it with mode.
+func AmountFromFloat(f float64, mode RoundingMode) (Amount, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return Amount{}, errors.Errorf("invalid amount %v", f)
+	}
+	return amountFromRat(new(big.Rat).SetFloat64(f), &mode)
+}
+
+// amountFromRat converts r to an Amount. If mode is nil, r must not be more
+// precise than Precision.
+func amountFromRat(r *big.Rat, mode *RoundingMode) (Amount, error) {
+	r = new(big.Rat).Mul(r, new(big.Rat).SetInt64(scale))
+
+	units := new(big.Int)
+	if r.IsInt() {
+		units.Set(r.Num())
+	} else if mode == nil {
+		return Amount{}, ErrPrecision
+	} else {
+		units = roundQuo(r.Num(), r.Denom(), *mode)
+	}
+
+	if !units.IsInt64() {
+		return Amount{}, ErrOverflow
+	}
+	return Amount{units: units.Int64()}, nil
+}
+
+// roundQuo returns num/den rounded with mode. den must be positive.
+func roundQuo(num, den *big.Int, mode RoundingMode) *big.Int {
+	q, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	if rem.Sign() == 0 {
+		return q
+	}
+
+	// away is the direction that increases the magnitude of q
+	away := big.NewInt(int64(num.Sign()))
+	switch mode {
+	case RoundUp:
+		q.Add(q, away)
+	case RoundHalfEven:
+		// compare 2|rem| with den
+		twice := new(big.Int).Abs(rem)
+		twice.Lsh(twice, 1)
+		switch c := twice.Cmp(den); {
+		case c > 0, c == 0 && q.Bit(0) == 1:
+			q.Add(q, away)
+		}
+	}
+
+	return q
+}
+
+// String formats a in canonical form: no trailing zeros, no decimal point for
+// whole amounts and a leading "-" for negative ones.
+func (a Amount) String() string {
+	units := a.units
+	sign := ""
+	if units < 0 {
+		sign = "-"
+	}
+
+	whole := units / scale
+	frac := units % scale
+	if whole < 0 {
+		whole = -whole
+	}
+	if frac < 0 {
+		frac = -frac
+	}
+
+	if frac == 0 {
+		return fmt.Sprintf("%s%d", sign, whole)
+	}
+	fracStr := strings.TrimRight(fmt.Sprintf("%0*d", precision, frac), "0")
+	return fmt.Sprintf("%s%d.%s", sign, whole, fracStr)
+}
+
+// Float64 returns the nearest float64 to a. It is meant for sampling random
+// amounts, not for accounting.
+func (a Amount) Float64() float64 {
+	return float64(a.units) / float64(scale)
+}
+
+// Sign returns -1, 0 or 1 depending on the sign of a.
+func (a Amount) Sign() int {
+	switch {
+	case a.units < 0:
+		return -1
+	case a.units > 0:
+		return 1
+	}
+	return 0
+}
+
+// IsZero reports whether a is zero.
+func (a Amount) IsZero() bool { return a.units == 0 }
+
+// Cmp returns -1, 0 or 1 depending on whether a is less than, equal to or
+// greater than b.
+func (a Amount) Cmp(b Amount) int {
+	switch {
+	case a.units < b.units:
+		return -1
+	case a.units > b.units:
+		return 1
+	}
+	return 0
+}
+
+// Add returns a+b. It panics on overflow.
+func (a Amount) Add(b Amount) Amount {
+	sum := a.units + b.units
+	if (sum > a.units) != (b.units > 0) {
+		panic(ErrOverflow)
+	}
+	return Amount{units: sum}
+}
+
+// Sub returns a-b. It panics on overflow.
+func (a Amount) Sub(b Amount) Amount {
+	diff := a.units - b.units
+	if (diff < a.units) != (b.units > 0) {
+		panic(ErrOverflow)
+	}
+	return Amount{units: diff}
+}
+
+// Neg returns -a.
+func (a Amount) Neg() Amount { return Amount{units: -a.units} }
+
+// Mul returns a*n. It panics on overflow.
+func (a Amount) Mul(n int64) Amount {
+	return a.MulRatio(n, 1, RoundDown)
+}
+
+// MulRatio returns a*num/den rounded with mode. It panics if den is zero or on
+// overflow.
+func (a Amount) MulRatio(num, den int64, mode RoundingMode) Amount {
+	if den == 0 {
+		panic("climatic: zero denominator")
+	}
+	n := new(big.Int).Mul(big.NewInt(a.units), big.NewInt(num))
+	d := big.NewInt(den)
+	if den < 0 {
+		n.Neg(n)
+		d.Neg(d)
+	}
+
+	units := roundQuo(n, d, mode)
+	if !units.IsInt64() {
+		panic(ErrOverflow)
+	}
+	return Amount{units: units.Int64()}
+}
+
+// MinAmount returns the smaller of a and b.
+func MinAmount(a, b Amount) Amount {
+	if a.Cmp(b) <= 0 {
+		return a
+	}
+	return b
+}
+
+// MaxAmount returns the larger of a and b.
+func MaxAmount(a, b Amount) Amount {
+	if a.Cmp(b) >= 0 {
+		return a
+	}
+	return b
+}
+
+// MarshalJSON encodes a as a JSON string, which is how the Jobcoin API sends
+// amounts.
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.String())
+}
+
+// UnmarshalJSON decodes a JSON string or number. Amounts more precise than
+// Precision are rounded toward zero, so that a balance is never overstated.
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	var s string
+	if len(data) > 0 && data[0] == '"' {
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+	} else {
+		s = string(data)
+	}
+
+	amt, err := ParseAmountRound(s, RoundDown)
+	if err != nil {
+		return err
+	}
+	*a = amt
+
+	return nil
+}
+
+// Set parses s exactly into a. Together with String it makes *Amount usable as
+// a command line flag.
+func (a *Amount) Set(s string) error {
+	amt, err := ParseAmount(s)
+	if err != nil {
+		return err
+	}
+	*a = amt
+
+	return nil
+}
+
+func pow10(n int) int64 {
+	p := int64(1)
+	for i := 0; i < n; i++ {
+		p *= 10
+	}
+	return p
+}
@@ -0,0 +1,145 @@
+package climatic
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAmount(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		in   string
+		want string
+		err  error
+	}{
+		{in: "0", want: "0"},
+		{in: "12.5", want: "12.5"},
+		{in: "12.50000000", want: "12.5"},
+		{in: " 1. ", want: "1"},
+		{in: ".25", want: "0.25"},
+		{in: "-3.1", want: "-3.1"},
+		{in: "0.00000001", want: "0.00000001"},
+		{in: "1e2", want: "100"},
+		{in: "0.000000001", err: ErrPrecision},
+		{in: "92233720368.54775807", want: "92233720368.54775807"},
+		{in: "100000000000", err: ErrOverflow},
+		{in: ""},
+		{in: "1/2"},
+		{in: "abc"},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.in, func(t *testing.T) {
+			require := require.New(t)
+
+			amt, err := ParseAmount(test.in)
+			if test.want == "" {
+				require.Error(err)
+				if test.err != nil {
+					require.True(errors.Is(err, test.err), "unexpected error: %v", err)
+				}
+				return
+			}
+			require.NoError(err)
+			require.Equal(test.want, amt.String())
+		})
+	}
+}
+
+func TestRounding(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		in   string
+		mode RoundingMode
+		want string
+	}{
+		{in: "0.000000015", mode: RoundDown, want: "0.00000001"},
+		{in: "0.000000015", mode: RoundUp, want: "0.00000002"},
+		{in: "0.000000015", mode: RoundHalfEven, want: "0.00000002"},
+		{in: "0.000000025", mode: RoundHalfEven, want: "0.00000002"},
+		{in: "0.0000000251", mode: RoundHalfEven, want: "0.00000003"},
+		{in: "-0.000000015", mode: RoundDown, want: "-0.00000001"},
+		{in: "-0.000000015", mode: RoundUp, want: "-0.00000002"},
+		{in: "-0.000000015", mode: RoundHalfEven, want: "-0.00000002"},
+		{in: "2", mode: RoundUp, want: "2"},
+	}
+
+	for _, test := range tests {
+		amt, err := ParseAmountRound(test.in, test.mode)
+		require.NoError(t, err)
+		require.Equal(t, test.want, amt.String(), "rounding %s with mode %d", test.in, test.mode)
+	}
+
+	amt, err := AmountFromFloat(0.1, RoundHalfEven)
+	require.NoError(t, err)
+	require.Equal(t, "0.1", amt.String())
+	_, err = AmountFromFloat(math.NaN(), RoundDown)
+	require.Error(t, err)
+}
+
+func TestAmountArithmetic(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	a := MustParseAmount("10.1")
+	b := MustParseAmount("0.2")
+
+	require.Equal(MustParseAmount("10.3"), a.Add(b))
+	require.Equal(MustParseAmount("9.9"), a.Sub(b))
+	require.Equal(MustParseAmount("-0.2"), b.Neg())
+	require.Equal(MustParseAmount("30.3"), a.Mul(3))
+	require.Equal(MustParseAmount("3.36666666"), a.MulRatio(1, 3, RoundDown))
+	require.Equal(MustParseAmount("3.36666667"), a.MulRatio(1, 3, RoundHalfEven))
+	require.Equal(1, a.Cmp(b))
+	require.Equal(-1, b.Cmp(a))
+	require.Equal(0, a.Cmp(MustParseAmount("10.10")))
+	require.Equal(b, MinAmount(a, b))
+	require.Equal(a, MaxAmount(a, b))
+	require.True(Amount{}.IsZero())
+	require.Equal(-1, b.Neg().Sign())
+
+	max := Amount{units: math.MaxInt64}
+	require.Panics(func() { max.Add(b) })
+	require.Panics(func() { max.Neg().Sub(b) })
+}
+
+func TestAmountJSON(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	data, err := json.Marshal(struct{ A Amount }{MustParseAmount("1.50")})
+	require.NoError(err)
+	require.Equal(`{"A":"1.5"}`, string(data))
+
+	var v struct{ A, B, C Amount }
+	require.NoError(json.Unmarshal([]byte(`{"A":"2.25","B":3,"C":"0.123456789"}`), &v))
+	require.Equal(MustParseAmount("2.25"), v.A)
+	require.Equal(MustParseAmount("3"), v.B)
+	require.Equal(MustParseAmount("0.12345678"), v.C, "rounded toward zero")
+
+	require.Error(json.Unmarshal([]byte(`{"A":"x"}`), &v))
+}
+
+func TestSetPrecision(t *testing.T) {
+	// not parallel: the precision is global
+	require := require.New(t)
+	defer func() { require.NoError(SetPrecision(DefaultPrecision)) }()
+
+	require.Error(SetPrecision(-1))
+	require.Error(SetPrecision(MaxPrecision + 1))
+
+	require.NoError(SetPrecision(2))
+	require.Equal(2, Precision())
+	amt, err := ParseAmount("1.25")
+	require.NoError(err)
+	require.Equal("1.25", amt.String())
+	_, err = ParseAmount("1.255")
+	require.True(errors.Is(err, ErrPrecision))
+}
@@ -11,6 +11,19 @@ It is generated from these files:
 It has these top-level messages:
 	RegisterRequest
 	RegisterResponse
+	StatusRequest
+	StatusResponse
+	Payout
+	PlannedPayout
+	Split
+	Window
+	FeeReportRequest
+	FeeReportResponse
+	FeePeriod
+	FeeEntry
+	ReconcileRequest
+	ReconcileResponse
+	Discrepancy
 */
 package climatic
 
@@ -35,7 +48,12 @@ var _ = math.Inf
 const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
 
 type RegisterRequest struct {
+	// addresses each get an equal share of what is left after the fixed
+	// amounts of splits, as if they were splits of weight 1
 	Addresses []string `protobuf:"bytes,1,rep,name=addresses" json:"addresses,omitempty"`
+	Splits    []*Split `protobuf:"bytes,2,rep,name=splits" json:"splits,omitempty"`
+	// window, if set, is when the deposits must be paid out
+	Window *Window `protobuf:"bytes,3,opt,name=window" json:"window,omitempty"`
 }
 
 func (m *RegisterRequest) Reset()                    { *m = RegisterRequest{} }
@@ -50,6 +68,20 @@ func (m *RegisterRequest) GetAddresses() []string {
 	return nil
 }
 
+func (m *RegisterRequest) GetSplits() []*Split {
+	if m != nil {
+		return m.Splits
+	}
+	return nil
+}
+
+func (m *RegisterRequest) GetWindow() *Window {
+	if m != nil {
+		return m.Window
+	}
+	return nil
+}
+
 type RegisterResponse struct {
 	Address string `protobuf:"bytes,1,opt,name=address" json:"address,omitempty"`
 }
@@ -66,9 +98,654 @@ func (m *RegisterResponse) GetAddress() string {
 	return ""
 }
 
+type StatusRequest struct {
+	// address is a deposit address
+	Address string `protobuf:"bytes,1,opt,name=address" json:"address,omitempty"`
+}
+
+func (m *StatusRequest) Reset()                    { *m = StatusRequest{} }
+func (m *StatusRequest) String() string            { return proto.CompactTextString(m) }
+func (*StatusRequest) ProtoMessage()               {}
+func (*StatusRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
+
+func (m *StatusRequest) GetAddress() string {
+	if m != nil {
+		return m.Address
+	}
+	return ""
+}
+
+// Amounts are decimal strings.
+type StatusResponse struct {
+	Address       string   `protobuf:"bytes,1,opt,name=address" json:"address,omitempty"`
+	UserAddresses []string `protobuf:"bytes,2,rep,name=user_addresses,json=userAddresses" json:"user_addresses,omitempty"`
+	// remaining is what is left in the deposit address to mix
+	Remaining string `protobuf:"bytes,3,opt,name=remaining" json:"remaining,omitempty"`
+	// owed is what was swept into the pool and has yet to be paid out
+	Owed    string `protobuf:"bytes,4,opt,name=owed" json:"owed,omitempty"`
+	FeePaid bool   `protobuf:"varint,5,opt,name=fee_paid,json=feePaid" json:"fee_paid,omitempty"`
+	// in_flight holds the payouts that are still on their way through hop
+	// addresses
+	InFlight []*Payout `protobuf:"bytes,6,rep,name=in_flight,json=inFlight" json:"in_flight,omitempty"`
+	// plan holds the payouts planned for the deposits, paid or not
+	Plan []*PlannedPayout `protobuf:"bytes,7,rep,name=plan" json:"plan,omitempty"`
+	// deadline is when the planned payouts must be made by, in seconds
+	// since the Unix epoch, if the addresses were registered with a window
+	Deadline int64 `protobuf:"varint,8,opt,name=deadline" json:"deadline,omitempty"`
+	// at_risk is whether the deadline could be missed
+	AtRisk bool `protobuf:"varint,9,opt,name=at_risk,json=atRisk" json:"at_risk,omitempty"`
+	// state is where the deposit address is in its life: created, funded,
+	// mixing, completed or expired
+	State string `protobuf:"bytes,10,opt,name=state" json:"state,omitempty"`
+}
+
+func (m *StatusResponse) Reset()                    { *m = StatusResponse{} }
+func (m *StatusResponse) String() string            { return proto.CompactTextString(m) }
+func (*StatusResponse) ProtoMessage()               {}
+func (*StatusResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+
+func (m *StatusResponse) GetAddress() string {
+	if m != nil {
+		return m.Address
+	}
+	return ""
+}
+
+func (m *StatusResponse) GetUserAddresses() []string {
+	if m != nil {
+		return m.UserAddresses
+	}
+	return nil
+}
+
+func (m *StatusResponse) GetRemaining() string {
+	if m != nil {
+		return m.Remaining
+	}
+	return ""
+}
+
+func (m *StatusResponse) GetOwed() string {
+	if m != nil {
+		return m.Owed
+	}
+	return ""
+}
+
+func (m *StatusResponse) GetFeePaid() bool {
+	if m != nil {
+		return m.FeePaid
+	}
+	return false
+}
+
+func (m *StatusResponse) GetInFlight() []*Payout {
+	if m != nil {
+		return m.InFlight
+	}
+	return nil
+}
+
+func (m *StatusResponse) GetPlan() []*PlannedPayout {
+	if m != nil {
+		return m.Plan
+	}
+	return nil
+}
+
+func (m *StatusResponse) GetDeadline() int64 {
+	if m != nil {
+		return m.Deadline
+	}
+	return 0
+}
+
+func (m *StatusResponse) GetAtRisk() bool {
+	if m != nil {
+		return m.AtRisk
+	}
+	return false
+}
+
+func (m *StatusResponse) GetState() string {
+	if m != nil {
+		return m.State
+	}
+	return ""
+}
+
+type Payout struct {
+	ToAddress string `protobuf:"bytes,1,opt,name=to_address,json=toAddress" json:"to_address,omitempty"`
+	Amount    string `protobuf:"bytes,2,opt,name=amount" json:"amount,omitempty"`
+	Hops      int32  `protobuf:"varint,3,opt,name=hops" json:"hops,omitempty"`
+	HopsDone  int32  `protobuf:"varint,4,opt,name=hops_done,json=hopsDone" json:"hops_done,omitempty"`
+}
+
+func (m *Payout) Reset()                    { *m = Payout{} }
+func (m *Payout) String() string            { return proto.CompactTextString(m) }
+func (*Payout) ProtoMessage()               {}
+func (*Payout) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
+
+func (m *Payout) GetToAddress() string {
+	if m != nil {
+		return m.ToAddress
+	}
+	return ""
+}
+
+func (m *Payout) GetAmount() string {
+	if m != nil {
+		return m.Amount
+	}
+	return ""
+}
+
+func (m *Payout) GetHops() int32 {
+	if m != nil {
+		return m.Hops
+	}
+	return 0
+}
+
+func (m *Payout) GetHopsDone() int32 {
+	if m != nil {
+		return m.HopsDone
+	}
+	return 0
+}
+
+type PlannedPayout struct {
+	ToAddress string `protobuf:"bytes,1,opt,name=to_address,json=toAddress" json:"to_address,omitempty"`
+	Amount    string `protobuf:"bytes,2,opt,name=amount" json:"amount,omitempty"`
+	// at is when the payout is due, in seconds since the Unix epoch
+	At   int64 `protobuf:"varint,3,opt,name=at" json:"at,omitempty"`
+	Paid bool  `protobuf:"varint,4,opt,name=paid" json:"paid,omitempty"`
+	// deadline is when the payout must be made by, in seconds since the
+	// Unix epoch, if there is a window
+	Deadline int64 `protobuf:"varint,5,opt,name=deadline" json:"deadline,omitempty"`
+	// refund is why the payout sends a deposit back to its sender, if it
+	// does: late, below-minimum, above-maximum or unmixable
+	Refund string `protobuf:"bytes,6,opt,name=refund" json:"refund,omitempty"`
+}
+
+func (m *PlannedPayout) Reset()                    { *m = PlannedPayout{} }
+func (m *PlannedPayout) String() string            { return proto.CompactTextString(m) }
+func (*PlannedPayout) ProtoMessage()               {}
+func (*PlannedPayout) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{5} }
+
+func (m *PlannedPayout) GetToAddress() string {
+	if m != nil {
+		return m.ToAddress
+	}
+	return ""
+}
+
+func (m *PlannedPayout) GetAmount() string {
+	if m != nil {
+		return m.Amount
+	}
+	return ""
+}
+
+func (m *PlannedPayout) GetAt() int64 {
+	if m != nil {
+		return m.At
+	}
+	return 0
+}
+
+func (m *PlannedPayout) GetPaid() bool {
+	if m != nil {
+		return m.Paid
+	}
+	return false
+}
+
+func (m *PlannedPayout) GetDeadline() int64 {
+	if m != nil {
+		return m.Deadline
+	}
+	return 0
+}
+
+func (m *PlannedPayout) GetRefund() string {
+	if m != nil {
+		return m.Refund
+	}
+	return ""
+}
+
+// Split says how much of a deposit goes to a user address: either a fixed
+// amount, or a share of what is left after the fixed amounts in proportion to
+// its weight.
+type Split struct {
+	Address string `protobuf:"bytes,1,opt,name=address" json:"address,omitempty"`
+	Weight  uint32 `protobuf:"varint,2,opt,name=weight" json:"weight,omitempty"`
+	// amount is a decimal string
+	Amount string `protobuf:"bytes,3,opt,name=amount" json:"amount,omitempty"`
+}
+
+func (m *Split) Reset()                    { *m = Split{} }
+func (m *Split) String() string            { return proto.CompactTextString(m) }
+func (*Split) ProtoMessage()               {}
+func (*Split) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{6} }
+
+func (m *Split) GetAddress() string {
+	if m != nil {
+		return m.Address
+	}
+	return ""
+}
+
+func (m *Split) GetWeight() uint32 {
+	if m != nil {
+		return m.Weight
+	}
+	return 0
+}
+
+func (m *Split) GetAmount() string {
+	if m != nil {
+		return m.Amount
+	}
+	return ""
+}
+
+// Window bounds how long after a deposit is found its payouts arrive.
+type Window struct {
+	MinSeconds int64 `protobuf:"varint,1,opt,name=min_seconds,json=minSeconds" json:"min_seconds,omitempty"`
+	MaxSeconds int64 `protobuf:"varint,2,opt,name=max_seconds,json=maxSeconds" json:"max_seconds,omitempty"`
+}
+
+func (m *Window) Reset()                    { *m = Window{} }
+func (m *Window) String() string            { return proto.CompactTextString(m) }
+func (*Window) ProtoMessage()               {}
+func (*Window) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{7} }
+
+func (m *Window) GetMinSeconds() int64 {
+	if m != nil {
+		return m.MinSeconds
+	}
+	return 0
+}
+
+func (m *Window) GetMaxSeconds() int64 {
+	if m != nil {
+		return m.MaxSeconds
+	}
+	return 0
+}
+
+// FeeReportRequest asks for the fees collected from from up to to, in seconds
+// since the Unix epoch.
+type FeeReportRequest struct {
+	// token is the admin token of the mixer
+	Token string `protobuf:"bytes,1,opt,name=token" json:"token,omitempty"`
+	From  int64  `protobuf:"varint,2,opt,name=from" json:"from,omitempty"`
+	// to is now if it is zero
+	To int64 `protobuf:"varint,3,opt,name=to" json:"to,omitempty"`
+	// period is day, week or month to sum up the fees by, in UTC, or empty
+	// to sum them all up
+	Period string `protobuf:"bytes,4,opt,name=period" json:"period,omitempty"`
+	// entries is whether to list every fee too
+	Entries bool `protobuf:"varint,5,opt,name=entries" json:"entries,omitempty"`
+}
+
+func (m *FeeReportRequest) Reset()                    { *m = FeeReportRequest{} }
+func (m *FeeReportRequest) String() string            { return proto.CompactTextString(m) }
+func (*FeeReportRequest) ProtoMessage()               {}
+func (*FeeReportRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{8} }
+
+func (m *FeeReportRequest) GetToken() string {
+	if m != nil {
+		return m.Token
+	}
+	return ""
+}
+
+func (m *FeeReportRequest) GetFrom() int64 {
+	if m != nil {
+		return m.From
+	}
+	return 0
+}
+
+func (m *FeeReportRequest) GetTo() int64 {
+	if m != nil {
+		return m.To
+	}
+	return 0
+}
+
+func (m *FeeReportRequest) GetPeriod() string {
+	if m != nil {
+		return m.Period
+	}
+	return ""
+}
+
+func (m *FeeReportRequest) GetEntries() bool {
+	if m != nil {
+		return m.Entries
+	}
+	return false
+}
+
+type FeeReportResponse struct {
+	// periods leaves out the periods without fees
+	Periods []*FeePeriod `protobuf:"bytes,1,rep,name=periods" json:"periods,omitempty"`
+	Entries []*FeeEntry  `protobuf:"bytes,2,rep,name=entries" json:"entries,omitempty"`
+}
+
+func (m *FeeReportResponse) Reset()                    { *m = FeeReportResponse{} }
+func (m *FeeReportResponse) String() string            { return proto.CompactTextString(m) }
+func (*FeeReportResponse) ProtoMessage()               {}
+func (*FeeReportResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{9} }
+
+func (m *FeeReportResponse) GetPeriods() []*FeePeriod {
+	if m != nil {
+		return m.Periods
+	}
+	return nil
+}
+
+func (m *FeeReportResponse) GetEntries() []*FeeEntry {
+	if m != nil {
+		return m.Entries
+	}
+	return nil
+}
+
+// FeePeriod sums up the fees collected in a period.
+type FeePeriod struct {
+	Start     int64  `protobuf:"varint,1,opt,name=start" json:"start,omitempty"`
+	End       int64  `protobuf:"varint,2,opt,name=end" json:"end,omitempty"`
+	Fees      int32  `protobuf:"varint,3,opt,name=fees" json:"fees,omitempty"`
+	Collected string `protobuf:"bytes,4,opt,name=collected" json:"collected,omitempty"`
+	// charged is what the deposits were charged, which is more than
+	// collected if fees were reduced to what was in the deposit address
+	Charged string `protobuf:"bytes,5,opt,name=charged" json:"charged,omitempty"`
+	// reduced is how many fees were reduced
+	Reduced int32 `protobuf:"varint,6,opt,name=reduced" json:"reduced,omitempty"`
+}
+
+func (m *FeePeriod) Reset()                    { *m = FeePeriod{} }
+func (m *FeePeriod) String() string            { return proto.CompactTextString(m) }
+func (*FeePeriod) ProtoMessage()               {}
+func (*FeePeriod) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{10} }
+
+func (m *FeePeriod) GetStart() int64 {
+	if m != nil {
+		return m.Start
+	}
+	return 0
+}
+
+func (m *FeePeriod) GetEnd() int64 {
+	if m != nil {
+		return m.End
+	}
+	return 0
+}
+
+func (m *FeePeriod) GetFees() int32 {
+	if m != nil {
+		return m.Fees
+	}
+	return 0
+}
+
+func (m *FeePeriod) GetCollected() string {
+	if m != nil {
+		return m.Collected
+	}
+	return ""
+}
+
+func (m *FeePeriod) GetCharged() string {
+	if m != nil {
+		return m.Charged
+	}
+	return ""
+}
+
+func (m *FeePeriod) GetReduced() int32 {
+	if m != nil {
+		return m.Reduced
+	}
+	return 0
+}
+
+// FeeEntry is a fee that was collected.
+type FeeEntry struct {
+	TransferId     string `protobuf:"bytes,1,opt,name=transfer_id,json=transferId" json:"transfer_id,omitempty"`
+	DepositAddress string `protobuf:"bytes,2,opt,name=deposit_address,json=depositAddress" json:"deposit_address,omitempty"`
+	DepositId      string `protobuf:"bytes,3,opt,name=deposit_id,json=depositId" json:"deposit_id,omitempty"`
+	Amount         string `protobuf:"bytes,4,opt,name=amount" json:"amount,omitempty"`
+	Charged        string `protobuf:"bytes,5,opt,name=charged" json:"charged,omitempty"`
+	Time           int64  `protobuf:"varint,6,opt,name=time" json:"time,omitempty"`
+	Reduced        bool   `protobuf:"varint,7,opt,name=reduced" json:"reduced,omitempty"`
+}
+
+func (m *FeeEntry) Reset()                    { *m = FeeEntry{} }
+func (m *FeeEntry) String() string            { return proto.CompactTextString(m) }
+func (*FeeEntry) ProtoMessage()               {}
+func (*FeeEntry) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{11} }
+
+func (m *FeeEntry) GetTransferId() string {
+	if m != nil {
+		return m.TransferId
+	}
+	return ""
+}
+
+func (m *FeeEntry) GetDepositAddress() string {
+	if m != nil {
+		return m.DepositAddress
+	}
+	return ""
+}
+
+func (m *FeeEntry) GetDepositId() string {
+	if m != nil {
+		return m.DepositId
+	}
+	return ""
+}
+
+func (m *FeeEntry) GetAmount() string {
+	if m != nil {
+		return m.Amount
+	}
+	return ""
+}
+
+func (m *FeeEntry) GetCharged() string {
+	if m != nil {
+		return m.Charged
+	}
+	return ""
+}
+
+func (m *FeeEntry) GetTime() int64 {
+	if m != nil {
+		return m.Time
+	}
+	return 0
+}
+
+func (m *FeeEntry) GetReduced() bool {
+	if m != nil {
+		return m.Reduced
+	}
+	return false
+}
+
+type ReconcileRequest struct {
+	// token is the admin token of the mixer
+	Token string `protobuf:"bytes,1,opt,name=token" json:"token,omitempty"`
+	// run is whether to reconcile now rather than report the last run
+	Run bool `protobuf:"varint,2,opt,name=run" json:"run,omitempty"`
+}
+
+func (m *ReconcileRequest) Reset()                    { *m = ReconcileRequest{} }
+func (m *ReconcileRequest) String() string            { return proto.CompactTextString(m) }
+func (*ReconcileRequest) ProtoMessage()               {}
+func (*ReconcileRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{12} }
+
+func (m *ReconcileRequest) GetToken() string {
+	if m != nil {
+		return m.Token
+	}
+	return ""
+}
+
+func (m *ReconcileRequest) GetRun() bool {
+	if m != nil {
+		return m.Run
+	}
+	return false
+}
+
+// ReconcileResponse is a reconciliation report. Times are in seconds since the
+// Unix epoch.
+type ReconcileResponse struct {
+	Start int64 `protobuf:"varint,1,opt,name=start" json:"start,omitempty"`
+	End   int64 `protobuf:"varint,2,opt,name=end" json:"end,omitempty"`
+	// checked is how many addresses were checked
+	Checked int32 `protobuf:"varint,3,opt,name=checked" json:"checked,omitempty"`
+	// skipped is how many deposit addresses were left out because the
+	// outcome of a transfer from them is unknown
+	Skipped       int32          `protobuf:"varint,4,opt,name=skipped" json:"skipped,omitempty"`
+	Discrepancies []*Discrepancy `protobuf:"bytes,5,rep,name=discrepancies" json:"discrepancies,omitempty"`
+	// error is why the run stopped early, if it did
+	Error string `protobuf:"bytes,6,opt,name=error" json:"error,omitempty"`
+}
+
+func (m *ReconcileResponse) Reset()                    { *m = ReconcileResponse{} }
+func (m *ReconcileResponse) String() string            { return proto.CompactTextString(m) }
+func (*ReconcileResponse) ProtoMessage()               {}
+func (*ReconcileResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{13} }
+
+func (m *ReconcileResponse) GetStart() int64 {
+	if m != nil {
+		return m.Start
+	}
+	return 0
+}
+
+func (m *ReconcileResponse) GetEnd() int64 {
+	if m != nil {
+		return m.End
+	}
+	return 0
+}
+
+func (m *ReconcileResponse) GetChecked() int32 {
+	if m != nil {
+		return m.Checked
+	}
+	return 0
+}
+
+func (m *ReconcileResponse) GetSkipped() int32 {
+	if m != nil {
+		return m.Skipped
+	}
+	return 0
+}
+
+func (m *ReconcileResponse) GetDiscrepancies() []*Discrepancy {
+	if m != nil {
+		return m.Discrepancies
+	}
+	return nil
+}
+
+func (m *ReconcileResponse) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
+// Discrepancy is a difference between the ledger and the mixer's accounting.
+type Discrepancy struct {
+	// kind is balance, outside-spend or missing-transfer
+	Kind    string `protobuf:"bytes,1,opt,name=kind" json:"kind,omitempty"`
+	Address string `protobuf:"bytes,2,opt,name=address" json:"address,omitempty"`
+	// expected is the balance the mixer expects or the amount of a missing
+	// transfer
+	Expected string `protobuf:"bytes,3,opt,name=expected" json:"expected,omitempty"`
+	// actual is the balance in the ledger or the amount of an outside spend
+	Actual     string `protobuf:"bytes,4,opt,name=actual" json:"actual,omitempty"`
+	TransferId string `protobuf:"bytes,5,opt,name=transfer_id,json=transferId" json:"transfer_id,omitempty"`
+	ToAddress  string `protobuf:"bytes,6,opt,name=to_address,json=toAddress" json:"to_address,omitempty"`
+}
+
+func (m *Discrepancy) Reset()                    { *m = Discrepancy{} }
+func (m *Discrepancy) String() string            { return proto.CompactTextString(m) }
+func (*Discrepancy) ProtoMessage()               {}
+func (*Discrepancy) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{14} }
+
+func (m *Discrepancy) GetKind() string {
+	if m != nil {
+		return m.Kind
+	}
+	return ""
+}
+
+func (m *Discrepancy) GetAddress() string {
+	if m != nil {
+		return m.Address
+	}
+	return ""
+}
+
+func (m *Discrepancy) GetExpected() string {
+	if m != nil {
+		return m.Expected
+	}
+	return ""
+}
+
+func (m *Discrepancy) GetActual() string {
+	if m != nil {
+		return m.Actual
+	}
+	return ""
+}
+
+func (m *Discrepancy) GetTransferId() string {
+	if m != nil {
+		return m.TransferId
+	}
+	return ""
+}
+
+func (m *Discrepancy) GetToAddress() string {
+	if m != nil {
+		return m.ToAddress
+	}
+	return ""
+}
+
 func init() {
 	proto.RegisterType((*RegisterRequest)(nil), "climatic.RegisterRequest")
 	proto.RegisterType((*RegisterResponse)(nil), "climatic.RegisterResponse")
+	proto.RegisterType((*StatusRequest)(nil), "climatic.StatusRequest")
+	proto.RegisterType((*StatusResponse)(nil), "climatic.StatusResponse")
+	proto.RegisterType((*Payout)(nil), "climatic.Payout")
+	proto.RegisterType((*PlannedPayout)(nil), "climatic.PlannedPayout")
+	proto.RegisterType((*Split)(nil), "climatic.Split")
+	proto.RegisterType((*Window)(nil), "climatic.Window")
+	proto.RegisterType((*FeeReportRequest)(nil), "climatic.FeeReportRequest")
+	proto.RegisterType((*FeeReportResponse)(nil), "climatic.FeeReportResponse")
+	proto.RegisterType((*FeePeriod)(nil), "climatic.FeePeriod")
+	proto.RegisterType((*FeeEntry)(nil), "climatic.FeeEntry")
+	proto.RegisterType((*ReconcileRequest)(nil), "climatic.ReconcileRequest")
+	proto.RegisterType((*ReconcileResponse)(nil), "climatic.ReconcileResponse")
+	proto.RegisterType((*Discrepancy)(nil), "climatic.Discrepancy")
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -83,6 +760,12 @@ const _ = grpc.SupportPackageIsVersion4
 
 type MixerClient interface {
 	Register(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*RegisterResponse, error)
+	Status(ctx context.Context, in *StatusRequest, opts ...grpc.CallOption) (*StatusResponse, error)
+	// FeeReport is an admin call that reports the fees collected.
+	FeeReport(ctx context.Context, in *FeeReportRequest, opts ...grpc.CallOption) (*FeeReportResponse, error)
+	// Reconcile is an admin call that reports where the ledger disagrees
+	// with the mixer's accounting.
+	Reconcile(ctx context.Context, in *ReconcileRequest, opts ...grpc.CallOption) (*ReconcileResponse, error)
 }
 
 type mixerClient struct {
@@ -102,10 +785,43 @@ func (c *mixerClient) Register(ctx context.Context, in *RegisterRequest, opts ..
 	return out, nil
 }
 
+func (c *mixerClient) Status(ctx context.Context, in *StatusRequest, opts ...grpc.CallOption) (*StatusResponse, error) {
+	out := new(StatusResponse)
+	err := grpc.Invoke(ctx, "/climatic.Mixer/Status", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mixerClient) FeeReport(ctx context.Context, in *FeeReportRequest, opts ...grpc.CallOption) (*FeeReportResponse, error) {
+	out := new(FeeReportResponse)
+	err := grpc.Invoke(ctx, "/climatic.Mixer/FeeReport", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mixerClient) Reconcile(ctx context.Context, in *ReconcileRequest, opts ...grpc.CallOption) (*ReconcileResponse, error) {
+	out := new(ReconcileResponse)
+	err := grpc.Invoke(ctx, "/climatic.Mixer/Reconcile", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // Server API for Mixer service
 
 type MixerServer interface {
 	Register(context.Context, *RegisterRequest) (*RegisterResponse, error)
+	Status(context.Context, *StatusRequest) (*StatusResponse, error)
+	// FeeReport is an admin call that reports the fees collected.
+	FeeReport(context.Context, *FeeReportRequest) (*FeeReportResponse, error)
+	// Reconcile is an admin call that reports where the ledger disagrees
+	// with the mixer's accounting.
+	Reconcile(context.Context, *ReconcileRequest) (*ReconcileResponse, error)
 }
 
 func RegisterMixerServer(s *grpc.Server, srv MixerServer) {
@@ -130,6 +846,60 @@ func _Mixer_Register_Handler(srv interface{}, ctx context.Context, dec func(inte
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Mixer_Status_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MixerServer).Status(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/climatic.Mixer/Status",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MixerServer).Status(ctx, req.(*StatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Mixer_FeeReport_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FeeReportRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MixerServer).FeeReport(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/climatic.Mixer/FeeReport",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MixerServer).FeeReport(ctx, req.(*FeeReportRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Mixer_Reconcile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReconcileRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MixerServer).Reconcile(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/climatic.Mixer/Reconcile",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MixerServer).Reconcile(ctx, req.(*ReconcileRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _Mixer_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "climatic.Mixer",
 	HandlerType: (*MixerServer)(nil),
@@ -138,6 +908,18 @@ var _Mixer_serviceDesc = grpc.ServiceDesc{
 			MethodName: "Register",
 			Handler:    _Mixer_Register_Handler,
 		},
+		{
+			MethodName: "Status",
+			Handler:    _Mixer_Status_Handler,
+		},
+		{
+			MethodName: "FeeReport",
+			Handler:    _Mixer_FeeReport_Handler,
+		},
+		{
+			MethodName: "Reconcile",
+			Handler:    _Mixer_Reconcile_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "github.com/r-medina/climatic/climatic.proto",
@@ -146,16 +928,67 @@ var _Mixer_serviceDesc = grpc.ServiceDesc{
 func init() { proto.RegisterFile("github.com/r-medina/climatic/climatic.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 167 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0xe2, 0xd2, 0x4e, 0xcf, 0x2c, 0xc9,
-	0x28, 0x4d, 0xd2, 0x4b, 0xce, 0xcf, 0xd5, 0x2f, 0xd2, 0xcd, 0x4d, 0x4d, 0xc9, 0xcc, 0x4b, 0xd4,
-	0x4f, 0xce, 0xc9, 0xcc, 0x4d, 0x2c, 0xc9, 0x4c, 0x86, 0x33, 0xf4, 0x0a, 0x8a, 0xf2, 0x4b, 0xf2,
-	0x85, 0x38, 0x60, 0x7c, 0x25, 0x7d, 0x2e, 0xfe, 0xa0, 0xd4, 0xf4, 0xcc, 0xe2, 0x92, 0xd4, 0xa2,
-	0xa0, 0xd4, 0xc2, 0xd2, 0xd4, 0xe2, 0x12, 0x21, 0x19, 0x2e, 0xce, 0xc4, 0x94, 0x94, 0xa2, 0xd4,
-	0xe2, 0xe2, 0xd4, 0x62, 0x09, 0x46, 0x05, 0x66, 0x0d, 0xce, 0x20, 0x84, 0x80, 0x92, 0x0e, 0x97,
-	0x00, 0x42, 0x43, 0x71, 0x41, 0x7e, 0x5e, 0x71, 0xaa, 0x90, 0x04, 0x17, 0x3b, 0x54, 0x81, 0x04,
-	0xa3, 0x02, 0xa3, 0x06, 0x67, 0x10, 0x8c, 0x6b, 0xe4, 0xc5, 0xc5, 0xea, 0x9b, 0x59, 0x91, 0x5a,
-	0x24, 0xe4, 0xc8, 0xc5, 0x01, 0xd3, 0x26, 0x24, 0xa9, 0x07, 0x77, 0x0e, 0x9a, 0xdd, 0x52, 0x52,
-	0xd8, 0xa4, 0x20, 0xb6, 0x24, 0xb1, 0x81, 0xdd, 0x6e, 0x0c, 0x08, 0x00, 0x00, 0xff, 0xff, 0x75,
-	0x37, 0xd0, 0x93, 0xea, 0x00, 0x00, 0x00,
+	// 988 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x56, 0xcd, 0x6e, 0xdb, 0x46,
+	0x10, 0x06, 0x25, 0x91, 0x22, 0xc7, 0xf0, 0x4f, 0xb6, 0xa9, 0xc3, 0xc8, 0x09, 0x2a, 0x10, 0x28,
+	0xa2, 0x22, 0xb1, 0x03, 0xb8, 0xb7, 0xe6, 0x14, 0xc0, 0x35, 0x90, 0x02, 0x05, 0xdc, 0xf5, 0xa1,
+	0x47, 0x61, 0xc3, 0x1d, 0xd9, 0x0b, 0x49, 0xbb, 0xec, 0x72, 0x05, 0xdb, 0x97, 0x1e, 0xfa, 0x0a,
+	0x3d, 0xf5, 0xd2, 0x57, 0xe8, 0x3b, 0x14, 0xe8, 0x13, 0xf4, 0x85, 0x0a, 0xee, 0x0f, 0x29, 0x3a,
+	0x4e, 0x5a, 0xf4, 0xa4, 0xf9, 0x66, 0x66, 0x67, 0xe7, 0xe7, 0xdb, 0xa1, 0xe0, 0xe5, 0x95, 0x30,
+	0xd7, 0x9b, 0xf7, 0x27, 0xa5, 0x5a, 0xbf, 0xd6, 0xc7, 0x6b, 0xe4, 0x42, 0xb2, 0xd7, 0xe5, 0x4a,
+	0xac, 0x99, 0x11, 0x65, 0x2b, 0x9c, 0x54, 0x5a, 0x19, 0x45, 0xd2, 0x80, 0x8b, 0x5f, 0x22, 0xd8,
+	0xa7, 0x78, 0x25, 0x6a, 0x83, 0x9a, 0xe2, 0x4f, 0x1b, 0xac, 0x0d, 0x79, 0x06, 0x19, 0xe3, 0x5c,
+	0x63, 0x5d, 0x63, 0x9d, 0x47, 0xd3, 0xe1, 0x2c, 0xa3, 0x9d, 0x82, 0xbc, 0x80, 0xa4, 0xae, 0x56,
+	0xc2, 0xd4, 0xf9, 0x60, 0x3a, 0x9c, 0xed, 0x9c, 0xee, 0x9f, 0xb4, 0xc1, 0x2f, 0x1b, 0x3d, 0xf5,
+	0x66, 0x32, 0x83, 0xe4, 0x46, 0x48, 0xae, 0x6e, 0xf2, 0xe1, 0x34, 0x9a, 0xed, 0x9c, 0x1e, 0x74,
+	0x8e, 0x3f, 0x5a, 0x3d, 0xf5, 0xf6, 0xe2, 0x15, 0x1c, 0x74, 0x39, 0xd4, 0x95, 0x92, 0x35, 0x92,
+	0x1c, 0xc6, 0xfe, 0xce, 0x3c, 0x9a, 0x46, 0xb3, 0x8c, 0x06, 0x58, 0x7c, 0x05, 0xbb, 0x97, 0x86,
+	0x99, 0x4d, 0x1d, 0xf2, 0xfd, 0xb8, 0xeb, 0x5f, 0x03, 0xd8, 0x0b, 0xbe, 0xff, 0x16, 0x97, 0x7c,
+	0x09, 0x7b, 0x9b, 0x1a, 0xf5, 0xbc, 0xab, 0x7d, 0x60, 0x6b, 0xdf, 0x6d, 0xb4, 0x6f, 0xdb, 0xfa,
+	0x9f, 0x41, 0xa6, 0x71, 0xcd, 0x84, 0x14, 0xf2, 0xca, 0x56, 0x96, 0xd1, 0x4e, 0x41, 0x08, 0x8c,
+	0xd4, 0x0d, 0xf2, 0x7c, 0x64, 0x0d, 0x56, 0x26, 0x4f, 0x21, 0x5d, 0x20, 0xce, 0x2b, 0x26, 0x78,
+	0x1e, 0x4f, 0xa3, 0x59, 0x4a, 0xc7, 0x0b, 0xc4, 0x0b, 0x26, 0x38, 0x39, 0x86, 0x4c, 0xc8, 0xf9,
+	0x62, 0x25, 0xae, 0xae, 0x4d, 0x9e, 0x4c, 0x87, 0xfd, 0x36, 0x5d, 0xb0, 0x3b, 0xb5, 0x31, 0x34,
+	0x15, 0xf2, 0xdc, 0x7a, 0x90, 0x97, 0x30, 0xaa, 0x56, 0x4c, 0xe6, 0x63, 0xeb, 0xf9, 0x64, 0xcb,
+	0x73, 0xc5, 0xa4, 0x44, 0xee, 0x0f, 0x58, 0x27, 0x32, 0x81, 0x94, 0x23, 0xe3, 0x2b, 0x21, 0x31,
+	0x4f, 0xa7, 0xd1, 0x6c, 0x48, 0x5b, 0x4c, 0x9e, 0xc0, 0x98, 0x99, 0xb9, 0x16, 0xf5, 0x32, 0xcf,
+	0x6c, 0x46, 0x09, 0x33, 0x54, 0xd4, 0x4b, 0xf2, 0x18, 0xe2, 0xda, 0x30, 0x83, 0x39, 0xd8, 0x02,
+	0x1c, 0x28, 0x2a, 0x48, 0x5c, 0x68, 0xf2, 0x1c, 0xc0, 0xa8, 0x79, 0xbf, 0x83, 0x99, 0x51, 0xbe,
+	0x3d, 0xe4, 0x10, 0x12, 0xb6, 0x56, 0x1b, 0x69, 0xf2, 0x81, 0x35, 0x79, 0xd4, 0xb4, 0xe5, 0x5a,
+	0x55, 0xb5, 0xed, 0x57, 0x4c, 0xad, 0x4c, 0x8e, 0x20, 0x6b, 0x7e, 0xe7, 0x5c, 0x49, 0xb4, 0xfd,
+	0x8a, 0x69, 0xda, 0x28, 0xce, 0x94, 0xc4, 0xe2, 0xf7, 0x08, 0x76, 0x7b, 0x45, 0xfd, 0xdf, 0x9b,
+	0xf7, 0x60, 0xc0, 0x8c, 0xbd, 0x77, 0x48, 0x07, 0xcc, 0x66, 0x62, 0x07, 0x31, 0xb2, 0x65, 0x5b,
+	0xb9, 0xd7, 0xa9, 0xf8, 0x5e, 0xa7, 0x0e, 0x21, 0xd1, 0xb8, 0xd8, 0x48, 0x9e, 0x27, 0x2e, 0xae,
+	0x43, 0xc5, 0x0f, 0x10, 0x5b, 0xba, 0x7f, 0x82, 0x50, 0x87, 0x90, 0xdc, 0xa0, 0x9d, 0x6c, 0x93,
+	0xd2, 0x2e, 0xf5, 0x68, 0x2b, 0xd5, 0xe1, 0x76, 0xaa, 0xc5, 0x77, 0x90, 0xb8, 0x87, 0x41, 0xbe,
+	0x80, 0x9d, 0xb5, 0x90, 0xf3, 0x1a, 0x4b, 0x25, 0xb9, 0x8b, 0x3b, 0xa4, 0xb0, 0x16, 0xf2, 0xd2,
+	0x69, 0xac, 0x03, 0xbb, 0x6d, 0x1d, 0x06, 0xde, 0x81, 0xdd, 0x7a, 0x87, 0xe2, 0x67, 0x38, 0x38,
+	0x47, 0xa4, 0x58, 0x29, 0x6d, 0xc2, 0x3b, 0x79, 0x0c, 0xb1, 0x51, 0x4b, 0x94, 0x3e, 0x4f, 0x07,
+	0x9a, 0x86, 0x2c, 0xb4, 0x5a, 0xfb, 0x18, 0x56, 0x6e, 0x9a, 0x66, 0x54, 0x68, 0x9a, 0x51, 0x4d,
+	0xc6, 0x15, 0x6a, 0xa1, 0x02, 0xaf, 0x3d, 0x6a, 0x6a, 0x47, 0x69, 0xb4, 0xc0, 0x3a, 0x10, 0xdb,
+	0xc3, 0xa2, 0x82, 0x47, 0x5b, 0xf7, 0xfb, 0xb7, 0x77, 0x0c, 0x63, 0x77, 0xd0, 0xad, 0x95, 0x9d,
+	0xd3, 0xcf, 0x3a, 0x06, 0x9f, 0x23, 0x5e, 0x58, 0x1b, 0x0d, 0x3e, 0xe4, 0x55, 0x17, 0xdd, 0xad,
+	0x1a, 0xd2, 0x73, 0xff, 0x56, 0x1a, 0x7d, 0xd7, 0xdd, 0xf8, 0x5b, 0x04, 0x59, 0x1b, 0xc4, 0xf3,
+	0x58, 0x1b, 0xdf, 0x3b, 0x07, 0xc8, 0x01, 0x0c, 0x51, 0x72, 0x5f, 0x6a, 0x23, 0xda, 0xea, 0x11,
+	0x5b, 0x62, 0x2e, 0xd0, 0xbd, 0xf0, 0x52, 0xad, 0x56, 0x58, 0x9a, 0xf6, 0x21, 0x77, 0x8a, 0xa6,
+	0xe6, 0xf2, 0x9a, 0xe9, 0x2b, 0x74, 0x8f, 0x39, 0xa3, 0x01, 0x36, 0x16, 0x8d, 0x7c, 0x53, 0xa2,
+	0xe3, 0x4a, 0x4c, 0x03, 0x2c, 0xfe, 0x8e, 0x20, 0x0d, 0x19, 0x37, 0xb3, 0x33, 0x9a, 0xc9, 0x7a,
+	0x81, 0x7a, 0x2e, 0xb8, 0x1f, 0x06, 0x04, 0xd5, 0x3b, 0x4e, 0x5e, 0xc0, 0x3e, 0xc7, 0x4a, 0xd5,
+	0xc2, 0xb4, 0x74, 0x77, 0x9c, 0xde, 0xf3, 0xea, 0xc0, 0xf9, 0xe7, 0x00, 0xc1, 0x51, 0xf0, 0xb0,
+	0x8b, 0xbc, 0xe6, 0x1d, 0xdf, 0xe2, 0xd9, 0xa8, 0xf7, 0x24, 0x3e, 0x5e, 0x01, 0x81, 0x91, 0x11,
+	0x6b, 0xb4, 0xe9, 0x0f, 0xa9, 0x95, 0xb7, 0xab, 0x1a, 0xbb, 0x19, 0x87, 0xaa, 0xbe, 0x69, 0xd6,
+	0x76, 0xa9, 0x64, 0x29, 0x56, 0xf8, 0x69, 0x8e, 0x1d, 0xc0, 0x50, 0x6f, 0xa4, 0xad, 0x22, 0xa5,
+	0x8d, 0x58, 0xfc, 0x19, 0xc1, 0xa3, 0xad, 0xc3, 0x9e, 0x20, 0xff, 0x75, 0x6a, 0xb6, 0x02, 0x2c,
+	0x97, 0xc8, 0xfd, 0xe0, 0x02, 0x6c, 0x2c, 0xf5, 0x52, 0x54, 0x95, 0x9f, 0x5c, 0x4c, 0x03, 0x24,
+	0x6f, 0x60, 0x97, 0x8b, 0xba, 0xd4, 0x58, 0x31, 0x59, 0x3a, 0xc6, 0x36, 0x9c, 0xfa, 0xbc, 0xe3,
+	0xd4, 0x59, 0x6b, 0xbe, 0xa3, 0x7d, 0xdf, 0x26, 0x31, 0xd4, 0x5a, 0x69, 0xbf, 0x04, 0x1c, 0x28,
+	0xfe, 0x88, 0x60, 0x67, 0xeb, 0x50, 0xd3, 0xbe, 0xa5, 0x90, 0x61, 0xa4, 0x56, 0xde, 0x5e, 0x0f,
+	0x83, 0xfe, 0x7a, 0x98, 0x40, 0x8a, 0xb7, 0x95, 0x63, 0x99, 0x9b, 0x5d, 0x8b, 0xed, 0xe8, 0x4a,
+	0xb3, 0x61, 0xab, 0x76, 0x74, 0x16, 0xdd, 0xe7, 0x4e, 0xfc, 0x01, 0x77, 0xfa, 0x5b, 0x32, 0xb9,
+	0xb7, 0x25, 0x4f, 0x7f, 0x1d, 0x40, 0xfc, 0xbd, 0xb8, 0x45, 0x4d, 0xde, 0x42, 0x1a, 0xbe, 0xb9,
+	0xe4, 0x69, 0xd7, 0x83, 0x7b, 0xff, 0x05, 0x26, 0x93, 0x87, 0x4c, 0x7e, 0x5a, 0x6f, 0x20, 0x71,
+	0x1f, 0x57, 0xb2, 0xf5, 0x25, 0xea, 0x7d, 0x9a, 0x27, 0xf9, 0x87, 0x06, 0x7f, 0xf8, 0x0c, 0xb2,
+	0x76, 0x41, 0x90, 0x49, 0xef, 0x61, 0xf7, 0xb6, 0xd6, 0xe4, 0xe8, 0x41, 0x5b, 0x17, 0xa5, 0x65,
+	0x11, 0xe9, 0xe5, 0xda, 0xe7, 0xe5, 0xe4, 0xe8, 0x41, 0x9b, 0x8b, 0xf2, 0x3e, 0xb1, 0xff, 0x8a,
+	0xbe, 0xfe, 0x67, 0x00, 0x4a, 0x06, 0x39, 0xd3, 0x44, 0x09, 0x00, 0x00,
 }
@@ -2,10 +2,13 @@ package main
 
 import (
 	"context"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"net"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"google.golang.org/grpc"
@@ -20,9 +23,34 @@ var config struct {
 	register struct {
 		mxrTCPAddr *net.TCPAddr
 		addrs      []string
+		windowMin  time.Duration
+		windowMax  time.Duration
 	}
 
-	jcClient jobcoin.Client
+	status struct {
+		mxrTCPAddr  *net.TCPAddr
+		depositAddr string
+	}
+
+	fees struct {
+		mxrTCPAddr *net.TCPAddr
+		adminToken string
+		from, to   string
+		period     string
+		entries    bool
+		format     string
+	}
+
+	reconcile struct {
+		mxrTCPAddr *net.TCPAddr
+		adminToken string
+		run        bool
+	}
+
+	jcClient  jobcoin.Client
+	jcAddr    string
+	timeout   time.Duration
+	precision int
 
 	send struct {
 		fromAddr string
@@ -44,11 +72,53 @@ var (
 )
 
 func init() {
+	app.Flag("timeout", "how long to wait for the mixer or the jobcoin API").
+		Default("10s").DurationVar(&config.timeout)
+	app.Flag("jobcoin-addr", "address of the jobcoin API").
+		Default(jobcoin.DefaultAPIAddress).StringVar(&config.jcAddr)
+	app.Flag("precision", "number of decimal places of the jobcoin ledger").
+		Default(fmt.Sprint(climatic.DefaultPrecision)).IntVar(&config.precision)
+
 	register := app.Command("register", "register your addresses with a mixer").Action(registerAddrs)
 	register.Arg("mixer-tcp-addr", "TCP address for mixer service").Required().
 		TCPVar(&config.register.mxrTCPAddr)
-	register.Arg("addrs", "deposit addresses for you to receive your Jobcoins").Required().
-		StringsVar(&config.register.addrs)
+	register.Arg(
+		"addrs",
+		"addresses for you to receive your Jobcoins, as addr, addr:weight or addr=amount",
+	).Required().StringsVar(&config.register.addrs)
+	register.Flag("window-min", "how long after a deposit is found its payouts may start").
+		DurationVar(&config.register.windowMin)
+	register.Flag("window-max", "how long after a deposit is found it must be paid out by (0 for no deadline)").
+		DurationVar(&config.register.windowMax)
+
+	status := app.Command("status", "show how far along the mix of a deposit address is").
+		Action(getStatus)
+	status.Arg("mixer-tcp-addr", "TCP address for mixer service").Required().
+		TCPVar(&config.status.mxrTCPAddr)
+	status.Arg("deposit-addr", "deposit address given by register").Required().
+		StringVar(&config.status.depositAddr)
+
+	fees := app.Command("fees", "report the fees a mixer collected").Action(getFees)
+	fees.Arg("mixer-tcp-addr", "TCP address for mixer service").Required().
+		TCPVar(&config.fees.mxrTCPAddr)
+	fees.Flag("admin-token", "admin token of the mixer").Required().StringVar(&config.fees.adminToken)
+	fees.Flag("from", "start of the report, as a date such as 2018-01-02 or a duration ago such as 720h").
+		StringVar(&config.fees.from)
+	fees.Flag("to", "end of the report, as a date or a duration ago (default now)").
+		StringVar(&config.fees.to)
+	fees.Flag("period", "period to sum up the fees by (day, week or month)").
+		EnumVar(&config.fees.period, "day", "week", "month")
+	fees.Flag("entries", "list every fee instead of the sums").BoolVar(&config.fees.entries)
+	fees.Flag("format", "output format (json or csv)").Default("json").
+		EnumVar(&config.fees.format, "json", "csv")
+
+	reconcile := app.Command("reconcile", "report where the ledger disagrees with a mixer's accounting").
+		Action(reconcile)
+	reconcile.Arg("mixer-tcp-addr", "TCP address for mixer service").Required().
+		TCPVar(&config.reconcile.mxrTCPAddr)
+	reconcile.Flag("admin-token", "admin token of the mixer").Required().
+		StringVar(&config.reconcile.adminToken)
+	reconcile.Flag("run", "reconcile now instead of reporting the last run").BoolVar(&config.reconcile.run)
 
 	send := app.Command("send", "send Jobcoins from an address to an address").
 		PreAction(getJobcoinClient).Action(sendJobcoins)
@@ -72,23 +142,36 @@ func main() {
 }
 
 func registerAddrs(*kingpin.ParseContext) error {
-	mxrTCPAddr := config.register.mxrTCPAddr.String()
-	fmt.Printf("dialing %v\n", mxrTCPAddr)
-	conn, err := grpc.Dial(
-		mxrTCPAddr,
-		grpc.WithInsecure(),
-		grpc.WithBlock(),
-		grpc.WithTimeout(5*time.Second),
-		grpc.FailOnNonTempDialError(true),
-	)
-	app.FatalIfError(err, "dialing %s failed", mxrTCPAddr)
+	ctx, cancel := context.WithTimeout(context.Background(), config.timeout)
+	defer cancel()
+	conn := dialMixer(ctx, config.register.mxrTCPAddr)
 	defer conn.Close()
 	client := climatic.NewMixerClient(conn)
 
+	req := &climatic.RegisterRequest{}
+	for _, arg := range config.register.addrs {
+		// the mixer checks the amounts against the precision of its ledger
+		if i := strings.LastIndex(arg, "="); i >= 0 {
+			req.Splits = append(req.Splits, &climatic.Split{Address: arg[:i], Amount: arg[i+1:]})
+			continue
+		}
+		if i := strings.LastIndex(arg, ":"); i >= 0 {
+			weight, err := strconv.ParseUint(arg[i+1:], 10, 32)
+			app.FatalIfError(err, "invalid weight for %s", arg[:i])
+			req.Splits = append(req.Splits, &climatic.Split{Address: arg[:i], Weight: uint32(weight)})
+			continue
+		}
+		req.Addresses = append(req.Addresses, arg)
+	}
+	if config.register.windowMax > 0 {
+		req.Window = &climatic.Window{
+			MinSeconds: int64(config.register.windowMin / time.Second),
+			MaxSeconds: int64(config.register.windowMax / time.Second),
+		}
+	}
+
 	fmt.Printf("registering %v\n", config.register.addrs)
-	resp, err := client.Register(
-		context.Background(), &climatic.RegisterRequest{Addresses: config.register.addrs},
-	)
+	resp, err := client.Register(ctx, req)
 	app.FatalIfError(err, "registration failed")
 
 	fmt.Println(resp)
@@ -96,14 +179,133 @@ func registerAddrs(*kingpin.ParseContext) error {
 	return nil
 }
 
+func getStatus(*kingpin.ParseContext) error {
+	ctx, cancel := context.WithTimeout(context.Background(), config.timeout)
+	defer cancel()
+	conn := dialMixer(ctx, config.status.mxrTCPAddr)
+	defer conn.Close()
+	client := climatic.NewMixerClient(conn)
+
+	resp, err := client.Status(ctx, &climatic.StatusRequest{Address: config.status.depositAddr})
+	app.FatalIfError(err, "getting status failed")
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "\t")
+	app.FatalIfError(encoder.Encode(resp), "could not serialize response")
+
+	return nil
+}
+
+func getFees(*kingpin.ParseContext) error {
+	req := &climatic.FeeReportRequest{
+		Token:   config.fees.adminToken,
+		Period:  config.fees.period,
+		Entries: config.fees.entries,
+	}
+	if config.fees.from != "" {
+		req.From = parseTime(config.fees.from, "from").Unix()
+	}
+	if config.fees.to != "" {
+		req.To = parseTime(config.fees.to, "to").Unix()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.timeout)
+	defer cancel()
+	conn := dialMixer(ctx, config.fees.mxrTCPAddr)
+	defer conn.Close()
+	client := climatic.NewMixerClient(conn)
+
+	resp, err := client.FeeReport(ctx, req)
+	app.FatalIfError(err, "getting fee report failed")
+	if config.fees.format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "\t")
+		app.FatalIfError(encoder.Encode(resp), "could not serialize response")
+		return nil
+	}
+
+	date := func(sec int64) string { return time.Unix(sec, 0).UTC().Format(time.RFC3339) }
+	w := csv.NewWriter(os.Stdout)
+	if config.fees.entries {
+		w.Write([]string{"time", "transfer_id", "deposit_address", "deposit_id", "amount", "charged", "reduced"})
+		for _, e := range resp.Entries {
+			w.Write([]string{
+				date(e.Time), e.TransferId, e.DepositAddress, e.DepositId,
+				e.Amount, e.Charged, strconv.FormatBool(e.Reduced),
+			})
+		}
+	} else {
+		w.Write([]string{"start", "end", "fees", "collected", "charged", "reduced"})
+		for _, p := range resp.Periods {
+			w.Write([]string{
+				date(p.Start), date(p.End), fmt.Sprint(p.Fees),
+				p.Collected, p.Charged, fmt.Sprint(p.Reduced),
+			})
+		}
+	}
+	w.Flush()
+	app.FatalIfError(w.Error(), "could not write report")
+
+	return nil
+}
+
+func reconcile(*kingpin.ParseContext) error {
+	ctx, cancel := context.WithTimeout(context.Background(), config.timeout)
+	defer cancel()
+	conn := dialMixer(ctx, config.reconcile.mxrTCPAddr)
+	defer conn.Close()
+	client := climatic.NewMixerClient(conn)
+
+	resp, err := client.Reconcile(ctx, &climatic.ReconcileRequest{
+		Token: config.reconcile.adminToken,
+		Run:   config.reconcile.run,
+	})
+	app.FatalIfError(err, "reconciliation failed")
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "\t")
+	app.FatalIfError(encoder.Encode(resp), "could not serialize response")
+
+	return nil
+}
+
+// parseTime parses a date, a time in RFC 3339 or a duration before now.
+func parseTime(s, name string) time.Time {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d)
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	app.FatalIfError(err, "invalid %s time", name)
+
+	return t
+}
+
+// dialMixer connects to the mixer at addr. It reports on stderr so the output
+// of a command can be piped.
+func dialMixer(ctx context.Context, addr *net.TCPAddr) *grpc.ClientConn {
+	fmt.Fprintf(os.Stderr, "dialing %v\n", addr)
+	conn, err := grpc.DialContext(
+		ctx,
+		addr.String(),
+		grpc.WithInsecure(),
+		grpc.WithBlock(),
+		grpc.FailOnNonTempDialError(true),
+	)
+	app.FatalIfError(err, "dialing %s failed", addr)
+
+	return conn
+}
+
 func sendJobcoins(*kingpin.ParseContext) error {
 	fromAddr := config.send.fromAddr
 	toAddr := config.send.toAddr
-	amt := config.send.amt
-	_, err := climatic.ParseFloat(config.send.amt)
+	amt, err := climatic.ParseAmount(config.send.amt)
 	app.FatalIfError(err, "could not parse amount")
 	fmt.Printf("sending %s Jobcoins from %v to %v\n", amt, fromAddr, toAddr)
-	err = config.jcClient.PostTransaction(fromAddr, toAddr, amt)
+	ctx, cancel := context.WithTimeout(context.Background(), config.timeout)
+	defer cancel()
+	err = config.jcClient.PostTransaction(ctx, fromAddr, toAddr, amt)
 	app.FatalIfError(err, "could not send jobcoins")
 
 	return nil
@@ -112,7 +314,9 @@ func sendJobcoins(*kingpin.ParseContext) error {
 func getAddrInfo(*kingpin.ParseContext) error {
 	addr := config.addrInfo.addr
 	fmt.Printf("getting information about address %v\n", addr)
-	addrInfo, err := config.jcClient.GetAddressInfo(addr)
+	ctx, cancel := context.WithTimeout(context.Background(), config.timeout)
+	defer cancel()
+	addrInfo, err := config.jcClient.GetAddressInfo(ctx, addr)
 	app.FatalIfError(err, "failed to get address info")
 	encoder := json.NewEncoder(os.Stdout)
 	encoder.SetIndent("", "\t")
@@ -124,13 +328,16 @@ func getAddrInfo(*kingpin.ParseContext) error {
 func createJobcoins(*kingpin.ParseContext) error {
 	addr := config.create.addr
 	fmt.Printf("creating Jobcoins for address %v\n", addr)
-	app.FatalIfError(config.jcClient.Create(addr), "failed to create Jobcoins")
+	ctx, cancel := context.WithTimeout(context.Background(), config.timeout)
+	defer cancel()
+	app.FatalIfError(config.jcClient.Create(ctx, addr), "failed to create Jobcoins")
 
 	return nil
 }
 
 func getJobcoinClient(*kingpin.ParseContext) error {
-	config.jcClient = jobcoin.NewClimaticClient()
+	app.FatalIfError(climatic.SetPrecision(config.precision), "invalid precision")
+	config.jcClient = jobcoin.NewClimaticClient(jobcoin.WithAPIAddress(config.jcAddr))
 
 	return nil
 }
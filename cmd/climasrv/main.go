@@ -3,13 +3,23 @@
 package main
 
 import (
+	"context"
+	"expvar"
 	"fmt"
 	"log"
+	"math"
+	"math/rand"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/r-medina/climatic"
+	"github.com/r-medina/climatic/jobcoin"
 	"github.com/r-medina/climatic/server"
 
 	"google.golang.org/grpc"
@@ -18,24 +28,72 @@ import (
 
 var config struct {
 	tcpAddr   *net.TCPAddr
+	precision int
 	fee       string
 	feeAddr   string
+	poolAddrs []string
 	pollCfg   server.PollConfig
 	mixCfg    server.MixConfig
+	routeCfg  server.RouteConfig
+	expiryCfg server.ExpiryConfig
+	// reconcileCfg writes its reports to reconcileReport, if it is set
+	reconcileCfg    server.ReconcileConfig
+	reconcileReport string
+	// the late policy and the mix strategy are converted once they are
+	// parsed
+	expiryLate  string
+	mixStrategy string
+	// the fee policy is built once the precision is known
+	feeTiers     []string
+	feeMin       string
+	feeMax       string
+	feeDiscounts []string
+	// the mix amounts are parsed once the precision is known
+	mixAmts struct {
+		mean, stdDev, min, max string
+		denominations          []string
+	}
+	depositAmts struct {
+		min, max, refundFee string
+	}
+	jcAddr    string
+	timeout   time.Duration
+	retry     bool
+	retryCfg  jobcoin.RetryConfig
 	pprofAddr *net.TCPAddr
+	// metricsAddr serves the expvar metrics on their own
+	metricsAddr *net.TCPAddr
+	datastore   string
+	dsPath      string
+	drain       time.Duration
+	// adminToken opens the admin calls, such as the fee report
+	adminToken string
+	// seed, if it is set, replaces crypto/rand with a seeded source for payouts
+	seed int64
 }
 
 var (
 	app = kingpin.New("climasrv", "climatic server").
-		PreAction(startPprof).Action(runServer).DefaultEnvars()
+		PreAction(startPprof).PreAction(startMetrics).Action(runServer).DefaultEnvars()
 
 	l = log.New(os.Stderr, "", log.LstdFlags|log.Lmicroseconds)
 )
 
 func init() {
 	app.Flag("tcp-addr", "address for TCP listener").Default("").TCPVar(&config.tcpAddr)
-	app.Flag("fee", "fee to charge people using the service").StringVar(&config.fee)
+	app.Flag("precision", "number of decimal places of the jobcoin ledger").
+		Default(str(climatic.DefaultPrecision)).IntVar(&config.precision)
+	app.Flag("fee", "fee to charge for every deposit, either an amount or a percentage such as 1.5%").
+		StringVar(&config.fee)
+	app.Flag("fee-tier", "fee for deposits of at least an amount, as amount:fee (repeatable)").
+		StringsVar(&config.feeTiers)
+	app.Flag("fee-min", "the smallest fee charged for a deposit").StringVar(&config.feeMin)
+	app.Flag("fee-max", "the largest fee charged for a deposit").StringVar(&config.feeMax)
+	app.Flag("fee-discount", "discount off the fee once an address was deposited an amount, as amount:percentage (repeatable)").
+		StringsVar(&config.feeDiscounts)
 	app.Flag("fee-addr", "jobcoin address to collect fees").StringVar(&config.feeAddr)
+	app.Flag("pool-addr", "house address to pool deposits in and pay users from (repeatable)").
+		StringsVar(&config.poolAddrs)
 
 	app.Flag("poll-delay", "mean of delay between polls to jobcoin API").
 		Default(str(server.DefaultPollConfig.MeanDelay)).
@@ -49,6 +107,9 @@ func init() {
 	app.Flag("poll-max-delay", "the maximum delay between polling").
 		Default(str(server.DefaultPollConfig.MaxDelay)).
 		DurationVar(&config.pollCfg.MaxDelay)
+	app.Flag("poll-watch-threshold", "the most deposit addresses to poll one by one instead of polling all transactions").
+		Default(str(server.DefaultPollConfig.WatchThreshold)).
+		IntVar(&config.pollCfg.WatchThreshold)
 
 	app.Flag("mix-delay", "mean of delay between times that jobcoins are mixed").
 		Default(str(server.DefaultMixConfig.MeanDelay)).
@@ -69,42 +130,200 @@ func init() {
 		DurationVar(&config.mixCfg.InitialDelay)
 	app.Flag("mix-amount", "mean of amount of jobcoins sent per transaction").
 		Default(str(server.DefaultMixConfig.MeanAmount)).
-		FloatVar(&config.mixCfg.MeanAmount)
+		StringVar(&config.mixAmts.mean)
 	app.Flag("mix-dev-amount", "the standard deviation of jobcoins sent per transaction").
 		Default(str(server.DefaultMixConfig.StdDevAmount)).
-		FloatVar(&config.mixCfg.StdDevAmount)
+		StringVar(&config.mixAmts.stdDev)
 	app.Flag("mix-min-amount", "the minimum amount of jobcoins sent").
 		Default(str(server.DefaultMixConfig.MinAmount)).
-		FloatVar(&config.mixCfg.MinAmount)
+		StringVar(&config.mixAmts.min)
 	app.Flag("mix-max-amount", "the maximum amount of jobcoins sent").
 		Default(str(server.DefaultMixConfig.MaxAmount)).
-		FloatVar(&config.mixCfg.MaxAmount)
+		StringVar(&config.mixAmts.max)
+	app.Flag("mix-denomination", "standard amount that payouts are made of, leaving only a remainder that isn't (repeatable)").
+		StringsVar(&config.mixAmts.denominations)
+	app.Flag("mix-workers", "how many deposits are paid out at the same time").
+		Default(str(server.DefaultMixConfig.Workers)).
+		IntVar(&config.mixCfg.Workers)
+	app.Flag(
+		"mix-deadline-margin",
+		"how long before the end of its window a deposit is planned to be paid out",
+	).Default(str(server.DefaultMixConfig.DeadlineMargin)).
+		DurationVar(&config.mixCfg.DeadlineMargin)
+	app.Flag(
+		"mix-strategy",
+		"how due deposits are ordered and payouts are sent (uniform, balance, round-robin or deadline)",
+	).Default(server.StrategyUniform).
+		EnumVar(
+			&config.mixStrategy,
+			server.StrategyUniform, server.StrategyBalance, server.StrategyRoundRobin, server.StrategyDeadline,
+		)
+
+	app.Flag("route-hops", "how many intermediate addresses each payout passes through (0 disables routing)").
+		Default(str(server.DefaultRouteConfig.Hops)).
+		IntVar(&config.routeCfg.Hops)
+	app.Flag("route-delay", "mean of delay that payouts wait in each intermediate address").
+		Default(str(server.DefaultRouteConfig.MeanDelay)).
+		DurationVar(&config.routeCfg.MeanDelay)
+	app.Flag("route-dev", "the standard deviation of delay in each intermediate address").
+		Default(str(server.DefaultRouteConfig.StdDevDelay)).
+		DurationVar(&config.routeCfg.StdDevDelay)
+	app.Flag("route-min-delay", "the minimum delay in each intermediate address").
+		Default(str(server.DefaultRouteConfig.MinDelay)).
+		DurationVar(&config.routeCfg.MinDelay)
+	app.Flag("route-max-delay", "the maximum delay in each intermediate address").
+		Default(str(server.DefaultRouteConfig.MaxDelay)).
+		DurationVar(&config.routeCfg.MaxDelay)
+
+	app.Flag("expiry", "how long a deposit address can go without a deposit before it expires (0 disables expiry)").
+		Default(str(server.DefaultExpiryConfig.After)).
+		DurationVar(&config.expiryCfg.After)
+	app.Flag("expiry-late", "what to do with deposits to expired addresses (honour or refund)").
+		Default(string(server.DefaultExpiryConfig.Late)).
+		EnumVar(&config.expiryLate, string(server.LateHonour), string(server.LateRefund))
+	app.Flag("expiry-forget", "how long expired addresses are kept before they are forgotten (0 keeps them)").
+		Default(str(server.DefaultExpiryConfig.Forget)).
+		DurationVar(&config.expiryCfg.Forget)
+
+	app.Flag("reconcile-interval", "how often to check balances against the jobcoin ledger (0 disables the checks)").
+		Default(str(server.DefaultReconcileConfig.Interval)).
+		DurationVar(&config.reconcileCfg.Interval)
+	app.Flag("reconcile-report", "file to append every reconciliation report to, as a line of JSON").
+		StringVar(&config.reconcileReport)
+
+	app.Flag("deposit-min", "the smallest deposit that is mixed, smaller ones are refunded").
+		Default(str(server.DefaultDepositConfig.MinAmount)).
+		StringVar(&config.depositAmts.min)
+	app.Flag("deposit-max", "the largest deposit that is mixed, larger ones are refunded (0 disables the limit)").
+		Default(str(server.DefaultDepositConfig.MaxAmount)).
+		StringVar(&config.depositAmts.max)
+	app.Flag("refund-fee", "fee taken from deposits that are refunded for their size").
+		Default(str(server.DefaultDepositConfig.RefundFee)).
+		StringVar(&config.depositAmts.refundFee)
+
+	app.Flag("jobcoin-addr", "address of the jobcoin API").
+		Default(jobcoin.DefaultAPIAddress).StringVar(&config.jcAddr)
+	app.Flag("jobcoin-timeout", "how long a single call to the jobcoin API may take").
+		Default(str(server.DefaultTimeout)).
+		DurationVar(&config.timeout)
+
+	app.Flag("retry", "retry calls to the jobcoin API that fail transiently").BoolVar(&config.retry)
+	for _, method := range []struct {
+		name, desc string
+		policy     *jobcoin.RetryPolicy
+	}{
+		{"address-info", "getting the balance and history of an address", &config.retryCfg.GetAddressInfo},
+		{"transactions", "getting the transaction history", &config.retryCfg.GetTransactions},
+		{"post", "sending jobcoins", &config.retryCfg.PostTransaction},
+		{"create", "creating jobcoins", &config.retryCfg.Create},
+	} {
+		app.Flag("retry-"+method.name+"-attempts", "the maximum number of attempts at "+method.desc).
+			Default(str(jobcoin.DefaultRetryPolicy.MaxAttempts)).
+			IntVar(&method.policy.MaxAttempts)
+		app.Flag("retry-"+method.name+"-backoff", "the delay before retrying "+method.desc).
+			Default(str(jobcoin.DefaultRetryPolicy.InitialBackoff)).
+			DurationVar(&method.policy.InitialBackoff)
+		app.Flag(
+			"retry-"+method.name+"-max-backoff",
+			"the maximum delay between attempts at "+method.desc+" (0 leaves it uncapped)",
+		).Default(str(jobcoin.DefaultRetryPolicy.MaxBackoff)).
+			DurationVar(&method.policy.MaxBackoff)
+		app.Flag("retry-"+method.name+"-multiplier", "how much the delay between attempts at "+method.desc+" grows").
+			Default(str(jobcoin.DefaultRetryPolicy.Multiplier)).
+			FloatVar(&method.policy.Multiplier)
+		app.Flag(
+			"retry-"+method.name+"-jitter",
+			"the fraction of the delay between attempts at "+method.desc+" that is random",
+		).Default(str(jobcoin.DefaultRetryPolicy.Jitter)).
+			FloatVar(&method.policy.Jitter)
+	}
+
+	app.Flag("datastore", "where to keep registered addresses (memory or bolt)").
+		Default("memory").EnumVar(&config.datastore, "memory", "bolt")
+	app.Flag("datastore-path", "path of the bolt datastore file").
+		Default("climatic.db").StringVar(&config.dsPath)
+
+	app.Flag("drain-timeout", "how long to wait for transfers under way when shutting down").
+		Default("30s").DurationVar(&config.drain)
+
+	app.Flag("admin-token", "token that opens the admin calls, such as the fee report and reconciliation (closed without one)").
+		StringVar(&config.adminToken)
+
+	app.Flag("seed", "seed for the randomness of payouts, which makes them predictable, for debugging only (0 uses crypto/rand)").
+		Int64Var(&config.seed)
 
 	app.Flag("pprof-addr", "address for running pprof tools").TCPVar(&config.pprofAddr)
+	app.Flag("metrics-addr", "address for serving the metrics at /debug/vars, without the pprof tools").
+		TCPVar(&config.metricsAddr)
 
 }
 
 func main() {
+	// the mixer has randomness of its own, but the retry jitter draws from
+	// the global source
+	rand.Seed(time.Now().UTC().UnixNano())
 	if _, err := app.Parse(os.Args[1:]); err != nil {
 		app.FatalUsage("command line parsing failed: %v", err)
 	}
 }
 
 func runServer(_ *kingpin.ParseContext) error {
+	fatalIfError(climatic.SetPrecision(config.precision), "invalid precision")
+	config.mixCfg.MeanAmount = parseAmount(config.mixAmts.mean, "mix amount")
+	config.mixCfg.StdDevAmount = parseAmount(config.mixAmts.stdDev, "mix amount deviation")
+	config.mixCfg.MinAmount = parseAmount(config.mixAmts.min, "mix minimum amount")
+	config.mixCfg.MaxAmount = parseAmount(config.mixAmts.max, "mix maximum amount")
+	for _, d := range config.mixAmts.denominations {
+		config.mixCfg.Denominations = append(config.mixCfg.Denominations, parseAmount(d, "mix denomination"))
+	}
+	depositCfg := server.DepositConfig{
+		MinAmount: parseAmount(config.depositAmts.min, "deposit minimum"),
+		MaxAmount: parseAmount(config.depositAmts.max, "deposit maximum"),
+		RefundFee: parseAmount(config.depositAmts.refundFee, "refund fee"),
+	}
+	config.expiryCfg.Late = server.LatePolicy(config.expiryLate)
+	if config.reconcileReport != "" {
+		f, err := os.OpenFile(config.reconcileReport, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		fatalIfError(err, "opening reconciliation report failed")
+		defer f.Close()
+		config.reconcileCfg.Report = f
+	}
+
 	opts := []server.Option{
 		server.WithLogger(l),
 		server.WithPollConfig(config.pollCfg),
 		server.WithMixConfig(config.mixCfg),
+		server.WithMixStrategy(server.NewMixStrategy(config.mixStrategy)),
+		server.WithRouteConfig(config.routeCfg),
+		server.WithExpiryConfig(config.expiryCfg),
+		server.WithDepositConfig(depositCfg),
+		server.WithReconcileConfig(config.reconcileCfg),
+		server.WithTimeout(config.timeout),
+		server.WithAdminToken(config.adminToken),
 	}
-	if config.fee != "" {
-		fee, err := climatic.ParseFloat(config.fee)
-		fatalIfError(err, "failed to parse fee")
-		opts = append(opts, server.WithFee(fee))
-
-	}
+	opts = append(opts, server.WithFeePolicy(feePolicy()))
 	if config.feeAddr != "" {
 		opts = append(opts, server.WithAddress(config.feeAddr))
 	}
+	if len(config.poolAddrs) > 0 {
+		opts = append(opts, server.WithPool(config.poolAddrs...))
+	}
+	if config.seed != 0 {
+		l.Printf("seeding randomness with %d, payouts are predictable", config.seed)
+		opts = append(opts, server.WithRand(rand.NewSource(config.seed)))
+	}
+	var jcClient jobcoin.Client = jobcoin.NewClimaticClient(jobcoin.WithAPIAddress(config.jcAddr))
+	if config.retry {
+		jcClient = jobcoin.NewRetryClient(jcClient, config.retryCfg)
+	}
+	opts = append(opts, server.WithJobcoinClient(jcClient))
+	if config.datastore == "bolt" {
+		ds, err := server.OpenBoltDS(config.dsPath)
+		fatalIfError(err, "opening datastore failed")
+		defer ds.Close()
+		l.Printf("using datastore %s", config.dsPath)
+		opts = append(opts, server.WithDatastore(ds))
+	}
 
 	mxr, err := server.NewMixer(opts...)
 	fatalIfError(err, "instantiating mixer failed")
@@ -118,13 +337,50 @@ func runServer(_ *kingpin.ParseContext) error {
 
 	climatic.RegisterMixerServer(grpcSrv, mxr)
 
-	go mxr.Start()
+	mxrErr := make(chan error, 1)
+	go func() { mxrErr <- mxr.Start(context.Background()) }()
+	srvErr := make(chan error, 1)
+	go func() { srvErr <- grpcSrv.Serve(lis) }()
 	l.Printf("listening on %s", lis.Addr())
-	_ = grpcSrv.Serve(lis)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	select {
+	case sig := <-sigs:
+		l.Printf("received %v, shutting down", sig)
+	case err := <-srvErr:
+		l.Printf("server failed, shutting down: %v", err)
+	case err := <-mxrErr:
+		l.Printf("mixer failed, shutting down: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.drain)
+	defer cancel()
+	shutdown(ctx, grpcSrv)
+	if err := mxr.Stop(ctx); err != nil {
+		l.Printf("transfers under way were cut off: %v", err)
+	}
+	l.Printf("shut down")
 
 	return nil
 }
 
+// shutdown stops the gRPC server, letting the calls under way finish until ctx
+// is done.
+func shutdown(ctx context.Context, grpcSrv *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		grpcSrv.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		grpcSrv.Stop()
+	}
+}
+
 func startPprof(_ *kingpin.ParseContext) error {
 	if config.pprofAddr == nil {
 		return nil
@@ -139,6 +395,22 @@ func startPprof(_ *kingpin.ParseContext) error {
 	return nil
 }
 
+func startMetrics(_ *kingpin.ParseContext) error {
+	if config.metricsAddr == nil {
+		return nil
+	}
+
+	l.Printf("running metrics server on %s", config.metricsAddr)
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	go func() {
+		err := http.ListenAndServe(config.metricsAddr.String(), mux)
+		fatalIfError(err, "metrics server failed")
+	}()
+
+	return nil
+}
+
 func fatalIfError(err error, format string, args ...interface{}) {
 	if err != nil {
 		if format != "" {
@@ -148,6 +420,91 @@ func fatalIfError(err error, format string, args ...interface{}) {
 	}
 }
 
+// feePolicy builds the fee policy from the flags. The tiers are on top of the
+// fee, which is the tier from zero, and the caps and discounts apply to all of
+// them.
+func feePolicy() server.FeePolicy {
+	var policy server.FeePolicy = server.FlatFee{}
+	if config.fee != "" {
+		policy = parseFee(config.fee, "fee")
+	}
+
+	if len(config.feeTiers) > 0 {
+		tiers := server.TieredFee{{Policy: policy}}
+		for _, tier := range config.feeTiers {
+			from, fee := splitPair(tier, "fee tier")
+			tiers = append(tiers, server.FeeTier{
+				From:   parseAmount(from, "fee tier"),
+				Policy: parseFee(fee, "fee tier"),
+			})
+		}
+		policy = tiers
+	}
+
+	if config.feeMin != "" || config.feeMax != "" {
+		capped := server.CappedFee{Policy: policy}
+		if config.feeMin != "" {
+			capped.Min = parseAmount(config.feeMin, "fee minimum")
+		}
+		if config.feeMax != "" {
+			capped.Max = parseAmount(config.feeMax, "fee maximum")
+		}
+		policy = capped
+	}
+
+	if len(config.feeDiscounts) > 0 {
+		discounted := server.DiscountedFee{Policy: policy}
+		for _, discount := range config.feeDiscounts {
+			from, pct := splitPair(discount, "fee discount")
+			discounted.Discounts = append(discounted.Discounts, server.VolumeDiscount{
+				From:        parseAmount(from, "fee discount"),
+				BasisPoints: parseBasisPoints(strings.TrimSuffix(pct, "%"), "fee discount"),
+			})
+		}
+		policy = discounted
+	}
+
+	return policy
+}
+
+// parseFee parses a fee given on the command line, which is either an amount
+// or a percentage of the deposit.
+func parseFee(s, what string) server.FeePolicy {
+	if pct := strings.TrimSuffix(s, "%"); pct != s {
+		return server.PercentFee{BasisPoints: parseBasisPoints(pct, what)}
+	}
+	return server.FlatFee{Amount: parseAmount(s, what)}
+}
+
+// parseBasisPoints parses a percentage with at most two decimal places into
+// hundredths of a percent.
+func parseBasisPoints(s, what string) int64 {
+	pct, err := strconv.ParseFloat(s, 64)
+	fatalIfError(err, "failed to parse %s", what)
+	bp := math.Round(pct * 100)
+	if pct < 0 || math.Abs(pct*100-bp) > 1e-6 {
+		fatalIfError(fmt.Errorf("%s%% is not a percentage with at most two decimal places", s), "invalid %s", what)
+	}
+	return int64(bp)
+}
+
+// splitPair splits a flag value of the form a:b.
+func splitPair(s, what string) (string, string) {
+	i := strings.LastIndex(s, ":")
+	if i < 0 {
+		fatalIfError(fmt.Errorf("%q is not of the form a:b", s), "invalid %s", what)
+	}
+	return s[:i], s[i+1:]
+}
+
+// parseAmount parses an amount of jobcoins given on the command line. The
+// precision must already be set.
+func parseAmount(s, what string) climatic.Amount {
+	amt, err := climatic.ParseAmount(s)
+	fatalIfError(err, "failed to parse %s", what)
+	return amt
+}
+
 func str(val interface{}) string {
 	return fmt.Sprintf("%v", val)
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	"github.com/r-medina/climatic"
+	"github.com/r-medina/climatic/jobcoin/jctest"
+
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+var config struct {
+	tcpAddr        *net.TCPAddr
+	precision      int
+	dataFile       string
+	createAmt      string
+	latency        time.Duration
+	latencyDev     time.Duration
+	errorRate      float64
+	errorAfterRate float64
+}
+
+var (
+	app = kingpin.New("jobcoind", "local Jobcoin API server").
+		Action(runServer).DefaultEnvars()
+
+	l = log.New(os.Stderr, "", log.LstdFlags|log.Lmicroseconds)
+)
+
+func init() {
+	rand.Seed(time.Now().UTC().UnixNano())
+
+	app.Flag("tcp-addr", "address for TCP listener").Default("localhost:8000").TCPVar(&config.tcpAddr)
+	app.Flag("data-file", "file in which to keep the ledger (kept in memory if empty)").
+		StringVar(&config.dataFile)
+	app.Flag("precision", "number of decimal places of amounts").
+		Default(fmt.Sprint(climatic.DefaultPrecision)).IntVar(&config.precision)
+	app.Flag("create-amount", "amount of jobcoins made by each call to create").
+		Default(jctest.DefaultCreateAmount.String()).StringVar(&config.createAmt)
+
+	app.Flag("latency", "mean of the delay added to every request").
+		Default("0s").DurationVar(&config.latency)
+	app.Flag("latency-dev", "the standard deviation of the delay added to every request").
+		Default("0s").DurationVar(&config.latencyDev)
+	app.Flag("error-rate", "fraction of requests that fail without doing anything").
+		Default("0").FloatVar(&config.errorRate)
+	app.Flag("error-after-rate", "fraction of requests that change the ledger and then fail anyway").
+		Default("0").FloatVar(&config.errorAfterRate)
+}
+
+func main() {
+	if _, err := app.Parse(os.Args[1:]); err != nil {
+		app.FatalUsage("command line parsing failed: %v", err)
+	}
+}
+
+func runServer(_ *kingpin.ParseContext) error {
+	fatalIfError(climatic.SetPrecision(config.precision), "invalid precision")
+	createAmt, err := climatic.ParseAmount(config.createAmt)
+	if err != nil || createAmt.Sign() <= 0 {
+		l.Fatalf("invalid create amount %q", config.createAmt)
+	}
+	opts := []jctest.LedgerOption{jctest.WithCreateAmount(createAmt)}
+
+	ledger := jctest.NewLedger(opts...)
+	if config.dataFile != "" {
+		f, err := os.OpenFile(config.dataFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+		fatalIfError(err, "opening data file %s failed", config.dataFile)
+		defer f.Close()
+
+		ledger, err = jctest.LoadLedger(f, append(opts, jctest.WithJournal(syncWriter{f}))...)
+		fatalIfError(err, "loading ledger from %s failed", config.dataFile)
+		l.Printf("loaded ledger from %s", config.dataFile)
+	}
+
+	lis, err := net.Listen("tcp", config.tcpAddr.String())
+	fatalIfError(err, "starting TCP listener on %s failed", config.tcpAddr)
+
+	l.Printf("listening on %s", lis.Addr())
+	return http.Serve(lis, logRequests(injectFaults(ledger)))
+}
+
+// syncWriter flushes every write to disk so that an acknowledged transaction
+// survives a crash.
+type syncWriter struct{ f *os.File }
+
+func (w syncWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, w.f.Sync()
+}
+
+// injectFaults slows down and fails requests as configured.
+func injectFaults(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if d := latency(); d > 0 {
+			select {
+			case <-req.Context().Done():
+				return
+			case <-time.After(d):
+			}
+		}
+
+		if rand.Float64() < config.errorRate {
+			injectedError(rw)
+			return
+		}
+
+		if req.Method == "POST" && rand.Float64() < config.errorAfterRate {
+			// let the ledger act on the request, but don't tell the
+			// client it worked
+			h.ServeHTTP(httptest.NewRecorder(), req)
+			injectedError(rw)
+			return
+		}
+
+		h.ServeHTTP(rw, req)
+	})
+}
+
+func latency() time.Duration {
+	d := rand.NormFloat64()*float64(config.latencyDev) + float64(config.latency)
+	return time.Duration(math.Max(0, d))
+}
+
+func injectedError(rw http.ResponseWriter) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusInternalServerError)
+	_, _ = rw.Write([]byte(`{"error":"Injected Failure"}`))
+}
+
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		l.Printf("%s %s", req.Method, req.URL.Path)
+		h.ServeHTTP(rw, req)
+	})
+}
+
+func fatalIfError(err error, format string, args ...interface{}) {
+	if err != nil {
+		if format != "" {
+			format += ": "
+		}
+		l.Fatalf(format+"%v", append(args, err)...)
+	}
+}
@@ -0,0 +1,82 @@
+package jobcoin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Cursor marks how far into the transaction history a reader has got. Rather
+// than an index into the history, it holds the timestamp of the newest
+// transaction seen and the fingerprints of the transactions with exactly that
+// timestamp. That way it keeps working if the API returns the history in a
+// different order or drops old transactions from it.
+//
+// The zero Cursor is before every transaction.
+type Cursor struct {
+	// Time is the timestamp of the newest transaction seen.
+	Time time.Time `json:"time"`
+	// Seen holds the fingerprints of the transactions seen at Time.
+	Seen []string `json:"seen,omitempty"`
+}
+
+// Next returns the transactions in txs that come after c, oldest first, and a
+// cursor that comes after all of them.
+func (c Cursor) Next(txs []*Transaction) ([]*Transaction, Cursor) {
+	sorted := make([]*Transaction, len(txs))
+	copy(sorted, txs)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Timestamp.Before(sorted[j].Timestamp)
+	})
+
+	seen := make(map[string]bool, len(c.Seen))
+	for _, fp := range c.Seen {
+		seen[fp] = true
+	}
+
+	next := Cursor{Time: c.Time, Seen: append([]string(nil), c.Seen...)}
+	newTxs := []*Transaction{}
+	for i, fp := range fingerprints(sorted) {
+		tx := sorted[i]
+		if tx.Timestamp.Before(c.Time) || (tx.Timestamp.Equal(c.Time) && seen[fp]) {
+			continue
+		}
+
+		newTxs = append(newTxs, tx)
+		if tx.Timestamp.After(next.Time) {
+			next = Cursor{Time: tx.Timestamp}
+		}
+		next.Seen = append(next.Seen, fp)
+	}
+
+	return newTxs, next
+}
+
+// Fingerprint identifies a transaction by its contents.
+func Fingerprint(tx *Transaction) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf(
+		"%s\x00%s\x00%s\x00%s",
+		tx.Timestamp.UTC().Format(time.RFC3339Nano), tx.FromAddress, tx.ToAddress, tx.Amount,
+	)))
+	return hex.EncodeToString(sum[:])
+}
+
+// fingerprints fingerprints txs, telling apart transactions that are otherwise
+// identical by the order in which they appear.
+func fingerprints(txs []*Transaction) []string {
+	fps := make([]string, len(txs))
+	counts := map[string]int{}
+	for i, tx := range txs {
+		fp := Fingerprint(tx)
+		if n := counts[fp]; n > 0 {
+			fps[i] = fmt.Sprintf("%s/%d", fp, n)
+		} else {
+			fps[i] = fp
+		}
+		counts[fp]++
+	}
+
+	return fps
+}
@@ -0,0 +1,45 @@
+package jobcoin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/r-medina/climatic"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCursorNext(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	at := func(sec int) time.Time { return time.Date(2018, 1, 1, 0, 0, sec, 0, time.UTC) }
+	one := climatic.MustParseAmount("1")
+	tx1 := &Transaction{Timestamp: at(1), ToAddress: "a", Amount: one}
+	tx2 := &Transaction{Timestamp: at(2), ToAddress: "b", Amount: one}
+	tx3 := &Transaction{Timestamp: at(2), ToAddress: "c", Amount: one}
+	tx4 := &Transaction{Timestamp: at(3), ToAddress: "d", Amount: one}
+	tx4dup := &Transaction{Timestamp: at(3), ToAddress: "d", Amount: one}
+
+	txs, c := Cursor{}.Next([]*Transaction{tx2, tx1})
+	require.Equal([]*Transaction{tx1, tx2}, txs, "sorted oldest first")
+	require.Equal(at(2), c.Time)
+
+	// tx3 shares a timestamp with tx2 but hasn't been seen
+	txs, c = c.Next([]*Transaction{tx1, tx2, tx3})
+	require.Equal([]*Transaction{tx3}, txs)
+	require.Len(c.Seen, 2)
+
+	// reordered and truncated history
+	txs, c = c.Next([]*Transaction{tx4, tx3})
+	require.Equal([]*Transaction{tx4}, txs)
+	require.Equal(at(3), c.Time)
+	require.Len(c.Seen, 1)
+
+	// identical transactions are told apart
+	txs, c = c.Next([]*Transaction{tx4, tx4dup})
+	require.Equal([]*Transaction{tx4dup}, txs)
+
+	txs, _ = c.Next([]*Transaction{tx1, tx2, tx3, tx4, tx4dup})
+	require.Empty(txs)
+}
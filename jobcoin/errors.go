@@ -0,0 +1,125 @@
+package jobcoin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Sentinel errors describing why a call to the Jobcoin API failed. Every
+// *APIError wraps exactly one of these, so callers can use errors.Is to tell
+// them apart.
+var (
+	// ErrInsufficientFunds means the sending address does not have enough
+	// Jobcoins for the transaction.
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	// ErrNotFound means the API does not know about the requested resource.
+	ErrNotFound = errors.New("not found")
+	// ErrRateLimited means the API refused the call because too many were
+	// made.
+	ErrRateLimited = errors.New("rate limited")
+	// ErrServer means the API failed to handle the call.
+	ErrServer = errors.New("server error")
+	// ErrBadRequest means the API rejected the call as invalid.
+	ErrBadRequest = errors.New("bad request")
+	// ErrMalformedResponse means the API responded with something that could
+	// not be understood.
+	ErrMalformedResponse = errors.New("malformed response")
+)
+
+// APIError is returned when the Jobcoin API responds to a call with an error or
+// with a response that can't be decoded.
+type APIError struct {
+	// Err is the sentinel error describing the failure.
+	Err error
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+	// Message is the error message sent by the API, if any.
+	Message string
+	// Body is the raw body of the response.
+	Body []byte
+}
+
+// Error returns the message sent by the API if there is one, otherwise it
+// describes the failure.
+func (err *APIError) Error() string {
+	if err.Message != "" {
+		return err.Message
+	}
+	return fmt.Sprintf("API error %d: %v", err.StatusCode, err.Err)
+}
+
+// Unwrap returns the sentinel error.
+func (err *APIError) Unwrap() error { return err.Err }
+
+// Cause returns the sentinel error. It allows errors.Cause to work.
+func (err *APIError) Cause() error { return err.Err }
+
+// IsTransient reports whether err is a failure that may go away if the call is
+// made again: rate limiting, server errors and failures to reach the API at all.
+// Rejections by the API and responses that could not be understood are
+// permanent.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	apiErr := &APIError{}
+	if !errors.As(err, &apiErr) {
+		// the API was never reached or the connection broke
+		return true
+	}
+
+	return errors.Is(apiErr, ErrRateLimited) || errors.Is(apiErr, ErrServer)
+}
+
+// checkResponse turns responses with error status codes into an *APIError.
+func checkResponse(statusCode int, body []byte) error {
+	if statusCode >= 200 && statusCode < 300 {
+		return nil
+	}
+
+	apiErr := &APIError{StatusCode: statusCode, Body: body}
+
+	msg := struct {
+		Error interface{} `json:"error"`
+	}{}
+	if err := json.Unmarshal(body, &msg); err == nil && msg.Error != nil {
+		apiErr.Message = fmt.Sprintf("%v", msg.Error)
+	}
+
+	switch {
+	case statusCode == http.StatusTooManyRequests:
+		apiErr.Err = ErrRateLimited
+	case statusCode == http.StatusNotFound:
+		apiErr.Err = ErrNotFound
+	case statusCode >= 500:
+		apiErr.Err = ErrServer
+	case statusCode >= 400 && strings.Contains(strings.ToLower(apiErr.Message), "insufficient"):
+		apiErr.Err = ErrInsufficientFunds
+	case statusCode >= 400:
+		apiErr.Err = ErrBadRequest
+	default:
+		apiErr.Err = ErrMalformedResponse
+	}
+
+	return apiErr
+}
+
+// decodeResponse decodes a successful response into v.
+func decodeResponse(statusCode int, body []byte, v interface{}) error {
+	if err := json.Unmarshal(body, v); err != nil {
+		return &APIError{
+			Err:        ErrMalformedResponse,
+			StatusCode: statusCode,
+			Message:    fmt.Sprintf("malformed response: %v", err),
+			Body:       body,
+		}
+	}
+
+	return nil
+}
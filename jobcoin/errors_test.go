@@ -0,0 +1,79 @@
+package jobcoin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc       string
+		statusCode int
+		body       string
+		want       error
+		msg        string
+		transient  bool
+	}{
+		{
+			desc:       "insufficient funds",
+			statusCode: 422,
+			body:       `{"error":"Insufficient Funds"}`,
+			want:       ErrInsufficientFunds,
+			msg:        "Insufficient Funds",
+		},
+		{desc: "bad request", statusCode: 422, body: `{"error":"nope"}`, want: ErrBadRequest, msg: "nope"},
+		{desc: "not found", statusCode: 404, want: ErrNotFound, msg: "API error 404: not found"},
+		{desc: "rate limited", statusCode: 429, want: ErrRateLimited, transient: true},
+		{desc: "server error", statusCode: 502, body: "<html>", want: ErrServer, transient: true},
+		{desc: "malformed", statusCode: 200, body: "<html>", want: ErrMalformedResponse},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			require := require.New(t)
+
+			server := httptest.NewServer(
+				http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+					rw.WriteHeader(test.statusCode)
+					_, _ = rw.Write([]byte(test.body))
+				}),
+			)
+			defer server.Close()
+			testClient := NewClimaticClient(WithAPIAddress(server.URL))
+
+			_, err := testClient.GetAddressInfo(context.Background(), "a")
+			require.Error(err)
+			require.True(errors.Is(err, test.want), "unexpected error: %v", err)
+			require.Equal(test.transient, IsTransient(err))
+
+			apiErr := &APIError{}
+			require.True(errors.As(err, &apiErr))
+			require.Equal(test.statusCode, apiErr.StatusCode)
+			require.Equal(test.body, string(apiErr.Body))
+			if test.msg != "" {
+				require.Equal(test.msg, err.Error())
+			}
+		})
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	require.False(IsTransient(nil))
+	require.False(IsTransient(context.Canceled))
+	require.True(IsTransient(errors.New("connection reset")))
+	require.True(IsTransient(errors.Wrap(&APIError{Err: ErrServer}, "wrapped")))
+	require.False(IsTransient(&APIError{Err: ErrInsufficientFunds}))
+}
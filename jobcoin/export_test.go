@@ -0,0 +1,8 @@
+package jobcoin
+
+import "time"
+
+// Backoff exposes backoff to the tests of the package.
+func (policy RetryPolicy) Backoff(retry int) time.Duration {
+	return policy.backoff(retry)
+}
@@ -1,6 +1,11 @@
 package jctest
 
-import "github.com/r-medina/climatic/jobcoin"
+import (
+	"context"
+
+	"github.com/r-medina/climatic"
+	"github.com/r-medina/climatic/jobcoin"
+)
 
 // MockClient mocks a jobcoin client.
 type MockClient struct {
@@ -12,7 +17,7 @@ type MockClient struct {
 var _ jobcoin.Client = (*MockClient)(nil)
 
 // GetAddressInfo calls func in mock.
-func (cli *MockClient) GetAddressInfo(string) (*jobcoin.AddressInfo, error) {
+func (cli *MockClient) GetAddressInfo(context.Context, string) (*jobcoin.AddressInfo, error) {
 	if cli.AddrInfo == nil {
 		return nil, nil
 	}
@@ -20,15 +25,28 @@ func (cli *MockClient) GetAddressInfo(string) (*jobcoin.AddressInfo, error) {
 }
 
 // GetTransactions calls func in mock.
-func (cli *MockClient) GetTransactions() ([]*jobcoin.Transaction, error) {
+func (cli *MockClient) GetTransactions(context.Context) ([]*jobcoin.Transaction, error) {
 	if cli.Transactions == nil {
 		return nil, nil
 	}
 	return cli.Transactions()
 }
 
+// GetTransactionsSince calls the Transactions func in mock and returns the
+// transactions that come after since.
+func (cli *MockClient) GetTransactionsSince(
+	ctx context.Context, since jobcoin.Cursor,
+) ([]*jobcoin.Transaction, jobcoin.Cursor, error) {
+	txs, err := cli.GetTransactions(ctx)
+	if err != nil {
+		return nil, since, err
+	}
+	txs, next := since.Next(txs)
+	return txs, next, nil
+}
+
 // PostTransaction calls func in mock.
-func (cli *MockClient) PostTransaction(_, _, _ string) error {
+func (cli *MockClient) PostTransaction(_ context.Context, _, _ string, _ climatic.Amount) error {
 	if cli.Post == nil {
 		return nil
 	}
@@ -36,6 +54,6 @@ func (cli *MockClient) PostTransaction(_, _, _ string) error {
 }
 
 // Create calls func in mock.
-func (cli *MockClient) Create(string) error {
+func (cli *MockClient) Create(context.Context, string) error {
 	return nil
 }
@@ -0,0 +1,371 @@
+package jctest
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/r-medina/climatic"
+	"github.com/r-medina/climatic/jobcoin"
+)
+
+// DefaultCreateAmount is how many Jobcoins a Ledger creates per call to Create.
+var DefaultCreateAmount = climatic.MustParseAmount("50")
+
+// Ledger is an in-memory Jobcoin ledger. It keeps real balances, rejects
+// overdrafts and records a timestamped history of every transaction.
+//
+// A Ledger can be used as a jobcoin.Client directly, and it is also an
+// http.Handler serving the same routes as the Jobcoin API, so
+//
+//	srv := httptest.NewServer(ledger)
+//	cli := jobcoin.NewClimaticClient(jobcoin.WithAPIAddress(srv.URL))
+//
+// exercises the real client against it.
+type Ledger struct {
+	balances map[string]climatic.Amount
+	txs      []*jobcoin.Transaction
+	mtx      sync.Mutex
+
+	createAmt climatic.Amount
+	now       func() time.Time
+	// journal, if set, receives every transaction before it is applied
+	journal io.Writer
+	// latency is how long every call takes
+	latency time.Duration
+}
+
+var (
+	_ jobcoin.Client = (*Ledger)(nil)
+	_ http.Handler   = (*Ledger)(nil)
+)
+
+// NewLedger returns an empty Ledger.
+func NewLedger(opts ...LedgerOption) *Ledger {
+	l := &Ledger{
+		balances:  map[string]climatic.Amount{},
+		createAmt: DefaultCreateAmount,
+		now:       time.Now,
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+
+	return l
+}
+
+// LedgerOption customizes a Ledger.
+type LedgerOption func(*Ledger)
+
+// WithCreateAmount sets how many Jobcoins are created per call to Create.
+func WithCreateAmount(amt climatic.Amount) LedgerOption {
+	return func(l *Ledger) {
+		l.createAmt = amt
+	}
+}
+
+// WithClock sets the function used to timestamp transactions.
+func WithClock(now func() time.Time) LedgerOption {
+	return func(l *Ledger) {
+		l.now = now
+	}
+}
+
+// WithLatency makes every call to the Ledger take d, like a call to a remote
+// API would. Calls waiting it out are cut short by their context.
+func WithLatency(d time.Duration) LedgerOption {
+	return func(l *Ledger) {
+		l.latency = d
+	}
+}
+
+// WithJournal makes the Ledger write every transaction to w, as a line of JSON,
+// before applying it. If writing fails the transaction fails too, so w always
+// holds at least everything that has been applied. The history can be restored
+// with LoadLedger.
+func WithJournal(w io.Writer) LedgerOption {
+	return func(l *Ledger) {
+		l.journal = w
+	}
+}
+
+// LoadLedger returns a Ledger that has replayed the transactions in r, as
+// written by a Ledger using WithJournal. The transactions are replayed before
+// any journal passed in opts is used, so the same file can be read from and
+// appended to.
+func LoadLedger(r io.Reader, opts ...LedgerOption) (*Ledger, error) {
+	l := NewLedger(opts...)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		tx := &jobcoin.Transaction{}
+		if err := json.Unmarshal(scanner.Bytes(), tx); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if tx.Amount.Sign() <= 0 {
+			return nil, fmt.Errorf("line %d: invalid amount %v", line, tx.Amount)
+		}
+		if tx.FromAddress != "" {
+			balance := l.balances[tx.FromAddress]
+			if balance.Cmp(tx.Amount) < 0 {
+				return nil, fmt.Errorf("line %d: overdraft of %s", line, tx.FromAddress)
+			}
+			l.balances[tx.FromAddress] = balance.Sub(tx.Amount)
+		}
+		l.balances[tx.ToAddress] = l.balances[tx.ToAddress].Add(tx.Amount)
+		l.txs = append(l.txs, tx)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Balance returns the balance of addr.
+func (l *Ledger) Balance(addr string) climatic.Amount {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	return l.balances[addr]
+}
+
+// GetAddressInfo returns all the transactions and the balance for an address.
+func (l *Ledger) GetAddressInfo(ctx context.Context, addr string) (*jobcoin.AddressInfo, error) {
+	if err := l.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	addrInfo := &jobcoin.AddressInfo{
+		Balance:      l.balances[addr],
+		Transactions: []*jobcoin.Transaction{},
+	}
+	for _, tx := range l.txs {
+		if tx.FromAddress == addr || tx.ToAddress == addr {
+			txCopy := *tx
+			addrInfo.Transactions = append(addrInfo.Transactions, &txCopy)
+		}
+	}
+
+	return addrInfo, nil
+}
+
+// GetTransactions returns all the transactions in the jobcoin history.
+func (l *Ledger) GetTransactions(ctx context.Context) ([]*jobcoin.Transaction, error) {
+	return l.transactionsFrom(ctx, time.Time{})
+}
+
+// transactionsFrom returns the transactions no older than from.
+func (l *Ledger) transactionsFrom(ctx context.Context, from time.Time) ([]*jobcoin.Transaction, error) {
+	if err := l.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	txs := []*jobcoin.Transaction{}
+	for _, tx := range l.txs {
+		if tx.Timestamp.Before(from) {
+			continue
+		}
+		txCopy := *tx
+		txs = append(txs, &txCopy)
+	}
+
+	return txs, nil
+}
+
+// GetTransactionsSince returns the transactions that come after since, oldest
+// first, and a cursor to pass to the next call.
+func (l *Ledger) GetTransactionsSince(
+	ctx context.Context, since jobcoin.Cursor,
+) ([]*jobcoin.Transaction, jobcoin.Cursor, error) {
+	txs, err := l.transactionsFrom(ctx, since.Time)
+	if err != nil {
+		return nil, since, err
+	}
+	txs, next := since.Next(txs)
+	return txs, next, nil
+}
+
+// PostTransaction sends jobcoin. It fails with jobcoin.ErrInsufficientFunds if
+// fromAddr can't cover amt.
+func (l *Ledger) PostTransaction(
+	ctx context.Context, fromAddr, toAddr string, amt climatic.Amount,
+) error {
+	if err := l.wait(ctx); err != nil {
+		return err
+	}
+
+	if amt.Sign() <= 0 || fromAddr == "" || toAddr == "" {
+		return apiError(jobcoin.ErrBadRequest, http.StatusUnprocessableEntity, "Invalid transaction")
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	balance := l.balances[fromAddr]
+	if balance.Cmp(amt) < 0 {
+		return apiError(jobcoin.ErrInsufficientFunds, http.StatusUnprocessableEntity, "Insufficient Funds")
+	}
+
+	if err := l.record(fromAddr, toAddr, amt); err != nil {
+		return err
+	}
+	l.balances[fromAddr] = balance.Sub(amt)
+	l.balances[toAddr] = l.balances[toAddr].Add(amt)
+
+	return nil
+}
+
+// Create creates Jobcoins for the given address.
+func (l *Ledger) Create(ctx context.Context, addr string) error {
+	if err := l.wait(ctx); err != nil {
+		return err
+	}
+	if addr == "" {
+		return apiError(jobcoin.ErrBadRequest, http.StatusUnprocessableEntity, "Invalid address")
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if err := l.record("", addr, l.createAmt); err != nil {
+		return err
+	}
+	l.balances[addr] = l.balances[addr].Add(l.createAmt)
+
+	return nil
+}
+
+// ServeHTTP serves the Jobcoin API.
+func (l *Ledger) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	const addrsPrefix = "/api/addresses/"
+
+	switch {
+	case strings.HasPrefix(req.URL.Path, addrsPrefix) && req.Method == "GET":
+		addrInfo, err := l.GetAddressInfo(req.Context(), strings.TrimPrefix(req.URL.Path, addrsPrefix))
+		writeResponse(rw, addrInfo, err)
+
+	case req.URL.Path == "/api/transactions" && req.Method == "GET":
+		var from time.Time
+		if since := req.URL.Query().Get("since"); since != "" {
+			var err error
+			if from, err = time.Parse(time.RFC3339Nano, since); err != nil {
+				writeResponse(rw, nil, apiError(jobcoin.ErrBadRequest, http.StatusBadRequest, "Invalid since"))
+				return
+			}
+		}
+		txs, err := l.transactionsFrom(req.Context(), from)
+		writeResponse(rw, txs, err)
+
+	case req.URL.Path == "/api/transactions" && req.Method == "POST":
+		tx := struct {
+			FromAddress string `json:"fromAddress"`
+			ToAddress   string `json:"toAddress"`
+			Amount      string `json:"amount"`
+		}{}
+		if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+			if err := json.NewDecoder(req.Body).Decode(&tx); err != nil {
+				writeResponse(rw, nil, apiError(jobcoin.ErrBadRequest, http.StatusBadRequest, err.Error()))
+				return
+			}
+		} else {
+			tx.FromAddress = req.FormValue("fromAddress")
+			tx.ToAddress = req.FormValue("toAddress")
+			tx.Amount = req.FormValue("amount")
+		}
+		amt, err := climatic.ParseAmount(tx.Amount)
+		if err != nil {
+			writeResponse(rw, nil, apiError(jobcoin.ErrBadRequest, http.StatusUnprocessableEntity, "Invalid amount"))
+			return
+		}
+		err = l.PostTransaction(req.Context(), tx.FromAddress, tx.ToAddress, amt)
+		writeResponse(rw, map[string]string{"status": "OK"}, err)
+
+	case req.URL.Path == "/create" && req.Method == "POST":
+		err := l.Create(req.Context(), req.FormValue("address"))
+		writeResponse(rw, map[string]string{"status": "OK"}, err)
+
+	default:
+		writeResponse(rw, nil, apiError(jobcoin.ErrNotFound, http.StatusNotFound, "Not Found"))
+	}
+}
+
+// wait waits out the latency of a call, unless ctx is done first.
+func (l *Ledger) wait(ctx context.Context) error {
+	if l.latency <= 0 {
+		return ctx.Err()
+	}
+
+	t := time.NewTimer(l.latency)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// record appends a transaction to the journal, if there is one, and to the
+// history. l.mtx must be held.
+func (l *Ledger) record(fromAddr, toAddr string, amt climatic.Amount) error {
+	tx := &jobcoin.Transaction{
+		Timestamp:   l.now().UTC(),
+		FromAddress: fromAddr,
+		ToAddress:   toAddr,
+		Amount:      amt,
+	}
+
+	if l.journal != nil {
+		line, err := json.Marshal(tx)
+		if err != nil {
+			return err
+		}
+		if _, err := l.journal.Write(append(line, '\n')); err != nil {
+			return apiError(jobcoin.ErrServer, http.StatusInternalServerError, "Journal Unavailable")
+		}
+	}
+
+	l.txs = append(l.txs, tx)
+
+	return nil
+}
+
+func apiError(err error, statusCode int, msg string) *jobcoin.APIError {
+	body, _ := json.Marshal(map[string]string{"error": msg})
+	return &jobcoin.APIError{Err: err, StatusCode: statusCode, Message: msg, Body: body}
+}
+
+// writeResponse writes v as JSON, or err if it isn't nil.
+func writeResponse(rw http.ResponseWriter, v interface{}, err error) {
+	rw.Header().Set("Content-Type", "application/json")
+
+	if err != nil {
+		apiErr, ok := err.(*jobcoin.APIError)
+		if !ok {
+			apiErr = apiError(jobcoin.ErrServer, http.StatusInternalServerError, err.Error())
+		}
+		rw.WriteHeader(apiErr.StatusCode)
+		_, _ = rw.Write(apiErr.Body)
+		return
+	}
+
+	_ = json.NewEncoder(rw).Encode(v)
+}
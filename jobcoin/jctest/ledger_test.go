@@ -0,0 +1,126 @@
+package jctest
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/r-medina/climatic"
+	"github.com/r-medina/climatic/jobcoin"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLedger(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	tick := 0
+	clock := func() time.Time {
+		tick++
+		return start.Add(time.Duration(tick) * time.Second)
+	}
+
+	ledger := NewLedger(WithClock(clock), WithCreateAmount(climatic.MustParseAmount("10.5")))
+	srv := httptest.NewServer(ledger)
+	defer srv.Close()
+
+	clients := map[string]jobcoin.Client{
+		"direct": ledger,
+		"http":   jobcoin.NewClimaticClient(jobcoin.WithAPIAddress(srv.URL)),
+	}
+
+	ctx := context.Background()
+	for desc, cli := range clients {
+		t.Run(desc, func(t *testing.T) {
+			require := require.New(t)
+
+			alice, bob := desc+"-alice", desc+"-bob"
+			require.NoError(cli.Create(ctx, alice))
+			require.NoError(cli.PostTransaction(ctx, alice, bob, climatic.MustParseAmount("3.25")))
+
+			err := cli.PostTransaction(ctx, bob, alice, climatic.MustParseAmount("3.2500001"))
+			require.True(errors.Is(err, jobcoin.ErrInsufficientFunds), "unexpected error: %v", err)
+			err = cli.PostTransaction(ctx, bob, alice, climatic.MustParseAmount("-1"))
+			require.True(errors.Is(err, jobcoin.ErrBadRequest), "unexpected error: %v", err)
+
+			addrInfo, err := cli.GetAddressInfo(ctx, alice)
+			require.NoError(err)
+			require.Equal(climatic.MustParseAmount("7.25"), addrInfo.Balance)
+			require.Len(addrInfo.Transactions, 2)
+			require.Equal("", addrInfo.Transactions[0].FromAddress)
+			require.Equal(climatic.MustParseAmount("10.5"), addrInfo.Transactions[0].Amount)
+			require.Equal(bob, addrInfo.Transactions[1].ToAddress)
+			require.True(addrInfo.Transactions[0].Timestamp.Before(addrInfo.Transactions[1].Timestamp))
+
+			addrInfo, err = cli.GetAddressInfo(ctx, bob)
+			require.NoError(err)
+			require.Equal(climatic.MustParseAmount("3.25"), addrInfo.Balance)
+
+			addrInfo, err = cli.GetAddressInfo(ctx, desc+"-nobody")
+			require.NoError(err)
+			require.Equal(climatic.MustParseAmount("0"), addrInfo.Balance)
+			require.Empty(addrInfo.Transactions)
+		})
+	}
+
+	txs, err := ledger.GetTransactions(ctx)
+	require.NoError(t, err)
+	require.Len(t, txs, 4)
+	for i := 1; i < len(txs); i++ {
+		require.True(t, txs[i-1].Timestamp.Before(txs[i].Timestamp), "history out of order")
+	}
+}
+
+func TestLedgerJournal(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	ctx := context.Background()
+	journal := &bytes.Buffer{}
+
+	ledger := NewLedger(WithJournal(journal))
+	require.NoError(ledger.Create(ctx, "alice"))
+	require.NoError(ledger.PostTransaction(ctx, "alice", "bob", climatic.MustParseAmount("0.125")))
+	require.Error(ledger.PostTransaction(ctx, "bob", "alice", climatic.MustParseAmount("1")))
+	want, err := ledger.GetTransactions(ctx)
+	require.NoError(err)
+
+	// the journal is appended to while it is being replayed from
+	replay := bytes.NewBuffer(journal.Bytes())
+	loaded, err := LoadLedger(replay, WithJournal(journal))
+	require.NoError(err)
+	got, err := loaded.GetTransactions(ctx)
+	require.NoError(err)
+	require.Equal(want, got)
+	require.Equal(climatic.MustParseAmount("49.875"), loaded.Balance("alice"))
+	require.Equal(climatic.MustParseAmount("0.125"), loaded.Balance("bob"))
+
+	require.NoError(loaded.PostTransaction(ctx, "bob", "carol", climatic.MustParseAmount("0.125")))
+	loaded, err = LoadLedger(bytes.NewReader(journal.Bytes()))
+	require.NoError(err)
+	require.Equal(climatic.MustParseAmount("0"), loaded.Balance("bob"))
+	require.Equal(climatic.MustParseAmount("0.125"), loaded.Balance("carol"))
+
+	_, err = LoadLedger(strings.NewReader(`{"fromAddress":"nobody","toAddress":"bob","amount":"1"}`))
+	require.Error(err, "overdrafts must not load")
+}
+
+func TestLedgerLatency(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	ledger := NewLedger(WithLatency(20 * time.Millisecond))
+	start := time.Now()
+	require.NoError(ledger.Create(context.Background(), "alice"))
+	require.True(time.Since(start) >= 20*time.Millisecond, "call took %v", time.Since(start))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	_, err := ledger.GetAddressInfo(ctx, "alice")
+	require.Equal(context.DeadlineExceeded, err)
+}
@@ -1,44 +1,54 @@
-// TODO: use pkg/errors and make better errors.
-
 package jobcoin
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
+	"github.com/r-medina/climatic"
+
 	"github.com/pkg/errors"
 )
 
-// Client represents a Jobcoin API client.
+// Client represents a Jobcoin API client. Every call takes a context so that
+// callers can bound it with a deadline or cancel it.
 type Client interface {
 	// GetAddressInfo returns all the transactions and the balance for an address.
-	GetAddressInfo(addr string) (*AddressInfo, error)
+	GetAddressInfo(ctx context.Context, addr string) (*AddressInfo, error)
 	// GetTransactions returns all the transactions in the jobcoin history.
-	GetTransactions() ([]*Transaction, error)
+	GetTransactions(ctx context.Context) ([]*Transaction, error)
+	// GetTransactionsSince returns the transactions that come after since,
+	// oldest first, and a cursor to pass to the next call.
+	GetTransactionsSince(ctx context.Context, since Cursor) ([]*Transaction, Cursor, error)
 	// PostTransaction sends jobcoin.
-	PostTransaction(fromAddr, toAddr, amt string) error
+	PostTransaction(ctx context.Context, fromAddr, toAddr string, amt climatic.Amount) error
 	// Create creates 50 Jobcons out of thin air.
-	Create(addr string) error
+	Create(ctx context.Context, addr string) error
 }
 
 // AddressInfo contains all the data relating to a Jobcoin address.
 type AddressInfo struct {
-	Balance      string         `json:"balance"`
-	Transactions []*Transaction `json:"transactions"`
+	Balance      climatic.Amount `json:"balance"`
+	Transactions []*Transaction  `json:"transactions"`
 }
 
 // Transaction contains information about a transaction.
 type Transaction struct {
-	Timestamp   time.Time `json:"time,string"`
-	FromAddress string    `json:"fromAddress"`
-	ToAddress   string    `json:"toAddress"`
-	Amount      string    `json:"amount"`
+	Timestamp   time.Time       `json:"time,string"`
+	FromAddress string          `json:"fromAddress"`
+	ToAddress   string          `json:"toAddress"`
+	Amount      climatic.Amount `json:"amount"`
 }
 
+// DefaultAPIAddress is the address of the hosted Jobcoin API.
+const DefaultAPIAddress = "https://jobcoin.gemini.com/climatic"
+
 // ClimaticClient uses the https://jobcoin.gemini.com/climatic/api.
 type ClimaticClient struct {
 	apiAddr    string
@@ -50,7 +60,7 @@ var _ Client = (*ClimaticClient)(nil)
 // NewClimaticClient returns a Client implementation that uses the climatic API.
 func NewClimaticClient(opts ...Option) *ClimaticClient {
 	cli := &ClimaticClient{
-		apiAddr:    "https://jobcoin.gemini.com/climatic",
+		apiAddr:    DefaultAPIAddress,
 		httpClient: http.DefaultClient,
 	}
 	for _, opt := range opts {
@@ -79,57 +89,72 @@ func WithAPIAddress(apiAddr string) Option {
 }
 
 // GetAddressInfo returns all the transactions and the balance for an address.
-func (cli *ClimaticClient) GetAddressInfo(addr string) (*AddressInfo, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/api/addresses/%s", cli.apiAddr, addr), nil)
+func (cli *ClimaticClient) GetAddressInfo(ctx context.Context, addr string) (*AddressInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/api/addresses/%s", cli.apiAddr, addr), nil)
 	if err != nil {
 		return nil, err
 	}
 
-	res, err := cli.httpClient.Do(req)
-	if err != nil {
-		return nil, errors.Wrap(err, "HTTPClient.DO failed")
-	}
-	defer res.Body.Close()
-
 	addrInfo := &AddressInfo{}
-	decoder := json.NewDecoder(res.Body)
-	if err = decoder.Decode(addrInfo); err != nil {
-		return nil, errors.Wrap(err, "Decode failed")
+	if err := cli.do(req, addrInfo); err != nil {
+		return nil, err
 	}
 
 	return addrInfo, nil
 }
 
 // GetTransactions returns all the transactions in the jobcoin history.
-func (cli *ClimaticClient) GetTransactions() ([]*Transaction, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/api/transactions", cli.apiAddr), nil)
+func (cli *ClimaticClient) GetTransactions(ctx context.Context) ([]*Transaction, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/api/transactions", cli.apiAddr), nil)
 	if err != nil {
 		return nil, err
 	}
 
-	res, err := cli.httpClient.Do(req)
-	if err != nil {
+	txs := []*Transaction{}
+	if err := cli.do(req, &txs); err != nil {
 		return nil, err
 	}
-	defer res.Body.Close()
+
+	return txs, nil
+}
+
+// GetTransactionsSince returns the transactions that come after since, oldest
+// first, and a cursor to pass to the next call.
+//
+// The time of since is sent to the API so that servers that support it only
+// send recent transactions, but the result is filtered here as well, so it
+// works with servers that always send the whole history.
+func (cli *ClimaticClient) GetTransactionsSince(
+	ctx context.Context, since Cursor,
+) ([]*Transaction, Cursor, error) {
+	reqURL := fmt.Sprintf("%s/api/transactions", cli.apiAddr)
+	if !since.Time.IsZero() {
+		reqURL += "?" + url.Values{"since": {since.Time.UTC().Format(time.RFC3339Nano)}}.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+	if err != nil {
+		return nil, since, err
+	}
 
 	txs := []*Transaction{}
-	decoder := json.NewDecoder(res.Body)
-	if err = decoder.Decode(&txs); err != nil {
-		return nil, err
+	if err := cli.do(req, &txs); err != nil {
+		return nil, since, err
 	}
 
-	return txs, nil
+	txs, next := since.Next(txs)
+	return txs, next, nil
 }
 
 // PostTransaction sends jobcoin.
-func (cli *ClimaticClient) PostTransaction(fromAddr, toAdddr, amt string) error {
+func (cli *ClimaticClient) PostTransaction(
+	ctx context.Context, fromAddr, toAdddr string, amt climatic.Amount,
+) error {
 	body := &bytes.Buffer{}
 	encoder := json.NewEncoder(body)
 	err := encoder.Encode(struct {
-		FromAddress string `json:"fromAddress"`
-		ToAddress   string `json:"toAddress"`
-		Amount      string `json:"amount"`
+		FromAddress string          `json:"fromAddress"`
+		ToAddress   string          `json:"toAddress"`
+		Amount      climatic.Amount `json:"amount"`
 	}{
 		FromAddress: fromAddr,
 		ToAddress:   toAdddr,
@@ -139,45 +164,50 @@ func (cli *ClimaticClient) PostTransaction(fromAddr, toAdddr, amt string) error
 		return err
 	}
 
-	res, err := cli.httpClient.Post(
-		fmt.Sprintf("%s/api/transactions", cli.apiAddr), "application/json", body,
+	req, err := http.NewRequestWithContext(
+		ctx, "POST", fmt.Sprintf("%s/api/transactions", cli.apiAddr), body,
 	)
 	if err != nil {
 		return err
 	}
-	defer res.Body.Close()
-
-	if res.StatusCode >= 400 {
-		apiErr := map[string]interface{}{}
-		decoder := json.NewDecoder(res.Body)
-		if err = decoder.Decode(&apiErr); err != nil {
-			return errors.Errorf("API error: %d", res.StatusCode)
-		}
-
-		return fmt.Errorf("%v", apiErr["error"])
-	}
+	req.Header.Set("Content-Type", "application/json")
 
-	return nil
+	return cli.do(req, nil)
 }
 
 // Create creates Jobcoins for the given address.
-func (cli *ClimaticClient) Create(addr string) error {
+func (cli *ClimaticClient) Create(ctx context.Context, addr string) error {
 	body := strings.NewReader("address=" + addr)
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/create", cli.apiAddr), body)
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/create", cli.apiAddr), body)
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
+	return cli.do(req, nil)
+}
+
+// do sends req and decodes the response into v, unless v is nil. Responses with
+// error status codes and responses that can't be decoded result in an
+// *APIError.
+func (cli *ClimaticClient) do(req *http.Request, v interface{}) error {
 	res, err := cli.httpClient.Do(req)
 	if err != nil {
-		return err
+		return errors.Wrap(err, "HTTPClient.Do failed")
 	}
 	defer res.Body.Close()
 
-	if res.StatusCode >= 400 {
-		return errors.Errorf("API error: %d", res.StatusCode)
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return errors.Wrap(err, "reading response failed")
+	}
+
+	if err := checkResponse(res.StatusCode, body); err != nil {
+		return err
+	}
+	if v == nil {
+		return nil
 	}
 
-	return nil
+	return decodeResponse(res.StatusCode, body, v)
 }
@@ -1,12 +1,15 @@
 package jobcoin
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/r-medina/climatic"
+
 	"github.com/stretchr/testify/assert"
 )
 
@@ -21,7 +24,7 @@ func TestGetAddressInfo(t *testing.T) {
 	}{
 		{desc: "empty"},
 		{desc: "balance, no txs", addrInfo: AddressInfo{
-			Balance: "2.0",
+			Balance: climatic.MustParseAmount("2.0"),
 		}},
 	}
 
@@ -40,7 +43,7 @@ func TestGetAddressInfo(t *testing.T) {
 			)
 			testClient := NewClimaticClient(WithAPIAddress(server.URL))
 
-			addrInfo, err := testClient.GetAddressInfo("")
+			addrInfo, err := testClient.GetAddressInfo(context.Background(), "")
 			require.NoError(err, "failed GetAddressInfo")
 			require.Equal(addrInfo, &test.addrInfo, "unexpected output")
 		})
@@ -72,12 +75,12 @@ func TestGetTransactions(t *testing.T) {
 		{desc: "2 txs", txs: []*Transaction{{
 			Timestamp: makeTime("2014-04-22T13:10:01.210Z"),
 			ToAddress: "BobsAddress",
-			Amount:    "50.35",
+			Amount:    climatic.MustParseAmount("50.35"),
 		}, {
 			Timestamp:   makeTime("2014-04-23T18:25:43.511Z"),
 			FromAddress: "BobsAddress",
 			ToAddress:   "AlicesAddress",
-			Amount:      "30.1",
+			Amount:      climatic.MustParseAmount("30.1"),
 		}}},
 	}
 
@@ -93,7 +96,7 @@ func TestGetTransactions(t *testing.T) {
 			)
 			testClient := NewClimaticClient(WithAPIAddress(server.URL))
 
-			txs, err := testClient.GetTransactions()
+			txs, err := testClient.GetTransactions(context.Background())
 			require.NoError(err, "failed calling GetTransactions")
 			require.Equal(txs, test.txs, "expected same output")
 
@@ -131,10 +134,36 @@ func TestPostTransaction(t *testing.T) {
 			)
 			testClient := NewClimaticClient(WithAPIAddress(server.URL))
 
-			err := testClient.PostTransaction("a", "b", "1.")
+			err := testClient.PostTransaction(context.Background(), "a", "b", climatic.MustParseAmount("1."))
 			if err != nil {
 				require.Equal(test.errStr, err.Error(), "unexpected error")
 			}
 		})
 	}
 }
+
+func TestContextCanceled(t *testing.T) {
+	t.Parallel()
+
+	require := assert.New(t) // this is not working as expected
+
+	done := make(chan struct{})
+	defer close(done)
+	server := httptest.NewServer(
+		http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			select {
+			case <-req.Context().Done():
+			case <-done:
+			}
+		}),
+	)
+	defer server.Close()
+	testClient := NewClimaticClient(WithAPIAddress(server.URL))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := testClient.GetTransactions(ctx)
+	require.Error(err, "expected call to be abandoned")
+	require.Equal(context.DeadlineExceeded, ctx.Err())
+}
@@ -0,0 +1,259 @@
+package jobcoin
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/r-medina/climatic"
+
+	"github.com/pkg/errors"
+)
+
+// RetryPolicy configures how many times and how patiently a call is retried.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	// Values below 2 disable retrying.
+	MaxAttempts int
+	// InitialBackoff is how long to wait before the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between attempts. Zero leaves it uncapped.
+	MaxBackoff time.Duration
+	// Multiplier grows the wait after every attempt.
+	Multiplier float64
+	// Jitter is the fraction of every wait that is randomized, between 0
+	// and 1.
+	Jitter float64
+}
+
+// backoff returns how long to wait before the given retry, starting at 1.
+func (policy RetryPolicy) backoff(retry int) time.Duration {
+	d := float64(policy.InitialBackoff)
+	for i := 1; i < retry; i++ {
+		d *= policy.Multiplier
+		if max := float64(policy.MaxBackoff); max > 0 && d >= max {
+			break
+		}
+	}
+	if max := float64(policy.MaxBackoff); max > 0 && d > max {
+		d = max
+	}
+
+	jitter := policy.Jitter
+	if jitter < 0 {
+		jitter = 0
+	} else if jitter > 1 {
+		jitter = 1
+	}
+	// spread the wait uniformly over [d*(1-jitter), d]
+	d -= d * jitter * rand.Float64()
+
+	return time.Duration(d)
+}
+
+// RetryConfig holds the RetryPolicy used for each method of a Client.
+type RetryConfig struct {
+	GetAddressInfo  RetryPolicy
+	GetTransactions RetryPolicy
+	PostTransaction RetryPolicy
+	Create          RetryPolicy
+}
+
+// DefaultRetryPolicy is the default policy for a single method.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    4,
+	InitialBackoff: 250 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+}
+
+// DefaultRetryConfig is the default retry configuration.
+var DefaultRetryConfig = RetryConfig{
+	GetAddressInfo:  DefaultRetryPolicy,
+	GetTransactions: DefaultRetryPolicy,
+	PostTransaction: DefaultRetryPolicy,
+	Create:          DefaultRetryPolicy,
+}
+
+// RetryClient wraps a Client and retries calls that fail transiently.
+//
+// Calls that move Jobcoins are only retried when it is certain they had no
+// effect. If a transaction may have gone through before failing (the
+// connection broke or the API errored after receiving it), RetryClient looks
+// at the history of the address the coins came from and only tries again if
+// the transaction is not there. That takes knowing how many identical
+// transactions were there before, which the caller passes with WithPrior; a
+// call without it isn't retried after such a failure.
+type RetryClient struct {
+	cli Client
+	cfg RetryConfig
+}
+
+var _ Client = (*RetryClient)(nil)
+
+// NewRetryClient returns a Client that retries calls to cli according to cfg.
+func NewRetryClient(cli Client, cfg RetryConfig) *RetryClient {
+	return &RetryClient{cli: cli, cfg: cfg}
+}
+
+// GetAddressInfo returns all the transactions and the balance for an address.
+func (rc *RetryClient) GetAddressInfo(ctx context.Context, addr string) (*AddressInfo, error) {
+	var addrInfo *AddressInfo
+	err := retry(ctx, rc.cfg.GetAddressInfo, func() (err error) {
+		addrInfo, err = rc.cli.GetAddressInfo(ctx, addr)
+		return err
+	})
+
+	return addrInfo, err
+}
+
+// GetTransactions returns all the transactions in the jobcoin history.
+func (rc *RetryClient) GetTransactions(ctx context.Context) ([]*Transaction, error) {
+	var txs []*Transaction
+	err := retry(ctx, rc.cfg.GetTransactions, func() (err error) {
+		txs, err = rc.cli.GetTransactions(ctx)
+		return err
+	})
+
+	return txs, err
+}
+
+// GetTransactionsSince returns the transactions that come after since, oldest
+// first, and a cursor to pass to the next call. It uses the GetTransactions
+// policy.
+func (rc *RetryClient) GetTransactionsSince(
+	ctx context.Context, since Cursor,
+) ([]*Transaction, Cursor, error) {
+	var txs []*Transaction
+	next := since
+	err := retry(ctx, rc.cfg.GetTransactions, func() (err error) {
+		txs, next, err = rc.cli.GetTransactionsSince(ctx, since)
+		return err
+	})
+
+	return txs, next, err
+}
+
+// priorKey is the context key of the count set by WithPrior.
+type priorKey struct{}
+
+// WithPrior returns a copy of ctx telling RetryClient that prior transactions
+// identical to the one about to be sent with it are already in the history, so
+// that a failure after which it may have gone through can be retried.
+func WithPrior(ctx context.Context, prior int) context.Context {
+	return context.WithValue(ctx, priorKey{}, prior)
+}
+
+// PostTransaction sends jobcoin. It is never retried if the transaction might
+// have gone through.
+func (rc *RetryClient) PostTransaction(
+	ctx context.Context, fromAddr, toAddr string, amt climatic.Amount,
+) error {
+	sent := func(tx *Transaction) bool {
+		return tx.FromAddress == fromAddr && tx.ToAddress == toAddr && tx.Amount == amt
+	}
+	return rc.retrySend(ctx, rc.cfg.PostTransaction, fromAddr, sent, func() error {
+		return rc.cli.PostTransaction(ctx, fromAddr, toAddr, amt)
+	})
+}
+
+// Create creates Jobcoins for the given address. It is never retried if the
+// Jobcoins might have been created.
+func (rc *RetryClient) Create(ctx context.Context, addr string) error {
+	// created Jobcoins show up in the address' history as coming from nowhere
+	created := func(tx *Transaction) bool {
+		return tx.FromAddress == "" && tx.ToAddress == addr
+	}
+	return rc.retrySend(ctx, rc.cfg.Create, addr, created, func() error {
+		return rc.cli.Create(ctx, addr)
+	})
+}
+
+// retrySend retries call, which moves Jobcoins. After an attempt that may have
+// gone through anyway, the history of histAddr is checked for more
+// transactions matching sent, the one call makes, than the prior count from
+// ctx.
+func (rc *RetryClient) retrySend(
+	ctx context.Context, policy RetryPolicy, histAddr string, sent func(*Transaction) bool, call func() error,
+) error {
+	before, known := ctx.Value(priorKey{}).(int)
+
+	for attempt := 1; ; attempt++ {
+		err := call()
+		if err == nil || !IsTransient(err) || attempt >= policy.MaxAttempts {
+			return err
+		}
+
+		if ambiguous(err) {
+			if !known {
+				// there's no way to know if it landed
+				return err
+			}
+			after, checkErr := rc.countSent(ctx, histAddr, sent)
+			if checkErr != nil {
+				return err
+			}
+			if after > before {
+				// it went through after all
+				return nil
+			}
+		}
+
+		if sleepErr := sleep(ctx, policy.backoff(attempt)); sleepErr != nil {
+			return err
+		}
+	}
+}
+
+// countSent counts the transactions in the history of histAddr that match sent.
+func (rc *RetryClient) countSent(ctx context.Context, histAddr string, sent func(*Transaction) bool) (int, error) {
+	addrInfo, err := rc.GetAddressInfo(ctx, histAddr)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, tx := range addrInfo.Transactions {
+		if sent(tx) {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// ambiguous reports whether a transient failure could have happened after the
+// API acted on the call. Rate limited calls are rejected before anything
+// happens.
+func ambiguous(err error) bool {
+	return !errors.Is(err, ErrRateLimited)
+}
+
+// retry calls call until it succeeds, fails permanently or policy runs out of
+// attempts.
+func retry(ctx context.Context, policy RetryPolicy, call func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := call()
+		if err == nil || !IsTransient(err) || attempt >= policy.MaxAttempts {
+			return err
+		}
+
+		if sleepErr := sleep(ctx, policy.backoff(attempt)); sleepErr != nil {
+			return err
+		}
+	}
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
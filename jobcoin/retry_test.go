@@ -0,0 +1,193 @@
+package jobcoin_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/r-medina/climatic"
+	"github.com/r-medina/climatic/jobcoin"
+	"github.com/r-medina/climatic/jobcoin/jctest"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testPolicy = jobcoin.RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: time.Millisecond,
+	MaxBackoff:     2 * time.Millisecond,
+	Multiplier:     2,
+	Jitter:         0.5,
+}
+
+var testRetryConfig = jobcoin.RetryConfig{
+	GetAddressInfo:  testPolicy,
+	GetTransactions: testPolicy,
+	PostTransaction: testPolicy,
+	Create:          testPolicy,
+}
+
+var (
+	errServer      = &jobcoin.APIError{Err: jobcoin.ErrServer, StatusCode: 500}
+	errRateLimited = &jobcoin.APIError{Err: jobcoin.ErrRateLimited, StatusCode: 429}
+	errFunds       = &jobcoin.APIError{Err: jobcoin.ErrInsufficientFunds, StatusCode: 422}
+)
+
+func TestRetryBackoff(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc   string
+		policy jobcoin.RetryPolicy
+		want   []time.Duration
+	}{
+		{
+			desc:   "capped",
+			policy: jobcoin.RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 3 * time.Second, Multiplier: 2},
+			want:   []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second},
+		},
+		{
+			desc:   "uncapped",
+			policy: jobcoin.RetryPolicy{InitialBackoff: time.Second, Multiplier: 2},
+			want:   []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			require := require.New(t)
+
+			got := []time.Duration{}
+			for retry := 1; retry <= len(test.want); retry++ {
+				got = append(got, test.policy.Backoff(retry))
+			}
+			require.Equal(test.want, got)
+		})
+	}
+}
+
+func TestRetryGetTransactions(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc  string
+		errs  []error
+		calls int
+		err   error
+	}{
+		{desc: "success", calls: 1},
+		{desc: "transient then success", errs: []error{errServer, errRateLimited}, calls: 3},
+		{desc: "out of attempts", errs: []error{errServer, errServer, errServer, errServer}, calls: 3, err: errServer},
+		{desc: "permanent", errs: []error{errFunds}, calls: 1, err: errFunds},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			require := require.New(t)
+
+			calls := 0
+			cli := jobcoin.NewRetryClient(&jctest.MockClient{
+				Transactions: func() ([]*jobcoin.Transaction, error) {
+					calls++
+					if calls <= len(test.errs) {
+						return nil, test.errs[calls-1]
+					}
+					return []*jobcoin.Transaction{}, nil
+				},
+			}, testRetryConfig)
+
+			_, err := cli.GetTransactions(context.Background())
+			require.Equal(test.err, err)
+			require.Equal(test.calls, calls)
+		})
+	}
+}
+
+func TestRetryPostTransaction(t *testing.T) {
+	t.Parallel()
+
+	sent := &jobcoin.Transaction{FromAddress: "a", ToAddress: "b", Amount: climatic.MustParseAmount("1.5")}
+
+	tests := []struct {
+		desc string
+		err  error
+		// landed is whether the first, failed, post went through
+		landed bool
+		// noPrior leaves the prior count out of the context
+		noPrior bool
+		posts   int
+		// checks is how many times the history is fetched
+		checks int
+		want   error
+	}{
+		{desc: "ambiguous and landed", err: errServer, landed: true, posts: 1, checks: 1},
+		{desc: "ambiguous and lost", err: errServer, posts: 2, checks: 1},
+		{desc: "ambiguous without prior", err: errServer, noPrior: true, posts: 1, want: errServer},
+		{desc: "rate limited", err: errRateLimited, posts: 2},
+		{desc: "permanent", err: errFunds, posts: 1, want: errFunds},
+		{desc: "sent", posts: 1},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			require := require.New(t)
+
+			posts, checks := 0, 0
+			history := []*jobcoin.Transaction{sent}
+			cli := jobcoin.NewRetryClient(&jctest.MockClient{
+				AddrInfo: func() (*jobcoin.AddressInfo, error) {
+					checks++
+					return &jobcoin.AddressInfo{Transactions: history}, nil
+				},
+				Post: func() error {
+					posts++
+					if test.landed || test.err == nil || posts > 1 {
+						history = append(history, sent)
+					}
+					if posts > 1 {
+						return nil
+					}
+					return test.err
+				},
+			}, testRetryConfig)
+
+			ctx := context.Background()
+			if !test.noPrior {
+				ctx = jobcoin.WithPrior(ctx, 1)
+			}
+			err := cli.PostTransaction(ctx, "a", "b", climatic.MustParseAmount("1.50"))
+			require.Equal(test.want, err)
+			require.Equal(test.posts, posts)
+			require.Equal(test.checks, checks, "unexpected history checks")
+		})
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	calls := 0
+	cli := jobcoin.NewRetryClient(&jctest.MockClient{
+		Transactions: func() ([]*jobcoin.Transaction, error) {
+			calls++
+			return nil, errServer
+		},
+	}, jobcoin.RetryConfig{GetTransactions: jobcoin.RetryPolicy{
+		MaxAttempts:    10,
+		InitialBackoff: time.Hour,
+	}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := cli.GetTransactions(ctx)
+	require.Equal(errServer, err)
+	require.Equal(1, calls)
+}
@@ -8,7 +8,7 @@ cd "${SCRIPT_HOME}"/..
 
 ARCHS="amd64 386"
 OSS="darwin linux windows"
-BINS="climasrv climactl"
+BINS="climasrv climactl jobcoind"
 
 
 for bin in $BINS; do
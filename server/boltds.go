@@ -0,0 +1,605 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/r-medina/climatic"
+	"github.com/r-medina/climatic/jobcoin"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// addrsBucket maps deposit addresses to the JSON encoded list of their
+	// user addresses.
+	addrsBucket = []byte("addresses")
+	// pendingBucket maps IDs to JSON encoded PendingMixes.
+	pendingBucket = []byte("pending")
+	// mixesBucket maps deposit addresses to JSON encoded MixRecords.
+	mixesBucket = []byte("mixes")
+	// transfersBucket maps transfer IDs to JSON encoded Transfers. It is
+	// the transfer journal, and only holds the transfers that are pending.
+	transfersBucket = []byte("transfers")
+	// sentBucket holds a bucket for every address with transfers from it
+	// that went through, mapping their IDs to the JSON encoded Transfers.
+	// Transfers move there from the journal once they are finished, and
+	// are kept for reconciliation until it confirms them.
+	sentBucket = []byte("sent")
+	// confirmedBucket maps addresses to how many of the sends of their
+	// ledger history are accounted for by confirmed transfers, as JSON.
+	confirmedBucket = []byte("confirmed")
+	// termsBucket maps deposit addresses registered with terms to the JSON
+	// encoded Terms.
+	termsBucket = []byte("terms")
+	// lifecyclesBucket maps deposit addresses to their JSON encoded
+	// Lifecycles. Addresses registered before it existed have none.
+	lifecyclesBucket = []byte("lifecycles")
+	// volumesBucket maps deposit addresses to the JSON encoded amount that
+	// was deposited to them.
+	volumesBucket = []byte("volumes")
+	// feesBucket is the fee ledger. It maps the time a fee was collected, in
+	// big endian nanoseconds, followed by the transfer ID, to the JSON
+	// encoded FeeEntry, so that entries are sorted by time.
+	feesBucket = []byte("fees")
+	// routesBucket maps route IDs to JSON encoded Routes.
+	routesBucket = []byte("routes")
+	// metaBucket holds the poll cursor under cursorKey.
+	metaBucket = []byte("meta")
+	cursorKey  = []byte("cursor")
+)
+
+// BoltDS implements Datastore in a bolt database on disk, so that registered
+// addresses and the progress of the mixer survive restarts.
+type BoltDS struct {
+	db *bolt.DB
+}
+
+var _ Datastore = (*BoltDS)(nil)
+
+// OpenBoltDS opens the bolt database at path, creating it if it doesn't exist.
+// Only one process can have the database open at a time. It must be closed with
+// Close.
+func OpenBoltDS(path string) (*BoltDS, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening datastore %s", path)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{
+			addrsBucket, termsBucket, lifecyclesBucket, volumesBucket, pendingBucket, mixesBucket, transfersBucket, sentBucket,
+			confirmedBucket, routesBucket, feesBucket, metaBucket,
+		} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return compactJournal(tx)
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, errors.Wrapf(err, "initializing datastore %s", path)
+	}
+
+	return &BoltDS{db: db}, nil
+}
+
+// compactJournal moves the finished transfers that databases from before the
+// sent bucket kept in the journal out of it.
+func compactJournal(tx *bolt.Tx) error {
+	finished := []*Transfer{}
+	err := tx.Bucket(transfersBucket).ForEach(func(_, val []byte) error {
+		t := &Transfer{}
+		if err := json.Unmarshal(val, t); err != nil {
+			return err
+		}
+		if t.Status != TransferPending {
+			finished = append(finished, t)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, t := range finished {
+		if err := finishTransfer(tx, t); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// finishTransfer takes the finished transfer t out of the journal, and keeps it
+// with the transfers from its source address if it went through.
+func finishTransfer(tx *bolt.Tx, t *Transfer) error {
+	if err := tx.Bucket(transfersBucket).Delete([]byte(t.ID)); err != nil {
+		return err
+	}
+	if t.Status != TransferDone {
+		return nil
+	}
+
+	sent, err := tx.Bucket(sentBucket).CreateBucketIfNotExists([]byte(t.FromAddress))
+	if err != nil {
+		return err
+	}
+	return putJSON(sent, []byte(t.ID), t)
+}
+
+// Close closes the database.
+func (ds *BoltDS) Close() error {
+	return ds.db.Close()
+}
+
+// RegisterTerms registers a deposit address with the associated user addresses
+// and the terms they are paid on, as of since. It returns once the registration
+// is on disk.
+func (ds *BoltDS) RegisterTerms(depositAddr string, usrAddrs []string, terms *Terms, since time.Time) error {
+	return ds.db.Update(func(tx *bolt.Tx) error {
+		if err := putJSON(tx.Bucket(addrsBucket), []byte(depositAddr), usrAddrs); err != nil {
+			return err
+		}
+		lc := &Lifecycle{State: AddressCreated, Since: since}
+		if err := putJSON(tx.Bucket(lifecyclesBucket), []byte(depositAddr), lc); err != nil {
+			return err
+		}
+		if terms == nil {
+			return tx.Bucket(termsBucket).Delete([]byte(depositAddr))
+		}
+		return putJSON(tx.Bucket(termsBucket), []byte(depositAddr), terms)
+	})
+}
+
+// DepositAddresses lists all the deposit addresses.
+func (ds *BoltDS) DepositAddresses() ([]string, error) {
+	depositAddrs := []string{}
+
+	err := ds.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(addrsBucket).ForEach(func(k, _ []byte) error {
+			depositAddrs = append(depositAddrs, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return depositAddrs, nil
+}
+
+// UserAddresses lists all the user addresses for a given deposit address.
+func (ds *BoltDS) UserAddresses(depositAddr string) ([]string, error) {
+	var usrAddrs []string
+
+	err := ds.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(addrsBucket).Get([]byte(depositAddr))
+		if val == nil {
+			return nil
+		}
+		return json.Unmarshal(val, &usrAddrs)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return usrAddrs, nil
+}
+
+// Terms returns the terms of a deposit address, or nil if it was registered
+// without any.
+func (ds *BoltDS) Terms(depositAddr string) (*Terms, error) {
+	var terms *Terms
+
+	err := ds.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(termsBucket).Get([]byte(depositAddr))
+		if val == nil {
+			return nil
+		}
+		terms = &Terms{}
+		return json.Unmarshal(val, terms)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return terms, nil
+}
+
+// Lifecycle returns the lifecycle of a deposit address, or nil if it was never
+// registered. Forgotten addresses keep theirs.
+func (ds *BoltDS) Lifecycle(depositAddr string) (*Lifecycle, error) {
+	var lc *Lifecycle
+
+	err := ds.db.View(func(tx *bolt.Tx) error {
+		if val := tx.Bucket(lifecyclesBucket).Get([]byte(depositAddr)); val != nil {
+			lc = &Lifecycle{}
+			return json.Unmarshal(val, lc)
+		}
+		if tx.Bucket(addrsBucket).Get([]byte(depositAddr)) != nil {
+			lc = &Lifecycle{State: AddressCreated}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return lc, nil
+}
+
+// Lifecycles maps every deposit address, forgotten ones included, to its
+// lifecycle. Addresses registered before lifecycles were kept are created since
+// the zero time.
+func (ds *BoltDS) Lifecycles() (map[string]*Lifecycle, error) {
+	lcs := map[string]*Lifecycle{}
+
+	err := ds.db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket(addrsBucket).ForEach(func(k, _ []byte) error {
+			lcs[string(k)] = &Lifecycle{State: AddressCreated}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(lifecyclesBucket).ForEach(func(k, val []byte) error {
+			lc := &Lifecycle{}
+			lcs[string(k)] = lc
+			return json.Unmarshal(val, lc)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return lcs, nil
+}
+
+// SetLifecycle saves the lifecycle of a deposit address.
+func (ds *BoltDS) SetLifecycle(depositAddr string, lc *Lifecycle) error {
+	return ds.db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(lifecyclesBucket), []byte(depositAddr), lc)
+	})
+}
+
+// Forget removes a deposit address along with its user addresses, terms,
+// volume and the transfers from it that went through. Its lifecycle is kept.
+func (ds *BoltDS) Forget(depositAddr string) error {
+	return ds.db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{addrsBucket, termsBucket, volumesBucket, confirmedBucket} {
+			if err := tx.Bucket(bucket).Delete([]byte(depositAddr)); err != nil {
+				return err
+			}
+		}
+		err := tx.Bucket(sentBucket).DeleteBucket([]byte(depositAddr))
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+// Volume returns how much was deposited to a deposit address, not counting
+// refunded deposits.
+func (ds *BoltDS) Volume(depositAddr string) (climatic.Amount, error) {
+	var volume climatic.Amount
+
+	err := ds.db.View(func(tx *bolt.Tx) error {
+		return getJSON(tx.Bucket(volumesBucket), []byte(depositAddr), &volume)
+	})
+	if err != nil {
+		return climatic.Amount{}, err
+	}
+
+	return volume, nil
+}
+
+// SavePoll saves the poll cursor together with the deposits found up to it,
+// and adds the deposits to the volumes of their addresses.
+func (ds *BoltDS) SavePoll(cursor jobcoin.Cursor, pending []*PendingMix) error {
+	return ds.db.Update(func(tx *bolt.Tx) error {
+		if err := putJSON(tx.Bucket(metaBucket), cursorKey, cursor); err != nil {
+			return err
+		}
+		volumes := tx.Bucket(volumesBucket)
+		for _, p := range pending {
+			if err := putJSON(tx.Bucket(pendingBucket), []byte(p.ID), p); err != nil {
+				return err
+			}
+			if p.Refund || p.Deposit.Amount.Sign() <= 0 {
+				continue
+			}
+			key := []byte(p.Deposit.ToAddress)
+			var volume climatic.Amount
+			if err := getJSON(volumes, key, &volume); err != nil {
+				return err
+			}
+			if err := putJSON(volumes, key, volume.Add(p.Deposit.Amount)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PollState returns the poll cursor and the pending deposits to a deposit
+// address, read in the same transaction.
+func (ds *BoltDS) PollState(depositAddr string) (jobcoin.Cursor, []*PendingMix, error) {
+	var cursor jobcoin.Cursor
+	pending := []*PendingMix{}
+
+	err := ds.db.View(func(tx *bolt.Tx) error {
+		if err := getJSON(tx.Bucket(metaBucket), cursorKey, &cursor); err != nil {
+			return err
+		}
+		return tx.Bucket(pendingBucket).ForEach(func(_, val []byte) error {
+			p := &PendingMix{}
+			if err := json.Unmarshal(val, p); err != nil {
+				return err
+			}
+			if p.Deposit.ToAddress == depositAddr {
+				pending = append(pending, p)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return jobcoin.Cursor{}, nil, err
+	}
+	sortPending(pending)
+
+	return cursor, pending, nil
+}
+
+// SaveMix saves the mix of a deposit address, or deletes it if m is nil, and
+// removes the pending deposits with the given IDs.
+func (ds *BoltDS) SaveMix(depositAddr string, m *MixRecord, pendingIDs ...string) error {
+	return ds.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if m == nil {
+			err = tx.Bucket(mixesBucket).Delete([]byte(depositAddr))
+		} else {
+			err = putJSON(tx.Bucket(mixesBucket), []byte(depositAddr), m)
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, id := range pendingIDs {
+			if err := tx.Bucket(pendingBucket).Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// BeginTransfer journals a transfer before it is posted.
+func (ds *BoltDS) BeginTransfer(t *Transfer) error {
+	return ds.db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(transfersBucket), []byte(t.ID), t)
+	})
+}
+
+// FinishTransfer saves the outcome of a journaled transfer together with the
+// mix of the deposit address it was made for, and enters fee in the fee ledger
+// if it isn't nil. The transfer leaves the journal, and is kept with the
+// transfers from its source address if it went through.
+func (ds *BoltDS) FinishTransfer(t *Transfer, m *MixRecord, fee *FeeEntry) error {
+	return ds.db.Update(func(tx *bolt.Tx) error {
+		if err := finishTransfer(tx, t); err != nil {
+			return err
+		}
+		if fee != nil {
+			key := append(timeKey(fee.Time), fee.TransferID...)
+			if err := putJSON(tx.Bucket(feesBucket), key, fee); err != nil {
+				return err
+			}
+		}
+		return putJSON(tx.Bucket(mixesBucket), []byte(t.DepositAddress), m)
+	})
+}
+
+// Transfers returns the pending transfers from an address and the ones from it
+// that went through and aren't confirmed yet, oldest first.
+func (ds *BoltDS) Transfers(fromAddr string) ([]*Transfer, error) {
+	transfers := []*Transfer{}
+
+	err := ds.db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket(transfersBucket).ForEach(func(_, val []byte) error {
+			t := &Transfer{}
+			if err := json.Unmarshal(val, t); err != nil {
+				return err
+			}
+			if t.FromAddress == fromAddr {
+				transfers = append(transfers, t)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		sent := tx.Bucket(sentBucket).Bucket([]byte(fromAddr))
+		if sent == nil {
+			return nil
+		}
+		return sent.ForEach(func(_, val []byte) error {
+			t := &Transfer{}
+			if err := json.Unmarshal(val, t); err != nil {
+				return err
+			}
+			transfers = append(transfers, t)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortTransfers(transfers)
+
+	return transfers, nil
+}
+
+// ConfirmTransfers drops the transfers with the given IDs that went through
+// from an address, and records how many sends of its ledger history they and
+// the ones confirmed before account for.
+func (ds *BoltDS) ConfirmTransfers(fromAddr string, sends int, ids []string) error {
+	return ds.db.Update(func(tx *bolt.Tx) error {
+		if sent := tx.Bucket(sentBucket).Bucket([]byte(fromAddr)); sent != nil {
+			for _, id := range ids {
+				if err := sent.Delete([]byte(id)); err != nil {
+					return err
+				}
+			}
+		}
+		return putJSON(tx.Bucket(confirmedBucket), []byte(fromAddr), sends)
+	})
+}
+
+// ConfirmedSends returns how many of the first sends of the ledger history of
+// an address are accounted for by confirmed transfers.
+func (ds *BoltDS) ConfirmedSends(fromAddr string) (int, error) {
+	var sends int
+
+	err := ds.db.View(func(tx *bolt.Tx) error {
+		return getJSON(tx.Bucket(confirmedBucket), []byte(fromAddr), &sends)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return sends, nil
+}
+
+// FeeEntries returns the entries of the fee ledger from from up to to, oldest
+// first.
+func (ds *BoltDS) FeeEntries(from, to time.Time) ([]*FeeEntry, error) {
+	entries := []*FeeEntry{}
+
+	err := ds.db.View(func(tx *bolt.Tx) error {
+		end := timeKey(to)
+		c := tx.Bucket(feesBucket).Cursor()
+		for k, val := c.Seek(timeKey(from)); k != nil && bytes.Compare(k, end) < 0; k, val = c.Next() {
+			e := &FeeEntry{}
+			if err := json.Unmarshal(val, e); err != nil {
+				return err
+			}
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// timeKey encodes t so that keys sort by time.
+func timeKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return key
+}
+
+// SaveRoute saves a route, or deletes it if r is nil.
+func (ds *BoltDS) SaveRoute(id string, r *Route) error {
+	return ds.db.Update(func(tx *bolt.Tx) error {
+		if r == nil {
+			return tx.Bucket(routesBucket).Delete([]byte(id))
+		}
+		return putJSON(tx.Bucket(routesBucket), []byte(id), r)
+	})
+}
+
+// State returns the saved state of the mixer.
+func (ds *BoltDS) State() (*MixerState, error) {
+	state := &MixerState{
+		Pending:   []*PendingMix{},
+		Mixes:     map[string]*MixRecord{},
+		Transfers: []*Transfer{},
+		Routes:    []*Route{},
+	}
+
+	err := ds.db.View(func(tx *bolt.Tx) error {
+		if val := tx.Bucket(metaBucket).Get(cursorKey); val != nil {
+			if err := json.Unmarshal(val, &state.Cursor); err != nil {
+				return err
+			}
+		}
+
+		err := tx.Bucket(pendingBucket).ForEach(func(_, val []byte) error {
+			p := &PendingMix{}
+			if err := json.Unmarshal(val, p); err != nil {
+				return err
+			}
+			state.Pending = append(state.Pending, p)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(mixesBucket).ForEach(func(k, val []byte) error {
+			m := &MixRecord{}
+			if err := json.Unmarshal(val, m); err != nil {
+				return err
+			}
+			state.Mixes[string(k)] = m
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(transfersBucket).ForEach(func(_, val []byte) error {
+			t := &Transfer{}
+			if err := json.Unmarshal(val, t); err != nil {
+				return err
+			}
+			state.Transfers = append(state.Transfers, t)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(routesBucket).ForEach(func(_, val []byte) error {
+			r := &Route{}
+			if err := json.Unmarshal(val, r); err != nil {
+				return err
+			}
+			state.Routes = append(state.Routes, r)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "loading mixer state")
+	}
+	sortPending(state.Pending)
+
+	return state, nil
+}
+
+// getJSON decodes the value of key into v, leaving v alone if there is none.
+func getJSON(bucket *bolt.Bucket, key []byte, v interface{}) error {
+	val := bucket.Get(key)
+	if val == nil {
+		return nil
+	}
+	return json.Unmarshal(val, v)
+}
+
+func putJSON(bucket *bolt.Bucket, key []byte, v interface{}) error {
+	val, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, val)
+}
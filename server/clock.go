@@ -0,0 +1,22 @@
+package server
+
+import "time"
+
+// Clock tells the mixer the time and waits for it. The mixer uses the system
+// clock unless it is given another with WithClock, such as a fake clock that
+// tests move forward by hand.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// After sends the time on the returned channel once d has passed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the Clock of the system.
+type systemClock struct{}
+
+var _ Clock = systemClock{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
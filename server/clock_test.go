@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/r-medina/climatic"
+	"github.com/r-medina/climatic/jobcoin/jctest"
+	"github.com/r-medina/climatic/server/servertest"
+
+	"github.com/stretchr/testify/require"
+)
+
+var _ Clock = (*servertest.FakeClock)(nil)
+
+func TestReplay(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	// draws is how many times the other parts of the mixer draw first
+	run := func(seed int64, draws int) ([]PlannedPayout, []string, []string) {
+		mxr, err := NewMixer(
+			WithRand(rand.NewSource(seed)),
+			WithClock(servertest.NewFakeClock(start)),
+			WithMixConfig(MixConfig{
+				MeanDelay:    time.Minute,
+				StdDevDelay:  30 * time.Second,
+				MaxDelay:     time.Hour,
+				MeanAmount:   climatic.MustParseAmount("10"),
+				StdDevAmount: climatic.MustParseAmount("8"),
+				MaxAmount:    climatic.MustParseAmount("100"),
+			}),
+			WithLogger(log.New(ioutil.Discard, "", 0)),
+		)
+		require.NoError(err)
+
+		for i := 0; i < draws; i++ {
+			mxr.pollRnd.Int63()
+			mxr.routeRnd.Int63()
+			mxr.stream("mix other").Int63()
+		}
+		m := &mix{
+			usrAddrs:  []string{"u1", "u2", "u3"},
+			remaining: climatic.MustParseAmount("100"),
+			rnd:       mxr.stream("mix d"),
+		}
+		require.NoError(mxr.extendPlan(m, time.Time{}))
+
+		for _, addr := range []string{"d1", "d2", "d3", "d4", "d5"} {
+			mxr.outstanding[addr] = &mix{}
+		}
+		order, _, _ := mxr.duePlans()
+
+		res, err := mxr.Register(context.Background(), &climatic.RegisterRequest{Addresses: []string{"u"}})
+		require.NoError(err)
+
+		return m.plan, order, []string{mxr.addr, res.Address}
+	}
+
+	plan, order, addrs := run(1, 0)
+	require.True(len(plan) > 1)
+	require.True(plan[0].At.Equal(start), "first payout not due right away")
+	// the other loops and mixes running first make no difference
+	replayedPlan, replayedOrder, replayedAddrs := run(1, 10)
+	require.Equal(plan, replayedPlan, "plan not replayed")
+	require.Equal(order, replayedOrder, "order not replayed")
+	// the addresses can't be predicted from the seed
+	require.NotEqual(addrs[0], replayedAddrs[0], "fee address replayed")
+	require.NotEqual(addrs[1], replayedAddrs[1], "deposit address replayed")
+
+	otherPlan, _, _ := run(2, 0)
+	require.NotEqual(plan, otherPlan, "plan the same from another seed")
+}
+
+func TestFakeClockMixer(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// far from the system clock, so anything that reads that instead
+	// shows
+	start := time.Date(2001, time.January, 1, 0, 0, 0, 0, time.UTC)
+	clock := servertest.NewFakeClock(start)
+	ledger := jctest.NewLedger(jctest.WithClock(clock.Now))
+	mxr, err := NewMixer(
+		WithJobcoinClient(ledger),
+		WithClock(clock),
+		WithRand(rand.NewSource(1)),
+		WithAddress("fees"),
+		WithFee(climatic.MustParseAmount("1")),
+		WithPollConfig(PollConfig{MeanDelay: time.Minute, MinDelay: time.Minute, MaxDelay: time.Minute}),
+		WithMixConfig(MixConfig{
+			InitialDelay: time.Hour,
+			MeanDelay:    time.Minute,
+			MinDelay:     time.Minute,
+			MaxDelay:     time.Minute,
+			MeanAmount:   climatic.MustParseAmount("10"),
+			MinAmount:    climatic.MustParseAmount("10"),
+			MaxAmount:    climatic.MustParseAmount("10"),
+		}),
+		WithReconcileConfig(ReconcileConfig{}),
+		WithLogger(log.New(ioutil.Discard, "", 0)),
+	)
+	require.NoError(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = mxr.Start(ctx) }()
+
+	res, err := mxr.Register(ctx, &climatic.RegisterRequest{Addresses: []string{"u"}})
+	require.NoError(err)
+	lc, err := mxr.ds.Lifecycle(res.Address)
+	require.NoError(err)
+	require.True(lc.Since.Equal(start), "registered at %v", lc.Since)
+	require.NoError(ledger.Create(ctx, "alice"))
+	require.NoError(ledger.PostTransaction(ctx, "alice", res.Address, climatic.MustParseAmount("21")))
+
+	// the initial delay and the payouts take hours on the clock of the
+	// mixer, which is moved forward a minute at a time
+	deadline := time.Now().Add(5 * time.Second)
+	for !ledger.Balance(res.Address).IsZero() && time.Now().Before(deadline) {
+		clock.Advance(time.Minute)
+		time.Sleep(time.Millisecond)
+	}
+
+	require.True(ledger.Balance(res.Address).IsZero(), "deposit not fully mixed")
+	require.Equal(climatic.MustParseAmount("20"), ledger.Balance("u"))
+	require.Equal(climatic.MustParseAmount("1"), ledger.Balance("fees"))
+
+	addrInfo, err := ledger.GetAddressInfo(ctx, "u")
+	require.NoError(err)
+	require.Len(addrInfo.Transactions, 2)
+	for _, tx := range addrInfo.Transactions {
+		require.False(tx.Timestamp.Before(start.Add(time.Hour)), "paid out before the initial delay")
+	}
+}
@@ -1,17 +1,30 @@
 package server
 
 import (
+	"io"
 	"math"
 	"math/rand"
+	"sort"
 	"time"
+
+	"github.com/r-medina/climatic"
 )
 
+// DefaultTimeout is the default limit on how long a single call to the Jobcoin
+// API may take.
+const DefaultTimeout = 10 * time.Second
+
 // PollConfig configures the polling loop in the Mixer.
 type PollConfig struct {
 	MeanDelay   time.Duration
 	StdDevDelay time.Duration
 	MinDelay    time.Duration
 	MaxDelay    time.Duration
+
+	// WatchThreshold is the largest number of deposit addresses for which
+	// the mixer fetches the history of each deposit address instead of the
+	// new transactions of the whole ledger.
+	WatchThreshold int
 }
 
 func (pollCfg *PollConfig) makeValid() {
@@ -26,12 +39,16 @@ func (pollCfg *PollConfig) makeValid() {
 	if pollCfg.MaxDelay < pollCfg.MeanDelay {
 		pollCfg.MaxDelay = pollCfg.MeanDelay
 	}
+
+	if pollCfg.WatchThreshold < 0 {
+		pollCfg.WatchThreshold = 0
+	}
 }
 
 // delay determines the polling interval by sampling from a normal distribution
 // with the configured mean interval and standard deviation.
-func (pollCfg PollConfig) delay() time.Duration {
-	return delay(pollCfg.MeanDelay, pollCfg.StdDevDelay, pollCfg.MinDelay, pollCfg.MaxDelay)
+func (pollCfg PollConfig) delay(rnd *rand.Rand) time.Duration {
+	return delay(rnd, pollCfg.MeanDelay, pollCfg.StdDevDelay, pollCfg.MinDelay, pollCfg.MaxDelay)
 }
 
 // DefaultPollConfig is the default polling configuration.
@@ -40,6 +57,8 @@ var DefaultPollConfig = PollConfig{
 	StdDevDelay: 3 * time.Second,
 	MinDelay:    2 * time.Second,
 	MaxDelay:    20 * time.Second,
+
+	WatchThreshold: 10,
 }
 
 // MixConfig configures the mixer.
@@ -50,10 +69,24 @@ type MixConfig struct {
 	MaxDelay     time.Duration
 	InitialDelay time.Duration
 
-	MeanAmount   float64
-	StdDevAmount float64
-	MinAmount    float64
-	MaxAmount    float64
+	// Workers is how many deposit addresses are worked on at once.
+	Workers int
+	// DeadlineMargin is how long before the end of its window a deposit
+	// registered with one is planned to be paid out, leaving time to
+	// retry failed payouts. Windows must be longer than the margin.
+	DeadlineMargin time.Duration
+
+	MeanAmount   climatic.Amount
+	StdDevAmount climatic.Amount
+	MinAmount    climatic.Amount
+	MaxAmount    climatic.Amount
+
+	// Denominations, if there are any, are the standard amounts that
+	// payouts are made of, so that they can't be told apart by their
+	// amounts. Each payout is the largest denomination that fits in its
+	// sampled amount, and only what is left once no denomination fits is
+	// paid out as it is.
+	Denominations []climatic.Amount
 }
 
 func (mixCfg *MixConfig) makeValid() {
@@ -69,30 +102,86 @@ func (mixCfg *MixConfig) makeValid() {
 		mixCfg.MaxDelay = mixCfg.MeanDelay
 	}
 
-	if mixCfg.MeanAmount-mixCfg.StdDevAmount < 0 {
-		mixCfg.StdDevAmount = mixCfg.MeanAmount / 2
+	if mixCfg.Workers < 1 {
+		mixCfg.Workers = 1
+	}
+
+	if mixCfg.DeadlineMargin < 0 {
+		mixCfg.DeadlineMargin = 0
+	}
+
+	if mixCfg.MeanAmount.Cmp(mixCfg.StdDevAmount) < 0 {
+		mixCfg.StdDevAmount = mixCfg.MeanAmount.MulRatio(1, 2, climatic.RoundDown)
 	}
 
-	if mixCfg.MinAmount < 0 {
-		mixCfg.MinAmount = 1.
+	if mixCfg.MinAmount.Sign() < 0 {
+		mixCfg.MinAmount = climatic.MustParseAmount("1")
 	}
 
-	if mixCfg.MaxAmount < mixCfg.MeanAmount {
+	if mixCfg.MaxAmount.Cmp(mixCfg.MeanAmount) < 0 {
 		mixCfg.MaxAmount = mixCfg.MeanAmount
 	}
+
+	// the denominations are sorted, without duplicates or amounts that
+	// aren't positive
+	denoms := make([]climatic.Amount, 0, len(mixCfg.Denominations))
+	for _, d := range mixCfg.Denominations {
+		if d.Sign() > 0 {
+			denoms = append(denoms, d)
+		}
+	}
+	sort.Slice(denoms, func(i, j int) bool { return denoms[i].Cmp(denoms[j]) < 0 })
+	mixCfg.Denominations = denoms[:0]
+	for i, d := range denoms {
+		if i == 0 || d != denoms[i-1] {
+			mixCfg.Denominations = append(mixCfg.Denominations, d)
+		}
+	}
+	if len(mixCfg.Denominations) == 0 {
+		mixCfg.Denominations = nil
+	}
 }
 
-func (mixCfg MixConfig) delay() time.Duration {
-	return delay(mixCfg.MeanDelay, mixCfg.StdDevDelay, mixCfg.MinDelay, mixCfg.MaxDelay)
+func (mixCfg MixConfig) delay(rnd *rand.Rand) time.Duration {
+	return delay(rnd, mixCfg.MeanDelay, mixCfg.StdDevDelay, mixCfg.MinDelay, mixCfg.MaxDelay)
 }
 
-func (mixCfg MixConfig) amount() float64 {
-	return norm(
-		mixCfg.MeanAmount,
-		mixCfg.StdDevAmount,
-		mixCfg.MinAmount,
-		mixCfg.MaxAmount,
-	)
+// amount samples the amount of a single payout from a normal distribution. It
+// is rounded down to the ledger's precision and always within the configured
+// bounds.
+func (mixCfg MixConfig) amount(rnd *rand.Rand) climatic.Amount {
+	n := rnd.NormFloat64()*mixCfg.StdDevAmount.Float64() + mixCfg.MeanAmount.Float64()
+	amt, err := climatic.AmountFromFloat(n, climatic.RoundDown)
+	if err != nil {
+		amt = mixCfg.MeanAmount
+	}
+
+	amt = climatic.MaxAmount(mixCfg.MinAmount, amt)
+	return climatic.MinAmount(mixCfg.MaxAmount, amt)
+}
+
+// part returns how much of left the next payout sends. Without denominations,
+// it is a sampled amount. With them, it is the largest denomination that fits
+// in both the sampled amount and left, or the smallest one that fits in left
+// if the sample is smaller than that. Once no denomination fits, it is all of
+// left.
+func (mixCfg MixConfig) part(rnd *rand.Rand, left climatic.Amount) climatic.Amount {
+	sample := mixCfg.amount(rnd)
+	if mixCfg.Denominations == nil {
+		return climatic.MinAmount(sample, left)
+	}
+
+	part := left
+	for i, d := range mixCfg.Denominations {
+		if d.Cmp(left) > 0 {
+			break
+		}
+		if i == 0 || d.Cmp(sample) <= 0 {
+			part = d
+		}
+	}
+
+	return part
 }
 
 // DefaultMixConfig is the default mixing configuration.
@@ -103,18 +192,199 @@ var DefaultMixConfig = MixConfig{
 	MaxDelay:     3 * time.Second,
 	InitialDelay: 1 * time.Minute,
 
-	MeanAmount:   10.,
-	StdDevAmount: 8.,
-	MinAmount:    5.,
-	MaxAmount:    100.,
+	Workers:        4,
+	DeadlineMargin: 10 * time.Minute,
+
+	MeanAmount:   climatic.MustParseAmount("10"),
+	StdDevAmount: climatic.MustParseAmount("8"),
+	MinAmount:    climatic.MustParseAmount("5"),
+	MaxAmount:    climatic.MustParseAmount("100"),
+}
+
+// RouteConfig configures multi-hop routing of payouts.
+type RouteConfig struct {
+	// Hops is how many intermediate addresses every payout passes through
+	// on its way to the user address. Zero turns routing off.
+	Hops int
+
+	// The delays are how long the Jobcoins sit in each hop address.
+	MeanDelay   time.Duration
+	StdDevDelay time.Duration
+	MinDelay    time.Duration
+	MaxDelay    time.Duration
+}
+
+func (routeCfg *RouteConfig) makeValid() {
+	if routeCfg.Hops < 0 {
+		routeCfg.Hops = 0
+	}
+
+	if routeCfg.MeanDelay-routeCfg.StdDevDelay < 0 {
+		routeCfg.StdDevDelay = routeCfg.MeanDelay / 2
+	}
+
+	if routeCfg.MinDelay < 0 {
+		routeCfg.MinDelay = 0
+	}
+
+	if routeCfg.MaxDelay < routeCfg.MeanDelay {
+		routeCfg.MaxDelay = routeCfg.MeanDelay
+	}
+}
+
+func (routeCfg RouteConfig) delay(rnd *rand.Rand) time.Duration {
+	return delay(rnd, routeCfg.MeanDelay, routeCfg.StdDevDelay, routeCfg.MinDelay, routeCfg.MaxDelay)
 }
 
-func delay(delay, stdDev, min, max time.Duration) time.Duration {
-	return time.Duration(norm(float64(delay), float64(stdDev), float64(min), float64(max)))
+// DefaultRouteConfig is the default routing configuration, which has routing
+// turned off.
+var DefaultRouteConfig = RouteConfig{
+	Hops: 0,
+
+	MeanDelay:   30 * time.Second,
+	StdDevDelay: 10 * time.Second,
+	MinDelay:    5 * time.Second,
+	MaxDelay:    2 * time.Minute,
+}
+
+// ExpiryConfig configures when deposit addresses expire.
+type ExpiryConfig struct {
+	// After is how long a deposit address can go without a deposit, from
+	// when it is registered or its last mix is completed, before it
+	// expires. Zero keeps addresses forever.
+	After time.Duration
+	// Late is what happens to deposits to expired addresses.
+	Late LatePolicy
+	// Forget is how long expired addresses are kept before they are
+	// forgotten: their user addresses and everything else registered for
+	// them is removed from the datastore. Deposits to addresses that were
+	// forgotten are refunded, whatever Late says, since there is nowhere
+	// else to send them, and ones without a sender are left where they
+	// are. Zero keeps expired addresses forever.
+	Forget time.Duration
+}
+
+// LatePolicy says what happens to deposits to expired addresses.
+type LatePolicy string
+
+// The policies for late deposits.
+const (
+	// LateHonour mixes late deposits like any other.
+	LateHonour LatePolicy = "honour"
+	// LateRefund sends late deposits back to where they came from, without
+	// taking a fee. Deposits without a sender are honoured.
+	LateRefund LatePolicy = "refund"
+)
+
+func (expiryCfg *ExpiryConfig) makeValid() {
+	if expiryCfg.After < 0 {
+		expiryCfg.After = 0
+	}
+
+	if expiryCfg.Late != LateRefund {
+		expiryCfg.Late = LateHonour
+	}
+
+	if expiryCfg.Forget < 0 {
+		expiryCfg.Forget = 0
+	}
+}
+
+// DefaultExpiryConfig is the default expiry configuration. Addresses never
+// expire, so that upgrading the mixer doesn't start expiring the addresses it
+// already has.
+var DefaultExpiryConfig = ExpiryConfig{
+	Late: LateHonour,
+}
+
+// DepositConfig configures which deposits are mixed. Deposits that aren't are
+// refunded to their sender, or mixed anyway if they have none.
+type DepositConfig struct {
+	// MinAmount is the smallest deposit that is mixed, and MaxAmount the
+	// largest, unless it is zero.
+	MinAmount climatic.Amount
+	MaxAmount climatic.Amount
+	// RefundFee is taken from deposits that are refunded for being outside
+	// the limits or smaller than their fee. Deposits that it would take
+	// whole are refunded in full.
+	RefundFee climatic.Amount
+}
+
+func (depositCfg *DepositConfig) makeValid() {
+	if depositCfg.MinAmount.Sign() < 0 {
+		depositCfg.MinAmount = climatic.Amount{}
+	}
+
+	if depositCfg.MaxAmount.Sign() < 0 {
+		depositCfg.MaxAmount = climatic.Amount{}
+	}
+
+	if depositCfg.MaxAmount.Sign() > 0 && depositCfg.MaxAmount.Cmp(depositCfg.MinAmount) < 0 {
+		depositCfg.MaxAmount = depositCfg.MinAmount
+	}
+
+	if depositCfg.RefundFee.Sign() < 0 {
+		depositCfg.RefundFee = climatic.Amount{}
+	}
+}
+
+// refundReason returns why a deposit of amt with the given fee is refunded, or
+// an empty reason if it is mixed.
+func (depositCfg DepositConfig) refundReason(amt, fee climatic.Amount) RefundReason {
+	switch {
+	case amt.Cmp(depositCfg.MinAmount) < 0:
+		return RefundBelowMinimum
+	case depositCfg.MaxAmount.Sign() > 0 && amt.Cmp(depositCfg.MaxAmount) > 0:
+		return RefundAboveMaximum
+	case fee.Sign() > 0 && fee.Cmp(amt) >= 0:
+		return RefundUnmixable
+	}
+
+	return ""
+}
+
+// refundFee returns the fee of refunding a deposit of amt.
+func (depositCfg DepositConfig) refundFee(amt climatic.Amount) climatic.Amount {
+	if depositCfg.RefundFee.Cmp(amt) >= 0 {
+		return climatic.Amount{}
+	}
+
+	return depositCfg.RefundFee
+}
+
+// DefaultDepositConfig is the default deposit configuration, which mixes
+// deposits of any size.
+var DefaultDepositConfig = DepositConfig{}
+
+// ReconcileConfig configures how the mixer's accounting is checked against the
+// ledger.
+type ReconcileConfig struct {
+	// Interval is how long to wait between reconciliations. Zero turns them
+	// off, although they can still be run through the Reconcile call.
+	Interval time.Duration
+	// Report, if set, receives every reconciliation report as a line of
+	// JSON.
+	Report io.Writer
+}
+
+func (reconcileCfg *ReconcileConfig) makeValid() {
+	if reconcileCfg.Interval < 0 {
+		reconcileCfg.Interval = 0
+	}
+}
+
+// DefaultReconcileConfig is the default reconciliation configuration, which
+// only reconciles through the Reconcile call. Every run asks the ledger about
+// every deposit address there has been, so running them on a timer is left to
+// the operator.
+var DefaultReconcileConfig = ReconcileConfig{}
+
+func delay(rnd *rand.Rand, delay, stdDev, min, max time.Duration) time.Duration {
+	return time.Duration(norm(rnd, float64(delay), float64(stdDev), float64(min), float64(max)))
 }
 
-func norm(mean, stdDev, min, max float64) float64 {
-	n := rand.NormFloat64()*stdDev + mean
+func norm(rnd *rand.Rand, mean, stdDev, min, max float64) float64 {
+	n := rnd.NormFloat64()*stdDev + mean
 	n = math.Max(min, n)
 	n = math.Min(max, n)
 
@@ -1,34 +1,193 @@
 package server
 
-import "sync"
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/r-medina/climatic"
+	"github.com/r-medina/climatic/jobcoin"
+)
 
 // Datastore contains the functions necessary from a datastore for the Mixer
 type Datastore interface {
-	// Register registers a deposit address with the associated user addresses.
-	Register(depositAddr string, usrAddrs []string) error
+	// RegisterTerms registers a deposit address with the associated user
+	// addresses and the terms they are paid on, or none if terms is nil.
+	// The address starts out created as of since.
+	RegisterTerms(depositAddr string, usrAddrs []string, terms *Terms, since time.Time) error
 	// DepositAddresses lists all the deposit addresses.
 	DepositAddresses() ([]string, error)
 	// UserAddresses lists all the user addresses for a given deposit address.
 	UserAddresses(depositAddr string) ([]string, error)
+	// Terms returns the terms of a deposit address, or nil if it was
+	// registered without any.
+	Terms(depositAddr string) (*Terms, error)
+	// Lifecycle returns the lifecycle of a deposit address, or nil if it
+	// was never registered. Forgotten addresses keep theirs.
+	Lifecycle(depositAddr string) (*Lifecycle, error)
+	// Lifecycles maps every deposit address, forgotten ones included, to
+	// its lifecycle.
+	Lifecycles() (map[string]*Lifecycle, error)
+	// SetLifecycle saves the lifecycle of a deposit address.
+	SetLifecycle(depositAddr string, lc *Lifecycle) error
+	// Forget removes a deposit address along with everything registered
+	// for it and the transfers from it that went through, but keeps its
+	// lifecycle, so that deposits to it can still be told apart from
+	// transactions the mixer has nothing to do with.
+	Forget(depositAddr string) error
+
+	// Volume returns how much was deposited to a deposit address, not
+	// counting refunded deposits.
+	Volume(depositAddr string) (climatic.Amount, error)
+
+	// SavePoll saves the poll cursor together with the deposits found up to
+	// it, so that every deposit is either pending or after the cursor. The
+	// deposits are added to the volumes of their addresses.
+	SavePoll(cursor jobcoin.Cursor, pending []*PendingMix) error
+	// PollState returns the poll cursor and the pending deposits to a
+	// deposit address, read together, so that every deposit to it is
+	// after the cursor, pending or in its mix.
+	PollState(depositAddr string) (jobcoin.Cursor, []*PendingMix, error)
+	// SaveMix saves the mix of a deposit address, or deletes it if m is
+	// nil, and removes the pending deposits with the given IDs, which the
+	// mix now includes.
+	SaveMix(depositAddr string, m *MixRecord, pendingIDs ...string) error
+	// BeginTransfer journals a transfer before it is posted.
+	BeginTransfer(t *Transfer) error
+	// FinishTransfer saves the outcome of a journaled transfer together with
+	// the mix of the deposit address it was made for, and enters fee in the
+	// fee ledger if it isn't nil. The transfer leaves the journal, and is
+	// only kept, with the transfers from its source address, if it went
+	// through.
+	FinishTransfer(t *Transfer, m *MixRecord, fee *FeeEntry) error
+	// Transfers returns the pending transfers from an address and the ones
+	// from it that went through and aren't confirmed yet, oldest first.
+	Transfers(fromAddr string) ([]*Transfer, error)
+	// ConfirmTransfers drops the transfers with the given IDs that went
+	// through from an address, once the ledger shows them, and records
+	// that the first sends of its ledger history are accounted for.
+	ConfirmTransfers(fromAddr string, sends int, ids []string) error
+	// ConfirmedSends returns how many of the first sends of the ledger
+	// history of an address are accounted for by confirmed transfers.
+	ConfirmedSends(fromAddr string) (int, error)
+	// FeeEntries returns the entries of the fee ledger from from up to to,
+	// oldest first.
+	FeeEntries(from, to time.Time) ([]*FeeEntry, error)
+	// SaveRoute saves a route, or deletes it if r is nil.
+	SaveRoute(id string, r *Route) error
+	// State returns the saved state of the mixer.
+	State() (*MixerState, error)
+}
+
+// MixRecord is the saved state of a deposit address that is being mixed.
+type MixRecord struct {
+	UserAddresses []string        `json:"userAddresses"`
+	Terms         *Terms          `json:"terms,omitempty"`
+	Remaining     climatic.Amount `json:"remaining"`
+	// Fees holds the fee of every deposit in the mix.
+	Fees []DepositFee `json:"fees"`
+	// Owed is how much the pool still has to pay out, in pooled mode.
+	Owed climatic.Amount `json:"owed"`
+	// Plan holds the payouts planned for the deposit address.
+	Plan []PlannedPayout `json:"plan"`
+	// Refund is whether the mix only pays deposits back to their senders.
+	Refund bool `json:"refund,omitempty"`
+}
+
+// copy returns a copy of m that doesn't share its plan.
+func (m *MixRecord) copy() MixRecord {
+	mCopy := *m
+	mCopy.Fees = append([]DepositFee(nil), m.Fees...)
+	mCopy.Plan = append([]PlannedPayout(nil), m.Plan...)
+	return mCopy
+}
+
+// PendingMix is a saved deposit that is waiting out the initial delay before
+// it is mixed.
+type PendingMix struct {
+	ID            string               `json:"id"`
+	Deposit       *jobcoin.Transaction `json:"deposit"`
+	UserAddresses []string             `json:"userAddresses"`
+	Terms         *Terms               `json:"terms,omitempty"`
+	// Due is when the deposit becomes eligible for mixing.
+	Due time.Time `json:"due"`
+	// Deadline is when the deposit must be paid out by, if the user
+	// addresses were registered with a window.
+	Deadline time.Time `json:"deadline,omitempty"`
+	// Refund is whether the deposit is sent back, and RefundReason why.
+	// Refunds saved without a reason came after their address expired.
+	Refund       bool         `json:"refund,omitempty"`
+	RefundReason RefundReason `json:"refundReason,omitempty"`
+	// Fee is the fee the policy set for the deposit, which may be more than
+	// the deposit.
+	Fee climatic.Amount `json:"fee"`
+}
+
+// MixerState is everything a Mixer needs to pick up where it left off.
+type MixerState struct {
+	// Cursor is how far into the transaction history the mixer has polled.
+	Cursor jobcoin.Cursor
+	// Pending holds the deposits found but not yet mixed, oldest first.
+	Pending []*PendingMix
+	// Mixes maps deposit addresses to their outstanding mix.
+	Mixes map[string]*MixRecord
+	// Transfers holds the transfers that are still pending.
+	Transfers []*Transfer
+	// Routes holds the routes that have yet to reach the user address.
+	Routes []*Route
 }
 
 // memDS implements Datastore in memory.
 type memDS struct {
-	addrs map[string][]string
-	mtx   sync.RWMutex
+	addrs      map[string][]string
+	terms      map[string]Terms
+	lifecycles map[string]Lifecycle
+	volumes    map[string]climatic.Amount
+
+	cursor  jobcoin.Cursor
+	pending map[string]PendingMix
+	mixes   map[string]MixRecord
+	// transfers is the journal of pending transfers, sent maps addresses
+	// to the transfers from them that went through, by ID, and confirmed
+	// maps them to how many of their sends are confirmed
+	transfers map[string]Transfer
+	sent      map[string]map[string]Transfer
+	confirmed map[string]int
+	routes    map[string]Route
+	fees      map[string]FeeEntry
+
+	mtx sync.RWMutex
 }
 
 var _ Datastore = (*memDS)(nil)
 
 func newMemDS() *memDS {
-	return &memDS{addrs: map[string][]string{}}
+	return &memDS{
+		addrs:      map[string][]string{},
+		terms:      map[string]Terms{},
+		lifecycles: map[string]Lifecycle{},
+		volumes:    map[string]climatic.Amount{},
+		pending:    map[string]PendingMix{},
+		mixes:      map[string]MixRecord{},
+		transfers:  map[string]Transfer{},
+		sent:       map[string]map[string]Transfer{},
+		confirmed:  map[string]int{},
+		routes:     map[string]Route{},
+		fees:       map[string]FeeEntry{},
+	}
 }
 
-func (ds *memDS) Register(depositAddr string, usrAddrs []string) error {
+func (ds *memDS) RegisterTerms(depositAddr string, usrAddrs []string, terms *Terms, since time.Time) error {
 	ds.mtx.Lock()
 	defer ds.mtx.Unlock()
 
 	ds.addrs[depositAddr] = usrAddrs
+	ds.lifecycles[depositAddr] = Lifecycle{State: AddressCreated, Since: since}
+	if terms == nil {
+		delete(ds.terms, depositAddr)
+		return nil
+	}
+	ds.terms[depositAddr] = *terms
 
 	return nil
 }
@@ -54,3 +213,277 @@ func (ds *memDS) UserAddresses(depositAddr string) ([]string, error) {
 
 	return usrAddrs, nil
 }
+
+func (ds *memDS) Terms(depositAddr string) (*Terms, error) {
+	ds.mtx.RLock()
+	defer ds.mtx.RUnlock()
+
+	terms, ok := ds.terms[depositAddr]
+	if !ok {
+		return nil, nil
+	}
+	return &terms, nil
+}
+
+func (ds *memDS) Lifecycle(depositAddr string) (*Lifecycle, error) {
+	ds.mtx.RLock()
+	defer ds.mtx.RUnlock()
+
+	lc, ok := ds.lifecycles[depositAddr]
+	if _, registered := ds.addrs[depositAddr]; !ok && !registered {
+		return nil, nil
+	}
+	if lc.State == "" {
+		lc.State = AddressCreated
+	}
+	return &lc, nil
+}
+
+func (ds *memDS) Lifecycles() (map[string]*Lifecycle, error) {
+	ds.mtx.RLock()
+	defer ds.mtx.RUnlock()
+
+	lcs := map[string]*Lifecycle{}
+	for addr := range ds.addrs {
+		lcs[addr] = &Lifecycle{State: AddressCreated}
+	}
+	for addr, lc := range ds.lifecycles {
+		lc := lc
+		lcs[addr] = &lc
+	}
+
+	return lcs, nil
+}
+
+func (ds *memDS) SetLifecycle(depositAddr string, lc *Lifecycle) error {
+	ds.mtx.Lock()
+	defer ds.mtx.Unlock()
+
+	ds.lifecycles[depositAddr] = *lc
+
+	return nil
+}
+
+func (ds *memDS) Forget(depositAddr string) error {
+	ds.mtx.Lock()
+	defer ds.mtx.Unlock()
+
+	delete(ds.addrs, depositAddr)
+	delete(ds.terms, depositAddr)
+	delete(ds.volumes, depositAddr)
+	delete(ds.sent, depositAddr)
+	delete(ds.confirmed, depositAddr)
+
+	return nil
+}
+
+func (ds *memDS) Volume(depositAddr string) (climatic.Amount, error) {
+	ds.mtx.RLock()
+	defer ds.mtx.RUnlock()
+
+	return ds.volumes[depositAddr], nil
+}
+
+func (ds *memDS) SavePoll(cursor jobcoin.Cursor, pending []*PendingMix) error {
+	ds.mtx.Lock()
+	defer ds.mtx.Unlock()
+
+	ds.cursor = cursor
+	for _, p := range pending {
+		ds.pending[p.ID] = *p
+		if addr := p.Deposit.ToAddress; !p.Refund && p.Deposit.Amount.Sign() > 0 {
+			ds.volumes[addr] = ds.volumes[addr].Add(p.Deposit.Amount)
+		}
+	}
+
+	return nil
+}
+
+func (ds *memDS) SaveMix(depositAddr string, m *MixRecord, pendingIDs ...string) error {
+	ds.mtx.Lock()
+	defer ds.mtx.Unlock()
+
+	if m == nil {
+		delete(ds.mixes, depositAddr)
+	} else {
+		ds.mixes[depositAddr] = m.copy()
+	}
+	for _, id := range pendingIDs {
+		delete(ds.pending, id)
+	}
+
+	return nil
+}
+
+func (ds *memDS) PollState(depositAddr string) (jobcoin.Cursor, []*PendingMix, error) {
+	ds.mtx.RLock()
+	defer ds.mtx.RUnlock()
+
+	pending := []*PendingMix{}
+	for _, p := range ds.pending {
+		if p.Deposit.ToAddress == depositAddr {
+			p := p
+			pending = append(pending, &p)
+		}
+	}
+	sortPending(pending)
+
+	return ds.cursor, pending, nil
+}
+
+func (ds *memDS) BeginTransfer(t *Transfer) error {
+	ds.mtx.Lock()
+	defer ds.mtx.Unlock()
+
+	ds.transfers[t.ID] = *t
+
+	return nil
+}
+
+func (ds *memDS) FinishTransfer(t *Transfer, m *MixRecord, fee *FeeEntry) error {
+	ds.mtx.Lock()
+	defer ds.mtx.Unlock()
+
+	delete(ds.transfers, t.ID)
+	if t.Status == TransferDone {
+		if ds.sent[t.FromAddress] == nil {
+			ds.sent[t.FromAddress] = map[string]Transfer{}
+		}
+		ds.sent[t.FromAddress][t.ID] = *t
+	}
+	ds.mixes[t.DepositAddress] = m.copy()
+	if fee != nil {
+		ds.fees[fee.TransferID] = *fee
+	}
+
+	return nil
+}
+
+func (ds *memDS) Transfers(fromAddr string) ([]*Transfer, error) {
+	ds.mtx.RLock()
+	defer ds.mtx.RUnlock()
+
+	transfers := []*Transfer{}
+	for _, t := range ds.transfers {
+		if t.FromAddress == fromAddr {
+			t := t
+			transfers = append(transfers, &t)
+		}
+	}
+	for _, t := range ds.sent[fromAddr] {
+		t := t
+		transfers = append(transfers, &t)
+	}
+	sortTransfers(transfers)
+
+	return transfers, nil
+}
+
+func (ds *memDS) ConfirmTransfers(fromAddr string, sends int, ids []string) error {
+	ds.mtx.Lock()
+	defer ds.mtx.Unlock()
+
+	for _, id := range ids {
+		delete(ds.sent[fromAddr], id)
+	}
+	if len(ds.sent[fromAddr]) == 0 {
+		delete(ds.sent, fromAddr)
+	}
+	ds.confirmed[fromAddr] = sends
+
+	return nil
+}
+
+func (ds *memDS) ConfirmedSends(fromAddr string) (int, error) {
+	ds.mtx.RLock()
+	defer ds.mtx.RUnlock()
+
+	return ds.confirmed[fromAddr], nil
+}
+
+func (ds *memDS) FeeEntries(from, to time.Time) ([]*FeeEntry, error) {
+	ds.mtx.RLock()
+	defer ds.mtx.RUnlock()
+
+	entries := []*FeeEntry{}
+	for _, e := range ds.fees {
+		if e.Time.Before(from) || !e.Time.Before(to) {
+			continue
+		}
+		e := e
+		entries = append(entries, &e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Time.Equal(entries[j].Time) {
+			return entries[i].TransferID < entries[j].TransferID
+		}
+		return entries[i].Time.Before(entries[j].Time)
+	})
+
+	return entries, nil
+}
+
+func (ds *memDS) SaveRoute(id string, r *Route) error {
+	ds.mtx.Lock()
+	defer ds.mtx.Unlock()
+
+	if r == nil {
+		delete(ds.routes, id)
+	} else {
+		rCopy := *r
+		rCopy.Hops = append([]string(nil), r.Hops...)
+		ds.routes[id] = rCopy
+	}
+
+	return nil
+}
+
+func (ds *memDS) State() (*MixerState, error) {
+	ds.mtx.RLock()
+	defer ds.mtx.RUnlock()
+
+	state := &MixerState{
+		Cursor:    ds.cursor,
+		Pending:   []*PendingMix{},
+		Mixes:     map[string]*MixRecord{},
+		Transfers: []*Transfer{},
+		Routes:    []*Route{},
+	}
+	for _, p := range ds.pending {
+		p := p
+		state.Pending = append(state.Pending, &p)
+	}
+	sortPending(state.Pending)
+	for addr, m := range ds.mixes {
+		m := m.copy()
+		state.Mixes[addr] = &m
+	}
+	for _, t := range ds.transfers {
+		t := t
+		state.Transfers = append(state.Transfers, &t)
+	}
+	for _, r := range ds.routes {
+		r := r
+		r.Hops = append([]string(nil), r.Hops...)
+		state.Routes = append(state.Routes, &r)
+	}
+
+	return state, nil
+}
+
+// sortTransfers sorts transfers by when they were journaled.
+func sortTransfers(transfers []*Transfer) {
+	sort.SliceStable(transfers, func(i, j int) bool {
+		if transfers[i].Created.Equal(transfers[j].Created) {
+			return transfers[i].ID < transfers[j].ID
+		}
+		return transfers[i].Created.Before(transfers[j].Created)
+	})
+}
+
+// sortPending sorts pending deposits by when they are due.
+func sortPending(pending []*PendingMix) {
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].Due.Before(pending[j].Due)
+	})
+}
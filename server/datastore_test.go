@@ -1,12 +1,293 @@
 package server
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/r-medina/climatic"
+	"github.com/r-medina/climatic/jobcoin"
 
 	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
 )
 
 func TestMemDS(t *testing.T) {
+	testDatastore(t, func() Datastore { return newMemDS() })
+	testState(t, newMemDS())
+}
+
+func TestBoltDS(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "climatic")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	n := 0
+	opened := []*BoltDS{}
+	testDatastore(t, func() Datastore {
+		n++
+		ds, err := OpenBoltDS(filepath.Join(dir, fmt.Sprintf("%d.db", n)))
+		require.NoError(err, "failed to open datastore")
+		opened = append(opened, ds)
+		return ds
+	})
+	for _, ds := range opened {
+		require.NoError(ds.Close())
+	}
+
+	ds, err := OpenBoltDS(filepath.Join(dir, "state.db"))
+	require.NoError(err, "failed to open datastore")
+	testState(t, ds)
+	require.NoError(ds.Close())
+
+	// registrations and state survive reopening the database
+	path := filepath.Join(dir, "reopen.db")
+	ds, err = OpenBoltDS(path)
+	require.NoError(err, "failed to open datastore")
+	require.NoError(ds.RegisterTerms("a", []string{"b", "c"}, nil, time.Now()), "failed to register")
+	cursor := jobcoin.Cursor{Time: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC), Seen: []string{"fp"}}
+	require.NoError(ds.SavePoll(cursor, nil), "failed to save poll")
+	rec := &MixRecord{UserAddresses: []string{"b", "c"}, Remaining: climatic.MustParseAmount("1.5")}
+	require.NoError(ds.SaveMix("a", rec), "failed to save mix")
+	require.NoError(ds.Close())
+
+	ds, err = OpenBoltDS(path)
+	require.NoError(err, "failed to reopen datastore")
+
+	depositAddrs, err := ds.DepositAddresses()
+	require.NoError(err, "failed to get deposit addresses")
+	require.Equal([]string{"a"}, depositAddrs, "unexpected deposit addresses")
+
+	usrAddrs, err := ds.UserAddresses("a")
+	require.NoError(err, "failed to get user addresses")
+	require.Equal([]string{"b", "c"}, usrAddrs, "unexpected user addresses")
+
+	usrAddrs, err = ds.UserAddresses("unknown")
+	require.NoError(err, "failed to get user addresses")
+	require.Empty(usrAddrs, "unexpected user addresses")
+
+	state, err := ds.State()
+	require.NoError(err, "failed to load state")
+	require.Equal(cursor, state.Cursor, "unexpected cursor")
+	require.Equal(map[string]*MixRecord{"a": rec}, state.Mixes, "unexpected mixes")
+	require.NoError(ds.Close())
+
+	// finished transfers that older databases kept in the journal are
+	// moved out of it when it is opened
+	path = filepath.Join(dir, "journal.db")
+	ds, err = OpenBoltDS(path)
+	require.NoError(err, "failed to open datastore")
+	err = ds.db.Update(func(tx *bolt.Tx) error {
+		for _, tr := range []*Transfer{
+			{ID: "t0", FromAddress: "a", Status: TransferDone},
+			{ID: "t1", FromAddress: "a", Status: TransferFailed},
+			{ID: "t2", FromAddress: "a", Status: TransferPending},
+		} {
+			if err := putJSON(tx.Bucket(transfersBucket), []byte(tr.ID), tr); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(err, "failed to write the journal")
+	require.NoError(ds.Close())
+
+	ds, err = OpenBoltDS(path)
+	require.NoError(err, "failed to reopen datastore")
+	defer ds.Close()
+	state, err = ds.State()
+	require.NoError(err, "failed to load state")
+	require.Len(state.Transfers, 1, "finished transfers left in the journal")
+	require.Equal("t2", state.Transfers[0].ID, "pending transfer not kept")
+	transfers, err := ds.Transfers("a")
+	require.NoError(err, "failed to get transfers")
+	ids := []string{}
+	for _, tr := range transfers {
+		ids = append(ids, tr.ID)
+	}
+	require.ElementsMatch([]string{"t0", "t2"}, ids, "unexpected transfers")
+}
+
+// testState checks that ds saves the state of a mixer.
+func testState(t *testing.T, ds Datastore) {
+	require := require.New(t)
+
+	state, err := ds.State()
+	require.NoError(err, "failed to load state")
+	require.Equal(jobcoin.Cursor{}, state.Cursor, "unexpected cursor")
+	require.Empty(state.Pending, "unexpected pending deposits")
+	require.Empty(state.Mixes, "unexpected mixes")
+
+	at := func(sec int) time.Time { return time.Date(2018, 1, 1, 0, 0, sec, 0, time.UTC) }
+	deposit := func(addr, amt string) *jobcoin.Transaction {
+		return &jobcoin.Transaction{Timestamp: at(1), ToAddress: addr, Amount: climatic.MustParseAmount(amt)}
+	}
+	p1 := &PendingMix{ID: "1", Deposit: deposit("a", "1"), UserAddresses: []string{"u"}, Due: at(3)}
+	p2 := &PendingMix{ID: "2", Deposit: deposit("a", "2"), UserAddresses: []string{"u"}, Due: at(2)}
+	p3 := &PendingMix{ID: "3", Deposit: deposit("b", "3"), UserAddresses: []string{"v"}, Due: at(4)}
+	cursor := jobcoin.Cursor{Time: at(1), Seen: []string{"x", "y", "z"}}
+	require.NoError(ds.SavePoll(cursor, []*PendingMix{p1, p2, p3}), "failed to save poll")
+
+	state, err = ds.State()
+	require.NoError(err, "failed to load state")
+	require.Equal(cursor, state.Cursor, "unexpected cursor")
+	require.Equal([]*PendingMix{p2, p1, p3}, state.Pending, "pending deposits not sorted by due time")
+	pollCursor, pending, err := ds.PollState("a")
+	require.NoError(err, "failed to get poll state")
+	require.Equal(cursor, pollCursor, "unexpected poll cursor")
+	require.Equal([]*PendingMix{p2, p1}, pending, "unexpected pending deposits to a")
+
+	// deposits count toward the volume of their address, unless they are
+	// refunded
+	refund := &PendingMix{ID: "4", Deposit: deposit("b", "4"), UserAddresses: []string{"v"}, Due: at(5), Refund: true}
+	require.NoError(ds.SavePoll(cursor, []*PendingMix{refund}), "failed to save poll")
+	for addr, want := range map[string]string{"a": "3", "b": "3", "c": "0"} {
+		volume, err := ds.Volume(addr)
+		require.NoError(err, "failed to get volume")
+		require.Equal(climatic.MustParseAmount(want), volume, "unexpected volume of %s", addr)
+	}
+	require.NoError(ds.SaveMix("b", nil, "4"), "failed to drop refund")
+
+	// the deposits to a become a mix
+	rec := &MixRecord{
+		UserAddresses: []string{"u"},
+		Remaining:     climatic.MustParseAmount("3"),
+		Fees:          []DepositFee{{DepositID: "1", Amount: climatic.MustParseAmount("0.5")}},
+		Plan:          []PlannedPayout{{ID: "p", ToAddress: "u", Amount: climatic.MustParseAmount("3"), At: at(6)}},
+	}
+	require.NoError(ds.SaveMix("a", rec, "1", "2"), "failed to save mix")
+	state, err = ds.State()
+	require.NoError(err, "failed to load state")
+	require.Equal([]*PendingMix{p3}, state.Pending, "unexpected pending deposits")
+	require.Equal(map[string]*MixRecord{"a": rec}, state.Mixes, "unexpected mixes")
+
+	// saved records are copies
+	rec.Fees[0].Paid = true
+	rec.Plan[0].Paid = true
+	state, err = ds.State()
+	require.NoError(err, "failed to load state")
+	require.False(state.Mixes["a"].Fees[0].Paid, "fees not copied")
+	require.False(state.Mixes["a"].Plan[0].Paid, "plan not copied")
+
+	require.NoError(ds.SaveMix("a", rec), "failed to save mix")
+	state, err = ds.State()
+	require.NoError(err, "failed to load state")
+	require.True(state.Mixes["a"].Fees[0].Paid, "record not updated")
+
+	require.NoError(ds.SaveMix("a", nil), "failed to delete mix")
+	state, err = ds.State()
+	require.NoError(err, "failed to load state")
+	require.Empty(state.Mixes, "mix not deleted")
+
+	// fees go into the ledger as their transfers finish
+	for i, sec := range []int{9, 7, 8} {
+		tr := &Transfer{
+			ID:             fmt.Sprint("t", i),
+			Kind:           TransferFee,
+			DepositAddress: "a",
+			FromAddress:    "a",
+			Status:         TransferDone,
+			Created:        at(sec),
+		}
+		require.NoError(ds.BeginTransfer(tr), "failed to begin transfer")
+		fee := &FeeEntry{
+			TransferID:     tr.ID,
+			DepositAddress: "a",
+			DepositID:      fmt.Sprint(i),
+			Amount:         climatic.MustParseAmount("0.5"),
+			Charged:        climatic.MustParseAmount("1"),
+			Time:           at(sec),
+		}
+		require.NoError(ds.FinishTransfer(tr, rec, fee), "failed to finish transfer")
+	}
+	require.NoError(ds.FinishTransfer(&Transfer{ID: "t3", DepositAddress: "a"}, rec, nil), "failed to finish transfer")
+	entries, err := ds.FeeEntries(at(0), at(9))
+	require.NoError(err, "failed to get fee entries")
+	require.Len(entries, 2, "unexpected fee entries")
+	require.Equal([]string{"t1", "t2"}, []string{entries[0].TransferID, entries[1].TransferID}, "fee entries not sorted")
+	require.True(entries[0].Time.Equal(at(7)), "unexpected fee time")
+	require.Equal(climatic.MustParseAmount("1"), entries[0].Charged, "unexpected fee charged")
+	transfers, err := ds.Transfers("a")
+	require.NoError(err, "failed to get transfers")
+	require.Len(transfers, 3, "unexpected transfers")
+	require.Equal([]string{"t1", "t2", "t0"}, []string{transfers[0].ID, transfers[1].ID, transfers[2].ID}, "transfers not sorted")
+	require.Equal(TransferDone, transfers[0].Status, "finished transfer not kept")
+	transfers, err = ds.Transfers("b")
+	require.NoError(err, "failed to get transfers")
+	require.Empty(transfers, "unexpected transfers from b")
+
+	// finished transfers leave the journal, and only the ones that went
+	// through are kept
+	failed := &Transfer{ID: "t4", DepositAddress: "a", FromAddress: "a", Status: TransferPending, Created: at(10)}
+	require.NoError(ds.BeginTransfer(failed), "failed to begin transfer")
+	state, err = ds.State()
+	require.NoError(err, "failed to load state")
+	require.Equal([]*Transfer{failed}, state.Transfers, "unexpected pending transfers")
+	transfers, err = ds.Transfers("a")
+	require.NoError(err, "failed to get transfers")
+	require.Len(transfers, 4, "pending transfer not returned")
+	failed.Status = TransferFailed
+	require.NoError(ds.FinishTransfer(failed, rec, nil), "failed to finish transfer")
+	state, err = ds.State()
+	require.NoError(err, "failed to load state")
+	require.Empty(state.Transfers, "finished transfer left in the journal")
+	transfers, err = ds.Transfers("a")
+	require.NoError(err, "failed to get transfers")
+	require.Len(transfers, 3, "failed transfer kept")
+	require.NoError(ds.SaveMix("a", nil), "failed to delete mix")
+
+	// confirmed transfers are dropped, and the sends they account for
+	// counted
+	sends, err := ds.ConfirmedSends("a")
+	require.NoError(err, "failed to get confirmed sends")
+	require.Zero(sends, "unexpected confirmed sends")
+	require.NoError(ds.ConfirmTransfers("a", 2, []string{"t1", "t2"}), "failed to confirm transfers")
+	transfers, err = ds.Transfers("a")
+	require.NoError(err, "failed to get transfers")
+	require.Len(transfers, 1, "confirmed transfers kept")
+	require.Equal("t0", transfers[0].ID, "unconfirmed transfer dropped")
+	sends, err = ds.ConfirmedSends("a")
+	require.NoError(err, "failed to get confirmed sends")
+	require.Equal(2, sends, "unexpected confirmed sends")
+
+	require.NoError(ds.Forget("a"), "failed to forget")
+	transfers, err = ds.Transfers("a")
+	require.NoError(err, "failed to get transfers")
+	require.Empty(transfers, "transfers of a forgotten address kept")
+	sends, err = ds.ConfirmedSends("a")
+	require.NoError(err, "failed to get confirmed sends")
+	require.Zero(sends, "confirmed sends of a forgotten address kept")
+
+	r := &Route{
+		ID:             "r",
+		DepositAddress: "a",
+		UserAddress:    "u",
+		Amount:         climatic.MustParseAmount("1"),
+		Hops:           []string{"h1", "h2"},
+		Funded:         true,
+		Due:            at(5),
+	}
+	require.NoError(ds.SaveRoute(r.ID, r), "failed to save route")
+	r.At++
+	r.Hops[0] = "changed"
+	state, err = ds.State()
+	require.NoError(err, "failed to load state")
+	require.Len(state.Routes, 1, "unexpected routes")
+	require.Equal(0, state.Routes[0].At, "route not copied")
+	require.Equal([]string{"h1", "h2"}, state.Routes[0].Hops, "hops not copied")
+
+	require.NoError(ds.SaveRoute(r.ID, nil), "failed to delete route")
+	state, err = ds.State()
+	require.NoError(err, "failed to load state")
+	require.Empty(state.Routes, "route not deleted")
+}
+
+func testDatastore(t *testing.T, newDS func() Datastore) {
 	require := require.New(t)
 
 	tests := []struct {
@@ -19,9 +300,9 @@ func TestMemDS(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run("", func(t *testing.T) {
-			ds := newMemDS()
+			ds := newDS()
 
-			err := ds.Register(test.depositAddr, test.usrAddrs)
+			err := ds.RegisterTerms(test.depositAddr, test.usrAddrs, nil, time.Now())
 			require.NoError(err, "failed to register")
 
 			depositAddrs, err := ds.DepositAddresses()
@@ -38,11 +319,11 @@ func TestMemDS(t *testing.T) {
 	// tests with existing element
 	for _, test := range tests {
 		t.Run("", func(t *testing.T) {
-			ds := newMemDS()
-			err := ds.Register("some", []string{"thing"})
+			ds := newDS()
+			err := ds.RegisterTerms("some", []string{"thing"}, nil, time.Now())
 			require.NoError(err, "failed to register")
 
-			err = ds.Register(test.depositAddr, test.usrAddrs)
+			err = ds.RegisterTerms(test.depositAddr, test.usrAddrs, nil, time.Now())
 			require.NoError(err, "failed to register")
 
 			depositAddrs, err := ds.DepositAddresses()
@@ -56,4 +337,52 @@ func TestMemDS(t *testing.T) {
 		})
 	}
 
+	// registering with terms, and registering again without
+	ds := newDS()
+	terms := &Terms{
+		Splits: []Split{
+			{Address: "b", Weight: 7},
+			{Address: "c", Amount: climatic.MustParseAmount("2.5")},
+		},
+		Window: &Window{Min: time.Hour, Max: 24 * time.Hour},
+	}
+	require.NoError(ds.RegisterTerms("a", []string{"b", "c"}, terms, time.Now()), "failed to register terms")
+	usrAddrs, err := ds.UserAddresses("a")
+	require.NoError(err, "failed to get user addresses")
+	require.Equal([]string{"b", "c"}, usrAddrs, "unexpected user addresses")
+	got, err := ds.Terms("a")
+	require.NoError(err, "failed to get terms")
+	require.Equal(terms, got, "unexpected terms")
+
+	require.NoError(ds.RegisterTerms("a", []string{"d"}, nil, time.Now()), "failed to register")
+	got, err = ds.Terms("a")
+	require.NoError(err, "failed to get terms")
+	require.Nil(got, "terms not cleared")
+
+	// lifecycles start out created, and go with the address when it is
+	// forgotten
+	lc, err := ds.Lifecycle("a")
+	require.NoError(err, "failed to get lifecycle")
+	require.Equal(AddressCreated, lc.State, "unexpected state")
+	require.WithinDuration(time.Now(), lc.Since, time.Minute, "unexpected state time")
+	expired := &Lifecycle{State: AddressExpired, Since: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)}
+	require.NoError(ds.SetLifecycle("a", expired), "failed to set lifecycle")
+	lcs, err := ds.Lifecycles()
+	require.NoError(err, "failed to get lifecycles")
+	require.Equal(map[string]*Lifecycle{"a": expired}, lcs, "unexpected lifecycles")
+
+	lc, err = ds.Lifecycle("unknown")
+	require.NoError(err, "failed to get lifecycle")
+	require.Nil(lc, "lifecycle of unknown address")
+
+	require.NoError(ds.Forget("a"), "failed to forget")
+	depositAddrs, err := ds.DepositAddresses()
+	require.NoError(err, "failed to get deposit addresses")
+	require.Empty(depositAddrs, "address not forgotten")
+	lc, err = ds.Lifecycle("a")
+	require.NoError(err, "failed to get lifecycle")
+	require.Equal(expired, lc, "lifecycle of a forgotten address not kept")
+	lcs, err = ds.Lifecycles()
+	require.NoError(err, "failed to get lifecycles")
+	require.Equal(map[string]*Lifecycle{"a": expired}, lcs, "lifecycle of a forgotten address not listed")
 }
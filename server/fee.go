@@ -0,0 +1,209 @@
+package server
+
+import (
+	"context"
+	"sort"
+
+	"github.com/r-medina/climatic"
+)
+
+// FeePolicy decides the fee of every deposit. The fee is set when the deposit
+// is found and collected before any of the deposit is paid out. A fee larger
+// than the deposit is cut down to the deposit.
+type FeePolicy interface {
+	// Fee returns the fee for a deposit of amt to an address that volume
+	// was deposited to before.
+	Fee(amt, volume climatic.Amount) climatic.Amount
+}
+
+// FlatFee charges the same fee for every deposit.
+type FlatFee struct {
+	Amount climatic.Amount
+}
+
+var _ FeePolicy = FlatFee{}
+
+// Fee returns the flat fee.
+func (f FlatFee) Fee(_, _ climatic.Amount) climatic.Amount {
+	return f.Amount
+}
+
+// PercentFee charges a share of every deposit, rounded up.
+type PercentFee struct {
+	// BasisPoints is the share in hundredths of a percent.
+	BasisPoints int64
+}
+
+var _ FeePolicy = PercentFee{}
+
+// Fee returns the share of amt.
+func (f PercentFee) Fee(amt, _ climatic.Amount) climatic.Amount {
+	return amt.MulRatio(f.BasisPoints, 10000, climatic.RoundUp)
+}
+
+// FeeTier is the policy for the deposits of at least From.
+type FeeTier struct {
+	From   climatic.Amount
+	Policy FeePolicy
+}
+
+// TieredFee charges every deposit by the tier with the highest From that it
+// reaches. Deposits smaller than every tier are free.
+type TieredFee []FeeTier
+
+var _ FeePolicy = TieredFee{}
+
+// Fee returns the fee of the tier amt falls in.
+func (f TieredFee) Fee(amt, volume climatic.Amount) climatic.Amount {
+	tiers := append(TieredFee(nil), f...)
+	sort.SliceStable(tiers, func(i, j int) bool { return tiers[i].From.Cmp(tiers[j].From) > 0 })
+	for _, tier := range tiers {
+		if amt.Cmp(tier.From) >= 0 {
+			return tier.Policy.Fee(amt, volume)
+		}
+	}
+
+	return climatic.Amount{}
+}
+
+// CappedFee keeps the fees of Policy between Min and Max. A zero Max leaves
+// them uncapped.
+type CappedFee struct {
+	Policy   FeePolicy
+	Min, Max climatic.Amount
+}
+
+var _ FeePolicy = CappedFee{}
+
+// Fee returns the fee of the policy, capped.
+func (f CappedFee) Fee(amt, volume climatic.Amount) climatic.Amount {
+	fee := climatic.MaxAmount(f.Policy.Fee(amt, volume), f.Min)
+	if f.Max.Sign() > 0 {
+		fee = climatic.MinAmount(fee, f.Max)
+	}
+
+	return fee
+}
+
+// VolumeDiscount is a discount for the addresses that were deposited at least
+// From before.
+type VolumeDiscount struct {
+	From climatic.Amount
+	// BasisPoints is the discount in hundredths of a percent of the fee.
+	BasisPoints int64
+}
+
+// DiscountedFee takes the best discount an address has earned off the fees of
+// Policy.
+type DiscountedFee struct {
+	Policy    FeePolicy
+	Discounts []VolumeDiscount
+}
+
+var _ FeePolicy = DiscountedFee{}
+
+// Fee returns the fee of the policy, less the discount.
+func (f DiscountedFee) Fee(amt, volume climatic.Amount) climatic.Amount {
+	fee := f.Policy.Fee(amt, volume)
+
+	var best int64
+	for _, d := range f.Discounts {
+		if volume.Cmp(d.From) >= 0 && d.BasisPoints > best {
+			best = d.BasisPoints
+		}
+	}
+	if best > 10000 {
+		best = 10000
+	}
+
+	return fee.Sub(fee.MulRatio(best, 10000, climatic.RoundDown))
+}
+
+// DepositFee is the fee charged for one deposit.
+type DepositFee struct {
+	// DepositID is the ID of the deposit while it was pending.
+	DepositID string `json:"depositId"`
+	// Amount is how much is collected. It is less than Charged if the
+	// deposit, or what was left of it, was smaller.
+	Amount climatic.Amount `json:"amount"`
+	// Charged is the fee the policy set for the deposit.
+	Charged climatic.Amount `json:"charged"`
+	Paid    bool            `json:"paid"`
+}
+
+// feePaid reports whether every fee of m was collected.
+func (m *mix) feePaid() bool {
+	return m.feeDue().IsZero()
+}
+
+// feeDue is how much of the fees of m is left to collect.
+func (m *mix) feeDue() climatic.Amount {
+	var due climatic.Amount
+	for _, f := range m.fees {
+		if !f.Paid {
+			due = due.Add(f.Amount)
+		}
+	}
+
+	return due
+}
+
+// markFeePaid marks the fee of the deposit with the given ID as collected, with
+// amt in case it was cut down to what was left.
+func (m *mix) markFeePaid(depositID string, amt climatic.Amount) {
+	for i := range m.fees {
+		if m.fees[i].DepositID == depositID {
+			m.fees[i].Amount = amt
+			m.fees[i].Paid = true
+			return
+		}
+	}
+}
+
+// collectFees collects the fees of m that are left, one transfer per deposit.
+func (mxr *Mixer) collectFees(ctx context.Context, m *mix, addr string) error {
+	for i := range m.fees {
+		if m.fees[i].Paid {
+			continue
+		}
+		if err := mxr.collectFee(ctx, m, addr, m.fees[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// collectFee sends fee from the deposit address addr to the mixer. If less than
+// the fee is left, the rest is taken instead.
+func (mxr *Mixer) collectFee(ctx context.Context, m *mix, addr string, fee DepositFee) error {
+	l := mxr.log
+
+	if fee.Amount.Sign() <= 0 {
+		m.markFeePaid(fee.DepositID, climatic.Amount{})
+		return nil
+	}
+	amt := fee.Amount
+	if amt.Cmp(m.remaining) > 0 {
+		amt = m.remaining
+		l.Printf("reduced fee: %v", amt)
+	}
+	if amt.Sign() <= 0 {
+		return nil
+	}
+
+	l.Printf("collecting fee of %v for deposit %s", amt, fee.DepositID)
+	t := &Transfer{
+		Kind:           TransferFee,
+		DepositAddress: addr,
+		FromAddress:    addr,
+		ToAddress:      mxr.addr,
+		Amount:         amt,
+		DepositID:      fee.DepositID,
+	}
+	if err := mxr.journalTransfer(ctx, m, t); err != nil {
+		return err
+	}
+
+	return mxr.postTransfer(ctx, m, t)
+}
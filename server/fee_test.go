@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/r-medina/climatic"
+	"github.com/r-medina/climatic/jobcoin/jctest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFeePolicies(t *testing.T) {
+	t.Parallel()
+
+	amt := climatic.MustParseAmount
+	tiered := TieredFee{
+		{From: amt("100"), Policy: PercentFee{BasisPoints: 100}},
+		{From: amt("1"), Policy: FlatFee{Amount: amt("2")}},
+	}
+
+	tests := []struct {
+		desc   string
+		policy FeePolicy
+		amt    string
+		volume string
+		want   string
+	}{
+		{desc: "flat", policy: FlatFee{Amount: amt("2.5")}, amt: "1", want: "2.5"},
+		{desc: "percent", policy: PercentFee{BasisPoints: 150}, amt: "200", want: "3"},
+		{desc: "percent rounds up", policy: PercentFee{BasisPoints: 1}, amt: "0.00000001", want: "0.00000001"},
+		{desc: "tier below all", policy: tiered, amt: "0.5", want: "0"},
+		{desc: "low tier", policy: tiered, amt: "99", want: "2"},
+		{desc: "high tier", policy: tiered, amt: "500", want: "5"},
+		{desc: "min", policy: CappedFee{Policy: PercentFee{BasisPoints: 100}, Min: amt("1")}, amt: "10", want: "1"},
+		{desc: "max", policy: CappedFee{Policy: PercentFee{BasisPoints: 100}, Max: amt("1")}, amt: "1000", want: "1"},
+		{desc: "within caps", policy: CappedFee{Policy: PercentFee{BasisPoints: 100}, Min: amt("1"), Max: amt("5")}, amt: "300", want: "3"},
+		{
+			desc: "no discount",
+			policy: DiscountedFee{
+				Policy:    FlatFee{Amount: amt("4")},
+				Discounts: []VolumeDiscount{{From: amt("100"), BasisPoints: 2500}, {From: amt("1000"), BasisPoints: 5000}},
+			},
+			amt: "10", volume: "99", want: "4",
+		},
+		{
+			desc: "best discount",
+			policy: DiscountedFee{
+				Policy:    FlatFee{Amount: amt("4")},
+				Discounts: []VolumeDiscount{{From: amt("100"), BasisPoints: 2500}, {From: amt("1000"), BasisPoints: 5000}},
+			},
+			amt: "10", volume: "1000", want: "2",
+		},
+	}
+
+	for _, test := range tests {
+		volume := amt("0")
+		if test.volume != "" {
+			volume = amt(test.volume)
+		}
+		require.Equal(t, test.want, test.policy.Fee(amt(test.amt), volume).String(), test.desc)
+	}
+}
+
+func TestDepositFees(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	ctx := context.Background()
+	ledger := jctest.NewLedger()
+	mxr, err := NewMixer(
+		WithJobcoinClient(ledger),
+		WithAddress("fees"),
+		WithFeePolicy(DiscountedFee{
+			Policy:    FlatFee{Amount: climatic.MustParseAmount("2")},
+			Discounts: []VolumeDiscount{{From: jctest.DefaultCreateAmount, BasisPoints: 5000}},
+		}),
+		WithMixConfig(MixConfig{
+			MeanDelay:  time.Hour,
+			MaxDelay:   time.Hour,
+			MeanAmount: climatic.MustParseAmount("10"),
+			MinAmount:  climatic.MustParseAmount("10"),
+			MaxAmount:  climatic.MustParseAmount("10"),
+		}),
+		WithLogger(log.New(ioutil.Discard, "", 0)),
+	)
+	require.NoError(err)
+
+	res, err := mxr.Register(ctx, &climatic.RegisterRequest{Addresses: []string{"u"}})
+	require.NoError(err)
+	require.NoError(ledger.Create(ctx, res.Address))
+	first, err := mxr.findMixRequests(ctx)
+	require.NoError(err)
+	require.Len(first, 1)
+	require.Equal(climatic.MustParseAmount("2"), first[0].fee)
+
+	// the second deposit gets the discount of the first
+	require.NoError(ledger.Create(ctx, res.Address))
+	second, err := mxr.findMixRequests(ctx)
+	require.NoError(err)
+	require.Len(second, 1)
+	require.Equal(climatic.MustParseAmount("1"), second[0].fee)
+
+	// A deposit that comes in while the mix of another is under way is
+	// charged on its own, so neither fee is lost.
+	mxr.makeMix(first)
+	require.NoError(mxr.mix(ctx, res.Address))
+	require.Equal(climatic.MustParseAmount("2"), ledger.Balance("fees"))
+	mxr.makeMix(second)
+	m := mxr.outstanding[res.Address]
+	require.False(m.feePaid())
+	m.retryAt = time.Time{}
+	require.NoError(mxr.mix(ctx, res.Address))
+	require.Equal(climatic.MustParseAmount("3"), ledger.Balance("fees"))
+	require.True(m.feePaid())
+	require.Len(m.fees, 2)
+
+	// a fee is only collected once
+	m.retryAt = time.Time{}
+	require.NoError(mxr.mix(ctx, res.Address))
+	require.Equal(climatic.MustParseAmount("3"), ledger.Balance("fees"))
+}
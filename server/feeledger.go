@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"time"
+
+	"github.com/r-medina/climatic"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// FeeEntry is a fee in the fee ledger. An entry is made for every fee that is
+// collected, in the same write that finishes its transfer.
+type FeeEntry struct {
+	// TransferID is the transfer that collected the fee.
+	TransferID     string `json:"transferId"`
+	DepositAddress string `json:"depositAddress"`
+	// DepositID is the ID of the deposit the fee was charged for.
+	DepositID string `json:"depositId"`
+	// Amount is how much was collected.
+	Amount climatic.Amount `json:"amount"`
+	// Charged is the fee the deposit was charged by the fee policy. It is
+	// more than Amount if the fee was reduced to what was in the deposit
+	// address.
+	Charged climatic.Amount `json:"charged"`
+	// Time is when the fee was sent.
+	Time time.Time `json:"time"`
+}
+
+// Reduced reports whether less than the fee was collected.
+func (e *FeeEntry) Reduced() bool {
+	return e.Amount.Cmp(e.Charged) < 0
+}
+
+// FeePeriod sums up the fees collected in a period.
+type FeePeriod struct {
+	Start, End time.Time
+	// Fees is how many fees were collected.
+	Fees      int
+	Collected climatic.Amount
+	Charged   climatic.Amount
+	// Reduced is how many of the fees were reduced.
+	Reduced int
+}
+
+// The periods a fee report can be broken into.
+const (
+	PeriodDay   = "day"
+	PeriodWeek  = "week"
+	PeriodMonth = "month"
+)
+
+// feeEntry builds the ledger entry of the fee transfer t, which went through.
+func (m *mix) feeEntry(t *Transfer) *FeeEntry {
+	e := &FeeEntry{
+		TransferID:     t.ID,
+		DepositAddress: t.DepositAddress,
+		DepositID:      t.DepositID,
+		Amount:         t.Amount,
+		Charged:        t.Amount,
+		Time:           t.Created,
+	}
+	for _, f := range m.fees {
+		if f.DepositID == t.DepositID && f.Charged.Cmp(e.Charged) > 0 {
+			e.Charged = f.Charged
+		}
+	}
+
+	return e
+}
+
+// periodStart returns the start of the period that t is in, in UTC. Weeks
+// start on Monday.
+func periodStart(t time.Time, period string) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch period {
+	case PeriodDay:
+		return day
+	case PeriodWeek:
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	default:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+}
+
+// periodEnd returns the end of the period that starts at start.
+func periodEnd(start time.Time, period string) time.Time {
+	switch period {
+	case PeriodDay:
+		return start.AddDate(0, 0, 1)
+	case PeriodWeek:
+		return start.AddDate(0, 0, 7)
+	default:
+		return start.AddDate(0, 1, 0)
+	}
+}
+
+// sumFees sums up entries, which are sorted by time, by period. Periods without
+// fees are left out. Without a period, everything from from to to is one
+// period.
+func sumFees(entries []*FeeEntry, from, to time.Time, period string) ([]*FeePeriod, error) {
+	periods := []*FeePeriod{}
+	switch period {
+	case "":
+		if len(entries) == 0 {
+			return periods, nil
+		}
+		periods = append(periods, &FeePeriod{Start: from, End: to})
+	case PeriodDay, PeriodWeek, PeriodMonth:
+	default:
+		return nil, errors.Errorf("unknown period %q", period)
+	}
+
+	for _, e := range entries {
+		if period != "" {
+			start := periodStart(e.Time, period)
+			if last := len(periods) - 1; last < 0 || !periods[last].Start.Equal(start) {
+				periods = append(periods, &FeePeriod{Start: start, End: periodEnd(start, period)})
+			}
+		}
+		p := periods[len(periods)-1]
+		p.Fees++
+		p.Collected = p.Collected.Add(e.Amount)
+		p.Charged = p.Charged.Add(e.Charged)
+		if e.Reduced() {
+			p.Reduced++
+		}
+	}
+
+	return periods, nil
+}
+
+// checkAdmin returns a PermissionDenied error unless token is the admin token,
+// and logs that the call was denied.
+func (mxr *Mixer) checkAdmin(call, token string) error {
+	sum := sha256.Sum256([]byte(token))
+	if mxr.adminToken == nil || subtle.ConstantTimeCompare(sum[:], mxr.adminToken) != 1 {
+		mxr.log.Printf("%s denied", call)
+		return grpc.Errorf(codes.PermissionDenied, "admin token invalid")
+	}
+
+	return nil
+}
+
+// FeeReport reports the fees collected between two times, by period. It is
+// only open to callers with the admin token, and closed if there is none.
+func (mxr *Mixer) FeeReport(
+	ctx context.Context, req *climatic.FeeReportRequest,
+) (*climatic.FeeReportResponse, error) {
+	l := mxr.log
+
+	if err := mxr.checkAdmin("fee report", req.Token); err != nil {
+		return nil, err
+	}
+
+	from := time.Unix(req.From, 0).UTC()
+	to := mxr.clock.Now().UTC()
+	if req.To != 0 {
+		to = time.Unix(req.To, 0).UTC()
+	}
+	entries, err := mxr.ds.FeeEntries(from, to)
+	if err != nil {
+		l.Printf("could not get fee entries: %v", err)
+		return nil, grpc.Errorf(codes.Internal, "could not get fees")
+	}
+	periods, err := sumFees(entries, from, to, req.Period)
+	if err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "period invalid: %v", err)
+	}
+
+	res := &climatic.FeeReportResponse{
+		Periods: []*climatic.FeePeriod{},
+		Entries: []*climatic.FeeEntry{},
+	}
+	for _, p := range periods {
+		res.Periods = append(res.Periods, &climatic.FeePeriod{
+			Start:     p.Start.Unix(),
+			End:       p.End.Unix(),
+			Fees:      int32(p.Fees),
+			Collected: p.Collected.String(),
+			Charged:   p.Charged.String(),
+			Reduced:   int32(p.Reduced),
+		})
+	}
+	if req.Entries {
+		for _, e := range entries {
+			res.Entries = append(res.Entries, &climatic.FeeEntry{
+				TransferId:     e.TransferID,
+				DepositAddress: e.DepositAddress,
+				DepositId:      e.DepositID,
+				Amount:         e.Amount.String(),
+				Charged:        e.Charged.String(),
+				Time:           e.Time.Unix(),
+				Reduced:        e.Reduced(),
+			})
+		}
+	}
+
+	return res, nil
+}
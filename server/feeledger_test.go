@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/r-medina/climatic"
+	"github.com/r-medina/climatic/jobcoin/jctest"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestSumFees(t *testing.T) {
+	t.Parallel()
+
+	day := func(d int) time.Time { return time.Date(2018, 1, d, 12, 0, 0, 0, time.UTC) }
+	entry := func(d int, amt, charged string) *FeeEntry {
+		return &FeeEntry{
+			Time:    day(d),
+			Amount:  climatic.MustParseAmount(amt),
+			Charged: climatic.MustParseAmount(charged),
+		}
+	}
+	// 2018-01-01 is a Monday
+	entries := []*FeeEntry{
+		entry(1, "1", "1"),
+		entry(1, "0.5", "1"),
+		entry(3, "2", "2"),
+		entry(8, "1", "1"),
+		entry(31, "3", "3"),
+	}
+	from, to := day(1), day(31).AddDate(0, 1, 0)
+
+	type period struct {
+		start     time.Time
+		fees      int
+		collected string
+		reduced   int
+	}
+	tests := []struct {
+		period string
+		want   []period
+	}{
+		{period: "", want: []period{{start: from, fees: 5, collected: "7.5", reduced: 1}}},
+		{
+			period: PeriodDay,
+			want: []period{
+				{start: day(1).Truncate(24 * time.Hour), fees: 2, collected: "1.5", reduced: 1},
+				{start: day(3).Truncate(24 * time.Hour), fees: 1, collected: "2"},
+				{start: day(8).Truncate(24 * time.Hour), fees: 1, collected: "1"},
+				{start: day(31).Truncate(24 * time.Hour), fees: 1, collected: "3"},
+			},
+		},
+		{
+			period: PeriodWeek,
+			want: []period{
+				{start: day(1).Truncate(24 * time.Hour), fees: 3, collected: "3.5", reduced: 1},
+				{start: day(8).Truncate(24 * time.Hour), fees: 1, collected: "1"},
+				{start: day(29).Truncate(24 * time.Hour), fees: 1, collected: "3"},
+			},
+		},
+		{
+			period: PeriodMonth,
+			want:   []period{{start: day(1).Truncate(24 * time.Hour), fees: 5, collected: "7.5", reduced: 1}},
+		},
+	}
+
+	for _, test := range tests {
+		periods, err := sumFees(entries, from, to, test.period)
+		require.NoError(t, err, test.period)
+		got := []period{}
+		for _, p := range periods {
+			got = append(got, period{start: p.Start, fees: p.Fees, collected: p.Collected.String(), reduced: p.Reduced})
+		}
+		require.Equal(t, test.want, got, test.period)
+	}
+
+	periods, err := sumFees(nil, from, to, "")
+	require.NoError(t, err)
+	require.Empty(t, periods, "period without fees")
+
+	_, err = sumFees(entries, from, to, "year")
+	require.Error(t, err, "unknown period")
+}
+
+func TestFeeReport(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	ctx := context.Background()
+	ledger := jctest.NewLedger()
+	mxr, err := NewMixer(
+		WithJobcoinClient(ledger),
+		WithAddress("fees"),
+		WithFee(climatic.MustParseAmount("100")),
+		WithAdminToken("secret"),
+		WithMixConfig(MixConfig{
+			MeanAmount: climatic.MustParseAmount("10"),
+			MinAmount:  climatic.MustParseAmount("10"),
+			MaxAmount:  climatic.MustParseAmount("10"),
+		}),
+		WithLogger(log.New(ioutil.Discard, "", 0)),
+	)
+	require.NoError(err)
+
+	for _, token := range []string{"", "wrong"} {
+		_, err = mxr.FeeReport(ctx, &climatic.FeeReportRequest{Token: token})
+		require.Equal(codes.PermissionDenied, grpc.Code(err), "token %q", token)
+	}
+	_, err = mxr.FeeReport(ctx, &climatic.FeeReportRequest{Token: "secret", Period: "year"})
+	require.Equal(codes.InvalidArgument, grpc.Code(err))
+
+	// the fee is more than the deposit, so the whole deposit is taken
+	res, err := mxr.Register(ctx, &climatic.RegisterRequest{Addresses: []string{"u"}})
+	require.NoError(err)
+	require.NoError(ledger.Create(ctx, res.Address))
+	mixReqs, err := mxr.findMixRequests(ctx)
+	require.NoError(err)
+	mxr.makeMix(mixReqs)
+	require.NoError(mxr.mix(ctx, res.Address))
+	require.Equal(jctest.DefaultCreateAmount, ledger.Balance("fees"))
+
+	report, err := mxr.FeeReport(ctx, &climatic.FeeReportRequest{Token: "secret", Period: PeriodDay, Entries: true})
+	require.NoError(err)
+	require.Len(report.Periods, 1)
+	require.Equal(int32(1), report.Periods[0].Fees)
+	require.Equal(jctest.DefaultCreateAmount.String(), report.Periods[0].Collected)
+	require.Equal("100", report.Periods[0].Charged)
+	require.Equal(int32(1), report.Periods[0].Reduced)
+	require.Len(report.Entries, 1)
+	require.Equal(res.Address, report.Entries[0].DepositAddress)
+	require.Equal(mixReqs[0].id, report.Entries[0].DepositId)
+	require.True(report.Entries[0].Reduced)
+
+	// nothing was collected before the mixer started
+	report, err = mxr.FeeReport(ctx, &climatic.FeeReportRequest{
+		Token: "secret",
+		To:    time.Now().Add(-time.Hour).Unix(),
+	})
+	require.NoError(err)
+	require.Empty(report.Periods)
+	require.Empty(report.Entries)
+}
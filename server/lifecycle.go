@@ -0,0 +1,165 @@
+package server
+
+import (
+	"sort"
+	"time"
+)
+
+// AddressState is where a deposit address is in its life.
+type AddressState string
+
+// The states of a deposit address.
+const (
+	// AddressCreated addresses are registered and waiting for a deposit.
+	AddressCreated AddressState = "created"
+	// AddressFunded addresses have deposits waiting out the initial delay.
+	AddressFunded AddressState = "funded"
+	// AddressMixing addresses are being paid out.
+	AddressMixing AddressState = "mixing"
+	// AddressCompleted addresses were paid out in full. Another deposit
+	// starts a new mix.
+	AddressCompleted AddressState = "completed"
+	// AddressExpired addresses went too long without a deposit. What
+	// happens to deposits that arrive anyway is up to ExpiryConfig.Late.
+	AddressExpired AddressState = "expired"
+	// AddressForgotten addresses were expired for long enough that only
+	// their lifecycle is kept. Deposits that arrive anyway are refunded.
+	AddressForgotten AddressState = "forgotten"
+)
+
+// Lifecycle is the saved state of a deposit address.
+type Lifecycle struct {
+	State AddressState `json:"state"`
+	// Since is when the address got to State.
+	Since time.Time `json:"since"`
+}
+
+// RefundReason says why a deposit is sent back to its sender.
+type RefundReason string
+
+// The reasons for a refund.
+const (
+	// RefundLate deposits came after their address expired.
+	RefundLate RefundReason = "late"
+	// RefundBelowMinimum deposits are smaller than DepositConfig.MinAmount.
+	RefundBelowMinimum RefundReason = "below-minimum"
+	// RefundAboveMaximum deposits are larger than DepositConfig.MaxAmount.
+	RefundAboveMaximum RefundReason = "above-maximum"
+	// RefundUnmixable deposits are no larger than their fee, so nothing
+	// would be left to mix.
+	RefundUnmixable RefundReason = "unmixable"
+)
+
+// setState saves the state of addr. A failure is only logged, since the state
+// is caught up with the next time it changes.
+func (mxr *Mixer) setState(addr string, state AddressState) {
+	lc := &Lifecycle{State: state, Since: mxr.clock.Now()}
+	if err := mxr.ds.SetLifecycle(addr, lc); err != nil {
+		mxr.log.Printf("could not set state of %v to %v: %v", addr, state, err)
+	}
+}
+
+// isMixing reports whether addr has an outstanding mix.
+func (mxr *Mixer) isMixing(addr string) bool {
+	mxr.mtx.Lock()
+	defer mxr.mtx.Unlock()
+
+	_, ok := mxr.outstanding[addr]
+	return ok
+}
+
+// expire expires the deposit addresses that went without a deposit for too
+// long, and forgets the ones that have been expired for long enough, so only
+// their lifecycle is kept.
+func (mxr *Mixer) expire() error {
+	l := mxr.log
+
+	lcs, err := mxr.ds.Lifecycles()
+	if err != nil {
+		return err
+	}
+
+	now := mxr.clock.Now()
+	for addr, lc := range lcs {
+		switch {
+		case lc.Since.IsZero():
+			// registered before addresses had a lifecycle, so its
+			// clock starts now
+			lc.Since = now
+			if err := mxr.ds.SetLifecycle(addr, lc); err != nil {
+				return err
+			}
+
+		case lc.State == AddressCreated || lc.State == AddressCompleted:
+			if mxr.expiryCfg.After <= 0 || now.Sub(lc.Since) < mxr.expiryCfg.After {
+				continue
+			}
+			l.Printf("%v expired after %v %v", addr, lc.State, now.Sub(lc.Since))
+			mxr.setState(addr, AddressExpired)
+
+		case lc.State == AddressExpired:
+			if mxr.expiryCfg.Forget <= 0 || now.Sub(lc.Since) < mxr.expiryCfg.Forget {
+				continue
+			}
+			// a late deposit may still be refunding
+			if mxr.isMixing(addr) {
+				continue
+			}
+			l.Printf("forgetting %v", addr)
+			if err := mxr.ds.Forget(addr); err != nil {
+				return err
+			}
+			mxr.setState(addr, AddressForgotten)
+		}
+	}
+
+	return nil
+}
+
+// watchedAddresses lists the addresses that deposits are looked for in: the
+// registered deposit addresses, and the forgotten ones, whose deposits are
+// refunded.
+func (mxr *Mixer) watchedAddresses() ([]string, error) {
+	addrs, err := mxr.ds.DepositAddresses()
+	if err != nil {
+		return nil, err
+	}
+	lcs, err := mxr.ds.Lifecycles()
+	if err != nil {
+		return nil, err
+	}
+
+	forgotten := []string{}
+	for addr, lc := range lcs {
+		if lc.State == AddressForgotten {
+			forgotten = append(forgotten, addr)
+		}
+	}
+	sort.Strings(forgotten)
+
+	return append(addrs, forgotten...), nil
+}
+
+// addRefund adds a refunded deposit to m, which is a refund mix unless the
+// address was already mixing, with a payout back to the sender that is due
+// now. The payout is the whole deposit, less the fee of the refund if there is
+// one, and records why the deposit is refunded.
+func (m *mix) addRefund(mixReq mixRequest, now time.Time) {
+	amt := mixReq.tx.Amount
+	m.remaining = m.remaining.Add(amt)
+	if mixReq.fee.Sign() > 0 {
+		m.fees = append(m.fees, DepositFee{
+			DepositID: mixReq.id,
+			Amount:    mixReq.fee,
+			Charged:   mixReq.fee,
+		})
+		amt = amt.Sub(mixReq.fee)
+	}
+	m.plan = append(m.plan, PlannedPayout{
+		ID:        mixReq.id,
+		ToAddress: mixReq.tx.FromAddress,
+		Amount:    amt,
+		At:        now,
+		Refund:    mixReq.reason,
+	})
+}
@@ -0,0 +1,342 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/r-medina/climatic"
+	"github.com/r-medina/climatic/jobcoin/jctest"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestLifecycle(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	ctx := context.Background()
+	ledger := jctest.NewLedger()
+	mxr, err := NewMixer(
+		WithJobcoinClient(ledger),
+		WithMixConfig(MixConfig{
+			MeanAmount: climatic.MustParseAmount("50"),
+			MinAmount:  climatic.MustParseAmount("50"),
+			MaxAmount:  climatic.MustParseAmount("50"),
+		}),
+		WithLogger(log.New(ioutil.Discard, "", 0)),
+	)
+	require.NoError(err)
+
+	res, err := mxr.Register(ctx, &climatic.RegisterRequest{Addresses: []string{"u"}})
+	require.NoError(err)
+	state := func() string {
+		status, err := mxr.Status(ctx, &climatic.StatusRequest{Address: res.Address})
+		require.NoError(err)
+		return status.State
+	}
+	require.Equal("created", state())
+
+	require.NoError(ledger.Create(ctx, res.Address))
+	mixReqs, err := mxr.findMixRequests(ctx)
+	require.NoError(err)
+	require.Len(mixReqs, 1)
+	require.False(mixReqs[0].refund)
+	require.Equal("funded", state())
+
+	mxr.makeMix(mixReqs)
+	require.Equal("mixing", state())
+
+	require.NoError(mxr.mix(ctx, res.Address))
+	require.Equal(jctest.DefaultCreateAmount, ledger.Balance("u"))
+	require.Empty(mxr.outstanding)
+	require.Equal("completed", state())
+}
+
+func TestExpire(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	mxr, err := NewMixer(
+		WithExpiryConfig(ExpiryConfig{After: time.Hour, Forget: time.Hour}),
+		WithLogger(log.New(ioutil.Discard, "", 0)),
+	)
+	require.NoError(err)
+	ago := time.Now().Add(-2 * time.Hour)
+
+	// registered before lifecycles were kept
+	require.NoError(mxr.ds.RegisterTerms("old", []string{"u"}, nil, mxr.clock.Now()))
+	require.NoError(mxr.ds.SetLifecycle("old", &Lifecycle{State: AddressCreated}))
+	require.NoError(mxr.ds.RegisterTerms("fresh", []string{"u"}, nil, mxr.clock.Now()))
+	require.NoError(mxr.ds.RegisterTerms("unused", []string{"u"}, nil, mxr.clock.Now()))
+	require.NoError(mxr.ds.SetLifecycle("unused", &Lifecycle{State: AddressCreated, Since: ago}))
+	require.NoError(mxr.ds.RegisterTerms("done", []string{"u"}, nil, mxr.clock.Now()))
+	require.NoError(mxr.ds.SetLifecycle("done", &Lifecycle{State: AddressCompleted, Since: ago}))
+	require.NoError(mxr.ds.RegisterTerms("busy", []string{"u"}, nil, mxr.clock.Now()))
+	require.NoError(mxr.ds.SetLifecycle("busy", &Lifecycle{State: AddressMixing, Since: ago}))
+	require.NoError(mxr.ds.RegisterTerms("refunding", []string{"u"}, nil, mxr.clock.Now()))
+	require.NoError(mxr.ds.SetLifecycle("refunding", &Lifecycle{State: AddressExpired, Since: ago}))
+	mxr.outstanding["refunding"] = &mix{usrAddrs: []string{"u"}, refund: true}
+	require.NoError(mxr.ds.RegisterTerms("gone", []string{"u"}, nil, mxr.clock.Now()))
+	require.NoError(mxr.ds.SetLifecycle("gone", &Lifecycle{State: AddressExpired, Since: ago}))
+
+	require.NoError(mxr.expire())
+
+	lcs, err := mxr.ds.Lifecycles()
+	require.NoError(err)
+	states := map[string]AddressState{}
+	for addr, lc := range lcs {
+		states[addr] = lc.State
+	}
+	require.Equal(map[string]AddressState{
+		"old":       AddressCreated,
+		"fresh":     AddressCreated,
+		"unused":    AddressExpired,
+		"done":      AddressExpired,
+		"busy":      AddressMixing,
+		"refunding": AddressExpired,
+		"gone":      AddressForgotten,
+	}, states)
+	require.False(lcs["old"].Since.IsZero(), "clock of old address not started")
+
+	_, err = mxr.Status(context.Background(), &climatic.StatusRequest{Address: "gone"})
+	require.Equal(codes.NotFound, grpc.Code(err))
+}
+
+func TestLateDeposit(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		late   LatePolicy
+		refund bool
+		// state is the state of the address once the deposit is found
+		state AddressState
+	}{
+		{late: LateHonour, state: AddressFunded},
+		{late: LateRefund, refund: true, state: AddressExpired},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(string(test.late), func(t *testing.T) {
+			t.Parallel()
+			require := require.New(t)
+
+			ctx := context.Background()
+			ledger := jctest.NewLedger()
+			mxr, err := NewMixer(
+				WithJobcoinClient(ledger),
+				WithAddress("fees"),
+				WithFee(climatic.MustParseAmount("1")),
+				WithPool("house"),
+				WithRouteConfig(RouteConfig{Hops: 2}),
+				WithMixConfig(MixConfig{
+					InitialDelay: time.Hour,
+					MeanAmount:   climatic.MustParseAmount("50"),
+					MinAmount:    climatic.MustParseAmount("50"),
+					MaxAmount:    climatic.MustParseAmount("50"),
+				}),
+				WithExpiryConfig(ExpiryConfig{After: time.Hour, Late: test.late}),
+				WithLogger(log.New(ioutil.Discard, "", 0)),
+			)
+			require.NoError(err)
+
+			res, err := mxr.Register(ctx, &climatic.RegisterRequest{Addresses: []string{"u"}})
+			require.NoError(err)
+			require.NoError(mxr.ds.SetLifecycle(res.Address, &Lifecycle{State: AddressExpired, Since: time.Now()}))
+			require.NoError(ledger.Create(ctx, "alice"))
+			require.NoError(ledger.PostTransaction(ctx, "alice", res.Address, climatic.MustParseAmount("10")))
+
+			mixReqs, err := mxr.findMixRequests(ctx)
+			require.NoError(err)
+			require.Len(mixReqs, 1)
+			require.Equal(test.refund, mixReqs[0].refund)
+			lc, err := mxr.ds.Lifecycle(res.Address)
+			require.NoError(err)
+			require.Equal(test.state, lc.State)
+			if !test.refund {
+				require.True(mixReqs[0].due.After(time.Now().Add(time.Minute)), "late deposit not delayed")
+				return
+			}
+
+			// refunds skip the fee, the pool and the hops
+			mxr.makeMix(mixReqs)
+			require.NoError(mxr.mix(ctx, res.Address))
+			require.Equal(jctest.DefaultCreateAmount, ledger.Balance("alice"))
+			require.True(ledger.Balance("fees").IsZero())
+			require.Empty(mxr.outstanding)
+			require.Empty(mxr.routes)
+
+			lc, err = mxr.ds.Lifecycle(res.Address)
+			require.NoError(err)
+			require.Equal(AddressExpired, lc.State)
+		})
+	}
+}
+
+func TestForgottenDeposit(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	ctx := context.Background()
+	ledger := jctest.NewLedger()
+	mxr, err := NewMixer(
+		WithJobcoinClient(ledger),
+		WithAddress("fees"),
+		WithFee(climatic.MustParseAmount("1")),
+		WithExpiryConfig(ExpiryConfig{After: time.Hour, Forget: time.Hour}),
+		WithLogger(log.New(ioutil.Discard, "", 0)),
+	)
+	require.NoError(err)
+
+	ago := time.Now().Add(-2 * time.Hour)
+	forget := func() string {
+		res, err := mxr.Register(ctx, &climatic.RegisterRequest{Addresses: []string{"u"}})
+		require.NoError(err)
+		require.NoError(mxr.ds.SetLifecycle(res.Address, &Lifecycle{State: AddressExpired, Since: ago}))
+		return res.Address
+	}
+	addr, created := forget(), forget()
+	require.NoError(mxr.expire())
+	for _, addr := range []string{addr, created} {
+		usrAddrs, err := mxr.ds.UserAddresses(addr)
+		require.NoError(err)
+		require.Empty(usrAddrs, "address not forgotten")
+	}
+
+	// deposits without a sender can't go anywhere
+	require.NoError(ledger.Create(ctx, created))
+	require.NoError(ledger.Create(ctx, "alice"))
+	require.NoError(ledger.PostTransaction(ctx, "alice", addr, climatic.MustParseAmount("10")))
+
+	mixReqs, err := mxr.findMixRequests(ctx)
+	require.NoError(err)
+	require.Len(mixReqs, 1)
+	require.True(mixReqs[0].refund, "deposit to a forgotten address not refunded")
+	require.Equal(RefundLate, mixReqs[0].reason)
+
+	// the refund is whole
+	mxr.makeMix(mixReqs)
+	require.NoError(mxr.mix(ctx, addr))
+	require.Equal(jctest.DefaultCreateAmount, ledger.Balance("alice"))
+	require.True(ledger.Balance("fees").IsZero())
+	require.Empty(mxr.outstanding)
+
+	lc, err := mxr.ds.Lifecycle(addr)
+	require.NoError(err)
+	require.Equal(AddressForgotten, lc.State)
+}
+
+func TestDepositLimits(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc    string
+		fee     string
+		deposit string
+		// sender is empty if the deposit is created in the deposit
+		// address
+		sender string
+		reason RefundReason
+		// back is what the sender gets back and kept what the mixer
+		// keeps as the refund fee
+		back, kept string
+	}{
+		{desc: "within limits", fee: "1", deposit: "10", sender: "alice"},
+		{desc: "below minimum", fee: "1", deposit: "2", sender: "alice", reason: RefundBelowMinimum, back: "1.5", kept: "0.5"},
+		{desc: "refund fee too big", fee: "1", deposit: "0.4", sender: "alice", reason: RefundBelowMinimum, back: "0.4", kept: "0"},
+		{desc: "above maximum", fee: "1", deposit: "30", sender: "alice", reason: RefundAboveMaximum, back: "29.5", kept: "0.5"},
+		{desc: "unmixable", fee: "10", deposit: "8", sender: "alice", reason: RefundUnmixable, back: "7.5", kept: "0.5"},
+		// below the minimum, but there is no one to send it back to
+		{desc: "no sender", fee: "1", deposit: "2"},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			require := require.New(t)
+
+			ctx := context.Background()
+			amt := climatic.MustParseAmount(test.deposit)
+			ledger := jctest.NewLedger(jctest.WithCreateAmount(amt))
+			mxr, err := NewMixer(
+				WithJobcoinClient(ledger),
+				WithAddress("fees"),
+				WithFee(climatic.MustParseAmount(test.fee)),
+				WithPool("house"),
+				WithRouteConfig(RouteConfig{Hops: 2}),
+				WithMixConfig(MixConfig{
+					InitialDelay: time.Hour,
+					MeanAmount:   climatic.MustParseAmount("50"),
+					MinAmount:    climatic.MustParseAmount("50"),
+					MaxAmount:    climatic.MustParseAmount("50"),
+				}),
+				WithDepositConfig(DepositConfig{
+					MinAmount: climatic.MustParseAmount("5"),
+					MaxAmount: climatic.MustParseAmount("20"),
+					RefundFee: climatic.MustParseAmount("0.5"),
+				}),
+				WithLogger(log.New(ioutil.Discard, "", 0)),
+			)
+			require.NoError(err)
+
+			res, err := mxr.Register(ctx, &climatic.RegisterRequest{Addresses: []string{"u"}})
+			require.NoError(err)
+			if test.sender == "" {
+				require.NoError(ledger.Create(ctx, res.Address))
+			} else {
+				require.NoError(ledger.Create(ctx, test.sender))
+				require.NoError(ledger.PostTransaction(ctx, test.sender, res.Address, amt))
+			}
+
+			mixReqs, err := mxr.findMixRequests(ctx)
+			require.NoError(err)
+			require.Len(mixReqs, 1)
+			require.Equal(test.reason, mixReqs[0].reason)
+			require.Equal(test.reason != "", mixReqs[0].refund)
+			if test.reason == "" {
+				require.True(mixReqs[0].due.After(time.Now().Add(time.Minute)), "deposit not delayed")
+				return
+			}
+
+			// the reason is in the plan
+			mxr.makeMix(mixReqs)
+			status, err := mxr.Status(ctx, &climatic.StatusRequest{Address: res.Address})
+			require.NoError(err)
+			require.Equal(string(AddressMixing), status.State)
+			require.Len(status.Plan, 1)
+			require.Equal(string(test.reason), status.Plan[0].Refund)
+
+			// refunds skip the pool and the hops, and are kept in the
+			// journal with their reason
+			require.NoError(mxr.mix(ctx, res.Address))
+			require.Equal(climatic.MustParseAmount(test.back), ledger.Balance(test.sender))
+			require.Equal(climatic.MustParseAmount(test.kept), ledger.Balance("fees"))
+			require.Empty(mxr.outstanding)
+			require.Empty(mxr.routes)
+			transfers, err := mxr.ds.Transfers(res.Address)
+			require.NoError(err)
+			refunds := 0
+			for _, tr := range transfers {
+				if tr.Kind == TransferPayout {
+					refunds++
+					require.Equal(test.reason, tr.Refund)
+					require.Equal(test.sender, tr.ToAddress)
+				}
+			}
+			require.Equal(1, refunds)
+
+			lc, err := mxr.ds.Lifecycle(res.Address)
+			require.NoError(err)
+			require.Equal(AddressCompleted, lc.State)
+			volume, err := mxr.ds.Volume(res.Address)
+			require.NoError(err)
+			require.True(volume.IsZero(), "refund counted toward volume")
+		})
+	}
+}
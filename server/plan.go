@@ -0,0 +1,285 @@
+package server
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/r-medina/climatic"
+)
+
+// PlannedPayout is one payout in the plan of a deposit address. A plan is made
+// when a deposit is added to a mix, so every user knows up front how much is
+// sent where and when.
+type PlannedPayout struct {
+	ID        string          `json:"id"`
+	ToAddress string          `json:"toAddress"`
+	Amount    climatic.Amount `json:"amount"`
+	// At is when the payout is due.
+	At time.Time `json:"at"`
+	// Deadline is when the payout must be made by, if the user addresses
+	// were registered with a window.
+	Deadline time.Time `json:"deadline,omitempty"`
+	// Paid is whether the payout left the mixer. Routed payouts may still
+	// be on their way to ToAddress.
+	Paid bool `json:"paid"`
+	// Refund is why the payout sends a deposit back to its sender, if it
+	// does.
+	Refund RefundReason `json:"refund,omitempty"`
+}
+
+// payable is how much of m is left to pay out once the fees are collected.
+func (mxr *Mixer) payable(m *mix) climatic.Amount {
+	amt := m.remaining.Add(m.owed)
+	amt = amt.Sub(climatic.MinAmount(m.feeDue(), m.remaining))
+
+	return amt
+}
+
+// extendPlan plans payouts for whatever part of m is not covered by its plan
+// yet: a new deposit or a balance that turned out higher than expected. The
+// amounts are sampled from the mixing configuration, and go to random user
+// addresses unless the addresses were registered with splits. Without a
+// window, the first new payout is due right away and the others follow one
+// mixing delay after another. With one, they are spread over the window of
+// the deposits, which have to be paid out by deadline. A zero deadline
+// continues the latest deadline of the plan.
+func (mxr *Mixer) extendPlan(m *mix, deadline time.Time) error {
+	// refunds only pay back the deposits they were made for
+	if m.refund {
+		return nil
+	}
+
+	rnd := mxr.mixRand(m)
+	left := mxr.payable(m)
+	at := mxr.clock.Now()
+	for _, p := range m.plan {
+		if p.Paid {
+			continue
+		}
+		left = left.Sub(p.Amount)
+		if p.At.After(at) {
+			at = p.At.Add(mxr.strategy.Delay(rnd, mxr.mixCfg))
+		}
+	}
+	if len(m.usrAddrs) == 0 || left.Sign() <= 0 {
+		return nil
+	}
+
+	var (
+		payouts []PlannedPayout
+		err     error
+	)
+	if splits := m.terms.splits(); splits != nil {
+		payouts, err = mxr.splitPayouts(rnd, splits, m.plan, left)
+	} else {
+		payouts, err = mxr.randomPayouts(rnd, m.usrAddrs, m.plan, left)
+	}
+	if err != nil {
+		return err
+	}
+
+	if w := m.terms.window(); w != nil {
+		if deadline.IsZero() {
+			deadline = m.deadline()
+		}
+		if deadline.Sub(mxr.clock.Now()) < mxr.mixCfg.DeadlineMargin {
+			deadline = mxr.clock.Now().Add(w.Max)
+		}
+		mxr.spread(rnd, payouts, w, deadline)
+	} else {
+		for i := range payouts {
+			payouts[i].At = at
+			at = at.Add(mxr.strategy.Delay(rnd, mxr.mixCfg))
+		}
+	}
+	m.plan = append(m.plan, payouts...)
+
+	return nil
+}
+
+// randomPayouts cuts amt into payouts to usrAddrs, after the payouts of plan.
+// The strategy picks the amount and user address of each, drawing from rnd.
+func (mxr *Mixer) randomPayouts(rnd *rand.Rand, usrAddrs []string, plan []PlannedPayout, amt climatic.Amount) ([]PlannedPayout, error) {
+	planned := append([]PlannedPayout(nil), plan...)
+	payouts := []PlannedPayout{}
+	for amt.Sign() > 0 {
+		part := mxr.strategy.Amount(rnd, mxr.mixCfg, amt)
+		if part.Sign() <= 0 {
+			part = amt
+		}
+		id := newID(rnd)
+		p := PlannedPayout{
+			ID:        id.String(),
+			ToAddress: mxr.strategy.Address(rnd, usrAddrs, planned),
+			Amount:    part,
+		}
+		payouts = append(payouts, p)
+		planned = append(planned, p)
+		amt = amt.Sub(part)
+	}
+
+	return payouts, nil
+}
+
+// nextPayout returns the earliest unpaid payout in the plan of m, if there is
+// any.
+func (m *mix) nextPayout() *PlannedPayout {
+	var next *PlannedPayout
+	for i := range m.plan {
+		p := &m.plan[i]
+		if !p.Paid && (next == nil || p.At.Before(next.At)) {
+			next = p
+		}
+	}
+
+	return next
+}
+
+// markPaid marks the planned payout with the given ID as paid with amt, which
+// can be less than planned if the balance came up short.
+func (m *mix) markPaid(id string, amt climatic.Amount) {
+	for i := range m.plan {
+		if m.plan[i].ID == id {
+			m.plan[i].Paid = true
+			m.plan[i].Amount = amt
+			return
+		}
+	}
+}
+
+// nextDeadline returns the earliest deadline of the unpaid payouts in the plan
+// of m, or zero if none of them has one.
+func (m *mix) nextDeadline() time.Time {
+	var next time.Time
+	for _, p := range m.plan {
+		if !p.Paid && !p.Deadline.IsZero() && (next.IsZero() || p.Deadline.Before(next)) {
+			next = p.Deadline
+		}
+	}
+
+	return next
+}
+
+// due returns when the plan of m needs to be worked on next, which is now at
+// the earliest.
+func (m *mix) due(now time.Time) time.Time {
+	due := now
+	if p := m.nextPayout(); p != nil && p.At.After(due) {
+		due = p.At
+	}
+	if m.retryAt.After(due) {
+		due = m.retryAt
+	}
+
+	return due
+}
+
+// wakePlanner makes the scheduler look at the plans again.
+func (mxr *Mixer) wakePlanner() {
+	select {
+	case mxr.planned <- struct{}{}:
+	default:
+	}
+}
+
+// runPlans works on the plans of the outstanding mixes as they come due, with
+// at most MixConfig.Workers of them at a time, until the mixer stops. Each
+// deposit address is only worked on by one worker at a time.
+func (mxr *Mixer) runPlans(ctx context.Context) {
+	l := mxr.log
+
+	jobs := make(chan string)
+	var workers sync.WaitGroup
+	for i := 0; i < mxr.mixCfg.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for addr := range jobs {
+				l.Printf("running mix of %v", addr)
+				if err := mxr.mix(ctx, addr); err != nil {
+					l.Printf("mix of %v failed: %v", addr, err)
+				}
+
+				mxr.mtx.Lock()
+				delete(mxr.busy, addr)
+				mxr.mtx.Unlock()
+				mxr.wakePlanner()
+			}
+		}()
+	}
+	defer func() {
+		close(jobs)
+		workers.Wait()
+	}()
+
+	for {
+		addrs, wait, ok := mxr.duePlans()
+		for _, addr := range addrs {
+			select {
+			case <-ctx.Done():
+				return
+			case <-mxr.stopping:
+				return
+			case jobs <- addr:
+			}
+		}
+
+		// with no plan to wait for, only a new mix wakes the loop
+		var due <-chan time.Time
+		if ok {
+			due = mxr.clock.After(wait)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-mxr.stopping:
+			return
+		case <-mxr.planned:
+		case <-due:
+		}
+	}
+}
+
+// duePlans returns the deposit addresses whose plans are due, in the order the
+// strategy puts them in, and marks them as busy. It also returns how long until
+// the next plan is due, if there is any that isn't busy.
+func (mxr *Mixer) duePlans() ([]string, time.Duration, bool) {
+	mxr.mtx.Lock()
+	defer mxr.mtx.Unlock()
+
+	var (
+		dueMixes []DueMix
+		next     time.Time
+		pending  bool
+	)
+	now := mxr.clock.Now()
+	for addr, m := range mxr.outstanding {
+		if mxr.busy[addr] {
+			continue
+		}
+		due := m.next
+		if !due.After(now) {
+			mxr.busy[addr] = true
+			dueMixes = append(dueMixes, DueMix{Address: addr, Due: due, Balance: m.balance, Deadline: m.dueBy})
+			continue
+		}
+		if !pending || due.Before(next) {
+			next, pending = due, true
+		}
+	}
+
+	// maps are walked in random order, which would keep runs from being
+	// replayed
+	sort.Slice(dueMixes, func(i, j int) bool { return dueMixes[i].Address < dueMixes[j].Address })
+	mxr.strategy.Order(mxr.planRnd, dueMixes)
+	addrs := make([]string, 0, len(dueMixes))
+	for _, d := range dueMixes {
+		addrs = append(addrs, d.Address)
+	}
+
+	return addrs, next.Sub(now), pending
+}
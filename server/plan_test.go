@@ -0,0 +1,399 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/r-medina/climatic"
+	"github.com/r-medina/climatic/jobcoin"
+	"github.com/r-medina/climatic/jobcoin/jctest"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestExtendPlan(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	mxr, err := NewMixer(
+		WithFee(climatic.MustParseAmount("1")),
+		WithMixConfig(MixConfig{
+			MeanDelay:  time.Minute,
+			MinDelay:   time.Minute,
+			MaxDelay:   time.Minute,
+			MeanAmount: climatic.MustParseAmount("3"),
+			MinAmount:  climatic.MustParseAmount("3"),
+			MaxAmount:  climatic.MustParseAmount("3"),
+		}),
+		WithLogger(log.New(ioutil.Discard, "", 0)),
+	)
+	require.NoError(err)
+
+	m := &mix{
+		usrAddrs:  []string{"u1", "u2"},
+		remaining: climatic.MustParseAmount("11"),
+		fees:      []DepositFee{{DepositID: "1", Amount: climatic.MustParseAmount("1")}},
+	}
+	start := time.Now()
+	require.NoError(mxr.extendPlan(m, time.Time{}))
+
+	// the fee is left out, and the last payout takes what is left
+	require.Len(m.plan, 4)
+	amts := []string{}
+	for i, p := range m.plan {
+		amts = append(amts, p.Amount.String())
+		require.Contains(m.usrAddrs, p.ToAddress)
+		require.False(p.Paid)
+		require.False(p.At.Before(start.Add(time.Duration(i)*time.Minute)), "payout %d too early", i)
+		require.True(p.At.Before(time.Now().Add(time.Duration(i)*time.Minute)), "payout %d too late", i)
+	}
+	require.Equal([]string{"3", "3", "3", "1"}, amts)
+
+	// a plan that covers the mix is left alone
+	plan := append([]PlannedPayout(nil), m.plan...)
+	require.NoError(mxr.extendPlan(m, time.Time{}))
+	require.Equal(plan, m.plan)
+
+	// more Jobcoins are planned after the last payout
+	m.markPaid(m.plan[0].ID, m.plan[0].Amount)
+	m.remaining = climatic.MustParseAmount("10")
+	require.Equal(m.plan[1].ID, m.nextPayout().ID)
+	require.NoError(mxr.extendPlan(m, time.Time{}))
+	require.Len(m.plan, 5)
+	require.Equal("2", m.plan[4].Amount.String())
+	require.Equal(m.plan[3].At.Add(time.Minute), m.plan[4].At)
+}
+
+func TestDenominations(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	amts := func(ss ...string) []climatic.Amount {
+		amts := []climatic.Amount{}
+		for _, s := range ss {
+			amts = append(amts, climatic.MustParseAmount(s))
+		}
+		return amts
+	}
+	mixCfg := MixConfig{
+		MeanAmount:    climatic.MustParseAmount("12"),
+		MinAmount:     climatic.MustParseAmount("12"),
+		MaxAmount:     climatic.MustParseAmount("12"),
+		Denominations: amts("10", "1", "5", "50", "0", "5"),
+	}
+	mixCfg.makeValid()
+	require.Equal(amts("1", "5", "10", "50"), mixCfg.Denominations)
+
+	rnd := newRand(rand.NewSource(1))
+	for left, want := range map[string]string{
+		"100": "10",
+		"7":   "5",
+		"3":   "1",
+		"0.5": "0.5",
+	} {
+		require.Equal(want, mixCfg.part(rnd, climatic.MustParseAmount(left)).String(), "part of %s", left)
+	}
+
+	// samples below the smallest denomination are rounded up to it
+	small := mixCfg
+	small.MeanAmount = climatic.MustParseAmount("0.5")
+	small.MinAmount = climatic.MustParseAmount("0.5")
+	small.MaxAmount = climatic.MustParseAmount("0.5")
+	require.Equal("1", small.part(rnd, climatic.MustParseAmount("20")).String())
+
+	mxr, err := NewMixer(
+		WithFee(climatic.MustParseAmount("1")),
+		WithMixConfig(mixCfg),
+		WithLogger(log.New(ioutil.Discard, "", 0)),
+	)
+	require.NoError(err)
+	m := &mix{
+		usrAddrs:  []string{"u1", "u2"},
+		remaining: climatic.MustParseAmount("29.3"),
+		fees:      []DepositFee{{DepositID: "1", Amount: climatic.MustParseAmount("1")}},
+	}
+	require.NoError(mxr.extendPlan(m, time.Time{}))
+
+	// only the last payout isn't a denomination
+	planned := []string{}
+	for _, p := range m.plan {
+		planned = append(planned, p.Amount.String())
+	}
+	require.Equal([]string{"10", "10", "5", "1", "1", "1", "0.3"}, planned)
+}
+
+func TestMixerPlans(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ledger := jctest.NewLedger()
+	mxr, err := NewMixer(
+		WithJobcoinClient(ledger),
+		WithAddress("fees"),
+		WithFee(climatic.MustParseAmount("1")),
+		WithPollConfig(PollConfig{MeanDelay: 5 * time.Millisecond, MaxDelay: 5 * time.Millisecond}),
+		WithMixConfig(MixConfig{
+			MeanDelay:  time.Millisecond,
+			MaxDelay:   time.Millisecond,
+			MeanAmount: climatic.MustParseAmount("4"),
+			MinAmount:  climatic.MustParseAmount("2"),
+			MaxAmount:  climatic.MustParseAmount("8"),
+			Workers:    3,
+		}),
+		WithLogger(log.New(ioutil.Discard, "", 0)),
+	)
+	require.NoError(err)
+	go func() { _ = mxr.Start(ctx) }()
+
+	require.NoError(ledger.Create(ctx, "alice"))
+	depositAddrs := []string{}
+	for i := 0; i < 5; i++ {
+		usrAddr := fmt.Sprintf("u%d", i)
+		res, err := mxr.Register(ctx, &climatic.RegisterRequest{Addresses: []string{usrAddr}})
+		require.NoError(err)
+		require.NoError(ledger.PostTransaction(ctx, "alice", res.Address, climatic.MustParseAmount("9")))
+		depositAddrs = append(depositAddrs, res.Address)
+	}
+
+	paid := func() bool {
+		for i := range depositAddrs {
+			if ledger.Balance(fmt.Sprintf("u%d", i)) != climatic.MustParseAmount("8") {
+				return false
+			}
+		}
+		return true
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !paid() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	require.True(paid(), "not every deposit was paid out")
+	require.Equal(climatic.MustParseAmount("5"), ledger.Balance("fees"))
+
+	mxr.mtx.Lock()
+	require.Empty(mxr.outstanding)
+	require.Empty(mxr.busy)
+	mxr.mtx.Unlock()
+}
+
+func TestPlanStatus(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	ctx := context.Background()
+	ledger := jctest.NewLedger()
+	require.NoError(ledger.Create(ctx, "d"))
+	mxr, err := NewMixer(
+		WithJobcoinClient(ledger),
+		WithMixConfig(MixConfig{
+			MeanDelay:  time.Hour,
+			MaxDelay:   time.Hour,
+			MeanAmount: climatic.MustParseAmount("20"),
+			MinAmount:  climatic.MustParseAmount("20"),
+			MaxAmount:  climatic.MustParseAmount("20"),
+		}),
+		WithLogger(log.New(ioutil.Discard, "", 0)),
+	)
+	require.NoError(err)
+	require.NoError(mxr.ds.RegisterTerms("d", []string{"u"}, nil, mxr.clock.Now()))
+	// the deposit was found by an earlier poll
+	_, cursor, err := ledger.GetTransactionsSince(ctx, jobcoin.Cursor{})
+	require.NoError(err)
+	require.NoError(mxr.ds.SavePoll(cursor, nil))
+	mxr.outstanding["d"] = &mix{usrAddrs: []string{"u"}, remaining: jctest.DefaultCreateAmount}
+
+	// only the first payout is due
+	require.NoError(mxr.mix(ctx, "d"))
+	require.Equal(climatic.MustParseAmount("20"), ledger.Balance("u"))
+
+	status, err := mxr.Status(ctx, &climatic.StatusRequest{Address: "d"})
+	require.NoError(err)
+	require.Equal("30", status.Remaining)
+	require.Len(status.Plan, 3)
+	paid := 0
+	for _, p := range status.Plan {
+		require.Equal("u", p.ToAddress)
+		if p.Paid {
+			paid++
+		}
+	}
+	require.Equal(1, paid)
+	require.Equal([]string{"20", "20", "10"}, []string{
+		status.Plan[0].Amount, status.Plan[1].Amount, status.Plan[2].Amount,
+	})
+
+	// a worker on the mix doesn't hold up the status
+	m := mxr.outstanding["d"]
+	m.mtx.Lock()
+	status, err = mxr.Status(ctx, &climatic.StatusRequest{Address: "d"})
+	m.mtx.Unlock()
+	require.NoError(err)
+	require.Equal("30", status.Remaining)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = mxr.Status(cancelled, &climatic.StatusRequest{Address: "d"})
+	require.Equal(codes.Canceled, grpc.Code(err))
+}
+
+// stallingLedger holds up every transaction from one address until it is
+// released.
+type stallingLedger struct {
+	*jctest.Ledger
+	from    string
+	stalled chan struct{}
+	release chan struct{}
+}
+
+func (l *stallingLedger) PostTransaction(ctx context.Context, fromAddr, toAddr string, amt climatic.Amount) error {
+	if fromAddr == l.from {
+		select {
+		case l.stalled <- struct{}{}:
+		default:
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-l.release:
+		}
+	}
+
+	return l.Ledger.PostTransaction(ctx, fromAddr, toAddr, amt)
+}
+
+func TestMixesInParallel(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ledger := &stallingLedger{
+		Ledger:  jctest.NewLedger(),
+		from:    "slow",
+		stalled: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	mxr, err := NewMixer(
+		WithJobcoinClient(ledger),
+		WithMixConfig(MixConfig{
+			MeanDelay:  time.Millisecond,
+			MaxDelay:   time.Millisecond,
+			MeanAmount: climatic.MustParseAmount("50"),
+			MinAmount:  climatic.MustParseAmount("50"),
+			MaxAmount:  climatic.MustParseAmount("50"),
+			Workers:    2,
+		}),
+		WithLogger(log.New(ioutil.Discard, "", 0)),
+	)
+	require.NoError(err)
+	for _, addr := range []string{"slow", "fast"} {
+		require.NoError(ledger.Create(ctx, addr))
+		require.NoError(mxr.ds.RegisterTerms(addr, []string{addr + "-u"}, nil, mxr.clock.Now()))
+		mxr.outstanding[addr] = &mix{usrAddrs: []string{addr + "-u"}, remaining: jctest.DefaultCreateAmount}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mxr.runPlans(ctx)
+	}()
+
+	select {
+	case <-ledger.stalled:
+	case <-time.After(5 * time.Second):
+		require.FailNow("slow payout never started")
+	}
+
+	// the other deposit address is paid out while the slow one is stuck
+	deadline := time.Now().Add(5 * time.Second)
+	for ledger.Balance("fast-u").IsZero() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	require.Equal(jctest.DefaultCreateAmount, ledger.Balance("fast-u"), "fast deposit held up")
+	status, err := mxr.Status(ctx, &climatic.StatusRequest{Address: "fast"})
+	require.NoError(err)
+	require.Equal("completed", status.State)
+	// and so is the status of the slow one, while its worker waits
+	_, err = mxr.Status(ctx, &climatic.StatusRequest{Address: "slow"})
+	require.NoError(err)
+
+	close(ledger.release)
+	for ledger.Balance("slow-u").IsZero() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	require.Equal(jctest.DefaultCreateAmount, ledger.Balance("slow-u"))
+
+	cancel()
+	<-done
+}
+
+// BenchmarkMixerPlans pays out deposits through a ledger that takes a
+// millisecond per call, with more and more workers.
+func BenchmarkMixerPlans(b *testing.B) {
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			benchmarkMixerPlans(b, workers)
+		})
+	}
+}
+
+func benchmarkMixerPlans(b *testing.B, workers int) {
+	const deposits = 16
+
+	require := require.New(b)
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		ctx, cancel := context.WithCancel(context.Background())
+		ledger := jctest.NewLedger(jctest.WithLatency(time.Millisecond))
+		mxr, err := NewMixer(
+			WithJobcoinClient(ledger),
+			WithMixConfig(MixConfig{
+				MeanAmount: climatic.MustParseAmount("10"),
+				MinAmount:  climatic.MustParseAmount("10"),
+				MaxAmount:  climatic.MustParseAmount("10"),
+				Workers:    workers,
+			}),
+			WithLogger(log.New(ioutil.Discard, "", 0)),
+		)
+		require.NoError(err)
+		for d := 0; d < deposits; d++ {
+			addr := fmt.Sprintf("d%d", d)
+			require.NoError(ledger.Create(ctx, addr))
+			require.NoError(mxr.ds.RegisterTerms(addr, []string{"u"}, nil, mxr.clock.Now()))
+			mxr.outstanding[addr] = &mix{usrAddrs: []string{"u"}, remaining: jctest.DefaultCreateAmount}
+		}
+		// the deposits were found by an earlier poll
+		_, cursor, err := ledger.GetTransactionsSince(ctx, jobcoin.Cursor{})
+		require.NoError(err)
+		require.NoError(mxr.ds.SavePoll(cursor, nil))
+		done := make(chan struct{})
+		b.StartTimer()
+
+		go func() {
+			defer close(done)
+			mxr.runPlans(ctx)
+		}()
+		want := jctest.DefaultCreateAmount.MulRatio(deposits, 1, climatic.RoundDown)
+		deadline := time.Now().Add(time.Minute)
+		for ledger.Balance("u") != want {
+			if time.Now().After(deadline) {
+				cancel()
+				<-done
+				b.Fatalf("paid out %v of %v", ledger.Balance("u"), want)
+			}
+			time.Sleep(100 * time.Microsecond)
+		}
+
+		b.StopTimer()
+		cancel()
+		<-done
+	}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"math/rand"
+
+	"github.com/r-medina/climatic"
+)
+
+// sweep moves what is left in a deposit address into a random house address.
+// From then on it is owed to the user by the pool.
+func (mxr *Mixer) sweep(ctx context.Context, m *mix, addr string) error {
+	if m.remaining.Sign() <= 0 {
+		return nil
+	}
+
+	houseAddr := mxr.pool[mxr.mixRand(m).Intn(len(mxr.pool))]
+	mxr.log.Printf("sweeping %v from %v into the pool", m.remaining, addr)
+	t, err := mxr.beginTransfer(ctx, m, TransferSweep, addr, addr, houseAddr, m.remaining)
+	if err != nil {
+		return err
+	}
+
+	return mxr.postTransfer(ctx, m, t)
+}
+
+// payFromPool sends the planned payout p, which is part of what is owed for a
+// deposit, out of a house address.
+func (mxr *Mixer) payFromPool(ctx context.Context, m *mix, addr string, p *PlannedPayout) error {
+	amt := climatic.MinAmount(p.Amount, m.owed)
+	if amt.Sign() <= 0 {
+		return nil
+	}
+
+	houseAddr, amt, err := mxr.pickHouse(ctx, mxr.mixRand(m), amt)
+	if err != nil {
+		return err
+	}
+	if houseAddr != "" {
+		defer mxr.releaseHouse(houseAddr)
+	}
+	if amt.Sign() <= 0 {
+		// everything in the pool is still on its way in, or stuck
+		// behind a transfer that isn't resolved
+		mxr.log.Printf("pool is empty")
+		return nil
+	}
+
+	mxr.log.Printf("paying %v to %v out of the pool for %v", amt, p.ToAddress, addr)
+	return mxr.payout(ctx, m, addr, houseAddr, p, amt)
+}
+
+// pickHouse picks a random house address that can pay amt and reserves it. If
+// none can, it picks the one with the largest balance and lowers amt to that.
+// House addresses that another payout has reserved are passed over, and so are
+// those with an unresolved transfer from them: until it is resolved, an
+// identical payout from the same address would make it look like it went
+// through. The caller releases the address it gets, if it gets one. The order
+// the addresses are tried in is drawn from rnd.
+func (mxr *Mixer) pickHouse(ctx context.Context, rnd *rand.Rand, amt climatic.Amount) (string, climatic.Amount, error) {
+	var (
+		richest string
+		most    climatic.Amount
+	)
+	for _, i := range rnd.Perm(len(mxr.pool)) {
+		houseAddr := mxr.pool[i]
+		if !mxr.reserveHouse(houseAddr) {
+			continue
+		}
+		balance, err := mxr.getRemaining(ctx, houseAddr)
+		if err != nil {
+			mxr.releaseHouse(houseAddr)
+			if richest != "" {
+				mxr.releaseHouse(richest)
+			}
+			return "", climatic.Amount{}, err
+		}
+		if balance.Cmp(amt) >= 0 {
+			if richest != "" {
+				mxr.releaseHouse(richest)
+			}
+			return houseAddr, amt, nil
+		}
+		if richest != "" && balance.Cmp(most) <= 0 {
+			mxr.releaseHouse(houseAddr)
+			continue
+		}
+		if richest != "" {
+			mxr.releaseHouse(richest)
+		}
+		richest, most = houseAddr, balance
+	}
+
+	return richest, most, nil
+}
+
+// reserveHouse reserves the house address addr for a payout or a check of its
+// transfers, and reports whether it could. It can't while it is reserved
+// already, or while a transfer from it is unresolved.
+func (mxr *Mixer) reserveHouse(addr string) bool {
+	mxr.mtx.Lock()
+	defer mxr.mtx.Unlock()
+
+	if mxr.reserved[addr] || mxr.unresolvedFrom(addr) {
+		return false
+	}
+	mxr.reserved[addr] = true
+
+	return true
+}
+
+// releaseHouse releases the house address addr reserved with reserveHouse.
+func (mxr *Mixer) releaseHouse(addr string) {
+	mxr.mtx.Lock()
+	delete(mxr.reserved, addr)
+	mxr.mtx.Unlock()
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+
+	"github.com/satori/go.uuid"
+)
+
+// cryptoSource is a rand.Source that reads from crypto/rand, so nothing it
+// draws can be predicted from what it drew before. It can't be seeded.
+type cryptoSource struct{}
+
+var _ rand.Source64 = cryptoSource{}
+
+func (cryptoSource) Seed(int64) {}
+
+func (s cryptoSource) Int63() int64 {
+	return int64(s.Uint64() &^ (1 << 63))
+}
+
+func (cryptoSource) Uint64() uint64 {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		// the system has no randomness left to give, which nothing in
+		// the mixer can do without
+		panic("could not read random bytes: " + err.Error())
+	}
+
+	return binary.LittleEndian.Uint64(b[:])
+}
+
+// lockedSource makes a rand.Source safe to draw from concurrently, which the
+// workers do.
+type lockedSource struct {
+	mtx sync.Mutex
+	src rand.Source
+}
+
+var _ rand.Source64 = &lockedSource{}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mtx.Lock()
+	s.src.Seed(seed)
+	s.mtx.Unlock()
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if src, ok := s.src.(rand.Source64); ok {
+		return src.Uint64()
+	}
+	return uint64(s.src.Int63())>>31 | uint64(s.src.Int63())<<32
+}
+
+// newRand returns a rand.Rand that draws from src and is safe for concurrent
+// use, as long as its Read method isn't used.
+func newRand(src rand.Source) *rand.Rand {
+	return rand.New(&lockedSource{src: src})
+}
+
+// stream returns the randomness that the part of the mixer called name draws
+// from. With crypto/rand that is the randomness of the mixer itself. With a
+// source given to WithRand, every part gets a stream of its own, seeded from
+// the source and name, so what one part draws doesn't depend on when the
+// others draw.
+func (mxr *Mixer) stream(name string) *rand.Rand {
+	if !mxr.seeded {
+		return mxr.rnd
+	}
+
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+	return newRand(rand.NewSource(mxr.seed ^ int64(h.Sum64())))
+}
+
+// mixRand returns the randomness that the choices for m are drawn from.
+func (mxr *Mixer) mixRand(m *mix) *rand.Rand {
+	if m.rnd == nil {
+		return mxr.rnd
+	}
+	return m.rnd
+}
+
+// newID returns a random (version 4) UUID drawn from rnd, so that a seeded run
+// gets the same IDs every time.
+func newID(rnd *rand.Rand) uuid.UUID {
+	return newUUID(rnd.Uint64)
+}
+
+// newAddr returns a random (version 4) UUID for a new address of the mixer. It
+// is always drawn from crypto/rand, even when the mixer is seeded, since anyone
+// who could predict the addresses could follow Jobcoins through them.
+func newAddr() uuid.UUID {
+	return newUUID(cryptoSource{}.Uint64)
+}
+
+// newUUID returns a random (version 4) UUID made of two draws of uint64.
+func newUUID(uint64 func() uint64) uuid.UUID {
+	var id uuid.UUID
+	binary.LittleEndian.PutUint64(id[:8], uint64())
+	binary.LittleEndian.PutUint64(id[8:], uint64())
+	id.SetVersion(uuid.V4)
+	id.SetVariant(uuid.VariantRFC4122)
+
+	return id
+}
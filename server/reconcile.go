@@ -0,0 +1,537 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"sort"
+	"time"
+
+	"github.com/r-medina/climatic"
+	"github.com/r-medina/climatic/jobcoin"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// DiscrepancyKind says how the ledger disagrees with the mixer.
+type DiscrepancyKind string
+
+// The kinds of discrepancy.
+const (
+	// DiscrepancyBalance is a balance other than the mixer expects.
+	DiscrepancyBalance DiscrepancyKind = "balance"
+	// DiscrepancyOutsideSpend is a transaction from an address of the
+	// mixer that isn't in the transfer journal.
+	DiscrepancyOutsideSpend DiscrepancyKind = "outside-spend"
+	// DiscrepancyMissingTransfer is a transfer or fee that went through
+	// according to the mixer but isn't in the ledger.
+	DiscrepancyMissingTransfer DiscrepancyKind = "missing-transfer"
+)
+
+// Discrepancy is a difference between the ledger and the mixer's accounting
+// that no transfer explains.
+type Discrepancy struct {
+	Kind    DiscrepancyKind `json:"kind"`
+	Address string          `json:"address"`
+	// Expected is the balance the mixer expects, or the amount of a missing
+	// transfer.
+	Expected climatic.Amount `json:"expected"`
+	// Actual is the balance in the ledger, or the amount of an outside
+	// spend.
+	Actual climatic.Amount `json:"actual"`
+	// TransferID is the missing transfer.
+	TransferID string `json:"transferId,omitempty"`
+	// ToAddress is where a missing transfer or an outside spend went.
+	ToAddress string `json:"toAddress,omitempty"`
+}
+
+// ReconcileReport is the outcome of checking the mixer's accounting against
+// the ledger.
+type ReconcileReport struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Checked is how many addresses were checked.
+	Checked int `json:"checked"`
+	// Skipped is how many addresses were left out because the outcome of
+	// a transfer from them is unknown, a payout was using them, or the API
+	// doesn't know them.
+	Skipped       int            `json:"skipped"`
+	Discrepancies []*Discrepancy `json:"discrepancies"`
+	// Err is why the run stopped early, if it did.
+	Err string `json:"error,omitempty"`
+}
+
+// The reconciliation metrics are served by expvar, at /debug/vars on the
+// default HTTP mux or wherever expvar.Handler is mounted. runs, failed and drift count up, while discrepancies and
+// lastRun are from the last run.
+var (
+	reconcileVars          = expvar.NewMap("reconcile")
+	reconcileDiscrepancies = new(expvar.Int)
+	reconcileLastRun       = new(expvar.String)
+)
+
+func init() {
+	reconcileVars.Set("discrepancies", reconcileDiscrepancies)
+	reconcileVars.Set("lastRun", reconcileLastRun)
+}
+
+// addressInfo gets the ledger's view of the deposit address addr, along with
+// how much of its balance has yet to reach its mix in deposits that are pending
+// or that no poll has found yet. The mix of addr, if there is one, must be
+// locked, so that no deposit moves into it meanwhile.
+func (mxr *Mixer) addressInfo(
+	ctx context.Context, addr string,
+) (*jobcoin.AddressInfo, climatic.Amount, error) {
+	// Every deposit is either after the cursor or pending, and pending
+	// ones are in the ledger already, so reading the poll state first
+	// counts every deposit in the balance once.
+	cursor, pending, err := mxr.ds.PollState(addr)
+	if err != nil {
+		return nil, climatic.Amount{}, errors.Wrap(err, "could not get poll state")
+	}
+
+	callCtx, cancel := mxr.callCtx(ctx)
+	addrInfo, err := mxr.jcClient.GetAddressInfo(callCtx, addr)
+	cancel()
+	if err != nil {
+		return nil, climatic.Amount{}, err
+	}
+	if addrInfo == nil {
+		addrInfo = &jobcoin.AddressInfo{}
+	}
+
+	deposits := []*jobcoin.Transaction{}
+	for _, tx := range addrInfo.Transactions {
+		if tx.ToAddress == addr {
+			deposits = append(deposits, tx)
+		}
+	}
+	deposits, _ = cursor.Next(deposits)
+	for _, p := range pending {
+		deposits = append(deposits, p.Deposit)
+	}
+
+	var unmixed climatic.Amount
+	for _, tx := range deposits {
+		// negative deposits are never mixed
+		if tx.Amount.Sign() > 0 {
+			unmixed = unmixed.Add(tx.Amount)
+		}
+	}
+
+	return addrInfo, unmixed, nil
+}
+
+// compareJournal compares the transactions from addr in its history with the
+// journaled transfers from it. A transfer that went through according to the
+// journal but isn't in the history is missing, and a transaction that no
+// transfer explains is an outside spend. Pending transfers may or may not be in
+// the history. The first confirmed transactions from addr are accounted for by
+// transfers that were dropped from the journal, so they are left out. It returns
+// the discrepancies and how many transactions from addr there are.
+func compareJournal(
+	addr string, addrInfo *jobcoin.AddressInfo, transfers []*Transfer, confirmed int,
+) ([]*Discrepancy, int) {
+	type key struct {
+		to  string
+		amt climatic.Amount
+	}
+	txs := []*jobcoin.Transaction{}
+	for _, tx := range addrInfo.Transactions {
+		if tx.FromAddress == addr {
+			txs = append(txs, tx)
+		}
+	}
+	sort.SliceStable(txs, func(i, j int) bool { return txs[i].Timestamp.Before(txs[j].Timestamp) })
+	sends := len(txs)
+	if confirmed > sends {
+		confirmed = sends
+	}
+	sent := map[key][]*jobcoin.Transaction{}
+	for _, tx := range txs[confirmed:] {
+		k := key{to: tx.ToAddress, amt: tx.Amount}
+		sent[k] = append(sent[k], tx)
+	}
+	take := func(t *Transfer) bool {
+		k := key{to: t.ToAddress, amt: t.Amount}
+		if len(sent[k]) == 0 {
+			return false
+		}
+		sent[k] = sent[k][1:]
+		return true
+	}
+
+	discrepancies := []*Discrepancy{}
+	for _, t := range transfers {
+		if t.Status == TransferDone && !take(t) {
+			discrepancies = append(discrepancies, &Discrepancy{
+				Kind:       DiscrepancyMissingTransfer,
+				Address:    addr,
+				Expected:   t.Amount,
+				TransferID: t.ID,
+				ToAddress:  t.ToAddress,
+			})
+		}
+	}
+	// only once the done transfers have theirs
+	for _, t := range transfers {
+		if t.Status == TransferPending {
+			take(t)
+		}
+	}
+
+	outside := []*jobcoin.Transaction{}
+	for _, txs := range sent {
+		outside = append(outside, txs...)
+	}
+	sort.Slice(outside, func(i, j int) bool {
+		if !outside[i].Timestamp.Equal(outside[j].Timestamp) {
+			return outside[i].Timestamp.Before(outside[j].Timestamp)
+		}
+		return jobcoin.Fingerprint(outside[i]) < jobcoin.Fingerprint(outside[j])
+	})
+	for _, tx := range outside {
+		discrepancies = append(discrepancies, &Discrepancy{
+			Kind:      DiscrepancyOutsideSpend,
+			Address:   addr,
+			Actual:    tx.Amount,
+			ToAddress: tx.ToAddress,
+		})
+	}
+
+	return discrepancies, sends
+}
+
+// checkJournal adds the discrepancies between the journal of addr and its
+// history to report. If there are none and no transfer from addr is pending,
+// the transfers that went through are confirmed, which drops them from the
+// journal. Nothing else may send from addr while it is checked.
+func (mxr *Mixer) checkJournal(
+	addr string, addrInfo *jobcoin.AddressInfo, transfers []*Transfer, report *ReconcileReport,
+) error {
+	confirmed, err := mxr.ds.ConfirmedSends(addr)
+	if err != nil {
+		return errors.Wrapf(err, "could not get confirmed sends from %v", addr)
+	}
+	discrepancies, sends := compareJournal(addr, addrInfo, transfers, confirmed)
+	report.Discrepancies = append(report.Discrepancies, discrepancies...)
+	if len(discrepancies) > 0 {
+		return nil
+	}
+
+	ids := []string{}
+	for _, t := range transfers {
+		if t.Status != TransferDone {
+			return nil
+		}
+		ids = append(ids, t.ID)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := mxr.ds.ConfirmTransfers(addr, sends, ids); err != nil {
+		return errors.Wrapf(err, "could not confirm transfers from %v", addr)
+	}
+
+	return nil
+}
+
+// reconcileDeposit checks the deposit address addr against the ledger: its
+// balance should be what is left in its mix plus the deposits that haven't
+// reached the mix, and what was sent from it should match the journal. The mix
+// is locked while it is checked, and skipped if the outcome of a transfer from
+// it is unknown.
+func (mxr *Mixer) reconcileDeposit(ctx context.Context, addr string, report *ReconcileReport) error {
+	for {
+		m := mxr.lockMix(addr, nil)
+		retry, err := mxr.reconcileMix(ctx, addr, m, report)
+		if m != nil {
+			m.mtx.Unlock()
+		}
+		if !retry {
+			return err
+		}
+	}
+}
+
+// reconcileMix does the work of reconcileDeposit with the mix m of addr, or
+// nil, locked. Without a mix, pending deposits can move into a new one while
+// they are counted, in which case it returns true to be tried again.
+func (mxr *Mixer) reconcileMix(
+	ctx context.Context, addr string, m *mix, report *ReconcileReport,
+) (bool, error) {
+	l := mxr.log
+
+	mxr.mtx.Lock()
+	_, unresolved := mxr.unresolved[addr]
+	mxr.mtx.Unlock()
+	if unresolved {
+		report.Skipped++
+		return false, nil
+	}
+
+	transfers, err := mxr.ds.Transfers(addr)
+	if err != nil {
+		return false, errors.Wrapf(err, "could not get transfers from %v", addr)
+	}
+	addrInfo, unmixed, err := mxr.addressInfo(ctx, addr)
+	if errors.Is(err, jobcoin.ErrNotFound) {
+		l.Printf("skipping %v: %v", addr, err)
+		report.Skipped++
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "could not get %v", addr)
+	}
+
+	expected := unmixed
+	if m != nil {
+		expected = expected.Add(m.remaining)
+	} else {
+		mxr.mtx.Lock()
+		_, ok := mxr.outstanding[addr]
+		mxr.mtx.Unlock()
+		if ok {
+			return true, nil
+		}
+	}
+
+	report.Checked++
+	if err := mxr.checkJournal(addr, addrInfo, transfers, report); err != nil {
+		return false, err
+	}
+	if addrInfo.Balance.Cmp(expected) != 0 {
+		report.Discrepancies = append(report.Discrepancies, &Discrepancy{
+			Kind:     DiscrepancyBalance,
+			Address:  addr,
+			Expected: expected,
+			Actual:   addrInfo.Balance,
+		})
+	}
+
+	return false, nil
+}
+
+// reconcilePool checks that what was sent from the house addresses matches the
+// journal. Their balances can't be checked, since anyone may fund them. Each
+// house address is reserved while it is checked, and left out if a payout has
+// it reserved or a transfer from it is unresolved.
+func (mxr *Mixer) reconcilePool(ctx context.Context, report *ReconcileReport) error {
+	for _, addr := range mxr.pool {
+		if err := mxr.reconcileHouse(ctx, addr, report); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reconcileHouse does the work of reconcilePool with the house address addr.
+func (mxr *Mixer) reconcileHouse(ctx context.Context, addr string, report *ReconcileReport) error {
+	if !mxr.reserveHouse(addr) {
+		report.Skipped++
+		return nil
+	}
+	defer mxr.releaseHouse(addr)
+
+	transfers, err := mxr.ds.Transfers(addr)
+	if err != nil {
+		return errors.Wrapf(err, "could not get transfers from %v", addr)
+	}
+	callCtx, cancel := mxr.callCtx(ctx)
+	addrInfo, err := mxr.jcClient.GetAddressInfo(callCtx, addr)
+	cancel()
+	if err != nil {
+		return errors.Wrapf(err, "could not get %v", addr)
+	}
+	if addrInfo == nil {
+		addrInfo = &jobcoin.AddressInfo{}
+	}
+
+	report.Checked++
+
+	return mxr.checkJournal(addr, addrInfo, transfers, report)
+}
+
+// reconcileFees checks that every fee in the fee ledger reached the mixer's
+// address. What is sent from there is up to its owner, so that isn't checked.
+func (mxr *Mixer) reconcileFees(ctx context.Context, report *ReconcileReport) error {
+	// the entries are read first, so the fees they are for are all in the
+	// history
+	entries, err := mxr.ds.FeeEntries(time.Unix(0, 0), mxr.clock.Now())
+	if err != nil {
+		return errors.Wrap(err, "could not get fee entries")
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	callCtx, cancel := mxr.callCtx(ctx)
+	addrInfo, err := mxr.jcClient.GetAddressInfo(callCtx, mxr.addr)
+	cancel()
+	if err != nil {
+		return errors.Wrapf(err, "could not get %v", mxr.addr)
+	}
+	if addrInfo == nil {
+		addrInfo = &jobcoin.AddressInfo{}
+	}
+
+	type key struct {
+		from string
+		amt  climatic.Amount
+	}
+	received := map[key]int{}
+	for _, tx := range addrInfo.Transactions {
+		if tx.ToAddress == mxr.addr {
+			received[key{from: tx.FromAddress, amt: tx.Amount}]++
+		}
+	}
+
+	report.Checked++
+	for _, e := range entries {
+		k := key{from: e.DepositAddress, amt: e.Amount}
+		if received[k] > 0 {
+			received[k]--
+			continue
+		}
+		report.Discrepancies = append(report.Discrepancies, &Discrepancy{
+			Kind:       DiscrepancyMissingTransfer,
+			Address:    e.DepositAddress,
+			Expected:   e.Amount,
+			TransferID: e.TransferID,
+			ToAddress:  mxr.addr,
+		})
+	}
+
+	return nil
+}
+
+// reconcile checks every deposit address, house address and the fee address
+// against the ledger. The report is kept for the Reconcile call, written to the
+// report writer and added to the metrics. If a check fails, the run stops and
+// the report says why. Only one reconciliation runs at a time.
+func (mxr *Mixer) reconcile(ctx context.Context) *ReconcileReport {
+	l := mxr.log
+
+	mxr.reconcileMtx.Lock()
+	defer mxr.reconcileMtx.Unlock()
+
+	report := &ReconcileReport{
+		Start:         mxr.clock.Now().UTC(),
+		Discrepancies: []*Discrepancy{},
+	}
+	err := func() error {
+		depositAddrs, err := mxr.ds.DepositAddresses()
+		if err != nil {
+			return errors.Wrap(err, "could not get deposit addresses")
+		}
+		for _, addr := range depositAddrs {
+			if err := mxr.reconcileDeposit(ctx, addr, report); err != nil {
+				return err
+			}
+		}
+		if err := mxr.reconcilePool(ctx, report); err != nil {
+			return err
+		}
+		return mxr.reconcileFees(ctx, report)
+	}()
+	if err != nil {
+		report.Err = err.Error()
+		reconcileVars.Add("failed", 1)
+		l.Printf("reconciliation failed: %v", err)
+	}
+	report.End = mxr.clock.Now().UTC()
+
+	for _, d := range report.Discrepancies {
+		l.Printf("discrepancy in %v: %s, expected %v, actual %v", d.Address, d.Kind, d.Expected, d.Actual)
+	}
+	l.Printf(
+		"reconciled %d addresses, skipped %d, found %d discrepancies",
+		report.Checked, report.Skipped, len(report.Discrepancies),
+	)
+	reconcileVars.Add("runs", 1)
+	reconcileDiscrepancies.Set(int64(len(report.Discrepancies)))
+	reconcileLastRun.Set(report.End.Format(time.RFC3339))
+
+	mxr.mtx.Lock()
+	mxr.lastReport = report
+	mxr.mtx.Unlock()
+
+	if w := mxr.reconcileCfg.Report; w != nil {
+		buf, err := json.Marshal(report)
+		if err == nil {
+			_, err = w.Write(append(buf, '\n'))
+		}
+		if err != nil {
+			l.Printf("could not write reconciliation report: %v", err)
+		}
+	}
+
+	return report
+}
+
+// reconcileLoop reconciles every interval until the mixer stops. It doesn't
+// run if the interval is zero.
+func (mxr *Mixer) reconcileLoop(ctx context.Context) {
+	if mxr.reconcileCfg.Interval <= 0 {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-mxr.stopping:
+			return
+		case <-mxr.clock.After(mxr.reconcileCfg.Interval):
+		}
+
+		mxr.reconcile(ctx)
+	}
+}
+
+// Reconcile returns the report of the last reconciliation, or runs one first if
+// asked to. It is only open to callers with the admin token, and closed if
+// there is none.
+func (mxr *Mixer) Reconcile(
+	ctx context.Context, req *climatic.ReconcileRequest,
+) (*climatic.ReconcileResponse, error) {
+	if err := mxr.checkAdmin("reconcile", req.Token); err != nil {
+		return nil, err
+	}
+
+	var report *ReconcileReport
+	if req.Run {
+		report = mxr.reconcile(ctx)
+	} else {
+		mxr.mtx.Lock()
+		report = mxr.lastReport
+		mxr.mtx.Unlock()
+	}
+	if report == nil {
+		return nil, grpc.Errorf(codes.NotFound, "not reconciled yet")
+	}
+
+	res := &climatic.ReconcileResponse{
+		Start:         report.Start.Unix(),
+		End:           report.End.Unix(),
+		Checked:       int32(report.Checked),
+		Skipped:       int32(report.Skipped),
+		Discrepancies: []*climatic.Discrepancy{},
+		Error:         report.Err,
+	}
+	for _, d := range report.Discrepancies {
+		res.Discrepancies = append(res.Discrepancies, &climatic.Discrepancy{
+			Kind:       string(d.Kind),
+			Address:    d.Address,
+			Expected:   d.Expected.String(),
+			Actual:     d.Actual.String(),
+			TransferId: d.TransferID,
+			ToAddress:  d.ToAddress,
+		})
+	}
+
+	return res, nil
+}
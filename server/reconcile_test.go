@@ -0,0 +1,200 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/r-medina/climatic"
+	"github.com/r-medina/climatic/jobcoin"
+	"github.com/r-medina/climatic/jobcoin/jctest"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestCompareJournal(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	at := func(sec int) time.Time { return time.Date(2018, 1, 1, 0, 0, sec, 0, time.UTC) }
+	tx := func(sec int, from, to, amt string) *jobcoin.Transaction {
+		return &jobcoin.Transaction{Timestamp: at(sec), FromAddress: from, ToAddress: to, Amount: climatic.MustParseAmount(amt)}
+	}
+	transfer := func(id string, status TransferStatus, to, amt string) *Transfer {
+		return &Transfer{ID: id, Status: status, FromAddress: "d", ToAddress: to, Amount: climatic.MustParseAmount(amt)}
+	}
+
+	addrInfo := &jobcoin.AddressInfo{
+		Transactions: []*jobcoin.Transaction{
+			tx(1, "alice", "d", "10"),
+			tx(2, "d", "u", "1"),
+			tx(3, "d", "thief", "3"),
+			tx(4, "d", "u", "1"),
+			tx(5, "d", "x", "2"),
+		},
+	}
+	transfers := []*Transfer{
+		// the pending transfer doesn't take the transaction of the done
+		// one
+		transfer("pending", TransferPending, "u", "1"),
+		transfer("done", TransferDone, "u", "1"),
+		transfer("lost", TransferDone, "v", "5"),
+		transfer("failed", TransferFailed, "x", "2"),
+		transfer("unsent", TransferPending, "w", "4"),
+	}
+
+	got, sends := compareJournal("d", addrInfo, transfers, 0)
+	require.Equal(4, sends)
+	require.Equal([]*Discrepancy{
+		{
+			Kind:       DiscrepancyMissingTransfer,
+			Address:    "d",
+			Expected:   climatic.MustParseAmount("5"),
+			TransferID: "lost",
+			ToAddress:  "v",
+		},
+		{Kind: DiscrepancyOutsideSpend, Address: "d", Actual: climatic.MustParseAmount("3"), ToAddress: "thief"},
+		{Kind: DiscrepancyOutsideSpend, Address: "d", Actual: climatic.MustParseAmount("2"), ToAddress: "x"},
+	}, got)
+
+	got, sends = compareJournal("d", &jobcoin.AddressInfo{}, nil, 0)
+	require.Empty(got)
+	require.Zero(sends)
+
+	// the first sends are accounted for by transfers no longer journaled
+	got, _ = compareJournal("d", addrInfo, []*Transfer{transfer("later", TransferDone, "x", "2")}, 3)
+	require.Empty(got)
+}
+
+func TestReconcile(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	ctx := context.Background()
+	ledger := jctest.NewLedger()
+	ds := newMemDS()
+	reports := &bytes.Buffer{}
+	mxr, err := NewMixer(
+		WithJobcoinClient(ledger),
+		WithDatastore(ds),
+		WithAddress("fees"),
+		WithFee(climatic.MustParseAmount("1")),
+		WithPool("house"),
+		WithAdminToken("secret"),
+		WithReconcileConfig(ReconcileConfig{Report: reports}),
+		WithMixConfig(MixConfig{
+			MeanDelay:  time.Hour,
+			MinDelay:   time.Hour,
+			MaxDelay:   time.Hour,
+			MeanAmount: climatic.MustParseAmount("10"),
+			MinAmount:  climatic.MustParseAmount("10"),
+			MaxAmount:  climatic.MustParseAmount("10"),
+		}),
+		WithLogger(log.New(ioutil.Discard, "", 0)),
+	)
+	require.NoError(err)
+
+	for _, token := range []string{"", "wrong"} {
+		_, err = mxr.Reconcile(ctx, &climatic.ReconcileRequest{Token: token, Run: true})
+		require.Equal(codes.PermissionDenied, grpc.Code(err), "token %q", token)
+	}
+	_, err = mxr.Reconcile(ctx, &climatic.ReconcileRequest{Token: "secret"})
+	require.Equal(codes.NotFound, grpc.Code(err), "report before the first run")
+
+	res, err := mxr.Register(ctx, &climatic.RegisterRequest{Addresses: []string{"u"}})
+	require.NoError(err)
+	dep := res.Address
+	require.NoError(ledger.Create(ctx, "alice"))
+	require.NoError(ledger.PostTransaction(ctx, "alice", dep, climatic.MustParseAmount("20")))
+	mixReqs, err := mxr.findMixRequests(ctx)
+	require.NoError(err)
+	// not found by a poll yet
+	require.NoError(ledger.PostTransaction(ctx, "alice", dep, climatic.MustParseAmount("5")))
+
+	// the deposits haven't reached a mix, which is expected
+	report := mxr.reconcile(ctx)
+	require.Empty(report.Err)
+	require.Equal(2, report.Checked, "deposit and house addresses")
+	require.Empty(report.Discrepancies)
+
+	// the unpolled deposit isn't counted as remaining in the mix
+	mxr.makeMix(mixReqs)
+	require.NoError(mxr.mix(ctx, dep))
+	require.True(mxr.outstanding[dep].remaining.IsZero(), "unpolled deposit counted as remaining")
+	require.Equal(climatic.MustParseAmount("1"), ledger.Balance("fees"))
+	report = mxr.reconcile(ctx)
+	require.Empty(report.Err)
+	require.Equal(3, report.Checked, "deposit, house and fee addresses")
+	require.Empty(report.Discrepancies)
+
+	// the transfers the ledger shows are dropped from the journal, and
+	// their sends aren't taken for outside spends later
+	transfers, err := ds.Transfers(dep)
+	require.NoError(err)
+	require.Empty(transfers, "confirmed transfers kept")
+	sends, err := ds.ConfirmedSends(dep)
+	require.NoError(err)
+	require.NotZero(sends)
+	report = mxr.reconcile(ctx)
+	require.Empty(report.Err)
+	require.Empty(report.Discrepancies)
+
+	// someone else spends from the deposit address, the journal has a pool
+	// payout the ledger doesn't and a fee never arrived
+	require.NoError(ledger.PostTransaction(ctx, dep, "thief", climatic.MustParseAmount("2")))
+	require.NoError(ds.BeginTransfer(&Transfer{
+		ID:          "ghost",
+		Kind:        TransferPayout,
+		Status:      TransferDone,
+		FromAddress: "house",
+		ToAddress:   "u",
+		Amount:      climatic.MustParseAmount("4"),
+	}))
+	require.NoError(ds.FinishTransfer(
+		&Transfer{ID: "lost", Kind: TransferFee, Status: TransferDone, DepositAddress: "gone", FromAddress: "gone"},
+		&MixRecord{},
+		&FeeEntry{TransferID: "lost", DepositAddress: "gone", Amount: climatic.MustParseAmount("1"), Time: time.Now()},
+	))
+
+	resp, err := mxr.Reconcile(ctx, &climatic.ReconcileRequest{Token: "secret", Run: true})
+	require.NoError(err)
+	require.Empty(resp.Error)
+	require.Equal(int32(3), resp.Checked)
+	require.Equal([]*climatic.Discrepancy{
+		{Kind: "outside-spend", Address: dep, Expected: "0", Actual: "2", ToAddress: "thief"},
+		{Kind: "balance", Address: dep, Expected: "5", Actual: "3"},
+		{Kind: "missing-transfer", Address: "house", Expected: "4", Actual: "0", TransferId: "ghost", ToAddress: "u"},
+		{Kind: "missing-transfer", Address: "gone", Expected: "1", Actual: "0", TransferId: "lost", ToAddress: "fees"},
+	}, resp.Discrepancies)
+
+	last, err := mxr.Reconcile(ctx, &climatic.ReconcileRequest{Token: "secret"})
+	require.NoError(err)
+	require.Equal(resp, last, "last report")
+
+	// every report was written as a line of JSON
+	scanner := bufio.NewScanner(reports)
+	n := 0
+	for ; scanner.Scan(); n++ {
+		var written ReconcileReport
+		require.NoError(json.Unmarshal(scanner.Bytes(), &written))
+		if n == 3 {
+			require.Len(written.Discrepancies, 4)
+		}
+	}
+	require.Equal(4, n)
+
+	// addresses with a transfer of unknown outcome are skipped
+	mxr.mtx.Lock()
+	mxr.unresolved[dep] = &Transfer{ID: "unknown", DepositAddress: dep}
+	mxr.mtx.Unlock()
+	report = mxr.reconcile(ctx)
+	require.Equal(1, report.Skipped)
+	require.Equal(2, report.Checked)
+}
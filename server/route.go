@@ -0,0 +1,316 @@
+package server
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/r-medina/climatic"
+	"github.com/r-medina/climatic/jobcoin"
+
+	"github.com/pkg/errors"
+)
+
+// Route is a payout that passes through freshly generated hop addresses, one
+// random delay at a time, before it reaches the user address. Every hop
+// address is only ever used by its route, so whether a hop went through can be
+// read from the history of the address it left.
+type Route struct {
+	ID             string          `json:"id"`
+	DepositAddress string          `json:"depositAddress"`
+	UserAddress    string          `json:"userAddress"`
+	Amount         climatic.Amount `json:"amount"`
+	// Hops are the intermediate addresses, in order.
+	Hops []string `json:"hops"`
+	// Funded is whether the payout reached the first hop.
+	Funded bool `json:"funded"`
+	// At is the index of the hop holding the Jobcoins once the route is
+	// funded.
+	At int `json:"at"`
+	// Due is when the Jobcoins move on to the next hop.
+	Due time.Time `json:"due"`
+	// Deadline is when the payout must reach the user address, if there is
+	// a window.
+	Deadline time.Time `json:"deadline,omitempty"`
+}
+
+// next is the address the Jobcoins go to from the hop they are at.
+func (r *Route) next() string {
+	if r.At+1 < len(r.Hops) {
+		return r.Hops[r.At+1]
+	}
+	return r.UserAddress
+}
+
+// newRoute makes and saves a route for a payout of amt to usrAddr, which has
+// yet to be funded. A non-zero deadline squeezes the hops in before it. Its ID
+// is drawn from rnd.
+func (mxr *Mixer) newRoute(
+	rnd *rand.Rand, depositAddr, usrAddr string, amt climatic.Amount, deadline time.Time,
+) (*Route, error) {
+	id := newID(rnd)
+	r := &Route{
+		ID:             id.String(),
+		DepositAddress: depositAddr,
+		UserAddress:    usrAddr,
+		Amount:         amt,
+		Deadline:       deadline,
+	}
+	for i := 0; i < mxr.routeCfg.Hops; i++ {
+		r.Hops = append(r.Hops, newAddr().String())
+	}
+
+	// The route is saved before it's funded, so the hop addresses are
+	// never lost along with the Jobcoins sent to them.
+	if err := mxr.ds.SaveRoute(r.ID, r); err != nil {
+		return nil, err
+	}
+	mxr.mtx.Lock()
+	mxr.routes[r.ID] = r
+	mxr.mtx.Unlock()
+
+	return r, nil
+}
+
+// fundRoute starts the route of a payout that went through, or drops it if the
+// payout failed, drawing the delay of the first hop from rnd. mxr.mtx must be
+// held.
+func (mxr *Mixer) fundRoute(rnd *rand.Rand, t *Transfer) {
+	r, ok := mxr.routes[t.RouteID]
+	if !ok {
+		return
+	}
+
+	switch t.Status {
+	case TransferDone:
+		if r.Funded {
+			return
+		}
+		r.Funded = true
+		r.Due = mxr.clock.Now().Add(mxr.hopDelay(rnd, r))
+		mxr.saveRoute(r)
+		mxr.wakeRouter()
+	case TransferFailed:
+		mxr.dropRoute(r)
+	}
+}
+
+// saveRoute saves r. If saving fails, the state in memory is still used until
+// the mixer stops. mxr.mtx must be held.
+func (mxr *Mixer) saveRoute(r *Route) {
+	if err := mxr.ds.SaveRoute(r.ID, r); err != nil {
+		mxr.log.Printf("could not save route %s: %v", r.ID, err)
+	}
+}
+
+// dropRoute deletes r. mxr.mtx must be held.
+func (mxr *Mixer) dropRoute(r *Route) {
+	delete(mxr.routes, r.ID)
+	if err := mxr.ds.SaveRoute(r.ID, nil); err != nil {
+		mxr.log.Printf("could not delete route %s: %v", r.ID, err)
+	}
+}
+
+// wakeRouter makes the routing loop look at the routes again.
+func (mxr *Mixer) wakeRouter() {
+	select {
+	case mxr.routed <- struct{}{}:
+	default:
+	}
+}
+
+// routeLoop moves routes along as their hops come due, until the mixer stops.
+func (mxr *Mixer) routeLoop(ctx context.Context) {
+	for {
+		// with no route to wait for, only a new one wakes the loop
+		var due <-chan time.Time
+		if wait, ok := mxr.route(ctx); ok {
+			due = mxr.clock.After(wait)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-mxr.stopping:
+			return
+		case <-mxr.routed:
+		case <-due:
+		}
+	}
+}
+
+// route makes the hops that are due, and returns how long until the next one
+// is, if there is any. mxr.mtx is only held to pick the routes and to update
+// them, not while they hop.
+func (mxr *Mixer) route(ctx context.Context) (time.Duration, bool) {
+	mxr.mtx.Lock()
+	due := []*Route{}
+	now := mxr.clock.Now()
+	for _, r := range mxr.routes {
+		if !r.Funded && mxr.funding(r) {
+			// the mixing loop resolves the payout first
+			continue
+		}
+		if !now.Before(r.Due) {
+			due = append(due, r)
+		}
+	}
+	mxr.mtx.Unlock()
+	// in a steady order, so that runs can be replayed
+	sort.Slice(due, func(i, j int) bool { return due[i].ID < due[j].ID })
+
+	for _, r := range due {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := mxr.hop(ctx, r); err != nil {
+			mxr.log.Printf("route %s failed to hop: %v", r.ID, err)
+			mxr.mtx.Lock()
+			r.Due = mxr.clock.Now().Add(mxr.hopDelay(mxr.routeRnd, r))
+			mxr.mtx.Unlock()
+		}
+	}
+
+	mxr.mtx.Lock()
+	defer mxr.mtx.Unlock()
+
+	var (
+		next    time.Time
+		pending bool
+	)
+	for _, r := range mxr.routes {
+		if r.Funded && (!pending || r.Due.Before(next)) {
+			next, pending = r.Due, true
+		}
+	}
+
+	return next.Sub(mxr.clock.Now()), pending
+}
+
+// funding reports whether the payout funding r may still be under way: it is
+// unresolved, or a worker is on its deposit address. mxr.mtx must be held.
+func (mxr *Mixer) funding(r *Route) bool {
+	if mxr.busy[r.DepositAddress] {
+		return true
+	}
+	t, ok := mxr.unresolved[r.DepositAddress]
+	return ok && t.RouteID == r.ID
+}
+
+// hop moves the Jobcoins of r on to the next address. It is safe to call again
+// after a failure, since it first checks whether the hop went through. Only the
+// routing loop moves routes along, but workers fund them and report on them
+// meanwhile, so it calls the Jobcoin API on a copy of r taken under mxr.mtx and
+// only takes it again to update r.
+func (mxr *Mixer) hop(ctx context.Context, r *Route) error {
+	l := mxr.log
+
+	mxr.mtx.Lock()
+	snap := *r
+	mxr.mtx.Unlock()
+
+	if !snap.Funded {
+		// The mixer stopped between funding the route and saving it.
+		// The payout is resolved, so the first hop has the Jobcoins
+		// or never will.
+		received, err := mxr.routeSent(ctx, "", snap.Hops[0], snap.Amount)
+		if err != nil {
+			return err
+		}
+
+		mxr.mtx.Lock()
+		defer mxr.mtx.Unlock()
+
+		if r.Funded {
+			// a worker funded it meanwhile
+			return nil
+		}
+		if !received {
+			l.Printf("dropping route %s that was never funded", r.ID)
+			mxr.dropRoute(r)
+			return nil
+		}
+		// the first hop waits its delay as if it had just been funded
+		r.Funded = true
+		r.Due = mxr.clock.Now().Add(mxr.hopDelay(mxr.routeRnd, r))
+		mxr.saveRoute(r)
+		return nil
+	}
+
+	from, to := snap.Hops[snap.At], snap.next()
+	sent, err := mxr.routeSent(ctx, from, to, snap.Amount)
+	if err != nil {
+		return err
+	}
+	if !sent {
+		l.Printf("route %s hopping %v from %v to %v", snap.ID, snap.Amount, from, to)
+		callCtx, cancel := mxr.callCtx(ctx)
+		// it isn't in the history yet
+		callCtx = jobcoin.WithPrior(callCtx, 0)
+		err = mxr.jcClient.PostTransaction(callCtx, from, to, snap.Amount)
+		cancel()
+		if err != nil {
+			// whether it went through is checked on the next try
+			return err
+		}
+	}
+
+	mxr.mtx.Lock()
+	defer mxr.mtx.Unlock()
+
+	r.At = snap.At + 1
+	if r.At == len(r.Hops) {
+		l.Printf("route %s paid %v to %v", r.ID, r.Amount, r.UserAddress)
+		mxr.dropRoute(r)
+		return nil
+	}
+	r.Due = mxr.clock.Now().Add(mxr.hopDelay(mxr.routeRnd, r))
+	mxr.saveRoute(r)
+
+	return nil
+}
+
+// routeSent looks for a transaction of amt from fromAddr to toAddr in the
+// history of the hop address involved. An empty fromAddr matches any sender.
+func (mxr *Mixer) routeSent(ctx context.Context, fromAddr, toAddr string, amt climatic.Amount) (bool, error) {
+	hopAddr := fromAddr
+	if hopAddr == "" {
+		hopAddr = toAddr
+	}
+
+	callCtx, cancel := mxr.callCtx(ctx)
+	defer cancel()
+	addrInfo, err := mxr.jcClient.GetAddressInfo(callCtx, hopAddr)
+	if errors.Is(err, jobcoin.ErrNotFound) {
+		// the hop address was never used
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if addrInfo == nil {
+		return false, nil
+	}
+
+	for _, tx := range addrInfo.Transactions {
+		if (fromAddr == "" || tx.FromAddress == fromAddr) && tx.ToAddress == toAddr && tx.Amount == amt {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// inFlight returns the funded routes of a deposit address. mxr.mtx must be
+// held.
+func (mxr *Mixer) inFlight(depositAddr string) []*Route {
+	routes := []*Route{}
+	for _, r := range mxr.routes {
+		if r.DepositAddress == depositAddr && r.Funded {
+			routes = append(routes, r)
+		}
+	}
+
+	return routes
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/r-medina/climatic"
+	"github.com/r-medina/climatic/jobcoin/jctest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMixerRouted(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ledger := jctest.NewLedger()
+	mxr, err := NewMixer(
+		WithJobcoinClient(ledger),
+		WithAddress("fees"),
+		WithFee(climatic.MustParseAmount("2.5")),
+		WithPollConfig(PollConfig{MeanDelay: 5 * time.Millisecond, MaxDelay: 5 * time.Millisecond}),
+		WithMixConfig(MixConfig{
+			MeanDelay:  time.Millisecond,
+			MaxDelay:   time.Millisecond,
+			MeanAmount: climatic.MustParseAmount("10"),
+			MinAmount:  climatic.MustParseAmount("5"),
+			MaxAmount:  climatic.MustParseAmount("20"),
+		}),
+		WithRouteConfig(RouteConfig{Hops: 2, MeanDelay: time.Millisecond, MaxDelay: time.Millisecond}),
+		WithLogger(log.New(ioutil.Discard, "", 0)),
+	)
+	require.NoError(err)
+	go func() { _ = mxr.Start(ctx) }()
+
+	res, err := mxr.Register(ctx, &climatic.RegisterRequest{Addresses: []string{"u1", "u2"}})
+	require.NoError(err)
+	require.NoError(ledger.Create(ctx, "alice"))
+	require.NoError(ledger.PostTransaction(ctx, "alice", res.Address, climatic.MustParseAmount("42")))
+
+	paid := func() climatic.Amount { return ledger.Balance("u1").Add(ledger.Balance("u2")) }
+	want := climatic.MustParseAmount("39.5")
+	deadline := time.Now().Add(5 * time.Second)
+	for paid() != want && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	require.Equal(want, paid())
+
+	txs, err := ledger.GetTransactions(ctx)
+	require.NoError(err)
+	hops := map[string]bool{}
+	for _, tx := range txs {
+		switch tx.ToAddress {
+		case "u1", "u2":
+			require.NotEqual(res.Address, tx.FromAddress, "user paid from the deposit address")
+			hops[tx.FromAddress] = true
+		case "alice", res.Address, "fees":
+		default:
+			hops[tx.ToAddress] = true
+		}
+	}
+	for hop := range hops {
+		require.True(ledger.Balance(hop).IsZero(), "Jobcoins left in hop %v", hop)
+	}
+
+	status, err := mxr.Status(ctx, &climatic.StatusRequest{Address: res.Address})
+	require.NoError(err)
+	require.Empty(status.InFlight)
+}
+
+func TestRouteRecovery(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc   string
+		funded bool
+		// posted are the transactions that reached the ledger before
+		// the mixer died
+		posted   [][2]string
+		at       int
+		wantAt   int
+		wantDone bool
+	}{
+		{desc: "hop not posted", funded: true, posted: [][2]string{{"", "h1"}}, wantAt: 1},
+		{desc: "hop posted", funded: true, posted: [][2]string{{"", "h1"}, {"h1", "h2"}}, wantAt: 1},
+		{desc: "last hop posted", funded: true, posted: [][2]string{{"", "h1"}, {"h1", "h2"}, {"h2", "u"}}, at: 1, wantDone: true},
+		{desc: "funded but not saved", posted: [][2]string{{"", "h1"}}},
+		{desc: "never funded", wantDone: true},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			require := require.New(t)
+
+			ctx := context.Background()
+			ledger := jctest.NewLedger()
+			amt := jctest.DefaultCreateAmount
+			for _, tx := range test.posted {
+				if tx[0] == "" {
+					require.NoError(ledger.Create(ctx, tx[1]))
+					continue
+				}
+				require.NoError(ledger.PostTransaction(ctx, tx[0], tx[1], amt))
+			}
+
+			ds := newMemDS()
+			r := &Route{
+				ID:             "r",
+				DepositAddress: "d",
+				UserAddress:    "u",
+				Amount:         amt,
+				Hops:           []string{"h1", "h2"},
+				Funded:         test.funded,
+				At:             test.at,
+			}
+			require.NoError(ds.SaveRoute(r.ID, r))
+			mxr, err := NewMixer(
+				WithJobcoinClient(ledger),
+				WithDatastore(ds),
+				WithRouteConfig(RouteConfig{Hops: 2}),
+				WithLogger(log.New(ioutil.Discard, "", 0)),
+			)
+			require.NoError(err)
+			require.Contains(mxr.routes, "r")
+
+			mxr.route(ctx)
+
+			state, err := ds.State()
+			require.NoError(err)
+			if test.wantDone {
+				require.Empty(mxr.routes)
+				require.Empty(state.Routes)
+			} else {
+				require.Equal(test.wantAt, mxr.routes["r"].At)
+				require.True(mxr.routes["r"].Funded)
+				require.False(mxr.routes["r"].Due.IsZero(), "next hop not scheduled")
+				require.Equal([]*Route{mxr.routes["r"]}, state.Routes)
+			}
+
+			// nothing was sent twice
+			txs, err := ledger.GetTransactions(ctx)
+			require.NoError(err)
+			seen := map[[2]string]bool{}
+			for _, tx := range txs {
+				hop := [2]string{tx.FromAddress, tx.ToAddress}
+				require.False(seen[hop], "%v sent twice", hop)
+				seen[hop] = true
+			}
+		})
+	}
+}
+
+func TestRouteStatus(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	ctx := context.Background()
+	ledger := jctest.NewLedger()
+	require.NoError(ledger.Create(ctx, "d"))
+	mxr, err := NewMixer(
+		WithJobcoinClient(ledger),
+		WithRouteConfig(RouteConfig{Hops: 3, MeanDelay: time.Hour, MaxDelay: time.Hour}),
+		WithLogger(log.New(ioutil.Discard, "", 0)),
+	)
+	require.NoError(err)
+	require.NoError(mxr.ds.RegisterTerms("d", []string{"u"}, nil, mxr.clock.Now()))
+
+	_, err = mxr.Status(ctx, &climatic.StatusRequest{Address: "unknown"})
+	require.Error(err)
+
+	m := &mix{usrAddrs: []string{"u"}, remaining: jctest.DefaultCreateAmount}
+	mxr.outstanding["d"] = m
+	p := &PlannedPayout{ID: "p", ToAddress: "u", Amount: climatic.MustParseAmount("20")}
+	require.NoError(mxr.payout(ctx, m, "d", "d", p, p.Amount))
+
+	status, err := mxr.Status(ctx, &climatic.StatusRequest{Address: "d"})
+	require.NoError(err)
+	require.Equal("30", status.Remaining)
+	require.Len(status.InFlight, 1)
+	require.Equal(&climatic.Payout{ToAddress: "u", Amount: "20", Hops: 3}, status.InFlight[0])
+	require.True(ledger.Balance("u").IsZero(), "payout skipped the hops")
+
+	// the hops are made when they are due
+	for _, r := range mxr.routes {
+		r.Due = time.Time{}
+	}
+	mxr.route(ctx)
+	status, err = mxr.Status(ctx, &climatic.StatusRequest{Address: "d"})
+	require.NoError(err)
+	require.Equal(int32(1), status.InFlight[0].HopsDone)
+}
@@ -2,9 +2,9 @@ package server
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"log"
-	"math/big"
 	"math/rand"
 	"os"
 	"sync"
@@ -13,14 +13,12 @@ import (
 	"github.com/r-medina/climatic"
 	"github.com/r-medina/climatic/jobcoin"
 
-	"github.com/satori/go.uuid"
+	"github.com/pkg/errors"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/grpclog"
 )
 
-func init() { rand.Seed(time.Now().UTC().UnixNano()) }
-
 // Mixer implements the mixer interface and is a Jobcoin mixer.
 type Mixer struct {
 	// addr is the address at which to collect fees
@@ -32,26 +30,96 @@ type Mixer struct {
 	// deposit addresses
 	ds Datastore
 
-	// fee is how much fee is charged per deposit.
-	// There is a buggy edgecase, however, where if a new deposit happens
-	// after a failed attempt to collect a fee, we may only collect a fee on
-	// the latter oone.
-	fee *big.Float
-	// lastSeenTxIdx keeps track of the transaction that the mixer saw.
+	// feePolicy decides the fee of every deposit
+	feePolicy FeePolicy
+	// strategy decides the order due mixes are worked on in, and the user
+	// address, amount and time of every payout
+	strategy MixStrategy
+	// rnd is where the mixer's random choices are drawn from, apart from
+	// new addresses. The poll loop, the scheduler and the routing loop
+	// draw from streams of their own, and so does every mix. seeded is
+	// whether rnd was given with WithRand, and seed is what the streams
+	// are seeded from then.
+	rnd      *rand.Rand
+	pollRnd  *rand.Rand
+	planRnd  *rand.Rand
+	routeRnd *rand.Rand
+	seeded   bool
+	seed     int64
+	// clock is what the mixer tells the time by and waits on
+	clock Clock
+	// reconcileCfg configures how often the accounting is checked against
+	// the ledger, and lastReport is the report of the last check, guarded
+	// by mtx. reconcileMtx makes the checks one at a time.
+	reconcileCfg ReconcileConfig
+	lastReport   *ReconcileReport
+	reconcileMtx sync.Mutex
+	// adminToken is the hash of the token that opens the admin calls, which
+	// are closed without one. Only the hash is kept so the token isn't
+	// printed along with the mixer.
+	adminToken []byte
+	// cursor keeps track of the transactions that the mixer saw.
 	// This is useful for the polling loop so it doesn't repeat transactions
 	// it has mixed.
-	lastSeenTxIdx int
+	cursor jobcoin.Cursor
 
 	// outstanding maps deposit addresses to user addresses, amount
 	// remaining, and if the fee was paid
 	outstanding map[string]*mix
-	mtx         sync.Mutex
+	// mtx guards outstanding, pending, unresolved, reserved, busy, routes
+	// and when each mix is due. It is only held for bookkeeping, never across a call
+	// to the Jobcoin API. Every mix has a mutex of its own for the rest,
+	// which is always taken before mtx.
+	mtx sync.Mutex
+	// pending holds the deposits loaded from the datastore that are still
+	// waiting out the initial delay. They are scheduled by Start.
+	pending []mixRequest
+	// unresolved maps deposit addresses to the transfer from them whose
+	// outcome is unknown. Nothing else is sent from an address until its
+	// transfer is resolved.
+	unresolved map[string]*Transfer
+	// reserved holds the house addresses that a payout from the pool, or
+	// a check of their transfers, is using. Each is used by one at a time,
+	// so two payouts don't count on the same balance.
+	reserved map[string]bool
+	// busy holds the deposit addresses that a worker is on, and planned
+	// wakes the scheduler when a mix is added or a worker is done.
+	busy    map[string]bool
+	planned chan struct{}
+	// routes maps route IDs to the payouts that are on their way through
+	// hop addresses, and routed wakes the routing loop when one is funded.
+	routes map[string]*Route
+	routed chan struct{}
+
+	// stopping is closed to stop the mixer, done is closed once it has
+	// stopped, and cancelWork abandons what it is doing.
+	started    bool
+	stopping   chan struct{}
+	done       chan struct{}
+	cancelWork context.CancelFunc
+	lifeMtx    sync.Mutex
+	// wg tracks the loops and the deposits waiting out the initial delay
+	wg sync.WaitGroup
 
 	// pollCfg configures the polling interval time
 	pollCfg PollConfig
 	// mixCfg configures the mixing interval times as well as the minimum
 	// and maxiumum amounts sent
 	mixCfg MixConfig
+	// routeCfg configures how many hops payouts pass through and how long
+	// they wait in each
+	routeCfg RouteConfig
+	// expiryCfg configures when deposit addresses expire and what happens
+	// to late deposits
+	expiryCfg ExpiryConfig
+	// depositCfg configures the limits on deposits
+	depositCfg DepositConfig
+	// timeout bounds every individual call to the Jobcoin API
+	timeout time.Duration
+	// pool holds the house addresses that deposits are swept into in
+	// pooled mode. Payouts come from them instead of the deposit
+	// addresses, so they can't be linked to the deposits.
+	pool []string
 
 	log grpclog.Logger
 }
@@ -60,29 +128,102 @@ var _ climatic.MixerServer = (*Mixer)(nil)
 
 // NewMixer instantiates a new Mixer.
 func NewMixer(opts ...Option) (*Mixer, error) {
-	addr, err := uuid.NewV4()
-	if err != nil {
-		return nil, err
-	}
-
 	mxr := &Mixer{
-		jcClient:    jobcoin.NewClimaticClient(),
-		ds:          newMemDS(),
-		addr:        addr.String(),
-		fee:         big.NewFloat(0),
-		outstanding: map[string]*mix{},
-		pollCfg:     DefaultPollConfig,
-		mixCfg:      DefaultMixConfig,
-		log:         log.New(os.Stderr, "", log.LstdFlags),
+		jcClient:     jobcoin.NewClimaticClient(),
+		ds:           newMemDS(),
+		addr:         newAddr().String(),
+		outstanding:  map[string]*mix{},
+		unresolved:   map[string]*Transfer{},
+		reserved:     map[string]bool{},
+		busy:         map[string]bool{},
+		planned:      make(chan struct{}, 1),
+		routes:       map[string]*Route{},
+		routed:       make(chan struct{}, 1),
+		stopping:     make(chan struct{}),
+		done:         make(chan struct{}),
+		pollCfg:      DefaultPollConfig,
+		mixCfg:       DefaultMixConfig,
+		routeCfg:     DefaultRouteConfig,
+		expiryCfg:    DefaultExpiryConfig,
+		depositCfg:   DefaultDepositConfig,
+		reconcileCfg: DefaultReconcileConfig,
+		feePolicy:    FlatFee{},
+		strategy:     UniformStrategy{},
+		rnd:          newRand(cryptoSource{}),
+		clock:        systemClock{},
+		timeout:      DefaultTimeout,
+		log:          log.New(os.Stderr, "", log.LstdFlags),
 	}
 
 	for _, opt := range opts {
 		opt(mxr)
 	}
+	mxr.pollRnd = mxr.stream("poll")
+	mxr.planRnd = mxr.stream("plan")
+	mxr.routeRnd = mxr.stream("route")
+
+	if err := mxr.load(); err != nil {
+		return nil, err
+	}
 
 	return mxr, nil
 }
 
+// load restores the state saved in the datastore, so that a restarted mixer
+// resumes where it stopped.
+func (mxr *Mixer) load() error {
+	state, err := mxr.ds.State()
+	if err != nil {
+		return errors.Wrap(err, "could not load mixer state")
+	}
+
+	mxr.cursor = state.Cursor
+	for addr, rec := range state.Mixes {
+		m := &mix{
+			usrAddrs:  rec.UserAddresses,
+			terms:     rec.Terms,
+			remaining: rec.Remaining,
+			fees:      rec.Fees,
+			owed:      rec.Owed,
+			plan:      rec.Plan,
+			refund:    rec.Refund,
+			rnd:       mxr.stream("mix " + addr),
+		}
+		m.saved = m.record()
+		mxr.outstanding[addr] = m
+	}
+	for _, p := range state.Pending {
+		if p.Refund && p.RefundReason == "" {
+			p.RefundReason = RefundLate
+		}
+		mxr.pending = append(mxr.pending, mixRequest{
+			id:       p.ID,
+			tx:       p.Deposit,
+			usrAddrs: p.UserAddresses,
+			terms:    p.Terms,
+			deadline: p.Deadline,
+			due:      p.Due,
+			refund:   p.Refund,
+			reason:   p.RefundReason,
+			fee:      p.Fee,
+		})
+	}
+	for _, t := range state.Transfers {
+		mxr.unresolved[t.DepositAddress] = t
+	}
+	for _, r := range state.Routes {
+		mxr.routes[r.ID] = r
+	}
+	if n := len(state.Mixes) + len(state.Pending) + len(state.Transfers) + len(state.Routes); n > 0 {
+		mxr.log.Printf(
+			"resuming %d mixes, %d pending deposits, %d unfinished transfers and %d routes",
+			len(state.Mixes), len(state.Pending), len(state.Transfers), len(state.Routes),
+		)
+	}
+
+	return nil
+}
+
 // Option customizes a Mixer.
 type Option func(*Mixer)
 
@@ -93,6 +234,14 @@ func WithJobcoinClient(jcClient jobcoin.Client) Option {
 	}
 }
 
+// WithDatastore specifies where registered addresses are kept. By default they
+// are kept in memory and lost when the mixer stops.
+func WithDatastore(ds Datastore) Option {
+	return func(mxr *Mixer) {
+		mxr.ds = ds
+	}
+}
+
 // WithAddress allows you to specify the address of the mixer.
 func WithAddress(addr string) Option {
 	return func(mxr *Mixer) {
@@ -100,10 +249,47 @@ func WithAddress(addr string) Option {
 	}
 }
 
-// WithFee determines the fee that the mixer will take for mixing
-func WithFee(fee *big.Float) Option {
+// WithFee determines the fee that the mixer will take for mixing every deposit.
+func WithFee(fee climatic.Amount) Option {
+	return WithFeePolicy(FlatFee{Amount: fee})
+}
+
+// WithFeePolicy specifies how the fee of every deposit is decided.
+func WithFeePolicy(feePolicy FeePolicy) Option {
+	return func(mxr *Mixer) {
+		mxr.feePolicy = feePolicy
+	}
+}
+
+// WithMixStrategy specifies how due mixes are ordered and payouts are planned.
+func WithMixStrategy(strategy MixStrategy) Option {
+	return func(mxr *Mixer) {
+		mxr.strategy = strategy
+	}
+}
+
+// WithRand specifies the source that the mixer's random choices are drawn
+// from: the amounts, user addresses and times of payouts, the order of due
+// mixes, house addresses and IDs. By default it is crypto/rand, so none of them
+// can be predicted. New addresses are always drawn from crypto/rand.
+//
+// The poll loop, the scheduler, the routing loop and every mix draw from a
+// stream of their own, seeded from src, so a seeded source such as
+// rand.NewSource(seed) makes the same choices in every run with the same
+// deposits and clock, whatever order the workers and loops run in.
+func WithRand(src rand.Source) Option {
 	return func(mxr *Mixer) {
-		mxr.fee = fee
+		mxr.rnd = newRand(src)
+		mxr.seeded = true
+		mxr.seed = mxr.rnd.Int63()
+	}
+}
+
+// WithClock specifies the clock that the mixer tells the time by and waits on.
+// By default it is the system clock.
+func WithClock(clock Clock) Option {
+	return func(mxr *Mixer) {
+		mxr.clock = clock
 	}
 }
 
@@ -125,6 +311,74 @@ func WithMixConfig(mixCfg MixConfig) Option {
 	}
 }
 
+// WithRouteConfig specifies how payouts are routed through hop addresses. The
+// values are made valid silently.
+func WithRouteConfig(routeCfg RouteConfig) Option {
+	return func(mxr *Mixer) {
+		routeCfg.makeValid()
+		mxr.routeCfg = routeCfg
+	}
+}
+
+// WithExpiryConfig specifies when deposit addresses expire and what happens to
+// deposits that arrive after. The values are made valid silently.
+func WithExpiryConfig(expiryCfg ExpiryConfig) Option {
+	return func(mxr *Mixer) {
+		expiryCfg.makeValid()
+		mxr.expiryCfg = expiryCfg
+	}
+}
+
+// WithDepositConfig specifies which deposits are mixed and what refunding the
+// others costs. The values are made valid silently.
+func WithDepositConfig(depositCfg DepositConfig) Option {
+	return func(mxr *Mixer) {
+		depositCfg.makeValid()
+		mxr.depositCfg = depositCfg
+	}
+}
+
+// WithReconcileConfig specifies how often the mixer's accounting is checked
+// against the ledger and where the reports go. The values are made valid
+// silently.
+func WithReconcileConfig(reconcileCfg ReconcileConfig) Option {
+	return func(mxr *Mixer) {
+		reconcileCfg.makeValid()
+		mxr.reconcileCfg = reconcileCfg
+	}
+}
+
+// WithAdminToken opens the admin calls, such as FeeReport and Reconcile, to callers that
+// give token. Without it they are closed.
+func WithAdminToken(token string) Option {
+	return func(mxr *Mixer) {
+		if token == "" {
+			mxr.adminToken = nil
+			return
+		}
+		sum := sha256.Sum256([]byte(token))
+		mxr.adminToken = sum[:]
+	}
+}
+
+// WithTimeout specifies how long a single call to the Jobcoin API may take
+// before it is abandoned. A non-positive timeout disables the limit.
+func WithTimeout(timeout time.Duration) Option {
+	return func(mxr *Mixer) {
+		mxr.timeout = timeout
+	}
+}
+
+// WithPool turns on pooled mode. Deposits are swept into the given house
+// addresses, which the mixer must be the only one spending from, and users are
+// paid out of them. Without any addresses users are paid straight from the
+// deposit addresses.
+func WithPool(houseAddrs ...string) Option {
+	return func(mxr *Mixer) {
+		mxr.pool = houseAddrs
+	}
+}
+
 // WithLogger specifies the logger.
 func WithLogger(log grpclog.Logger) Option {
 	return func(mxr *Mixer) {
@@ -140,19 +394,24 @@ func (mxr *Mixer) Register(
 	l := mxr.log
 	l.Printf("Register called: %v", *req)
 
-	depositAddr, err := uuid.NewV4()
-	if err != nil {
-		l.Printf("could not make deposit addr: %v", err)
-		return nil, grpc.Errorf(codes.Internal, "could not generate deposit address")
-	}
+	depositAddr := newAddr()
 	l.Printf("deposit addr: %v", depositAddr)
 
-	if len(req.Addresses) == 0 {
+	if len(req.Addresses) == 0 && len(req.Splits) == 0 {
 		l.Printf("addresses empty")
 		return nil, grpc.Errorf(codes.InvalidArgument, "addresses invalid")
 	}
+	terms, err := mxr.termsFromRequest(req)
+	if err != nil {
+		l.Printf("invalid terms: %v", err)
+		return nil, grpc.Errorf(codes.InvalidArgument, "terms invalid: %v", err)
+	}
 
-	if err := mxr.ds.Register(depositAddr.String(), req.Addresses); err != nil {
+	usrAddrs := req.Addresses
+	if splits := terms.splits(); splits != nil {
+		usrAddrs = splitAddrs(splits)
+	}
+	if err := mxr.ds.RegisterTerms(depositAddr.String(), usrAddrs, terms, mxr.clock.Now()); err != nil {
 		l.Printf("could not register deposit addr: %v", err)
 		return nil, grpc.Errorf(codes.Internal, "could not register addresses")
 	}
@@ -160,187 +419,707 @@ func (mxr *Mixer) Register(
 	return &climatic.RegisterResponse{Address: depositAddr.String()}, nil
 }
 
-// Start starts the threads that poll jobcoin and deposits the coins.
-func (mxr *Mixer) Start() error {
+// Status reports how far along the mix of a deposit address is, as of the last
+// time it was saved. Payouts that are routed through hop addresses are in
+// flight until they reach the user address. Status doesn't wait for a worker
+// that is on the deposit address.
+func (mxr *Mixer) Status(
+	ctx context.Context, req *climatic.StatusRequest,
+) (*climatic.StatusResponse, error) {
+	l := mxr.log
+
+	switch ctx.Err() {
+	case context.Canceled:
+		return nil, grpc.Errorf(codes.Canceled, "status cancelled")
+	case context.DeadlineExceeded:
+		return nil, grpc.Errorf(codes.DeadlineExceeded, "status timed out")
+	}
+
+	usrAddrs, err := mxr.ds.UserAddresses(req.Address)
+	if err != nil {
+		l.Printf("could not get user addresses of %v: %v", req.Address, err)
+		return nil, grpc.Errorf(codes.Internal, "could not get status")
+	}
+	if len(usrAddrs) == 0 {
+		return nil, grpc.Errorf(codes.NotFound, "unknown deposit address")
+	}
+	lc, err := mxr.ds.Lifecycle(req.Address)
+	if err != nil || lc == nil {
+		l.Printf("could not get lifecycle of %v: %v", req.Address, err)
+		return nil, grpc.Errorf(codes.Internal, "could not get status")
+	}
+
+	res := &climatic.StatusResponse{
+		Address:       req.Address,
+		UserAddresses: usrAddrs,
+		Remaining:     climatic.Amount{}.String(),
+		Owed:          climatic.Amount{}.String(),
+		InFlight:      []*climatic.Payout{},
+		Plan:          []*climatic.PlannedPayout{},
+		State:         string(lc.State),
+	}
+
+	var rec *MixRecord
+	mxr.mtx.Lock()
+	if m, ok := mxr.outstanding[req.Address]; ok {
+		rec = m.saved
+	}
+	for _, r := range mxr.inFlight(req.Address) {
+		res.InFlight = append(res.InFlight, &climatic.Payout{
+			ToAddress: r.UserAddress,
+			Amount:    r.Amount.String(),
+			Hops:      int32(len(r.Hops)),
+			HopsDone:  int32(r.At),
+		})
+	}
+	mxr.mtx.Unlock()
+
+	if rec != nil {
+		// the record is never changed once it is saved, so it can be
+		// read without any lock
+		m := &mix{remaining: rec.Remaining, fees: rec.Fees, owed: rec.Owed, plan: rec.Plan}
+		res.Remaining = m.remaining.String()
+		res.Owed = m.owed.String()
+		res.FeePaid = m.feePaid()
+		for _, p := range m.plan {
+			planned := &climatic.PlannedPayout{
+				ToAddress: p.ToAddress,
+				Amount:    p.Amount.String(),
+				At:        p.At.Unix(),
+				Paid:      p.Paid,
+				Refund:    string(p.Refund),
+			}
+			if !p.Deadline.IsZero() {
+				planned.Deadline = p.Deadline.Unix()
+			}
+			res.Plan = append(res.Plan, planned)
+		}
+		if deadline := m.deadline(); !deadline.IsZero() {
+			res.Deadline = deadline.Unix()
+			res.AtRisk = len(mxr.atRisk(m, mxr.clock.Now())) > 0
+		}
+	}
+
+	return res, nil
+}
+
+// Start starts the threads that poll jobcoin and pay out the plans of the
+// deposits, and blocks until the mixer stops. That happens when Stop is
+// called, in which case Start returns nil, or when ctx is done, in which case
+// calls to the Jobcoin API are cancelled and Start returns ctx.Err(). A Mixer
+// can only be started once.
+func (mxr *Mixer) Start(ctx context.Context) error {
 	l := mxr.log
 
-	wg := sync.WaitGroup{}
-	wg.Add(2)
+	mxr.lifeMtx.Lock()
+	if mxr.started {
+		mxr.lifeMtx.Unlock()
+		return errors.New("mixer already started")
+	}
+	mxr.started = true
+	// work is the context of everything the mixer does. It outlives Stop
+	// until the drain is over.
+	work, cancel := context.WithCancel(ctx)
+	defer cancel()
+	mxr.cancelWork = cancel
+	mxr.lifeMtx.Unlock()
+	defer close(mxr.done)
+
+	select {
+	case <-mxr.stopping:
+		return nil
+	default:
+	}
+
+	mxr.recoverTransfers(work)
+
+	mxr.mtx.Lock()
+	pending := mxr.pending
+	mxr.pending = nil
+	mxr.mtx.Unlock()
+	mxr.schedule(work, pending)
+
+	mxr.wg.Add(4)
 	go func() {
-		defer wg.Done()
+		defer mxr.wg.Done()
 		for {
+			if err := mxr.expire(); err != nil {
+				l.Printf("could not expire addresses: %v", err)
+			}
 			l.Printf("running poll")
-			if err := mxr.poll(); err != nil {
+			if err := mxr.poll(work); err != nil {
 				l.Printf("poll failed: %v", err)
 			}
 
-			<-time.After(mxr.pollCfg.delay())
+			select {
+			case <-work.Done():
+				return
+			case <-mxr.stopping:
+				return
+			case <-mxr.clock.After(mxr.pollCfg.delay(mxr.pollRnd)):
+			}
 		}
 	}()
 
 	go func() {
-		defer wg.Done()
-		for {
-			l.Printf("running mix")
-			if err := mxr.mix(); err != nil {
-				l.Printf("mix failed: %v", err)
-			}
+		defer mxr.wg.Done()
+		mxr.runPlans(work)
+	}()
 
-			<-time.After(mxr.mixCfg.delay())
-		}
+	go func() {
+		defer mxr.wg.Done()
+		mxr.routeLoop(work)
 	}()
 
-	wg.Wait()
+	go func() {
+		defer mxr.wg.Done()
+		mxr.reconcileLoop(work)
+	}()
+
+	mxr.wg.Wait()
+	mxr.flush()
+	l.Printf("mixer stopped")
+
+	return ctx.Err()
+}
+
+// Stop stops the mixer and waits for Start to return. Transfers that are under
+// way are allowed to finish until ctx is done, at which point they are
+// cancelled and ctx.Err() is returned. Either way the mixer's state is saved,
+// and transfers that were cut off are resolved when the mixer starts again. A
+// Mixer that is stopped before it is started never starts.
+func (mxr *Mixer) Stop(ctx context.Context) error {
+	mxr.lifeMtx.Lock()
+	select {
+	case <-mxr.stopping:
+	default:
+		close(mxr.stopping)
+	}
+	started, cancel := mxr.started, mxr.cancelWork
+	mxr.lifeMtx.Unlock()
+	if !started {
+		return nil
+	}
+
+	select {
+	case <-mxr.done:
+		return nil
+	case <-ctx.Done():
+		cancel()
+		<-mxr.done
+		return ctx.Err()
+	}
+}
+
+// flush saves every outstanding mix and route, in case saving one of them
+// failed before.
+func (mxr *Mixer) flush() {
+	mxr.mtx.Lock()
+	mixes := make(map[string]*mix, len(mxr.outstanding))
+	for addr, m := range mxr.outstanding {
+		mixes[addr] = m
+	}
+	for _, r := range mxr.routes {
+		mxr.saveRoute(r)
+	}
+	mxr.mtx.Unlock()
+
+	for addr, m := range mixes {
+		m.mtx.Lock()
+		if !m.done {
+			mxr.saveMix(addr, m)
+		}
+		m.mtx.Unlock()
+	}
+}
+
+// callCtx returns a context for a single call to the Jobcoin API.
+func (mxr *Mixer) callCtx(ctx context.Context) (context.Context, context.CancelFunc) {
+	if mxr.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, mxr.timeout)
+}
+
+func (mxr *Mixer) poll(ctx context.Context) error {
+	mixReqs, err := mxr.findMixRequests(ctx)
+	if err != nil {
+		return err
+	}
+
+	mxr.schedule(ctx, mixReqs)
 
 	return nil
 }
 
-func (mxr *Mixer) poll() error {
+// schedule adds mix requests to the outstanding mixes once they are due. If
+// the mixer stops first, they are kept for the next time it starts.
+func (mxr *Mixer) schedule(ctx context.Context, mixReqs []mixRequest) {
+	mxr.wg.Add(len(mixReqs))
+	for _, mixReq := range mixReqs {
+		mixReq := mixReq
+		go func() {
+			defer mxr.wg.Done()
+
+			select {
+			case <-ctx.Done():
+			case <-mxr.stopping:
+			case <-mxr.clock.After(mixReq.due.Sub(mxr.clock.Now())):
+				mxr.makeMix([]mixRequest{mixReq})
+				return
+			}
+
+			// it's still pending in the datastore
+			mxr.mtx.Lock()
+			mxr.pending = append(mxr.pending, mixReq)
+			mxr.mtx.Unlock()
+		}()
+	}
+}
+
+// findMixRequests finds the transactions to deposit addresses that came in since
+// the last call.
+func (mxr *Mixer) findMixRequests(ctx context.Context) ([]mixRequest, error) {
 	l := mxr.log
 
-	txs, err := mxr.jcClient.GetTransactions()
+	depositAddrs, err := mxr.watchedAddresses()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// ignore transactions we've seen
-	txs = txs[mxr.lastSeenTxIdx:]
-	// set lastSeenTxIdx to appropriate value
-	mxr.lastSeenTxIdx += len(txs)
+	var txs []*jobcoin.Transaction
+	cursor := mxr.cursor
+	if n := len(depositAddrs); n > 0 && n <= mxr.pollCfg.WatchThreshold {
+		txs, cursor, err = mxr.watch(ctx, depositAddrs)
+	} else {
+		callCtx, cancel := mxr.callCtx(ctx)
+		txs, cursor, err = mxr.jcClient.GetTransactionsSince(callCtx, mxr.cursor)
+		cancel()
+	}
+	if err != nil {
+		return nil, err
+	}
 
+	now := mxr.clock.Now()
 	mixReqs := []mixRequest{}
+	pending := []*PendingMix{}
+	// volumes holds how much was deposited to each address before the
+	// deposit at hand
+	volumes := map[string]climatic.Amount{}
 	for _, tx := range txs {
 		usrAddrs, _ := mxr.ds.UserAddresses(tx.ToAddress)
-		if len(usrAddrs) == 0 {
+		lc, err := mxr.ds.Lifecycle(tx.ToAddress)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not get state of %v", tx.ToAddress)
+		}
+		// a forgotten address has a lifecycle left, but nowhere to pay
+		// its deposits out to
+		forgotten := len(usrAddrs) == 0 && lc != nil
+		if len(usrAddrs) == 0 && !forgotten {
+			continue
+		}
+		if forgotten && tx.FromAddress == "" {
+			l.Printf("can't refund deposit of %v to forgotten address %v without a sender", tx.Amount, tx.ToAddress)
 			continue
 		}
+		terms, err := mxr.ds.Terms(tx.ToAddress)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not get terms of %v", tx.ToAddress)
+		}
 
 		// for logging
 		buf, _ := json.Marshal(tx)
 		l.Printf("found transaction to mix: %v", string(buf))
 
-		mixReqs = append(mixReqs, mixRequest{tx: tx, usrAddrs: usrAddrs})
+		id := newID(mxr.pollRnd)
+		mixReq := mixRequest{
+			id:       id.String(),
+			tx:       tx,
+			usrAddrs: usrAddrs,
+			terms:    terms,
+			due:      now.Add(mxr.mixCfg.InitialDelay),
+		}
+		// A window starts when the deposit is found, so the initial
+		// delay can't hold it up past the start.
+		if w := terms.window(); w != nil {
+			if w.Min < mxr.mixCfg.InitialDelay {
+				mixReq.due = now.Add(w.Min)
+			}
+			mixReq.deadline = now.Add(w.Max)
+		}
+		if forgotten || (lc != nil && lc.State == AddressExpired) {
+			switch {
+			case (forgotten || mxr.expiryCfg.Late == LateRefund) && tx.FromAddress != "":
+				mixReq.setRefund(RefundLate, climatic.Amount{}, now)
+			default:
+				l.Printf("honouring late deposit to %v", tx.ToAddress)
+			}
+		}
+		if !mixReq.refund && tx.Amount.Sign() > 0 {
+			volume, ok := volumes[tx.ToAddress]
+			if !ok {
+				volume, err = mxr.ds.Volume(tx.ToAddress)
+				if err != nil {
+					return nil, errors.Wrapf(err, "could not get volume of %v", tx.ToAddress)
+				}
+			}
+			fee := mxr.feePolicy.Fee(tx.Amount, volume)
+			// Deposits without a sender can't be refunded, so the fee
+			// takes them whole if it has to.
+			if reason := mxr.depositCfg.refundReason(tx.Amount, fee); reason != "" && tx.FromAddress != "" {
+				mixReq.setRefund(reason, mxr.depositCfg.refundFee(tx.Amount), now)
+			} else {
+				mixReq.fee = fee
+				volumes[tx.ToAddress] = volume.Add(tx.Amount)
+			}
+		}
+		if mixReq.refund {
+			l.Printf("refunding deposit of %v to %v: %s", tx.Amount, tx.ToAddress, mixReq.reason)
+		}
+		mixReqs = append(mixReqs, mixReq)
+		pending = append(pending, mixReq.pendingMix())
+	}
+
+	// The cursor only moves on once the deposits before it are saved, so a
+	// crash can't lose them.
+	if err := mxr.ds.SavePoll(cursor, pending); err != nil {
+		return nil, errors.Wrap(err, "could not save poll")
 	}
+	mxr.cursor = cursor
 
-	// add the new requested mixes after a delay
-	go func() {
-		<-time.After(mxr.mixCfg.InitialDelay)
-		mxr.makeMix(mixReqs)
-	}()
+	// Addresses refunding late deposits stay expired, and are kept for as
+	// long again, or stay forgotten. Addresses that are mixing stay mixing.
+	for _, mixReq := range mixReqs {
+		addr := mixReq.tx.ToAddress
+		switch {
+		case mixReq.reason == RefundLate && len(mixReq.usrAddrs) == 0:
+			// forgotten
+		case mixReq.reason == RefundLate:
+			mxr.setState(addr, AddressExpired)
+		case !mxr.isMixing(addr):
+			mxr.setState(addr, AddressFunded)
+		}
+	}
 
-	return nil
+	return mixReqs, nil
+}
+
+// watch looks for new deposits by only fetching the history of the deposit
+// addresses, which is cheaper than fetching every transaction when there are
+// few of them. It returns the new deposits and the cursor after them.
+func (mxr *Mixer) watch(
+	ctx context.Context, depositAddrs []string,
+) ([]*jobcoin.Transaction, jobcoin.Cursor, error) {
+	deposits := []*jobcoin.Transaction{}
+	watched := map[string]bool{}
+	for len(depositAddrs) > 0 {
+		for _, addr := range depositAddrs {
+			callCtx, cancel := mxr.callCtx(ctx)
+			addrInfo, err := mxr.jcClient.GetAddressInfo(callCtx, addr)
+			cancel()
+			if err != nil {
+				return nil, mxr.cursor, err
+			}
+			watched[addr] = true
+
+			for _, tx := range addrInfo.Transactions {
+				if tx.ToAddress == addr {
+					deposits = append(deposits, tx)
+				}
+			}
+		}
+
+		// An address registered while the others were being fetched
+		// may already have a deposit older than the newest one found,
+		// which the cursor would skip from now on, so fetch it too.
+		// Addresses registered after this can only receive newer
+		// deposits.
+		all, err := mxr.watchedAddresses()
+		if err != nil {
+			return nil, mxr.cursor, err
+		}
+		depositAddrs = depositAddrs[:0]
+		for _, addr := range all {
+			if !watched[addr] {
+				depositAddrs = append(depositAddrs, addr)
+			}
+		}
+	}
+
+	deposits, cursor := mxr.cursor.Next(deposits)
+	return deposits, cursor, nil
 }
 
 // makeMix takes mix requests and adds them to the queue of Jobcoins to be mixed.
 // This function was broken out for testing purposes.
 func (mxr *Mixer) makeMix(mixReqs []mixRequest) {
-	l := mxr.log
+	// only the mixes the deposits go to are locked, one at a time
+	byAddr := map[string][]mixRequest{}
+	addrs := []string{}
+	for _, mixReq := range mixReqs {
+		addr := mixReq.tx.ToAddress
+		if _, ok := byAddr[addr]; !ok {
+			addrs = append(addrs, addr)
+		}
+		byAddr[addr] = append(byAddr[addr], mixReq)
+	}
+	for _, addr := range addrs {
+		mxr.addToMix(addr, byAddr[addr])
+	}
+	mxr.wakePlanner()
+}
 
-	mxr.mtx.Lock()
-	defer mxr.mtx.Unlock()
+// addToMix adds deposits to addr to its mix, which is made if there is none,
+// and saves the mix along with the pending deposits it now includes.
+func (mxr *Mixer) addToMix(addr string, mixReqs []mixRequest) {
+	l := mxr.log
 
+	var (
+		m          *mix
+		pendingIDs []string
+		// deadline is the earliest deadline of the deposits
+		deadline time.Time
+		// late is whether any of the deposits came after the address
+		// expired
+		late bool
+	)
 	for _, mixReq := range mixReqs {
-		amt, err := climatic.ParseFloat(mixReq.tx.Amount)
-		if err != nil {
-			l.Printf(
-				"could not parse transaction amount %q in %s: %v",
-				mixReq.tx.Amount, mixReq.tx.ToAddress, err,
-			)
+		pendingIDs = append(pendingIDs, mixReq.id)
+
+		amt := mixReq.tx.Amount
+		if amt.Sign() < 0 {
+			l.Printf("ignoring negative amount %v in %s", amt, addr)
 			continue
 		}
-		m, ok := mxr.outstanding[mixReq.tx.ToAddress]
-		if ok {
-			m.remaining.Add(m.remaining, amt) // m.remaining += mixReq.tx.Amount
-			m.feePaid = false
+		if d := mixReq.deadline; !d.IsZero() && (deadline.IsZero() || d.Before(deadline)) {
+			deadline = d
+		}
+		if m == nil {
+			m = mxr.lockMix(addr, func() *mix {
+				return &mix{
+					usrAddrs: mixReq.usrAddrs,
+					terms:    mixReq.terms,
+					refund:   mixReq.refund,
+					rnd:      mxr.stream("mix " + addr),
+				}
+			})
+			defer m.mtx.Unlock()
+		}
+		if mixReq.refund {
+			m.addRefund(mixReq, mxr.clock.Now())
+			late = late || mixReq.reason == RefundLate
 			continue
 		}
+		// the refunds already in the mix stay in its plan
+		m.refund = false
+		m.remaining = m.remaining.Add(amt)
+		if mixReq.fee.Sign() > 0 {
+			m.fees = append(m.fees, DepositFee{
+				DepositID: mixReq.id,
+				Amount:    climatic.MinAmount(mixReq.fee, amt),
+				Charged:   mixReq.fee,
+			})
+		}
+	}
 
-		mxr.outstanding[mixReq.tx.ToAddress] = &mix{
-			usrAddrs:  mixReq.usrAddrs,
-			remaining: amt,
+	if m == nil {
+		// none of the deposits count, but they are no longer pending
+		if m = mxr.lockMix(addr, nil); m != nil {
+			defer m.mtx.Unlock()
+		}
+	} else {
+		if err := mxr.extendPlan(m, deadline); err != nil {
+			l.Printf("could not plan payouts of %v: %v", addr, err)
 		}
+		if !m.refund || !late {
+			mxr.setState(addr, AddressMixing)
+		}
+		mxr.updateDue(m)
 	}
+	mxr.saveMix(addr, m, pendingIDs...)
 }
 
-// mix does the mixing. This function assumes that no other rthreads are
-// spending Jobcoins in the deposit addresses mxr knows about.
-func (mxr *Mixer) mix() error {
-	l := mxr.log
+// lockMix locks the outstanding mix of addr and returns it. If there is none,
+// it makes one with newMix, or returns nil if newMix is nil. A worker that is
+// on the mix finishes its turn first.
+func (mxr *Mixer) lockMix(addr string, newMix func() *mix) *mix {
+	for {
+		mxr.mtx.Lock()
+		m, ok := mxr.outstanding[addr]
+		if !ok {
+			if newMix != nil {
+				// locked before anyone else can see it
+				m = newMix()
+				m.mtx.Lock()
+				mxr.outstanding[addr] = m
+			}
+			mxr.mtx.Unlock()
+			return m
+		}
+		mxr.mtx.Unlock()
+
+		m.mtx.Lock()
+		if !m.done {
+			return m
+		}
+		// it was completed in the meantime
+		m.mtx.Unlock()
+	}
+}
+
+// updateDue tells the scheduler when m is due next, and what the strategy needs
+// to know to order it. m.mtx must be held.
+func (mxr *Mixer) updateDue(m *mix) {
+	due := m.due(mxr.clock.Now())
+	balance := mxr.payable(m)
+	deadline := m.nextDeadline()
 
 	mxr.mtx.Lock()
-	defer mxr.mtx.Unlock()
+	m.next = due
+	m.balance = balance
+	m.dueBy = deadline
+	mxr.mtx.Unlock()
+}
 
-	//
-	// The first few blocks are for selecting a mix request to send part of.
-	//
+// saveMix saves the mix of addr, or deletes it if m is nil, along with the
+// pending deposits it now includes. If saving fails, the state in memory is
+// still used until the mixer stops.
+func (mxr *Mixer) saveMix(addr string, m *mix, pendingIDs ...string) {
+	var rec *MixRecord
+	if m != nil {
+		rec = mxr.snapshot(m)
+	}
+	if err := mxr.ds.SaveMix(addr, rec, pendingIDs...); err != nil {
+		mxr.log.Printf("could not save mix of %v: %v", addr, err)
+	}
+}
 
-	// if there are no outstanding things to be mixed, exit
-	if len(mxr.outstanding) < 1 {
-		l.Printf("nothing to mix")
+// snapshot records m to be saved and keeps the record for Status. m.mtx must be
+// held.
+func (mxr *Mixer) snapshot(m *mix) *MixRecord {
+	rec := m.record()
+	mxr.mtx.Lock()
+	m.saved = rec
+	mxr.mtx.Unlock()
+
+	return rec
+}
+
+// mix works on the plan of the deposit address addr: it collects the fee,
+// sweeps the deposit into the pool in pooled mode and sends the next payout
+// that is due. Only the mix of addr is locked while it does, so other deposit
+// addresses can be worked on at the same time. This function assumes that no
+// other threads are spending Jobcoins in the deposit addresses mxr knows about.
+func (mxr *Mixer) mix(ctx context.Context, addr string) (err error) {
+	l := mxr.log
+
+	m := mxr.lockMix(addr, nil)
+	if m == nil {
+		l.Printf("nothing to mix in %v", addr)
 		return nil
 	}
-	// select random mix request
-	i := rand.Intn(len(mxr.outstanding))
-	var addr string
-	for addr = range mxr.outstanding {
-		if i == 0 {
-			break
-		}
-		i--
-	}
-	m := mxr.outstanding[addr]
+	defer m.mtx.Unlock()
 	// If no user addresses regitered, exit. This case should never get hit,
-	// but the state is possible.
-	if len(m.usrAddrs) < 1 {
+	// but the state is possible. Refunds of deposits to forgotten addresses
+	// don't need any.
+	if len(m.usrAddrs) < 1 && !m.refund {
 		return nil
 	}
 
-	// Tick a random user address to send the amount to. This is selected
-	// here so that the rest of the function is deterministic.
-	usrAddr := m.usrAddrs[rand.Intn(len(m.usrAddrs))]
-
-	//
-	// The rest of the function collects the fee and sends mixed Jobcoins.
-	//
-
 	l.Printf("mixing %v", addr)
 
+	// the next step waits at least one mixing delay, so that a mix that
+	// can't make progress doesn't spin
+	defer mxr.updateDue(m)
+	defer func() { m.retryAt = mxr.clock.Now().Add(mxr.retryDelay(m)) }()
+
 	// prevents a class of rounding error
 	defer func() {
-		del, err := mxr.updateRemaining(m, addr)
-		if err != nil {
-			l.Printf("failed to update remaining: %v", err)
+		switch {
+		case jobcoin.IsTransient(err):
+			// The API is having trouble, so asking it for the balance
+			// is pointless. Leave everything as it is and try again
+			// on a later tick.
+			l.Printf("transient failure mixing %v: %v", addr, err)
+			return
+		case errors.Is(err, jobcoin.ErrNotFound):
+			// A payout can be turned away as not found for reasons
+			// that have nothing to do with the deposit address, such
+			// as a misconfigured API URL, so the mix is only dropped
+			// once the ledger shows there is nothing left in it.
+			l.Printf("not found mixing %v: %v", addr, err)
+		case errors.Is(err, jobcoin.ErrInsufficientFunds):
+			// our accounting drifted from the ledger, which the
+			// update below corrects
+			l.Printf("balance of %v is lower than expected: %v", addr, err)
+		}
+
+		del, updateErr := mxr.updateRemaining(ctx, m, addr)
+		if updateErr != nil {
+			l.Printf("failed to update remaining: %v", updateErr)
 		}
 		if del {
-			delete(mxr.outstanding, addr)
+			mxr.complete(addr, m)
+			return
 		}
+		mxr.saveMix(addr, m)
 	}()
 
-	// collect fee
-	if mxr.fee.Cmp(big.NewFloat(0)) == 0 {
-		m.feePaid = true
+	// finish what was being sent when the mixer last stopped or failed
+	mxr.mtx.Lock()
+	t, ok := mxr.unresolved[addr]
+	mxr.mtx.Unlock()
+	if ok {
+		if err := mxr.resolveTransfer(ctx, m, t); err != nil {
+			return err
+		}
+	}
+
+	if err := mxr.collectFees(ctx, m, addr); err != nil {
+		return err
 	}
-	if !m.feePaid {
-		l.Printf("collecting fee")
-		if err := mxr.collectFee(m, addr); err != nil {
+
+	// refunds go straight back to the sender
+	if len(mxr.pool) > 0 && !m.refund {
+		if err := mxr.sweep(ctx, m, addr); err != nil {
 			return err
 		}
 	}
 
-	return mxr.sendMix(m, addr, usrAddr)
+	if err := mxr.extendPlan(m, time.Time{}); err != nil {
+		return errors.Wrap(err, "could not plan payouts")
+	}
+	mxr.rush(addr, m)
+	p := m.nextPayout()
+	if p == nil || p.At.After(mxr.clock.Now()) {
+		return nil
+	}
+
+	if len(mxr.pool) > 0 && !m.refund {
+		return mxr.payFromPool(ctx, m, addr, p)
+	}
+
+	return mxr.sendMix(ctx, m, addr, p)
 }
 
 // updateRemaining gets the API's view of the remaining balance and updates
-// it. It also returns of the mix request should be deleted.
-func (mxr *Mixer) updateRemaining(m *mix, addr string) (bool, error) {
+// it, leaving out the deposits that haven't reached the mix yet. A change that
+// the transfers don't explain is logged and counted as drift. It also returns
+// of the mix request should be deleted.
+func (mxr *Mixer) updateRemaining(ctx context.Context, m *mix, addr string) (bool, error) {
 	l := mxr.log
 
-	remaining, err := mxr.getRemaining(addr)
+	addrInfo, unmixed, err := mxr.addressInfo(ctx, addr)
 	if err != nil {
 		l.Printf("failed to get remaining: %v", err)
 		return false, err
 	}
-	if remaining.Cmp(big.NewFloat(0)) == 0 { // remaining == 0
+	remaining := climatic.MaxAmount(addrInfo.Balance.Sub(unmixed), climatic.Amount{})
+	if remaining.Cmp(m.remaining) != 0 {
+		l.Printf("accounting of %v drifted: expected %v, ledger has %v", addr, m.remaining, remaining)
+		reconcileVars.Add("drift", 1)
+	}
+	if remaining.IsZero() && m.owed.IsZero() {
 		l.Printf("done mixing %v", addr)
 		return true, nil
 	}
@@ -350,77 +1129,186 @@ func (mxr *Mixer) updateRemaining(m *mix, addr string) (bool, error) {
 	return false, nil
 }
 
-func (mxr *Mixer) collectFee(m *mix, addr string) error {
+func (mxr *Mixer) sendMix(ctx context.Context, m *mix, addr string, p *PlannedPayout) error {
 	l := mxr.log
 
-	// if the fee is larger than the amount to be mixed, just use the remaining amount
-	fee := mxr.fee
-	if mxr.fee.Cmp(m.remaining) == 1 { // mxr.fee > m.remaining
-		fee = m.remaining
-		l.Printf("reduced fee: %f", fee)
-	}
-	if fee.Cmp(big.NewFloat(0)) == 0 {
-		return nil
-	}
+	// if the amount is greater than the total remaining, only mix the remaining
+	amt := climatic.MinAmount(p.Amount, m.remaining)
 
-	// send fee from deposit address to mixer address
-	err := mxr.jcClient.PostTransaction(addr, mxr.addr, climatic.Ftos(fee))
-	if err != nil {
-		return err
-	}
+	if amt.Sign() > 0 {
+		// There's a small chance that the rest of this function will
+		// fail due to a discrepancy between our internal accounting and
+		// the balance on the server. The next time this address is
+		// mixed, it will work due to the updated remaining amount.
 
-	m.feePaid = true
-	m.remaining.Sub(m.remaining, fee) // m.remaining -= fee
+		l.Printf("mixing from %v to %v with amount %v", addr, p.ToAddress, amt)
+		return mxr.payout(ctx, m, addr, addr, p, amt)
+	}
 
 	return nil
 }
 
-func (mxr *Mixer) sendMix(m *mix, addr, usrAddr string) error {
-	l := mxr.log
-
-	// if the amount is greater than the total remaining, only mix the remaining
-	amt := big.NewFloat(mxr.mixCfg.amount())
-	if amt.Cmp(m.remaining) == 1 { // amt > m.remaining
-		amt = m.remaining
+// payout sends the planned payout p from fromAddr for the deposit address
+// addr, with amt in case the balance can't cover all of it. With routing on,
+// it only funds the first hop of a new route and the routing loop takes it
+// from there.
+func (mxr *Mixer) payout(
+	ctx context.Context, m *mix, addr, fromAddr string, p *PlannedPayout, amt climatic.Amount,
+) error {
+	t := &Transfer{
+		Kind:           TransferPayout,
+		DepositAddress: addr,
+		FromAddress:    fromAddr,
+		ToAddress:      p.ToAddress,
+		Amount:         amt,
+		PayoutID:       p.ID,
+		Refund:         p.Refund,
 	}
 
-	if amt.Cmp(big.NewFloat(0)) != 0 { // amt != 0
-		// There's a small chance that the rest of this function will
-		// fail due to a discrepancy between our internal accounting and
-		// the balance on the server. The next time this address is
-		// mixed, it will work due to the updated remaining amount.
-
-		l.Printf("mixing from %v to %v with amount %v", addr, usrAddr, amt)
-		err := mxr.jcClient.PostTransaction(addr, usrAddr, climatic.Ftos(amt))
+	var r *Route
+	if mxr.routeCfg.Hops > 0 && !m.refund {
+		var err error
+		r, err = mxr.newRoute(mxr.mixRand(m), addr, p.ToAddress, amt, p.Deadline)
 		if err != nil {
-			return err
+			return errors.Wrap(err, "could not make route")
 		}
-		m.remaining.Sub(m.remaining, amt) // m.remaining -= amt
+		t.ToAddress = r.Hops[0]
+		t.RouteID = r.ID
 	}
 
-	return nil
+	if err := mxr.journalTransfer(ctx, m, t); err != nil {
+		if r != nil {
+			mxr.mtx.Lock()
+			mxr.dropRoute(r)
+			mxr.mtx.Unlock()
+		}
+		return err
+	}
+
+	return mxr.postTransfer(ctx, m, t)
 }
 
-func (mxr *Mixer) getRemaining(addr string) (*big.Float, error) {
-	addrInfo, err := mxr.jcClient.GetAddressInfo(addr)
+// complete removes the finished mix m of addr. The address is completed, or
+// expired again if m refunded late deposits, unless it was forgotten. m.mtx
+// must be held.
+func (mxr *Mixer) complete(addr string, m *mix) {
+	m.done = true
+	mxr.mtx.Lock()
+	delete(mxr.outstanding, addr)
+	mxr.mtx.Unlock()
+	mxr.saveMix(addr, nil)
+	lc, err := mxr.ds.Lifecycle(addr)
 	if err != nil {
-		return nil, err
+		mxr.log.Printf("could not get state of %v: %v", addr, err)
 	}
-	remaining, err := climatic.ParseFloat(addrInfo.Balance)
-	if err != nil {
-		return nil, err
+	switch {
+	case m.refund && lc != nil && lc.State == AddressForgotten:
+		// it stays forgotten
+	case m.refund && lc != nil && lc.State == AddressExpired:
+		mxr.setState(addr, AddressExpired)
+	default:
+		mxr.setState(addr, AddressCompleted)
 	}
-	return remaining, nil
+}
 
+func (mxr *Mixer) getRemaining(ctx context.Context, addr string) (climatic.Amount, error) {
+	callCtx, cancel := mxr.callCtx(ctx)
+	defer cancel()
+	addrInfo, err := mxr.jcClient.GetAddressInfo(callCtx, addr)
+	if err != nil {
+		return climatic.Amount{}, err
+	}
+	return addrInfo.Balance, nil
 }
 
 type mix struct {
-	usrAddrs  []string
-	remaining *big.Float
-	feePaid   bool
+	// mtx guards the rest of the mix. A worker holds it for its whole turn,
+	// so a deposit address is only worked on by one goroutine at a time.
+	mtx sync.Mutex
+	// next is when the plan is due to be worked on again, and balance and
+	// dueBy are what is left to pay out and by when as of then. They are
+	// guarded by Mixer.mtx instead, so the scheduler doesn't wait for turns
+	// to end.
+	next    time.Time
+	balance climatic.Amount
+	dueBy   time.Time
+	// done is set once the mix is completed and no longer outstanding
+	done bool
+	// saved is the rest of the mix as it was last saved, which Status
+	// reports. It is guarded by Mixer.mtx too, so Status doesn't wait for
+	// a turn to end.
+	saved *MixRecord
+
+	usrAddrs []string
+	// terms are how the deposit is paid out to usrAddrs, if they were
+	// registered with any
+	terms *Terms
+	// remaining is what is left in the deposit address
+	remaining climatic.Amount
+	// fees holds the fee of every deposit in the mix
+	fees []DepositFee
+	// owed is what the pool still has to pay out for the deposit
+	owed climatic.Amount
+	// plan holds the payouts of the deposit, in the order they are due
+	plan []PlannedPayout
+	// retryAt is the earliest the plan is worked on again
+	retryAt time.Time
+	// refund is whether the mix only pays deposits back to their senders
+	refund bool
+	// rnd is where the choices for the mix are drawn from
+	rnd *rand.Rand
+}
+
+func (m *mix) record() *MixRecord {
+	return &MixRecord{
+		UserAddresses: m.usrAddrs,
+		Terms:         m.terms,
+		Remaining:     m.remaining,
+		Fees:          append([]DepositFee(nil), m.fees...),
+		Owed:          m.owed,
+		Plan:          append([]PlannedPayout(nil), m.plan...),
+		Refund:        m.refund,
+	}
 }
 
 type mixRequest struct {
+	id       string
 	tx       *jobcoin.Transaction
 	usrAddrs []string
+	terms    *Terms
+	// due is when the deposit becomes eligible for mixing
+	due time.Time
+	// deadline is when the deposit must be paid out by, if there is a
+	// window
+	deadline time.Time
+	// refund is whether the deposit is sent back, and reason why
+	refund bool
+	reason RefundReason
+	// fee is the fee the policy set for the deposit, which may be more
+	// than the deposit, or the fee of its refund
+	fee climatic.Amount
+}
+
+// setRefund makes the deposit a refund for reason that is due now, with fee
+// taken from it.
+func (mixReq *mixRequest) setRefund(reason RefundReason, fee climatic.Amount, now time.Time) {
+	mixReq.refund = true
+	mixReq.reason = reason
+	mixReq.fee = fee
+	mixReq.due = now
+	mixReq.deadline = time.Time{}
+}
+
+func (mixReq mixRequest) pendingMix() *PendingMix {
+	return &PendingMix{
+		ID:            mixReq.id,
+		Deposit:       mixReq.tx,
+		UserAddresses: mixReq.usrAddrs,
+		Terms:         mixReq.terms,
+		Due:           mixReq.due,
+		Deadline:      mixReq.deadline,
+		Refund:        mixReq.refund,
+		RefundReason:  mixReq.reason,
+		Fee:           mixReq.fee,
+	}
 }
@@ -1,9 +1,15 @@
 package server
 
 import (
+	"context"
 	"errors"
-	"math/big"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/r-medina/climatic"
 	"github.com/r-medina/climatic/jobcoin"
@@ -16,7 +22,6 @@ func TestMakeMix(t *testing.T) {
 	t.Parallel()
 
 	require := assert.New(t) // this is not working as expected
-	parseFloat := makeParseFloat(t)
 
 	tests := []struct {
 		desc        string
@@ -39,14 +44,14 @@ func TestMakeMix(t *testing.T) {
 			mixReqs: []mixRequest{{
 				tx: &jobcoin.Transaction{
 					ToAddress: "b",
-					Amount:    "2.",
+					Amount:    climatic.MustParseAmount("2."),
 				},
 				usrAddrs: []string{"u1", "u2"}},
 			},
 			want: map[string]*mix{
 				"b": {
 					usrAddrs:  []string{"u1", "u2"},
-					remaining: parseFloat("2."),
+					remaining: climatic.MustParseAmount("2."),
 				},
 			},
 		},
@@ -57,13 +62,13 @@ func TestMakeMix(t *testing.T) {
 				{
 					tx: &jobcoin.Transaction{
 						ToAddress: "b",
-						Amount:    "2.",
+						Amount:    climatic.MustParseAmount("2."),
 					},
 					usrAddrs: []string{"u1", "u2"},
 				}, {
 					tx: &jobcoin.Transaction{
 						ToAddress: "b",
-						Amount:    "2.",
+						Amount:    climatic.MustParseAmount("2."),
 					},
 					usrAddrs: []string{"u1", "u2"},
 				},
@@ -71,7 +76,7 @@ func TestMakeMix(t *testing.T) {
 			want: map[string]*mix{
 				"b": {
 					usrAddrs:  []string{"u1", "u2"},
-					remaining: parseFloat("4."),
+					remaining: climatic.MustParseAmount("4."),
 				},
 			},
 		},
@@ -81,20 +86,20 @@ func TestMakeMix(t *testing.T) {
 			outstanding: map[string]*mix{
 				"b": {
 					usrAddrs:  []string{"u1", "u2"},
-					remaining: parseFloat("2."),
+					remaining: climatic.MustParseAmount("2."),
 				},
 			},
 			mixReqs: []mixRequest{{
 				tx: &jobcoin.Transaction{
 					ToAddress: "b",
-					Amount:    "2.",
+					Amount:    climatic.MustParseAmount("2."),
 				},
 				usrAddrs: []string{"u1", "u2"},
 			}},
 			want: map[string]*mix{
 				"b": {
 					usrAddrs:  []string{"u1", "u2"},
-					remaining: parseFloat("4."),
+					remaining: climatic.MustParseAmount("4."),
 				},
 			},
 		},
@@ -104,30 +109,35 @@ func TestMakeMix(t *testing.T) {
 			outstanding: map[string]*mix{
 				"b": {
 					usrAddrs:  []string{"u1", "u2"},
-					remaining: parseFloat("2."),
+					remaining: climatic.MustParseAmount("2."),
 				},
 			},
 			mixReqs: []mixRequest{{
 				tx: &jobcoin.Transaction{
 					ToAddress: "c",
-					Amount:    "2.",
+					Amount:    climatic.MustParseAmount("2."),
 				},
 				usrAddrs: []string{"u3"},
 			}},
 			want: map[string]*mix{
 				"b": {
 					usrAddrs:  []string{"u1", "u2"},
-					remaining: parseFloat("2."),
+					remaining: climatic.MustParseAmount("2."),
 				},
 				"c": {
 					usrAddrs:  []string{"u3"},
-					remaining: parseFloat("2.00"),
+					remaining: climatic.MustParseAmount("2.00"),
 				},
 			},
 		},
 	}
 
-	mxr := &Mixer{ds: newMemDS()}
+	mxr := &Mixer{
+		ds:       newMemDS(),
+		strategy: UniformStrategy{},
+		rnd:      newRand(rand.NewSource(1)),
+		clock:    systemClock{},
+	}
 
 	for _, test := range tests {
 		t.Run(test.desc, func(t *testing.T) {
@@ -138,6 +148,19 @@ func TestMakeMix(t *testing.T) {
 
 			mxr.makeMix(test.mixReqs)
 
+			// the plans are random, but they cover what is left to pay
+			for _, mixReq := range test.mixReqs {
+				m := mxr.outstanding[mixReq.tx.ToAddress]
+				planned := climatic.Amount{}
+				for _, p := range m.plan {
+					planned = planned.Add(p.Amount)
+				}
+				require.Equal(mxr.payable(m), planned, "plan of %v", mixReq.tx.ToAddress)
+			}
+			// so is when they are due
+			for _, m := range mxr.outstanding {
+				m.plan, m.next, m.balance, m.saved, m.rnd = nil, time.Time{}, climatic.Amount{}, nil, nil
+			}
 			require.Equal(test.want, mxr.outstanding, "ending state equal")
 		})
 	}
@@ -147,15 +170,14 @@ func TestUpdateRemaining(t *testing.T) {
 	t.Parallel()
 
 	require := assert.New(t) // this is not working as expected
-	parseFloat := makeParseFloat(t)
 
 	tests := []struct {
-		remaining *big.Float
+		remaining string
 		err       error
 		del       bool
 	}{
-		{remaining: parseFloat("1"), del: false},
-		{remaining: parseFloat("0"), del: true},
+		{remaining: "1", del: false},
+		{remaining: "0", del: true},
 		{err: errors.New("some error"), del: false},
 	}
 
@@ -167,20 +189,20 @@ func TestUpdateRemaining(t *testing.T) {
 
 			jcClient.AddrInfo = func() (*jobcoin.AddressInfo, error) {
 				var addrInfo *jobcoin.AddressInfo
-				if test.remaining != nil {
+				if test.remaining != "" {
 					addrInfo = &jobcoin.AddressInfo{
-						Balance: test.remaining.String(),
+						Balance: climatic.MustParseAmount(test.remaining),
 					}
 				}
 				return addrInfo, test.err
 			}
 
 			m := &mix{}
-			del, err := mxr.updateRemaining(m, "")
+			del, err := mxr.updateRemaining(context.Background(), m, "")
 			require.Equal(test.err, err)
 			require.Equal(test.del, del)
-			if test.err != nil {
-				require.Equal(test.remaining, m.remaining)
+			if test.err == nil {
+				require.Equal(climatic.MustParseAmount(test.remaining), m.remaining)
 			}
 		})
 	}
@@ -191,43 +213,46 @@ func TestCollectFee(t *testing.T) {
 	t.Parallel()
 
 	require := assert.New(t) // this is not working as expected
-	parseFloat := makeParseFloat(t)
 
 	tests := []struct {
-		fee  *big.Float
-		m    *mix
-		err  error
-		want *mix
+		fee      climatic.Amount
+		m        *mix
+		err      error
+		want     *mix
+		wantPaid bool
 	}{
 		{
-			fee:  parseFloat("3"),
-			m:    &mix{remaining: parseFloat("10")},
-			want: &mix{remaining: parseFloat("7."), feePaid: true},
+			fee:      climatic.MustParseAmount("3"),
+			m:        &mix{remaining: climatic.MustParseAmount("10")},
+			want:     &mix{remaining: climatic.MustParseAmount("7.")},
+			wantPaid: true,
 		},
 
 		{
-			fee:  parseFloat("3"),
-			m:    &mix{remaining: parseFloat("2")},
-			want: &mix{remaining: big.NewFloat(0), feePaid: true},
+			fee:      climatic.MustParseAmount("3"),
+			m:        &mix{remaining: climatic.MustParseAmount("2")},
+			want:     &mix{remaining: climatic.Amount{}},
+			wantPaid: true,
 		},
 
 		{
-			fee:  parseFloat("0"),
-			m:    &mix{remaining: parseFloat("2")},
-			want: &mix{remaining: parseFloat("2")},
+			fee:      climatic.MustParseAmount("0"),
+			m:        &mix{remaining: climatic.MustParseAmount("2")},
+			want:     &mix{remaining: climatic.MustParseAmount("2")},
+			wantPaid: true,
 		},
 
 		{
-			fee:  parseFloat("100"),
-			m:    &mix{remaining: parseFloat("0")},
-			want: &mix{remaining: parseFloat("0"), feePaid: false},
+			fee:  climatic.MustParseAmount("100"),
+			m:    &mix{remaining: climatic.MustParseAmount("0")},
+			want: &mix{remaining: climatic.MustParseAmount("0")},
 		},
 
 		{
-			fee:  parseFloat("3"),
-			m:    &mix{remaining: parseFloat("10")},
+			fee:  climatic.MustParseAmount("3"),
+			m:    &mix{remaining: climatic.MustParseAmount("10")},
 			err:  errors.New("err"),
-			want: &mix{remaining: parseFloat("10"), feePaid: false},
+			want: &mix{remaining: climatic.MustParseAmount("10")},
 		},
 	}
 
@@ -235,7 +260,6 @@ func TestCollectFee(t *testing.T) {
 		t.Run("", func(t *testing.T) {
 			jcClient := &jctest.MockClient{}
 			mxr, err := NewMixer(
-				WithFee(test.fee),
 				WithJobcoinClient(jcClient),
 			)
 			require.NoError(err)
@@ -246,33 +270,425 @@ func TestCollectFee(t *testing.T) {
 				}
 			}
 
-			err = mxr.collectFee(test.m, "addr")
+			test.m.fees = []DepositFee{{DepositID: "1", Amount: test.fee}}
+			err = mxr.collectFee(context.Background(), test.m, "addr", test.m.fees[0])
 			if test.err != nil {
 				require.Equal(test.err, err)
 			}
 
-			// have to test it a little more hands on bc big.Float
-			// doesn't play great with equality checking
+			require.Equal(test.want.remaining, test.m.remaining)
+			require.Equal(test.wantPaid, test.m.feePaid())
+		})
+	}
+}
+
+func TestMixFailures(t *testing.T) {
+	t.Parallel()
+
+	require := assert.New(t) // this is not working as expected
+
+	tests := []struct {
+		desc string
+		err  error
+		// addrInfoCalls counts the history fetched for the transfer
+		// journal as well as balance updates
+		addrInfoCalls int
+		// balance is what the ledger has left in the deposit address
+		balance    string
+		dropped    bool
+		wantRemain string
+	}{
+		{
+			desc:          "transient",
+			err:           &jobcoin.APIError{Err: jobcoin.ErrServer, StatusCode: 503},
+			addrInfoCalls: 2,
+			balance:       "4",
+			wantRemain:    "10",
+		},
+		{
+			desc:          "not found",
+			err:           &jobcoin.APIError{Err: jobcoin.ErrNotFound, StatusCode: 404},
+			addrInfoCalls: 2,
+			balance:       "4",
+			wantRemain:    "4",
+		},
+		{
+			desc:          "not found and empty",
+			err:           &jobcoin.APIError{Err: jobcoin.ErrNotFound, StatusCode: 404},
+			addrInfoCalls: 2,
+			balance:       "0",
+			dropped:       true,
+		},
+		{
+			desc:          "insufficient funds",
+			err:           &jobcoin.APIError{Err: jobcoin.ErrInsufficientFunds, StatusCode: 422},
+			addrInfoCalls: 2,
+			balance:       "4",
+			wantRemain:    "4",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			addrInfoCalls := 0
+			jcClient := &jctest.MockClient{
+				Post: func() error { return test.err },
+				AddrInfo: func() (*jobcoin.AddressInfo, error) {
+					addrInfoCalls++
+					return &jobcoin.AddressInfo{Balance: climatic.MustParseAmount(test.balance)}, nil
+				},
+			}
+			mxr, err := NewMixer(WithJobcoinClient(jcClient))
+			require.NoError(err)
+			mxr.outstanding["b"] = &mix{usrAddrs: []string{"u"}, remaining: climatic.MustParseAmount("10")}
+
+			err = mxr.mix(context.Background(), "b")
+			require.Equal(test.err, err)
+			require.Equal(test.addrInfoCalls, addrInfoCalls)
+			require.Empty(mxr.unresolved, "transfer left unresolved")
+
+			m, ok := mxr.outstanding["b"]
+			require.Equal(!test.dropped, ok)
+			if ok {
+				require.Equal(climatic.MustParseAmount(test.wantRemain), m.remaining)
+			}
+		})
+	}
+}
+
+func TestMixerEndToEnd(t *testing.T) {
+	t.Parallel()
+
+	require := assert.New(t) // this is not working as expected
+
+	ledger := jctest.NewLedger()
+	srv := httptest.NewServer(ledger)
+	defer srv.Close()
+
+	mxr, err := NewMixer(
+		WithJobcoinClient(jobcoin.NewClimaticClient(jobcoin.WithAPIAddress(srv.URL))),
+		WithAddress("fees"),
+		WithFee(climatic.MustParseAmount("2.5")),
+		WithPollConfig(PollConfig{MeanDelay: 5 * time.Millisecond, MaxDelay: 5 * time.Millisecond}),
+		WithMixConfig(MixConfig{
+			MeanDelay:  time.Millisecond,
+			MaxDelay:   time.Millisecond,
+			MeanAmount: climatic.MustParseAmount("10"),
+			MinAmount:  climatic.MustParseAmount("5"),
+			MaxAmount:  climatic.MustParseAmount("20"),
+		}),
+		WithLogger(log.New(ioutil.Discard, "", 0)),
+	)
+	require.NoError(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = mxr.Start(ctx) }()
+
+	res, err := mxr.Register(ctx, &climatic.RegisterRequest{Addresses: []string{"u1", "u2"}})
+	require.NoError(err)
+
+	require.NoError(ledger.Create(ctx, "alice"))
+	require.NoError(ledger.PostTransaction(ctx, "alice", res.Address, climatic.MustParseAmount("42")))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !ledger.Balance(res.Address).IsZero() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	require.True(ledger.Balance(res.Address).IsZero(), "deposit not fully mixed")
+	require.Equal(climatic.MustParseAmount("2.5"), ledger.Balance("fees"))
+	require.Equal(climatic.MustParseAmount("39.5"), ledger.Balance("u1").Add(ledger.Balance("u2")))
+}
+
+func TestMixerPooled(t *testing.T) {
+	t.Parallel()
+
+	require := assert.New(t) // this is not working as expected
+
+	ledger := jctest.NewLedger()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the pool starts out with enough to pay before the deposit is swept
+	require.NoError(ledger.Create(ctx, "house1"))
+
+	mxr, err := NewMixer(
+		WithJobcoinClient(ledger),
+		WithAddress("fees"),
+		WithFee(climatic.MustParseAmount("2.5")),
+		WithPool("house1", "house2"),
+		WithPollConfig(PollConfig{MeanDelay: 5 * time.Millisecond, MaxDelay: 5 * time.Millisecond}),
+		WithMixConfig(MixConfig{
+			MeanDelay:  time.Millisecond,
+			MaxDelay:   time.Millisecond,
+			MeanAmount: climatic.MustParseAmount("10"),
+			MinAmount:  climatic.MustParseAmount("5"),
+			MaxAmount:  climatic.MustParseAmount("20"),
+		}),
+		WithLogger(log.New(ioutil.Discard, "", 0)),
+	)
+	require.NoError(err)
+	go func() { _ = mxr.Start(ctx) }()
+
+	res, err := mxr.Register(ctx, &climatic.RegisterRequest{Addresses: []string{"u1", "u2"}})
+	require.NoError(err)
+
+	require.NoError(ledger.Create(ctx, "alice"))
+	require.NoError(ledger.PostTransaction(ctx, "alice", res.Address, climatic.MustParseAmount("42")))
+
+	paid := func() climatic.Amount { return ledger.Balance("u1").Add(ledger.Balance("u2")) }
+	want := climatic.MustParseAmount("39.5")
+	deadline := time.Now().Add(5 * time.Second)
+	for paid() != want && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	require.Equal(want, paid())
+	require.True(ledger.Balance(res.Address).IsZero(), "deposit not swept")
+	require.Equal(climatic.MustParseAmount("2.5"), ledger.Balance("fees"))
+	require.Equal(
+		jctest.DefaultCreateAmount,
+		ledger.Balance("house1").Add(ledger.Balance("house2")),
+		"pool lost or gained coins",
+	)
+
+	txs, err := ledger.GetTransactions(ctx)
+	require.NoError(err)
+	for _, tx := range txs {
+		if tx.ToAddress == "u1" || tx.ToAddress == "u2" {
+			require.NotEqual(res.Address, tx.FromAddress, "user paid from the deposit address")
+		}
+	}
+}
+
+func TestFindMixRequests(t *testing.T) {
+	t.Parallel()
+
+	for _, watchThreshold := range []int{0, 10} {
+		watchThreshold := watchThreshold
+		t.Run(fmt.Sprintf("watch threshold %d", watchThreshold), func(t *testing.T) {
+			t.Parallel()
+			require := assert.New(t) // this is not working as expected
+
+			ctx := context.Background()
+			ledger := jctest.NewLedger()
+			srv := httptest.NewServer(ledger)
+			defer srv.Close()
+
+			mxr, err := NewMixer(
+				WithJobcoinClient(jobcoin.NewClimaticClient(jobcoin.WithAPIAddress(srv.URL))),
+				WithPollConfig(PollConfig{WatchThreshold: watchThreshold}),
+				WithLogger(log.New(ioutil.Discard, "", 0)),
+			)
+			require.NoError(err)
+			require.NoError(mxr.ds.RegisterTerms("d1", []string{"u1"}, nil, mxr.clock.Now()))
+			require.NoError(mxr.ds.RegisterTerms("d2", []string{"u2"}, nil, mxr.clock.Now()))
+
+			require.NoError(ledger.Create(ctx, "alice"))
+			require.NoError(ledger.PostTransaction(ctx, "alice", "d1", climatic.MustParseAmount("1")))
+			require.NoError(ledger.PostTransaction(ctx, "alice", "bob", climatic.MustParseAmount("1")))
+
+			mixReqs, err := mxr.findMixRequests(ctx)
+			require.NoError(err)
+			require.Len(mixReqs, 1)
+			require.Equal("d1", mixReqs[0].tx.ToAddress)
+			require.Equal([]string{"u1"}, mixReqs[0].usrAddrs)
 
-			want, _ := test.want.remaining.Float64()
-			got, _ := test.m.remaining.Float64()
-			require.InDelta(want, got, 0)
-			require.Equal(test.want.feePaid, test.m.feePaid)
+			mixReqs, err = mxr.findMixRequests(ctx)
+			require.NoError(err)
+			require.Empty(mixReqs, "deposits found twice")
+
+			require.NoError(ledger.PostTransaction(ctx, "alice", "d2", climatic.MustParseAmount("2")))
+			require.NoError(ledger.PostTransaction(ctx, "alice", "d1", climatic.MustParseAmount("3")))
+
+			mixReqs, err = mxr.findMixRequests(ctx)
+			require.NoError(err)
+			require.Len(mixReqs, 2)
+			require.Equal("d2", mixReqs[0].tx.ToAddress)
+			require.Equal("d1", mixReqs[1].tx.ToAddress)
 		})
 	}
 }
 
-// needed to get right precision
-func makeParseFloat(t *testing.T) func(v string) *big.Float {
-	t.Helper()
+func TestMixerRestart(t *testing.T) {
+	t.Parallel()
 
 	require := assert.New(t) // this is not working as expected
 
-	return func(v string) *big.Float {
-		t.Helper()
+	ctx := context.Background()
+	ledger := jctest.NewLedger()
+	ds := newMemDS()
+	newMixer := func() *Mixer {
+		mxr, err := NewMixer(
+			WithJobcoinClient(ledger),
+			WithDatastore(ds),
+			WithAddress("fees"),
+			WithFee(climatic.MustParseAmount("1")),
+			WithMixConfig(MixConfig{
+				InitialDelay: time.Hour,
+				MeanAmount:   climatic.MustParseAmount("2"),
+				MinAmount:    climatic.MustParseAmount("2"),
+				MaxAmount:    climatic.MustParseAmount("2"),
+			}),
+			WithLogger(log.New(ioutil.Discard, "", 0)),
+		)
+		require.NoError(err)
+		return mxr
+	}
+
+	mxr := newMixer()
+	require.NoError(ds.RegisterTerms("d1", []string{"u1"}, nil, time.Now()))
+	require.NoError(ds.RegisterTerms("d2", []string{"u2"}, nil, time.Now()))
+	require.NoError(ledger.Create(ctx, "alice"))
+	require.NoError(ledger.PostTransaction(ctx, "alice", "d1", climatic.MustParseAmount("10")))
+	require.NoError(ledger.PostTransaction(ctx, "alice", "d2", climatic.MustParseAmount("5")))
+
+	// d1 is mixed once, d2 is still waiting out the initial delay
+	mixReqs, err := mxr.findMixRequests(ctx)
+	require.NoError(err)
+	require.Len(mixReqs, 2)
+	mxr.makeMix(mixReqs[:1])
+	require.NoError(mxr.mix(ctx, "d1"))
+	require.Equal(climatic.MustParseAmount("1"), ledger.Balance("fees"))
+	require.Equal(climatic.MustParseAmount("2"), ledger.Balance("u1"))
+
+	restarted := newMixer()
+	// when to retry is not saved, a restart retries right away
+	mxr.outstanding["d1"].retryAt = time.Time{}
+	mxr.outstanding["d1"].next = time.Time{}
+	mxr.outstanding["d1"].balance = climatic.Amount{}
+	require.Equal(mxr.cursor, restarted.cursor, "cursor not restored")
+	require.Equal(mxr.outstanding, restarted.outstanding, "outstanding mixes not restored")
+	require.Len(restarted.pending, 1)
+	require.Equal("d2", restarted.pending[0].tx.ToAddress)
+
+	mixReqs, err = restarted.findMixRequests(ctx)
+	require.NoError(err)
+	require.Empty(mixReqs, "deposits found again after restart")
+
+	// the fee is not charged again
+	restarted.makeMix(restarted.pending)
+	restarted.pending = nil
+	for i := 0; len(restarted.outstanding) > 0 && i < 100; i++ {
+		for addr := range restarted.outstanding {
+			require.NoError(restarted.mix(ctx, addr))
+		}
+	}
+	require.Equal(climatic.MustParseAmount("2"), ledger.Balance("fees"))
+	require.Equal(climatic.MustParseAmount("9"), ledger.Balance("u1"))
+	require.Equal(climatic.MustParseAmount("4"), ledger.Balance("u2"))
+
+	state, err := ds.State()
+	require.NoError(err)
+	require.Empty(state.Pending)
+	require.Empty(state.Mixes)
+}
+
+// blockingClient is a Ledger whose transfers block until released.
+type blockingClient struct {
+	*jctest.Ledger
+	posting chan struct{}
+	release chan struct{}
+}
+
+func (cli *blockingClient) PostTransaction(
+	ctx context.Context, fromAddr, toAddr string, amt climatic.Amount,
+) error {
+	select {
+	case cli.posting <- struct{}{}:
+	default:
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-cli.release:
+	}
+	return cli.Ledger.PostTransaction(ctx, fromAddr, toAddr, amt)
+}
+
+func TestMixerStop(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc    string
+		release bool
+		wantErr error
+		// wantStatus is the status of the transfer under way when the
+		// mixer was stopped
+		wantStatus TransferStatus
+	}{
+		{desc: "drained", release: true, wantStatus: TransferDone},
+		{desc: "drain timed out", wantErr: context.DeadlineExceeded, wantStatus: TransferPending},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			require := assert.New(t) // this is not working as expected
+
+			ctx := context.Background()
+			cli := &blockingClient{
+				Ledger:  jctest.NewLedger(),
+				posting: make(chan struct{}, 1),
+				release: make(chan struct{}),
+			}
+			ds := newMemDS()
+			mxr, err := NewMixer(
+				WithJobcoinClient(cli),
+				WithDatastore(ds),
+				WithPollConfig(PollConfig{MeanDelay: time.Hour, MinDelay: time.Hour, MaxDelay: time.Hour}),
+				WithMixConfig(MixConfig{
+					MeanDelay:    time.Millisecond,
+					MaxDelay:     time.Millisecond,
+					InitialDelay: time.Hour,
+					MeanAmount:   climatic.MustParseAmount("10"),
+					MinAmount:    climatic.MustParseAmount("10"),
+					MaxAmount:    climatic.MustParseAmount("10"),
+				}),
+				WithLogger(log.New(ioutil.Discard, "", 0)),
+			)
+			require.NoError(err)
+			require.NoError(ds.RegisterTerms("d2", []string{"u2"}, nil, time.Now()))
+			require.NoError(cli.Create(ctx, "d1"))
+			require.NoError(cli.Create(ctx, "d2"))
+
+			// d1 is being mixed and d2 is waiting out the initial delay
+			mxr.outstanding["d1"] = &mix{usrAddrs: []string{"u1"}, remaining: climatic.MustParseAmount("50")}
+
+			started := make(chan error, 1)
+			go func() { started <- mxr.Start(ctx) }()
+			<-cli.posting
+
+			stopCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+			defer cancel()
+			stopped := make(chan error, 1)
+			go func() { stopped <- mxr.Stop(stopCtx) }()
+			if test.release {
+				close(cli.release)
+			}
+
+			require.Equal(test.wantErr, <-stopped)
+			require.NoError(<-started)
+			require.Empty(cli.posting, "mixed after stopping")
 
-		f, err := climatic.ParseFloat(v)
-		require.NoError(err, "failed parsing float")
-		return f
+			require.Len(mxr.pending, 1, "waiting deposit dropped")
+			state, err := ds.State()
+			require.NoError(err)
+			require.Len(state.Pending, 1, "waiting deposit not saved")
+			require.Equal("d2", state.Pending[0].Deposit.ToAddress)
+
+			transfers, err := ds.Transfers("d1")
+			require.NoError(err)
+			require.Len(transfers, 1)
+			for _, tr := range transfers {
+				require.Equal(test.wantStatus, tr.Status)
+			}
+			require.Equal(mxr.outstanding["d1"].record(), state.Mixes["d1"], "mix not flushed")
+
+			require.Error(mxr.Start(ctx), "started twice")
+			require.NoError(mxr.Stop(ctx), "stopped twice")
+		})
 	}
 }
@@ -0,0 +1,91 @@
+package servertest
+
+import (
+	"sync"
+	"time"
+)
+
+// FakeClock is a clock that only moves when it is told to, for mixers made with
+// server.WithClock. Everything waiting on it is woken up once it is moved past
+// the time it waits for.
+type FakeClock struct {
+	mtx     sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []waiter
+}
+
+type waiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// NewFakeClock returns a fake clock that starts at now.
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{now: now}
+	c.cond = sync.NewCond(&c.mtx)
+
+	return c
+}
+
+// Now returns the time of the clock.
+func (c *FakeClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.now
+}
+
+// After sends the time on the returned channel once the clock is moved d past
+// its current time, or right away if d isn't positive.
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, waiter{at: c.now.Add(d), ch: ch})
+	c.cond.Broadcast()
+
+	return ch
+}
+
+// Advance moves the clock forward by d and wakes up whatever was waiting for a
+// time up to the new one.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiters = append(waiters, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = waiters
+}
+
+// Waiters returns how many calls to After are still waiting.
+func (c *FakeClock) Waiters() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return len(c.waiters)
+}
+
+// BlockUntil blocks until at least n calls to After are waiting, so that a
+// test can be sure the goroutines it moves the clock for are waiting on it.
+func (c *FakeClock) BlockUntil(n int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for len(c.waiters) < n {
+		c.cond.Wait()
+	}
+}
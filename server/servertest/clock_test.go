@@ -0,0 +1,49 @@
+package servertest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeClock(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	require.Equal(start, clock.Now())
+
+	now := clock.After(0)
+	require.Equal(start, <-now, "no wait")
+
+	soon, later := clock.After(time.Minute), clock.After(time.Hour)
+	require.Equal(2, clock.Waiters())
+
+	clock.Advance(30 * time.Second)
+	select {
+	case <-soon:
+		require.Fail("woken up too early")
+	default:
+	}
+
+	clock.Advance(30 * time.Second)
+	require.Equal(start.Add(time.Minute), <-soon)
+	require.Equal(1, clock.Waiters())
+
+	// waiters are woken up with the time the clock was moved to
+	clock.Advance(2 * time.Hour)
+	require.Equal(start.Add(2*time.Hour+time.Minute), <-later)
+	require.Equal(start.Add(2*time.Hour+time.Minute), clock.Now())
+
+	waiting := make(chan struct{})
+	go func() {
+		clock.BlockUntil(1)
+		close(waiting)
+	}()
+	woken := clock.After(time.Second)
+	<-waiting
+	clock.Advance(time.Second)
+	<-woken
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"math/rand"
+
+	"github.com/r-medina/climatic"
+
+	"github.com/pkg/errors"
+)
+
+// Split says how much of a deposit goes to a user address. An address with a
+// fixed Amount is paid that much of the mix of its deposit address before the
+// addresses with a Weight get anything, and those share the rest in proportion
+// to their weights. Once a mix is paid out in full, the next deposit starts
+// over.
+type Split struct {
+	Address string          `json:"address"`
+	Weight  uint32          `json:"weight"`
+	Amount  climatic.Amount `json:"amount"`
+}
+
+// splitsFromRequest checks the splits of a registration. Addresses without a
+// split are given a weight of 1. It returns nil if there are no splits, in
+// which case every payout goes to a random address.
+func splitsFromRequest(req *climatic.RegisterRequest) ([]Split, error) {
+	if len(req.Splits) == 0 {
+		return nil, nil
+	}
+
+	splits := []Split{}
+	seen := map[string]bool{}
+	weighted := false
+	add := func(s Split) error {
+		if s.Address == "" {
+			return errors.New("empty address")
+		}
+		if seen[s.Address] {
+			return errors.Errorf("address %s given twice", s.Address)
+		}
+		seen[s.Address] = true
+		if (s.Weight > 0) == (s.Amount.Sign() > 0) {
+			return errors.Errorf("address %s needs either a weight or an amount", s.Address)
+		}
+		weighted = weighted || s.Weight > 0
+		splits = append(splits, s)
+		return nil
+	}
+
+	for _, addr := range req.Addresses {
+		if err := add(Split{Address: addr, Weight: 1}); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range req.Splits {
+		split := Split{Address: s.Address, Weight: s.Weight}
+		if s.Amount != "" {
+			amt, err := climatic.ParseAmount(s.Amount)
+			if err != nil {
+				return nil, errors.Wrapf(err, "amount of %s", s.Address)
+			}
+			split.Amount = amt
+		}
+		if err := add(split); err != nil {
+			return nil, err
+		}
+	}
+	if !weighted {
+		return nil, errors.New("no address has a weight to take what is left after the amounts")
+	}
+
+	return splits, nil
+}
+
+// splitAddrs lists the user addresses of splits.
+func splitAddrs(splits []Split) []string {
+	addrs := make([]string, 0, len(splits))
+	for _, s := range splits {
+		addrs = append(addrs, s.Address)
+	}
+
+	return addrs
+}
+
+// share divides amt, the part of a deposit that has yet to be planned, between
+// the splits. planned holds how much each address was planned already, which
+// counts toward its fixed amount. The shares are in the order of the splits,
+// and whatever is lost to rounding goes to the heaviest address.
+func share(splits []Split, planned map[string]climatic.Amount, amt climatic.Amount) []climatic.Amount {
+	shares := make([]climatic.Amount, len(splits))
+
+	var total int64
+	heaviest := -1
+	for i, s := range splits {
+		if s.Weight > 0 {
+			total += int64(s.Weight)
+			if heaviest < 0 || s.Weight > splits[heaviest].Weight {
+				heaviest = i
+			}
+			continue
+		}
+
+		owed := s.Amount.Sub(planned[s.Address])
+		if owed.Sign() <= 0 || amt.Sign() <= 0 {
+			continue
+		}
+		shares[i] = climatic.MinAmount(owed, amt)
+		amt = amt.Sub(shares[i])
+	}
+	if total == 0 || amt.Sign() <= 0 {
+		return shares
+	}
+
+	left := amt
+	for i, s := range splits {
+		if s.Weight == 0 {
+			continue
+		}
+		part := amt.MulRatio(int64(s.Weight), total, climatic.RoundDown)
+		shares[i] = shares[i].Add(part)
+		left = left.Sub(part)
+	}
+	shares[heaviest] = shares[heaviest].Add(left)
+
+	return shares
+}
+
+// splitPayouts cuts amt into payouts of random amounts to the addresses of
+// splits, in line with their shares and what plan already holds for them. The
+// payouts to the different addresses are shuffled together, so they can't be
+// told apart by their order. The random choices are drawn from rnd.
+func (mxr *Mixer) splitPayouts(rnd *rand.Rand, splits []Split, plan []PlannedPayout, amt climatic.Amount) ([]PlannedPayout, error) {
+	planned := map[string]climatic.Amount{}
+	for _, p := range plan {
+		planned[p.ToAddress] = planned[p.ToAddress].Add(p.Amount)
+	}
+
+	payouts := []PlannedPayout{}
+	for i, share := range share(splits, planned, amt) {
+		if share.Sign() <= 0 {
+			continue
+		}
+		shared, err := mxr.randomPayouts(rnd, []string{splits[i].Address}, plan, share)
+		if err != nil {
+			return nil, err
+		}
+		payouts = append(payouts, shared...)
+	}
+	rnd.Shuffle(len(payouts), func(i, j int) { payouts[i], payouts[j] = payouts[j], payouts[i] })
+
+	return payouts, nil
+}
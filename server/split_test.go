@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/r-medina/climatic"
+	"github.com/r-medina/climatic/jobcoin/jctest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitsFromRequest(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc  string
+		req   *climatic.RegisterRequest
+		want  []Split
+		isErr bool
+	}{
+		{
+			desc: "no splits",
+			req:  &climatic.RegisterRequest{Addresses: []string{"a", "b"}},
+		},
+		{
+			desc: "weights and amounts",
+			req: &climatic.RegisterRequest{
+				Addresses: []string{"a"},
+				Splits: []*climatic.Split{
+					{Address: "b", Weight: 3},
+					{Address: "c", Amount: "1.5"},
+				},
+			},
+			want: []Split{
+				{Address: "a", Weight: 1},
+				{Address: "b", Weight: 3},
+				{Address: "c", Amount: climatic.MustParseAmount("1.5")},
+			},
+		},
+		{
+			desc:  "weight and amount",
+			req:   &climatic.RegisterRequest{Splits: []*climatic.Split{{Address: "a", Weight: 1, Amount: "1"}}},
+			isErr: true,
+		},
+		{
+			desc:  "neither weight nor amount",
+			req:   &climatic.RegisterRequest{Splits: []*climatic.Split{{Address: "a"}}},
+			isErr: true,
+		},
+		{
+			desc:  "only amounts",
+			req:   &climatic.RegisterRequest{Splits: []*climatic.Split{{Address: "a", Amount: "1"}}},
+			isErr: true,
+		},
+		{
+			desc: "address twice",
+			req: &climatic.RegisterRequest{
+				Addresses: []string{"a"},
+				Splits:    []*climatic.Split{{Address: "a", Weight: 2}},
+			},
+			isErr: true,
+		},
+		{
+			desc:  "bad amount",
+			req:   &climatic.RegisterRequest{Splits: []*climatic.Split{{Address: "a", Weight: 1}, {Address: "b", Amount: "x"}}},
+			isErr: true,
+		},
+		{
+			desc:  "negative amount",
+			req:   &climatic.RegisterRequest{Splits: []*climatic.Split{{Address: "a", Weight: 1}, {Address: "b", Amount: "-1"}}},
+			isErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			require := require.New(t)
+
+			splits, err := splitsFromRequest(test.req)
+			if test.isErr {
+				require.Error(err)
+				return
+			}
+			require.NoError(err)
+			require.Equal(test.want, splits)
+		})
+	}
+}
+
+func TestShare(t *testing.T) {
+	t.Parallel()
+
+	amt := climatic.MustParseAmount
+	splits := []Split{
+		{Address: "cold", Weight: 7},
+		{Address: "spend", Weight: 3},
+		{Address: "rent", Amount: amt("5")},
+	}
+
+	tests := []struct {
+		desc    string
+		planned map[string]climatic.Amount
+		amt     string
+		want    []string
+	}{
+		{desc: "fixed first", amt: "15", want: []string{"7", "3", "5"}},
+		{desc: "fixed short", amt: "3", want: []string{"0", "0", "3"}},
+		{desc: "fixed planned", planned: map[string]climatic.Amount{"rent": amt("4")}, amt: "11", want: []string{"7", "3", "1"}},
+		{desc: "rounding", amt: "5.00000001", want: []string{"0.00000001", "0", "5"}},
+		{desc: "rounding to heaviest", amt: "5.00000003", want: []string{"0.00000003", "0", "5"}},
+	}
+
+	for _, test := range tests {
+		got := []string{}
+		for _, share := range share(splits, test.planned, amt(test.amt)) {
+			got = append(got, share.String())
+		}
+		require.Equal(t, test.want, got, test.desc)
+	}
+}
+
+func TestMixerSplits(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ledger := jctest.NewLedger()
+	mxr, err := NewMixer(
+		WithJobcoinClient(ledger),
+		WithAddress("fees"),
+		WithFee(climatic.MustParseAmount("1")),
+		WithPollConfig(PollConfig{MeanDelay: 5 * time.Millisecond, MaxDelay: 5 * time.Millisecond}),
+		WithMixConfig(MixConfig{
+			MeanDelay:  time.Millisecond,
+			MaxDelay:   time.Millisecond,
+			MeanAmount: climatic.MustParseAmount("4"),
+			MinAmount:  climatic.MustParseAmount("1"),
+			MaxAmount:  climatic.MustParseAmount("8"),
+		}),
+		WithLogger(log.New(ioutil.Discard, "", 0)),
+	)
+	require.NoError(err)
+	go func() { _ = mxr.Start(ctx) }()
+
+	_, err = mxr.Register(ctx, &climatic.RegisterRequest{
+		Splits: []*climatic.Split{{Address: "rent", Amount: "5"}},
+	})
+	require.Error(err, "registered without a weighted address")
+
+	res, err := mxr.Register(ctx, &climatic.RegisterRequest{
+		Splits: []*climatic.Split{
+			{Address: "cold", Weight: 70},
+			{Address: "spend", Weight: 30},
+			{Address: "rent", Amount: "5"},
+		},
+	})
+	require.NoError(err)
+	require.NoError(ledger.Create(ctx, "alice"))
+	require.NoError(ledger.PostTransaction(ctx, "alice", res.Address, climatic.MustParseAmount("26")))
+
+	want := map[string]string{"cold": "14", "spend": "6", "rent": "5"}
+	paid := func() map[string]string {
+		got := map[string]string{}
+		for addr := range want {
+			got[addr] = ledger.Balance(addr).String()
+		}
+		return got
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && !reflect.DeepEqual(want, paid()) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	require.Equal(want, paid())
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/r-medina/climatic"
+)
+
+// MixStrategy makes the choices of mixing: which deposit address is worked on
+// first when several are due, which user address each payout goes to, how much
+// it sends and how long after the one before it it is due. Whatever it picks at
+// random, it draws from the randomness of the mixer, which it is handed.
+type MixStrategy interface {
+	// Order sorts the deposit addresses whose plans are due into the order
+	// they are handed to the workers in.
+	Order(rnd *rand.Rand, due []DueMix)
+	// Address picks the user address of the next payout out of usrAddrs,
+	// given the payouts planned before it.
+	Address(rnd *rand.Rand, usrAddrs []string, planned []PlannedPayout) string
+	// Amount returns how much of left the next payout sends.
+	Amount(rnd *rand.Rand, mixCfg MixConfig, left climatic.Amount) climatic.Amount
+	// Delay returns how long after the payout before it the next payout is
+	// due, and how long a failed payout waits before it is retried.
+	Delay(rnd *rand.Rand, mixCfg MixConfig) time.Duration
+}
+
+// DueMix is a deposit address whose plan is due, as of the end of its last
+// turn.
+type DueMix struct {
+	Address string
+	// Due is when the plan came due.
+	Due time.Time
+	// Balance is what is left to pay out.
+	Balance climatic.Amount
+	// Deadline is the earliest deadline of the payouts left, if they have
+	// one.
+	Deadline time.Time
+}
+
+// The names of the built-in strategies.
+const (
+	StrategyUniform    = "uniform"
+	StrategyBalance    = "balance"
+	StrategyRoundRobin = "round-robin"
+	StrategyDeadline   = "deadline"
+)
+
+// NewMixStrategy returns a new built-in strategy by name, or nil if there is
+// none by that name.
+func NewMixStrategy(name string) MixStrategy {
+	switch name {
+	case StrategyUniform:
+		return UniformStrategy{}
+	case StrategyBalance:
+		return BalanceStrategy{}
+	case StrategyRoundRobin:
+		return &RoundRobinStrategy{}
+	case StrategyDeadline:
+		return DeadlineStrategy{}
+	default:
+		return nil
+	}
+}
+
+// UniformStrategy leaves everything to chance: due deposit addresses are worked
+// on in random order and every payout goes to a random user address. Amounts
+// and delays are sampled from the mixing configuration. It is the default.
+type UniformStrategy struct{}
+
+var _ MixStrategy = UniformStrategy{}
+
+// Order shuffles due.
+func (UniformStrategy) Order(rnd *rand.Rand, due []DueMix) {
+	rnd.Shuffle(len(due), func(i, j int) { due[i], due[j] = due[j], due[i] })
+}
+
+// Address returns a random user address.
+func (UniformStrategy) Address(rnd *rand.Rand, usrAddrs []string, _ []PlannedPayout) string {
+	return usrAddrs[rnd.Intn(len(usrAddrs))]
+}
+
+// Amount returns a sampled amount, or a denomination if there are any.
+func (UniformStrategy) Amount(rnd *rand.Rand, mixCfg MixConfig, left climatic.Amount) climatic.Amount {
+	return mixCfg.part(rnd, left)
+}
+
+// Delay returns a sampled mixing delay.
+func (UniformStrategy) Delay(rnd *rand.Rand, mixCfg MixConfig) time.Duration {
+	return mixCfg.delay(rnd)
+}
+
+// BalanceStrategy works on due deposit addresses in a random order weighted by
+// their balances, so the addresses with the most left to pay out tend to go
+// first. Otherwise it is the same as UniformStrategy.
+type BalanceStrategy struct {
+	UniformStrategy
+}
+
+var _ MixStrategy = BalanceStrategy{}
+
+// Order shuffles due, with the larger balances more likely to come first.
+func (BalanceStrategy) Order(rnd *rand.Rand, due []DueMix) {
+	// every address draws a key that is larger the larger its balance,
+	// and the largest keys go first
+	keys := make(map[string]float64, len(due))
+	for _, d := range due {
+		keys[d.Address] = math.Inf(-1)
+		if w := d.Balance.Float64(); w > 0 {
+			keys[d.Address] = math.Log(rnd.Float64()) / w
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool { return keys[due[i].Address] > keys[due[j].Address] })
+}
+
+// RoundRobinStrategy takes turns: due deposit addresses are worked on in the
+// order of their addresses, starting after the last one that was handed out,
+// and the payouts of a plan go to its user addresses one after the other.
+// Otherwise it is the same as UniformStrategy. It must not be copied once it is
+// in use.
+type RoundRobinStrategy struct {
+	UniformStrategy
+
+	mtx  sync.Mutex
+	last string
+}
+
+var _ MixStrategy = &RoundRobinStrategy{}
+
+// Order sorts due by address, starting after the last address handed out.
+func (s *RoundRobinStrategy) Order(_ *rand.Rand, due []DueMix) {
+	if len(due) == 0 {
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	sort.Slice(due, func(i, j int) bool {
+		iAfter, jAfter := due[i].Address > s.last, due[j].Address > s.last
+		if iAfter != jAfter {
+			return iAfter
+		}
+		return due[i].Address < due[j].Address
+	})
+	s.last = due[len(due)-1].Address
+}
+
+// Address returns the user address after the one the last planned payout went
+// to.
+func (s *RoundRobinStrategy) Address(_ *rand.Rand, usrAddrs []string, planned []PlannedPayout) string {
+	if len(planned) == 0 {
+		return usrAddrs[0]
+	}
+
+	last := planned[len(planned)-1].ToAddress
+	for i, addr := range usrAddrs {
+		if addr == last {
+			return usrAddrs[(i+1)%len(usrAddrs)]
+		}
+	}
+
+	return usrAddrs[0]
+}
+
+// DeadlineStrategy works on due deposit addresses with the nearest deadline
+// first, and then on those without one in the order they came due. Otherwise it
+// is the same as UniformStrategy.
+type DeadlineStrategy struct {
+	UniformStrategy
+}
+
+var _ MixStrategy = DeadlineStrategy{}
+
+// Order sorts due by deadline, then by when it came due.
+func (DeadlineStrategy) Order(_ *rand.Rand, due []DueMix) {
+	sort.SliceStable(due, func(i, j int) bool {
+		di, dj := due[i].Deadline, due[j].Deadline
+		switch {
+		case di.IsZero() != dj.IsZero():
+			return !di.IsZero()
+		case !di.Equal(dj):
+			return di.Before(dj)
+		default:
+			return due[i].Due.Before(due[j].Due)
+		}
+	})
+}
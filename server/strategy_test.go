@@ -0,0 +1,132 @@
+package server
+
+import (
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/r-medina/climatic"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMixStrategyOrder(t *testing.T) {
+	t.Parallel()
+
+	rnd := newRand(rand.NewSource(1))
+	now := time.Now()
+	due := func() []DueMix {
+		return []DueMix{
+			{Address: "b", Due: now, Balance: climatic.MustParseAmount("1")},
+			{Address: "d", Due: now.Add(-time.Minute), Balance: climatic.MustParseAmount("0")},
+			{Address: "a", Due: now, Balance: climatic.MustParseAmount("1000000"), Deadline: now.Add(time.Hour)},
+			{Address: "c", Due: now.Add(-time.Hour), Deadline: now.Add(time.Minute)},
+		}
+	}
+	addrs := func(due []DueMix) []string {
+		addrs := []string{}
+		for _, d := range due {
+			addrs = append(addrs, d.Address)
+		}
+		return addrs
+	}
+
+	t.Run("names", func(t *testing.T) {
+		require := require.New(t)
+
+		require.IsType(UniformStrategy{}, NewMixStrategy(StrategyUniform))
+		require.IsType(BalanceStrategy{}, NewMixStrategy(StrategyBalance))
+		require.IsType(&RoundRobinStrategy{}, NewMixStrategy(StrategyRoundRobin))
+		require.IsType(DeadlineStrategy{}, NewMixStrategy(StrategyDeadline))
+		require.Nil(NewMixStrategy("best"))
+	})
+
+	t.Run("uniform", func(t *testing.T) {
+		require := require.New(t)
+
+		got := due()
+		UniformStrategy{}.Order(rnd, got)
+		require.ElementsMatch([]string{"a", "b", "c", "d"}, addrs(got))
+	})
+
+	t.Run("balance", func(t *testing.T) {
+		require := require.New(t)
+
+		// the largest balance is all but sure to go first, and nothing
+		// left to pay out goes last
+		got := due()
+		BalanceStrategy{}.Order(rnd, got)
+		require.Equal([]string{"a", "b"}, addrs(got[:2]))
+		require.ElementsMatch([]string{"c", "d"}, addrs(got[2:]))
+	})
+
+	t.Run("round-robin", func(t *testing.T) {
+		require := require.New(t)
+
+		s := &RoundRobinStrategy{}
+		got := due()
+		s.Order(rnd, got)
+		require.Equal([]string{"a", "b", "c", "d"}, addrs(got))
+
+		// the next turn starts after the last address handed out
+		got = append(due()[2:], due()[0])
+		s.Order(rnd, got)
+		require.Equal([]string{"a", "b", "c"}, addrs(got))
+		got = due()
+		s.Order(rnd, got)
+		require.Equal([]string{"d", "a", "b", "c"}, addrs(got))
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		require := require.New(t)
+
+		got := due()
+		DeadlineStrategy{}.Order(rnd, got)
+		require.Equal([]string{"c", "a", "d", "b"}, addrs(got))
+	})
+}
+
+func TestRoundRobinPlan(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	mxr, err := NewMixer(
+		WithMixStrategy(NewMixStrategy(StrategyRoundRobin)),
+		WithMixConfig(MixConfig{
+			MeanDelay:  time.Minute,
+			MinDelay:   time.Minute,
+			MaxDelay:   time.Minute,
+			MeanAmount: climatic.MustParseAmount("2"),
+			MinAmount:  climatic.MustParseAmount("2"),
+			MaxAmount:  climatic.MustParseAmount("2"),
+		}),
+		WithLogger(log.New(ioutil.Discard, "", 0)),
+	)
+	require.NoError(err)
+
+	m := &mix{
+		usrAddrs:  []string{"u1", "u2", "u3"},
+		remaining: climatic.MustParseAmount("8"),
+	}
+	require.NoError(mxr.extendPlan(m, time.Time{}))
+
+	// more Jobcoins carry on with the next address
+	m.remaining = climatic.MustParseAmount("12")
+	require.NoError(mxr.extendPlan(m, time.Time{}))
+
+	to := []string{}
+	for _, p := range m.plan {
+		to = append(to, p.ToAddress)
+	}
+	require.Equal([]string{"u1", "u2", "u3", "u1", "u2", "u3"}, to)
+
+	// the scheduler hands out due mixes in the order of the strategy
+	for _, addr := range []string{"d3", "d1", "d2"} {
+		mxr.outstanding[addr] = &mix{}
+	}
+	addrs, _, pending := mxr.duePlans()
+	require.Equal([]string{"d1", "d2", "d3"}, addrs)
+	require.False(pending)
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/r-medina/climatic"
+
+	"github.com/pkg/errors"
+)
+
+// Terms are what a user asked for at registration, besides the addresses to
+// pay.
+type Terms struct {
+	// Splits are how the deposits are shared between the user addresses.
+	// Without them every payout goes to a random address.
+	Splits []Split `json:"splits,omitempty"`
+	// Window is when the deposits must be paid out.
+	Window *Window `json:"window,omitempty"`
+}
+
+// Window bounds how long after the mixer finds a deposit its payouts are made.
+// The mixer plans the payouts between Min and Max, and has them done a margin
+// (MixConfig.DeadlineMargin) before Max, so there is time to retry failures.
+type Window struct {
+	Min time.Duration `json:"min"`
+	Max time.Duration `json:"max"`
+}
+
+func (terms *Terms) splits() []Split {
+	if terms == nil {
+		return nil
+	}
+	return terms.Splits
+}
+
+func (terms *Terms) window() *Window {
+	if terms == nil {
+		return nil
+	}
+	return terms.Window
+}
+
+// termsFromRequest checks the terms of a registration. It returns nil if the
+// user didn't ask for anything special.
+func (mxr *Mixer) termsFromRequest(req *climatic.RegisterRequest) (*Terms, error) {
+	splits, err := splitsFromRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	terms := &Terms{Splits: splits}
+
+	if req.Window != nil {
+		w := &Window{
+			Min: time.Duration(req.Window.MinSeconds) * time.Second,
+			Max: time.Duration(req.Window.MaxSeconds) * time.Second,
+		}
+		if w.Min < 0 {
+			return nil, errors.New("window starts before the deposit")
+		}
+		if w.Max-w.Min <= mxr.mixCfg.DeadlineMargin {
+			return nil, errors.Errorf("window must be longer than %v", mxr.mixCfg.DeadlineMargin)
+		}
+		terms.Window = w
+	}
+
+	if terms.Splits == nil && terms.Window == nil {
+		return nil, nil
+	}
+	return terms, nil
+}
+
+// spread plans payouts over the window of a deposit that must be paid out by
+// deadline. The payouts are due at random times between the start of the
+// window and a margin before its end, drawn from rnd.
+func (mxr *Mixer) spread(rnd *rand.Rand, payouts []PlannedPayout, w *Window, deadline time.Time) {
+	now := mxr.clock.Now()
+	start := deadline.Add(w.Min - w.Max)
+	if start.Before(now) {
+		start = now
+	}
+	end := deadline.Add(-mxr.mixCfg.DeadlineMargin)
+	if end.Before(start) {
+		end = start
+	}
+
+	times := make([]time.Time, len(payouts))
+	for i := range times {
+		times[i] = start.Add(time.Duration(rnd.Int63n(int64(end.Sub(start)) + 1)))
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	for i := range payouts {
+		payouts[i].At = times[i]
+		payouts[i].Deadline = deadline
+	}
+}
+
+// deadline returns the latest deadline in the plan of m, or the zero time if
+// it has none.
+func (m *mix) deadline() time.Time {
+	var deadline time.Time
+	for _, p := range m.plan {
+		if p.Deadline.After(deadline) {
+			deadline = p.Deadline
+		}
+	}
+
+	return deadline
+}
+
+// atRisk returns the unpaid payouts of m that are less than the deadline
+// margin away from their deadline, which they should have been paid by.
+func (mxr *Mixer) atRisk(m *mix, now time.Time) []*PlannedPayout {
+	risky := []*PlannedPayout{}
+	for i := range m.plan {
+		p := &m.plan[i]
+		if !p.Paid && !p.Deadline.IsZero() && p.Deadline.Sub(now) < mxr.mixCfg.DeadlineMargin {
+			risky = append(risky, p)
+		}
+	}
+
+	return risky
+}
+
+// rush makes the payouts of m that are at risk of missing their deadline due
+// right away, and reports whether there were any.
+func (mxr *Mixer) rush(addr string, m *mix) bool {
+	now := mxr.clock.Now()
+	risky := mxr.atRisk(m, now)
+	for _, p := range risky {
+		if p.At.After(now) {
+			p.At = now
+		}
+	}
+	if len(risky) > 0 {
+		mxr.log.Printf(
+			"%v is at risk of missing its deadline with %d payouts left, the first due by %v",
+			addr, len(risky), risky[0].Deadline,
+		)
+	}
+
+	return len(risky) > 0
+}
+
+// retryDelay is how long to wait before working on m again. It gets shorter as
+// the next deadline of m nears, so there are enough tries left to meet it.
+func (mxr *Mixer) retryDelay(m *mix) time.Duration {
+	delay := mxr.strategy.Delay(mxr.mixRand(m), mxr.mixCfg)
+
+	next := m.nextDeadline()
+	if next.IsZero() {
+		return delay
+	}
+
+	if d := next.Sub(mxr.clock.Now()) / 4; d < delay {
+		if d < minRetryDelay {
+			d = minRetryDelay
+		}
+		if d < delay {
+			delay = d
+		}
+	}
+	return delay
+}
+
+// minRetryDelay keeps a mix that is close to or past its deadline from
+// hammering the Jobcoin API.
+const minRetryDelay = 100 * time.Millisecond
+
+// hopDelay is how long r waits in its next hop. With a deadline, the hops left
+// share the time left before it. The delay is drawn from rnd.
+func (mxr *Mixer) hopDelay(rnd *rand.Rand, r *Route) time.Duration {
+	delay := mxr.routeCfg.delay(rnd)
+	if r.Deadline.IsZero() {
+		return delay
+	}
+
+	hopsLeft := len(r.Hops) - r.At
+	if d := r.Deadline.Sub(mxr.clock.Now()) / time.Duration(hopsLeft+1); d < delay {
+		delay = d
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return delay
+}
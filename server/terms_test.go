@@ -0,0 +1,253 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/r-medina/climatic"
+	"github.com/r-medina/climatic/jobcoin"
+	"github.com/r-medina/climatic/jobcoin/jctest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTermsFromRequest(t *testing.T) {
+	t.Parallel()
+
+	mxr, err := NewMixer(
+		WithMixConfig(MixConfig{DeadlineMargin: time.Minute}),
+		WithLogger(log.New(ioutil.Discard, "", 0)),
+	)
+	require.NoError(t, err)
+
+	tests := []struct {
+		desc  string
+		req   *climatic.RegisterRequest
+		want  *Terms
+		isErr bool
+	}{
+		{desc: "no terms", req: &climatic.RegisterRequest{Addresses: []string{"a"}}},
+		{
+			desc: "window",
+			req: &climatic.RegisterRequest{
+				Addresses: []string{"a"},
+				Window:    &climatic.Window{MinSeconds: 3600, MaxSeconds: 86400},
+			},
+			want: &Terms{Window: &Window{Min: time.Hour, Max: 24 * time.Hour}},
+		},
+		{
+			desc: "splits and window",
+			req: &climatic.RegisterRequest{
+				Splits: []*climatic.Split{{Address: "a", Weight: 2}},
+				Window: &climatic.Window{MaxSeconds: 120},
+			},
+			want: &Terms{
+				Splits: []Split{{Address: "a", Weight: 2}},
+				Window: &Window{Max: 2 * time.Minute},
+			},
+		},
+		{
+			desc: "window shorter than the margin",
+			req: &climatic.RegisterRequest{
+				Addresses: []string{"a"},
+				Window:    &climatic.Window{MinSeconds: 60, MaxSeconds: 90},
+			},
+			isErr: true,
+		},
+		{
+			desc: "window ends before it starts",
+			req: &climatic.RegisterRequest{
+				Addresses: []string{"a"},
+				Window:    &climatic.Window{MinSeconds: 600, MaxSeconds: 60},
+			},
+			isErr: true,
+		},
+		{
+			desc: "window starts before the deposit",
+			req: &climatic.RegisterRequest{
+				Addresses: []string{"a"},
+				Window:    &climatic.Window{MinSeconds: -60, MaxSeconds: 600},
+			},
+			isErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		terms, err := mxr.termsFromRequest(test.req)
+		if test.isErr {
+			require.Error(t, err, test.desc)
+			continue
+		}
+		require.NoError(t, err, test.desc)
+		require.Equal(t, test.want, terms, test.desc)
+	}
+}
+
+func TestWindowPlan(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	mxr, err := NewMixer(
+		WithMixConfig(MixConfig{
+			DeadlineMargin: 10 * time.Minute,
+			MeanAmount:     climatic.MustParseAmount("1"),
+			MinAmount:      climatic.MustParseAmount("1"),
+			MaxAmount:      climatic.MustParseAmount("1"),
+		}),
+		WithLogger(log.New(ioutil.Discard, "", 0)),
+	)
+	require.NoError(err)
+
+	w := &Window{Min: time.Hour, Max: 24 * time.Hour}
+	m := &mix{
+		usrAddrs:  []string{"u"},
+		terms:     &Terms{Window: w},
+		remaining: climatic.MustParseAmount("20"),
+	}
+	now := time.Now()
+	deadline := now.Add(w.Max)
+	require.NoError(mxr.extendPlan(m, deadline))
+
+	require.Len(m.plan, 20)
+	for i, p := range m.plan {
+		require.Equal(deadline, p.Deadline)
+		require.False(p.At.Before(now.Add(w.Min)), "payout %d before the window", i)
+		require.False(p.At.After(deadline.Add(-10*time.Minute)), "payout %d in the margin", i)
+		if i > 0 {
+			require.False(p.At.Before(m.plan[i-1].At), "payouts not in order")
+		}
+	}
+	require.Empty(mxr.atRisk(m, now))
+
+	// more Jobcoins are planned with the same deadline
+	m.remaining = climatic.MustParseAmount("21")
+	require.NoError(mxr.extendPlan(m, time.Time{}))
+	require.Len(m.plan, 21)
+	require.Equal(deadline, m.plan[20].Deadline)
+
+	// the plan is at risk once the margin is reached
+	require.Len(mxr.atRisk(m, deadline.Add(-time.Minute)), 21)
+}
+
+func TestDeadlineRush(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	ctx := context.Background()
+	ledger := jctest.NewLedger()
+	require.NoError(ledger.Create(ctx, "d"))
+	mxr, err := NewMixer(
+		WithJobcoinClient(ledger),
+		WithMixConfig(MixConfig{
+			MeanDelay:      time.Hour,
+			MaxDelay:       time.Hour,
+			DeadlineMargin: time.Hour,
+			MeanAmount:     climatic.MustParseAmount("20"),
+			MinAmount:      climatic.MustParseAmount("20"),
+			MaxAmount:      climatic.MustParseAmount("20"),
+		}),
+		WithLogger(log.New(ioutil.Discard, "", 0)),
+	)
+	require.NoError(err)
+	require.NoError(mxr.ds.RegisterTerms("d", []string{"u"}, nil, mxr.clock.Now()))
+	// the deposit was found by an earlier poll
+	_, cursor, err := ledger.GetTransactionsSince(ctx, jobcoin.Cursor{})
+	require.NoError(err)
+	require.NoError(mxr.ds.SavePoll(cursor, nil))
+
+	// The mixer was down for most of the window, so the payouts that were
+	// planned are late and the deadline is within the margin.
+	deadline := time.Now().Add(30 * time.Minute)
+	m := &mix{
+		usrAddrs:  []string{"u"},
+		terms:     &Terms{Window: &Window{Max: 2 * time.Hour}},
+		remaining: jctest.DefaultCreateAmount,
+		plan: []PlannedPayout{
+			{ID: "1", ToAddress: "u", Amount: climatic.MustParseAmount("30"), At: time.Now().Add(time.Minute), Deadline: deadline},
+			{ID: "2", ToAddress: "u", Amount: climatic.MustParseAmount("20"), At: time.Now().Add(time.Minute), Deadline: deadline},
+		},
+	}
+	mxr.outstanding["d"] = m
+	mxr.saveMix("d", m)
+
+	status, err := mxr.Status(ctx, &climatic.StatusRequest{Address: "d"})
+	require.NoError(err)
+	require.True(status.AtRisk)
+	require.Equal(deadline.Unix(), status.Deadline)
+	require.Equal(deadline.Unix(), status.Plan[0].Deadline)
+
+	// the retries come quicker than the mixing delay, and the late
+	// payouts don't wait for their time
+	require.True(mxr.retryDelay(m) < 10*time.Minute)
+	require.NoError(mxr.mix(ctx, "d"))
+	m.retryAt = time.Time{}
+	require.NoError(mxr.mix(ctx, "d"))
+	require.Equal(jctest.DefaultCreateAmount, ledger.Balance("u"))
+	require.Empty(mxr.outstanding)
+}
+
+func TestWindowDeposit(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	ctx := context.Background()
+	ledger := jctest.NewLedger()
+	mxr, err := NewMixer(
+		WithJobcoinClient(ledger),
+		WithMixConfig(MixConfig{InitialDelay: time.Hour, DeadlineMargin: time.Minute}),
+		WithLogger(log.New(ioutil.Discard, "", 0)),
+	)
+	require.NoError(err)
+
+	res, err := mxr.Register(ctx, &climatic.RegisterRequest{
+		Addresses: []string{"u"},
+		Window:    &climatic.Window{MinSeconds: 60, MaxSeconds: 600},
+	})
+	require.NoError(err)
+	require.NoError(ledger.Create(ctx, res.Address))
+
+	before := time.Now()
+	mixReqs, err := mxr.findMixRequests(ctx)
+	require.NoError(err)
+	require.Len(mixReqs, 1)
+	require.WithinDuration(before.Add(time.Minute), mixReqs[0].due, time.Second, "initial delay not cut short")
+	require.WithinDuration(before.Add(10*time.Minute), mixReqs[0].deadline, time.Second)
+
+	// the deadline survives a restart
+	state, err := mxr.ds.State()
+	require.NoError(err)
+	require.Len(state.Pending, 1)
+	require.Equal(mixReqs[0].deadline, state.Pending[0].Deadline)
+
+	mxr.makeMix(mixReqs)
+	m := mxr.outstanding[res.Address]
+	require.NotEmpty(m.plan)
+	for _, p := range m.plan {
+		require.Equal(mixReqs[0].deadline, p.Deadline)
+	}
+}
+
+func TestHopDelay(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	mxr, err := NewMixer(
+		WithRouteConfig(RouteConfig{Hops: 3, MeanDelay: time.Hour, MaxDelay: time.Hour}),
+		WithLogger(log.New(ioutil.Discard, "", 0)),
+	)
+	require.NoError(err)
+
+	r := &Route{Hops: []string{"h1", "h2", "h3"}}
+	require.Equal(time.Hour, mxr.hopDelay(mxr.routeRnd, r))
+
+	// three hops are left and one slot is kept spare
+	r.Deadline = time.Now().Add(time.Hour)
+	d := mxr.hopDelay(mxr.routeRnd, r)
+	require.True(d <= 15*time.Minute && d > 14*time.Minute, "unexpected delay %v", d)
+
+	r.Deadline = time.Now().Add(-time.Minute)
+	require.Equal(time.Duration(0), mxr.hopDelay(mxr.routeRnd, r))
+}
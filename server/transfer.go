@@ -0,0 +1,254 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/r-medina/climatic"
+	"github.com/r-medina/climatic/jobcoin"
+
+	"github.com/pkg/errors"
+)
+
+// TransferKind says what a transfer is for.
+type TransferKind string
+
+// The kinds of transfer.
+const (
+	// TransferFee sends the fee from a deposit address to the mixer.
+	TransferFee TransferKind = "fee"
+	// TransferSweep moves a deposit into the pool.
+	TransferSweep TransferKind = "sweep"
+	// TransferPayout sends mixed Jobcoins to a user address, from the
+	// deposit address or, in pooled mode, from the pool. Refunds are
+	// payouts back to the sender of a deposit that isn't mixed.
+	TransferPayout TransferKind = "payout"
+)
+
+// TransferStatus is where a transfer is in its life.
+type TransferStatus string
+
+// The statuses of a transfer.
+const (
+	// TransferPending transfers have been journaled and may or may not
+	// have reached the ledger.
+	TransferPending TransferStatus = "pending"
+	// TransferDone transfers are in the ledger.
+	TransferDone TransferStatus = "done"
+	// TransferFailed transfers never reached the ledger.
+	TransferFailed TransferStatus = "failed"
+)
+
+// Transfer is an entry in the transfer journal. Every transfer is journaled as
+// pending before it is posted, so that if the mixer dies before it knows the
+// outcome, it can find out from the ledger history when it starts again.
+type Transfer struct {
+	ID     string         `json:"id"`
+	Kind   TransferKind   `json:"kind"`
+	Status TransferStatus `json:"status"`
+	// DepositAddress is the deposit the transfer is made for. Payouts from
+	// the pool come from a different address.
+	DepositAddress string          `json:"depositAddress"`
+	FromAddress    string          `json:"fromAddress"`
+	ToAddress      string          `json:"toAddress"`
+	Amount         climatic.Amount `json:"amount"`
+	// Prior is how many transactions identical to this one were in the
+	// history of FromAddress before it was posted. One more means it went
+	// through.
+	Prior   int       `json:"prior"`
+	Created time.Time `json:"created"`
+	// RouteID is the route a payout funds, if it goes through hops.
+	RouteID string `json:"routeId,omitempty"`
+	// PayoutID is the planned payout that a payout sends.
+	PayoutID string `json:"payoutId,omitempty"`
+	// DepositID is the deposit that a fee is charged for.
+	DepositID string `json:"depositId,omitempty"`
+	// Refund is why a payout sends a deposit back to its sender, if it
+	// does.
+	Refund RefundReason `json:"refund,omitempty"`
+}
+
+// beginTransfer journals a transfer for the mix m before it is posted.
+func (mxr *Mixer) beginTransfer(
+	ctx context.Context, m *mix, kind TransferKind, depositAddr, fromAddr, toAddr string, amt climatic.Amount,
+) (*Transfer, error) {
+	t := &Transfer{
+		Kind:           kind,
+		DepositAddress: depositAddr,
+		FromAddress:    fromAddr,
+		ToAddress:      toAddr,
+		Amount:         amt,
+	}
+	if err := mxr.journalTransfer(ctx, m, t); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// journalTransfer fills in the ID, status, creation time and prior count of t
+// and journals it. The ID is drawn from the randomness of the mix m.
+func (mxr *Mixer) journalTransfer(ctx context.Context, m *mix, t *Transfer) error {
+	t.ID = newID(mxr.mixRand(m)).String()
+	t.Status = TransferPending
+	t.Created = mxr.clock.Now().UTC()
+
+	var err error
+	t.Prior, err = mxr.countTransfer(ctx, t)
+	if err != nil {
+		return err
+	}
+	if err := mxr.ds.BeginTransfer(t); err != nil {
+		return errors.Wrap(err, "could not journal transfer")
+	}
+
+	return nil
+}
+
+// postTransfer posts a journaled transfer and applies it to m. If the outcome
+// is unknown, the transfer is left unresolved and the error returned.
+func (mxr *Mixer) postTransfer(ctx context.Context, m *mix, t *Transfer) error {
+	callCtx, cancel := mxr.callCtx(ctx)
+	// a retrying client can tell from the prior count if it went through
+	callCtx = jobcoin.WithPrior(callCtx, t.Prior)
+	err := mxr.jcClient.PostTransaction(callCtx, t.FromAddress, t.ToAddress, t.Amount)
+	cancel()
+	if err != nil && (jobcoin.IsTransient(err) || ctx.Err() != nil) {
+		// it may have gone through anyway, even if it was cancelled
+		if resolveErr := mxr.resolveTransfer(ctx, m, t); resolveErr != nil {
+			return err
+		}
+		if t.Status == TransferDone {
+			return nil
+		}
+		return err
+	}
+	if err != nil {
+		mxr.finishTransfer(m, t, TransferFailed)
+		return err
+	}
+
+	mxr.finishTransfer(m, t, TransferDone)
+
+	return nil
+}
+
+// resolveTransfer finds out from the ledger history if a pending transfer went
+// through, and finishes it. If the history can't be fetched, the transfer is
+// left unresolved and blocks its deposit address.
+func (mxr *Mixer) resolveTransfer(ctx context.Context, m *mix, t *Transfer) error {
+	n, err := mxr.countTransfer(ctx, t)
+	if err != nil {
+		mxr.mtx.Lock()
+		mxr.unresolved[t.DepositAddress] = t
+		mxr.mtx.Unlock()
+		mxr.log.Printf("could not resolve transfer %s: %v", t.ID, err)
+		return err
+	}
+
+	if n > t.Prior {
+		mxr.log.Printf("transfer %s of %v from %v to %v went through", t.ID, t.Amount, t.FromAddress, t.ToAddress)
+		mxr.finishTransfer(m, t, TransferDone)
+	} else {
+		mxr.log.Printf("transfer %s of %v from %v to %v did not go through", t.ID, t.Amount, t.FromAddress, t.ToAddress)
+		mxr.finishTransfer(m, t, TransferFailed)
+	}
+
+	return nil
+}
+
+// unresolvedFrom reports whether a transfer from fromAddr is unresolved.
+// mxr.mtx must be held.
+func (mxr *Mixer) unresolvedFrom(fromAddr string) bool {
+	for _, t := range mxr.unresolved {
+		if t.FromAddress == fromAddr {
+			return true
+		}
+	}
+
+	return false
+}
+
+// finishTransfer applies a transfer that went through to m and saves its
+// outcome together with m. Fees, sweeps and payouts from the deposit address
+// spend what is left in it, sweeps move that to what is owed from the pool and
+// payouts from the pool pay it off.
+func (mxr *Mixer) finishTransfer(m *mix, t *Transfer, status TransferStatus) {
+	t.Status = status
+	mxr.mtx.Lock()
+	delete(mxr.unresolved, t.DepositAddress)
+	if t.RouteID != "" {
+		mxr.fundRoute(mxr.mixRand(m), t)
+	}
+	mxr.mtx.Unlock()
+	var fee *FeeEntry
+	if status == TransferDone {
+		switch {
+		case t.Kind == TransferFee:
+			fee = m.feeEntry(t)
+			m.markFeePaid(t.DepositID, t.Amount)
+			m.remaining = m.remaining.Sub(t.Amount)
+		case t.Kind == TransferSweep:
+			m.remaining = m.remaining.Sub(t.Amount)
+			m.owed = m.owed.Add(t.Amount)
+		case t.FromAddress == t.DepositAddress:
+			m.remaining = m.remaining.Sub(t.Amount)
+		default:
+			// paid out of the pool
+			m.owed = m.owed.Sub(t.Amount)
+		}
+		if t.PayoutID != "" {
+			m.markPaid(t.PayoutID, t.Amount)
+		}
+	}
+
+	if err := mxr.ds.FinishTransfer(t, mxr.snapshot(m), fee); err != nil {
+		mxr.log.Printf("could not save transfer %s: %v", t.ID, err)
+	}
+}
+
+// countTransfer counts the transactions identical to t in the history of its
+// source address.
+func (mxr *Mixer) countTransfer(ctx context.Context, t *Transfer) (int, error) {
+	callCtx, cancel := mxr.callCtx(ctx)
+	defer cancel()
+	addrInfo, err := mxr.jcClient.GetAddressInfo(callCtx, t.FromAddress)
+	if err != nil {
+		return 0, err
+	}
+	if addrInfo == nil {
+		return 0, nil
+	}
+
+	n := 0
+	for _, tx := range addrInfo.Transactions {
+		if tx.FromAddress == t.FromAddress && tx.ToAddress == t.ToAddress && tx.Amount == t.Amount {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// recoverTransfers resolves the transfers that were pending when the mixer stopped.
+func (mxr *Mixer) recoverTransfers(ctx context.Context) {
+	mxr.mtx.Lock()
+	unresolved := make(map[string]*Transfer, len(mxr.unresolved))
+	for addr, t := range mxr.unresolved {
+		unresolved[addr] = t
+	}
+	mxr.mtx.Unlock()
+
+	for addr, t := range unresolved {
+		m := mxr.lockMix(addr, nil)
+		if m == nil {
+			// the mix was never saved, which can't happen as
+			// transfers are only made for outstanding mixes
+			mxr.log.Printf("transfer %s has no mix", t.ID)
+			continue
+		}
+		// failures are retried before the next mix from addr
+		_ = mxr.resolveTransfer(ctx, m, t)
+		m.mtx.Unlock()
+	}
+}
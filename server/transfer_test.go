@@ -0,0 +1,287 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/r-medina/climatic"
+	"github.com/r-medina/climatic/jobcoin"
+	"github.com/r-medina/climatic/jobcoin/jctest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransferRecovery(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc     string
+		kind     TransferKind
+		from, to string
+		// posted is whether the transfer reached the ledger before the
+		// mixer died
+		posted     bool
+		wantRemain string
+		wantOwed   string
+		wantFee    bool
+	}{
+		{desc: "fee posted", kind: TransferFee, from: "d", to: "fees", posted: true, wantRemain: "9", wantOwed: "5", wantFee: true},
+		{desc: "fee not posted", kind: TransferFee, from: "d", to: "fees", wantRemain: "10", wantOwed: "5"},
+		{desc: "payout posted", kind: TransferPayout, from: "d", to: "u", posted: true, wantRemain: "9", wantOwed: "5"},
+		{desc: "payout not posted", kind: TransferPayout, from: "d", to: "u", wantRemain: "10", wantOwed: "5"},
+		{desc: "sweep posted", kind: TransferSweep, from: "d", to: "house", posted: true, wantRemain: "9", wantOwed: "6"},
+		{desc: "sweep not posted", kind: TransferSweep, from: "d", to: "house", wantRemain: "10", wantOwed: "5"},
+		{desc: "pool payout posted", kind: TransferPayout, from: "house", to: "u", posted: true, wantRemain: "10", wantOwed: "4"},
+		{desc: "pool payout not posted", kind: TransferPayout, from: "house", to: "u", wantRemain: "10", wantOwed: "5"},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			require := require.New(t)
+
+			ctx := context.Background()
+			ledger := jctest.NewLedger()
+			require.NoError(ledger.Create(ctx, "d"))
+			require.NoError(ledger.Create(ctx, "house"))
+			ds := newMemDS()
+			newMixer := func() *Mixer {
+				mxr, err := NewMixer(
+					WithJobcoinClient(ledger),
+					WithDatastore(ds),
+					WithAddress("fees"),
+					WithPool("house"),
+					WithLogger(log.New(ioutil.Discard, "", 0)),
+				)
+				require.NoError(err)
+				return mxr
+			}
+
+			mxr := newMixer()
+			m := &mix{
+				usrAddrs:  []string{"u"},
+				remaining: climatic.MustParseAmount("10"),
+				owed:      climatic.MustParseAmount("5"),
+				fees:      []DepositFee{{DepositID: "1", Amount: climatic.MustParseAmount("1")}},
+			}
+			mxr.outstanding["d"] = m
+			mxr.saveMix("d", m)
+
+			// an earlier identical transfer must not be mistaken for
+			// this one
+			require.NoError(ledger.PostTransaction(ctx, test.from, test.to, climatic.MustParseAmount("1")))
+
+			// the mixer dies after journaling and maybe posting
+			tr := &Transfer{
+				Kind:           test.kind,
+				DepositAddress: "d",
+				FromAddress:    test.from,
+				ToAddress:      test.to,
+				Amount:         climatic.MustParseAmount("1"),
+			}
+			if test.kind == TransferFee {
+				tr.DepositID = "1"
+			}
+			require.NoError(mxr.journalTransfer(ctx, m, tr))
+			require.Equal(1, tr.Prior)
+			if test.posted {
+				require.NoError(ledger.PostTransaction(ctx, test.from, test.to, climatic.MustParseAmount("1")))
+			}
+
+			restarted := newMixer()
+			require.Contains(restarted.unresolved, "d")
+			restarted.recoverTransfers(ctx)
+			require.Empty(restarted.unresolved)
+
+			got := restarted.outstanding["d"]
+			require.Equal(climatic.MustParseAmount(test.wantRemain), got.remaining)
+			require.Equal(climatic.MustParseAmount(test.wantOwed), got.owed)
+			require.Equal(test.wantFee, got.feePaid())
+
+			state, err := ds.State()
+			require.NoError(err)
+			require.Empty(state.Transfers, "transfer still pending")
+			require.Equal(got.record(), state.Mixes["d"])
+		})
+	}
+}
+
+func TestLoadUnfinishedTransfer(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// the mixer died with nothing but a transfer under way
+	ds := newMemDS()
+	require.NoError(ds.BeginTransfer(&Transfer{
+		ID:             "t",
+		Kind:           TransferPayout,
+		Status:         TransferPending,
+		DepositAddress: "d",
+		FromAddress:    "d",
+		ToAddress:      "u",
+		Amount:         climatic.MustParseAmount("1"),
+	}))
+
+	var buf bytes.Buffer
+	mxr, err := NewMixer(WithDatastore(ds), WithLogger(log.New(&buf, "", 0)))
+	require.NoError(err)
+	require.Contains(mxr.unresolved, "d")
+	require.Contains(buf.String(), "1 unfinished transfers")
+}
+
+func TestUnresolvedTransferBlocksMix(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	ctx := context.Background()
+	ledger := jctest.NewLedger()
+	require.NoError(ledger.Create(ctx, "d"))
+
+	historyErr := &jobcoin.APIError{Err: jobcoin.ErrServer, StatusCode: 503}
+	failHistory := false
+	jcClient := &jctest.MockClient{
+		AddrInfo: func() (*jobcoin.AddressInfo, error) {
+			if failHistory {
+				return nil, historyErr
+			}
+			return ledger.GetAddressInfo(ctx, "d")
+		},
+		Post: func() error {
+			// the transfer goes through, but the response is lost
+			failHistory = true
+			_ = ledger.PostTransaction(ctx, "d", "u", climatic.MustParseAmount("50"))
+			return errors.New("connection reset")
+		},
+	}
+	mxr, err := NewMixer(
+		WithJobcoinClient(jcClient),
+		WithMixConfig(MixConfig{
+			MeanAmount: climatic.MustParseAmount("50"),
+			MinAmount:  climatic.MustParseAmount("50"),
+			MaxAmount:  climatic.MustParseAmount("50"),
+		}),
+		WithLogger(log.New(ioutil.Discard, "", 0)),
+	)
+	require.NoError(err)
+	mxr.outstanding["d"] = &mix{usrAddrs: []string{"u"}, remaining: climatic.MustParseAmount("50")}
+
+	require.Error(mxr.mix(ctx, "d"))
+	require.Contains(mxr.unresolved, "d", "transfer resolved without the history")
+	require.Equal(climatic.MustParseAmount("50"), mxr.outstanding["d"].remaining)
+
+	// nothing is sent until the transfer is resolved
+	require.Equal(historyErr, mxr.mix(ctx, "d"))
+	require.Equal(climatic.MustParseAmount("50"), ledger.Balance("u"))
+
+	failHistory = false
+	jcClient.Post = func() error { return errors.New("sent twice") }
+	require.NoError(mxr.mix(ctx, "d"))
+	require.Empty(mxr.unresolved)
+	require.NotContains(mxr.outstanding, "d", "mix not finished")
+	require.Equal(climatic.MustParseAmount("50"), ledger.Balance("u"))
+}
+
+// lossyLedger is a Ledger that loses the next transfer and then fails to return
+// the history of addresses.
+type lossyLedger struct {
+	*jctest.Ledger
+	lose        bool
+	failHistory bool
+}
+
+func (l *lossyLedger) GetAddressInfo(ctx context.Context, addr string) (*jobcoin.AddressInfo, error) {
+	if l.failHistory {
+		return nil, &jobcoin.APIError{Err: jobcoin.ErrServer, StatusCode: 503}
+	}
+	return l.Ledger.GetAddressInfo(ctx, addr)
+}
+
+func (l *lossyLedger) PostTransaction(ctx context.Context, fromAddr, toAddr string, amt climatic.Amount) error {
+	if l.lose {
+		l.lose, l.failHistory = false, true
+		return errors.New("connection reset")
+	}
+	return l.Ledger.PostTransaction(ctx, fromAddr, toAddr, amt)
+}
+
+func TestUnresolvedTransferBlocksHouse(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	ctx := context.Background()
+	ledger := &lossyLedger{Ledger: jctest.NewLedger()}
+	require.NoError(ledger.Create(ctx, "house"))
+	mxr, err := NewMixer(
+		WithJobcoinClient(ledger),
+		WithPool("house"),
+		WithLogger(log.New(ioutil.Discard, "", 0)),
+	)
+	require.NoError(err)
+	amt := climatic.MustParseAmount("5")
+	m1 := &mix{usrAddrs: []string{"u"}, owed: amt}
+	m2 := &mix{usrAddrs: []string{"u"}, owed: amt}
+	mxr.outstanding["d1"] = m1
+	mxr.outstanding["d2"] = m2
+
+	// the payout for d1 fails, but it can't be told yet
+	ledger.lose = true
+	require.Error(mxr.payFromPool(ctx, m1, "d1", &PlannedPayout{ID: "1", ToAddress: "u", Amount: amt}))
+	require.Contains(mxr.unresolved, "d1")
+	ledger.failHistory = false
+
+	// an identical payout for d2 would pass for the one that failed
+	require.NoError(mxr.payFromPool(ctx, m2, "d2", &PlannedPayout{ID: "1", ToAddress: "u", Amount: amt}))
+	require.True(ledger.Balance("u").IsZero(), "paid from a house address with an unresolved transfer")
+
+	mxr.recoverTransfers(ctx)
+	require.Empty(mxr.unresolved)
+	require.Equal(amt, m1.owed, "failed payout taken for done")
+
+	require.NoError(mxr.payFromPool(ctx, m2, "d2", &PlannedPayout{ID: "1", ToAddress: "u", Amount: amt}))
+	require.Equal(amt, ledger.Balance("u"))
+	require.True(m2.owed.IsZero())
+	require.Equal(amt, m1.owed)
+}
+
+func TestReservedHouse(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	ctx := context.Background()
+	ledger := jctest.NewLedger()
+	require.NoError(ledger.Create(ctx, "h1"))
+	require.NoError(ledger.Create(ctx, "h2"))
+	mxr, err := NewMixer(
+		WithJobcoinClient(ledger),
+		WithPool("h1", "h2"),
+		WithLogger(log.New(ioutil.Discard, "", 0)),
+	)
+	require.NoError(err)
+	amt := climatic.MustParseAmount("5")
+	m := &mix{usrAddrs: []string{"u"}, owed: amt}
+	mxr.outstanding["d"] = m
+
+	// another payout is using h1
+	require.True(mxr.reserveHouse("h1"))
+	require.False(mxr.reserveHouse("h1"))
+
+	require.NoError(mxr.payFromPool(ctx, m, "d", &PlannedPayout{ID: "1", ToAddress: "u", Amount: amt}))
+	require.Equal(amt, ledger.Balance("u"))
+	require.Equal(jctest.DefaultCreateAmount, ledger.Balance("h1"), "paid from a reserved house address")
+	require.Equal(map[string]bool{"h1": true}, mxr.reserved, "h2 still reserved")
+
+	// checking the pool leaves out what is in use
+	report := &ReconcileReport{}
+	require.NoError(mxr.reconcilePool(ctx, report))
+	require.Equal(1, report.Checked)
+	require.Equal(1, report.Skipped)
+	require.Empty(report.Discrepancies)
+
+	mxr.releaseHouse("h1")
+	require.Empty(mxr.reserved)
+}